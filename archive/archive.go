@@ -0,0 +1,306 @@
+// Package archive exports events to JSONL files and imports them back,
+// including dumps made by other relays.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/klauspost/compress/zstd"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Compression formats archives can be written in. Reading detects them.
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	sqliteMagic = []byte("SQLite format 3\x00")
+)
+
+// CompressionFor guesses an archive's compression from its file name.
+func CompressionFor(path string) string {
+	switch filepath.Ext(path) {
+	case ".gz":
+		return Gzip
+	case ".zst":
+		return Zstd
+	}
+	return None
+}
+
+// NewWriter compresses everything written to w. Closing it flushes the
+// compression, and leaves w open.
+func NewWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "", None:
+		return nopCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %q, expected %s, %s or %s", compression, None, Gzip, Zstd)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Export writes every stored event matching filter to w, one JSON event
+// per line, and returns how many were written.
+func Export(ctx context.Context, store eventstore.Store, filter nostr.Filter, w io.Writer) (int, error) {
+	ch, err := store.QueryEvents(eventstore.SetNegentropy(ctx), filter)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := bufio.NewWriter(w)
+	count := 0
+	for event := range ch {
+		// Storage doesn't stop when we do, so the channel is always drained
+		if err != nil {
+			continue
+		}
+		line, _ := event.MarshalJSON()
+		if _, err = buf.Write(append(line, '\n')); err == nil {
+			count++
+		}
+	}
+	if err != nil {
+		return count, err
+	}
+	return count, buf.Flush()
+}
+
+// Stats counts what happened to each event read by Import.
+type Stats struct {
+	Read       int `json:"read"`
+	Imported   int `json:"imported"`
+	Duplicates int `json:"duplicates"`
+	// Skipped events didn't match the filter, or are ephemeral
+	Skipped int `json:"skipped"`
+	// Invalid lines weren't events, or had a bad id or signature
+	Invalid int `json:"invalid"`
+}
+
+// Import saves the events read from r that match filter, after checking
+// their ids and signatures. r may be compressed, and besides our own
+// exports it can be:
+//
+//   - strfry's `export`, which is JSONL with extra fields
+//   - `["EVENT", ...]` messages, as saved from a websocket
+//   - a nostr-rs-relay SQLite database, or the `content` column of its
+//     event table dumped one row per line
+//
+// progress, if not nil, is called every thousand events.
+func Import(ctx context.Context, store eventstore.Store, filter nostr.Filter, r io.Reader, progress func(Stats)) (Stats, error) {
+	var stats Stats
+
+	r, err := Decompress(r)
+	if err != nil {
+		return stats, err
+	}
+	br := bufio.NewReaderSize(r, 1<<20)
+	if header, _ := br.Peek(len(sqliteMagic)); bytes.Equal(header, sqliteMagic) {
+		return importSQLite(ctx, store, filter, br, progress)
+	}
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if err := importLine(ctx, store, filter, line, &stats); err != nil {
+				return stats, err
+			}
+			if progress != nil && stats.Read%1000 == 0 {
+				progress(stats)
+			}
+		}
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+	}
+}
+
+// Decompress detects gzip or zstd compression and undoes it.
+func Decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(header, zstdMagic):
+		decoder, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return br, nil
+}
+
+// importLine saves the event on one line. Only storage failures are
+// returned, bad lines are counted as invalid.
+func importLine(ctx context.Context, store eventstore.Store, filter nostr.Filter, line []byte, stats *Stats) error {
+	stats.Read++
+	event, ok := parseLine(line)
+	if !ok {
+		stats.Invalid++
+		return nil
+	}
+	return save(ctx, store, filter, event, stats)
+}
+
+func save(ctx context.Context, store eventstore.Store, filter nostr.Filter, event *nostr.Event, stats *Stats) error {
+	if !event.CheckID() {
+		stats.Invalid++
+		return nil
+	}
+	if ok, err := event.CheckSignature(); err != nil || !ok {
+		stats.Invalid++
+		return nil
+	}
+	if nostr.IsEphemeralKind(event.Kind) || !filter.Matches(event) {
+		stats.Skipped++
+		return nil
+	}
+
+	var err error
+	if nostr.IsReplaceableKind(event.Kind) || nostr.IsAddressableKind(event.Kind) {
+		err = store.ReplaceEvent(ctx, event)
+	} else {
+		err = store.SaveEvent(ctx, event)
+	}
+	switch {
+	case errors.Is(err, eventstore.ErrDupEvent):
+		stats.Duplicates++
+	case err != nil:
+		return fmt.Errorf("failed to save %s: %w", event.ID, err)
+	default:
+		stats.Imported++
+	}
+	return nil
+}
+
+// parseLine reads an event, either on its own or in an EVENT message.
+func parseLine(line []byte) (*nostr.Event, bool) {
+	line = bytes.TrimSpace(line)
+	// Dumps of JSON arrays put a comma after each element
+	line = bytes.TrimSuffix(line, []byte(","))
+
+	if bytes.HasPrefix(line, []byte("[")) {
+		var message []json.RawMessage
+		if err := json.Unmarshal(line, &message); err != nil || len(message) < 2 {
+			return nil, false
+		}
+		var label string
+		if json.Unmarshal(message[0], &label) != nil || label != "EVENT" {
+			return nil, false
+		}
+		line = message[len(message)-1]
+	}
+
+	// nostr.Event's own decoding fails on fields it doesn't know, like the
+	// ones strfry adds
+	var event struct {
+		ID        string          `json:"id"`
+		PubKey    string          `json:"pubkey"`
+		CreatedAt nostr.Timestamp `json:"created_at"`
+		Kind      int             `json:"kind"`
+		Tags      nostr.Tags      `json:"tags"`
+		Content   string          `json:"content"`
+		Sig       string          `json:"sig"`
+	}
+	if err := json.Unmarshal(line, &event); err != nil || event.ID == "" {
+		return nil, false
+	}
+	return (*nostr.Event)(&event), true
+}
+
+// importSQLite copies a nostr-rs-relay database arriving on a stream to a
+// file, so SQLite can open it.
+func importSQLite(ctx context.Context, store eventstore.Store, filter nostr.Filter, r io.Reader, progress func(Stats)) (Stats, error) {
+	tmp, err := os.CreateTemp("", "nostr-rs-relay-*.db")
+	if err != nil {
+		return Stats{}, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Stats{}, err
+	}
+	return ImportSQLite(ctx, store, filter, tmp.Name(), progress)
+}
+
+// IsSQLite reports whether the file at path is a SQLite database, such as
+// nostr-rs-relay's.
+func IsSQLite(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, len(sqliteMagic))
+	_, err = io.ReadFull(f, header)
+	return err == nil && bytes.Equal(header, sqliteMagic)
+}
+
+// ImportSQLite imports the events of the nostr-rs-relay database at path,
+// which keeps each event's JSON in the content column of its event table.
+func ImportSQLite(ctx context.Context, store eventstore.Store, filter nostr.Filter, path string, progress func(Stats)) (Stats, error) {
+	var stats Stats
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return stats, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, "SELECT content FROM event")
+	if err != nil {
+		return stats, fmt.Errorf("not a nostr-rs-relay database: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var content string
+		if err := rows.Scan(&content); err != nil {
+			return stats, err
+		}
+		if err := importLine(ctx, store, filter, []byte(content), &stats); err != nil {
+			return stats, err
+		}
+		if progress != nil && stats.Read%1000 == 0 {
+			progress(stats)
+		}
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,162 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+func openTestStore(t *testing.T) *storage.DB {
+	t.Helper()
+
+	db, err := storage.Open(storage.Badger, filepath.Join(t.TempDir(), "db"), storage.Settings{})
+	if err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func signedEvent(t *testing.T, kind int, content string) *nostr.Event {
+	t.Helper()
+
+	event := &nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Content: content, Tags: nostr.Tags{}}
+	if err := event.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	return event
+}
+
+func countStored(t *testing.T, db *storage.DB) int {
+	t.Helper()
+
+	ch, err := db.QueryEvents(context.Background(), nostr.Filter{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	count := 0
+	for range ch {
+		count++
+	}
+	return count
+}
+
+func TestExportAndImport(t *testing.T) {
+	for _, compression := range []string{None, Gzip, Zstd} {
+		t.Run(compression, func(t *testing.T) {
+			ctx := context.Background()
+			source := openTestStore(t)
+			for i := range 3 {
+				if err := source.SaveEvent(ctx, signedEvent(t, 1, fmt.Sprint("note ", i))); err != nil {
+					t.Fatalf("Failed to save event: %v", err)
+				}
+			}
+			if err := source.SaveEvent(ctx, signedEvent(t, 7, "+")); err != nil {
+				t.Fatalf("Failed to save event: %v", err)
+			}
+
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, compression)
+			if err != nil {
+				t.Fatalf("NewWriter failed: %v", err)
+			}
+			count, err := Export(ctx, source, nostr.Filter{Kinds: []int{1}}, w)
+			if err != nil || w.Close() != nil {
+				t.Fatalf("Export failed: %v", err)
+			}
+			if count != 3 {
+				t.Errorf("Expected 3 notes to be exported, got %d", count)
+			}
+
+			destination := openTestStore(t)
+			stats, err := Import(ctx, destination, nostr.Filter{}, &buf, nil)
+			if err != nil {
+				t.Fatalf("Import failed: %v", err)
+			}
+			if stats.Imported != 3 || countStored(t, destination) != 3 {
+				t.Errorf("Expected 3 events to be imported, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestImportChecksEvents(t *testing.T) {
+	ctx := context.Background()
+	db := openTestStore(t)
+
+	good := signedEvent(t, 1, "good")
+	forged := signedEvent(t, 1, "forged")
+	forged.Content = "changed after signing"
+	filtered := signedEvent(t, 7, "+")
+
+	var dump strings.Builder
+	for _, event := range []*nostr.Event{good, good, forged, filtered} {
+		dump.WriteString(event.String() + "\n")
+	}
+	dump.WriteString("not an event\n\n")
+
+	stats, err := Import(ctx, db, nostr.Filter{Kinds: []int{1}}, strings.NewReader(dump.String()), nil)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	expected := Stats{Read: 5, Imported: 1, Duplicates: 1, Skipped: 1, Invalid: 2}
+	if stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestImportReadsOtherRelaysDumps(t *testing.T) {
+	ctx := context.Background()
+	db := openTestStore(t)
+
+	strfry := signedEvent(t, 1, "from strfry")
+	message := signedEvent(t, 1, "from a websocket")
+	fried := strings.TrimSuffix(strfry.String(), "}") + `,"fried":"abc"}`
+	dump := fried + "\n" + `["EVENT","sub",` + message.String() + "]\n"
+
+	stats, err := Import(ctx, db, nostr.Filter{}, strings.NewReader(dump), nil)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if stats.Imported != 2 {
+		t.Errorf("Expected both events to be imported, got %+v", stats)
+	}
+}
+
+func TestImportNostrRsRelayDatabase(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "nostr.db")
+
+	sqlite, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	if _, err := sqlite.Exec("CREATE TABLE event (id INTEGER PRIMARY KEY, content TEXT NOT NULL)"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for _, content := range []string{"one", "two"} {
+		if _, err := sqlite.Exec("INSERT INTO event (content) VALUES (?)", signedEvent(t, 1, content).String()); err != nil {
+			t.Fatalf("Failed to insert event: %v", err)
+		}
+	}
+	sqlite.Close()
+
+	if !IsSQLite(path) {
+		t.Fatal("Expected the database to be recognised")
+	}
+	db := openTestStore(t)
+	stats, err := ImportSQLite(ctx, db, nostr.Filter{}, path, nil)
+	if err != nil {
+		t.Fatalf("ImportSQLite failed: %v", err)
+	}
+	if stats.Imported != 2 || countStored(t, db) != 2 {
+		t.Errorf("Expected 2 events to be imported, got %+v", stats)
+	}
+}
@@ -0,0 +1,74 @@
+package blossom
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindAuthorization is a Blossom authorization event, from BUD-01.
+const KindAuthorization = 24242
+
+// Verbs an authorization event can allow, in its "t" tag.
+const (
+	VerbUpload = "upload"
+	VerbList   = "list"
+	VerbDelete = "delete"
+	VerbGet    = "get"
+)
+
+// ErrNoAuthorization is returned when a request isn't signed at all.
+var ErrNoAuthorization = errors.New("missing Nostr authorization")
+
+// Authorize checks a request's authorization event allows verb, returning
+// the event so its "x" tags can be checked against the blob.
+func Authorize(r *http.Request, verb string) (*nostr.Event, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !found {
+		return nil, ErrNoAuthorization
+	}
+
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("invalid base64 in authorization")
+	}
+	var event nostr.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, errors.New("invalid authorization event")
+	}
+
+	if event.Kind != KindAuthorization {
+		return nil, errors.New("authorization event has the wrong kind")
+	}
+	if ok, _ := event.CheckSignature(); !ok {
+		return nil, errors.New("invalid authorization signature")
+	}
+	if event.CreatedAt > nostr.Now()+60 {
+		return nil, errors.New("authorization event is from the future")
+	}
+	expiration := event.Tags.Find("expiration")
+	if expiration == nil {
+		return nil, errors.New("authorization has no expiration")
+	}
+	if at, err := strconv.ParseInt(expiration[1], 10, 64); err != nil || nostr.Timestamp(at) < nostr.Now() {
+		return nil, errors.New("authorization has expired")
+	}
+	if event.Tags.FindWithValue("t", verb) == nil {
+		return nil, errors.New("authorization is not for " + verb)
+	}
+	return &event, nil
+}
+
+// Covers reports whether an authorization event covers a blob. Events
+// without "x" tags cover any blob.
+func Covers(auth *nostr.Event, hash string) bool {
+	if auth.Tags.Find("x") == nil {
+		return true
+	}
+	return auth.Tags.FindWithValue("x", hash) != nil
+}
@@ -0,0 +1,202 @@
+package blossom
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := storage.Open(storage.Bolt, filepath.Join(dir, "db"), storage.Settings{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(db.Close)
+	store, err := Open(filepath.Join(dir, "media"), db.Meta)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	return store
+}
+
+func keep(t *testing.T, store *Store, pubkey string, data []byte) Descriptor {
+	t.Helper()
+
+	upload, err := store.Write(bytes.NewReader(data), 0)
+	if err != nil {
+		t.Fatalf("Failed to write blob: %v", err)
+	}
+	descriptor, err := upload.Keep(pubkey, "image/png")
+	if err != nil {
+		t.Fatalf("Failed to keep blob: %v", err)
+	}
+	return descriptor
+}
+
+func TestStoreKeepsBlobsUntilEveryOwnerRemovesThem(t *testing.T) {
+	store := openTestStore(t)
+	alice, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	bob, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	data := []byte("a photo of a lost cat")
+	hash := sha256.Sum256(data)
+	descriptor := keep(t, store, alice, data)
+	if descriptor.SHA256 != hex.EncodeToString(hash[:]) || descriptor.Size != int64(len(data)) {
+		t.Errorf("Expected the blob's hash and size, got %+v", descriptor)
+	}
+	keep(t, store, bob, data)
+	keep(t, store, alice, []byte("another photo"))
+
+	if usage, _ := store.Usage(alice); usage != int64(len(data)+len("another photo")) {
+		t.Errorf("Expected alice to use %d bytes, got %d", len(data)+len("another photo"), usage)
+	}
+	if listed, _ := store.List(bob); len(listed) != 1 || listed[0].SHA256 != descriptor.SHA256 {
+		t.Errorf("Expected bob to own the cat photo, got %+v", listed)
+	}
+
+	deleted, err := store.Remove(descriptor.SHA256, alice)
+	if err != nil || deleted {
+		t.Errorf("Expected the blob to be kept for bob, got %v (%v)", deleted, err)
+	}
+	if _, found, _ := store.Get(descriptor.SHA256); !found {
+		t.Error("Expected the blob to still be stored")
+	}
+	deleted, err = store.Remove(descriptor.SHA256, bob)
+	if err != nil || !deleted {
+		t.Errorf("Expected the blob to be deleted, got %v (%v)", deleted, err)
+	}
+	if _, err := store.Open(descriptor.SHA256); err == nil {
+		t.Error("Expected the blob's file to be deleted")
+	}
+}
+
+func TestWriteRefusesLargeBlobs(t *testing.T) {
+	store := openTestStore(t)
+
+	if _, err := store.Write(bytes.NewReader(make([]byte, 101)), 100); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+	if _, err := store.Write(bytes.NewReader(make([]byte, 100)), 100); err != nil {
+		t.Errorf("Expected a blob at the limit to be accepted, got %v", err)
+	}
+}
+
+func authorization(t *testing.T, sk, verb string, expiration nostr.Timestamp, tags ...nostr.Tag) string {
+	t.Helper()
+
+	event := &nostr.Event{
+		Kind:      KindAuthorization,
+		CreatedAt: nostr.Now(),
+		Tags:      append(nostr.Tags{{"t", verb}, {"expiration", strconv.FormatInt(int64(expiration), 10)}}, tags...),
+	}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	data, _ := json.Marshal(event)
+	return "Nostr " + base64.StdEncoding.EncodeToString(data)
+}
+
+func TestAuthorize(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	hash := hex.EncodeToString(make([]byte, 32))
+	later := nostr.Now() + 60
+
+	tests := []struct {
+		name   string
+		header string
+		valid  bool
+	}{
+		{"valid", authorization(t, sk, VerbUpload, later), true},
+		{"missing", "", false},
+		{"wrong verb", authorization(t, sk, VerbDelete, later), false},
+		{"expired", authorization(t, sk, VerbUpload, nostr.Now()-1), false},
+		{"not base64", "Nostr !!!", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/upload", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			auth, err := Authorize(r, VerbUpload)
+			if tt.valid && (err != nil || auth.PubKey != pubkey) {
+				t.Errorf("Expected authorization, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("Expected authorization to be refused")
+			}
+		})
+	}
+
+	r := httptest.NewRequest("PUT", "/upload", nil)
+	r.Header.Set("Authorization", authorization(t, sk, VerbUpload, later, nostr.Tag{"x", hash}))
+	auth, err := Authorize(r, VerbUpload)
+	if err != nil {
+		t.Fatalf("Expected authorization, got %v", err)
+	}
+	if !Covers(auth, hash) || Covers(auth, hex.EncodeToString(bytes.Repeat([]byte{1}, 32))) {
+		t.Error("Expected x tags to limit the blobs covered")
+	}
+}
+
+func TestDetectType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	tests := []struct {
+		name     string
+		head     []byte
+		declared string
+		expected string
+	}{
+		{"sniffed", png, "", "image/png"},
+		{"sniffed over declared", png, "image/jpeg", "image/png"},
+		{"declared when unknown", []byte{0, 1, 2, 3}, "video/quicktime", "video/quicktime"},
+		{"html is html", []byte("<html><script>"), "image/png", "text/html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectType(tt.head, tt.declared); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+
+	if !TypeAllowed("image/png", []string{"image/*"}) || TypeAllowed("text/html", []string{"image/*", "video/mp4"}) {
+		t.Error("Expected patterns to match by prefix or in full")
+	}
+}
+
+func TestReferences(t *testing.T) {
+	hash := hex.EncodeToString(bytes.Repeat([]byte{0xab}, 32))
+	other := hex.EncodeToString(bytes.Repeat([]byte{0xcd}, 32))
+	event := &nostr.Event{
+		Content: "Found this cat https://media.example.com/" + other + ".jpg and https://example.com/page",
+		Tags: nostr.Tags{
+			{"imeta", "url https://relay.example.com/" + hash + ".png", "m image/png", "x " + hash},
+		},
+	}
+
+	refs := References(event)
+	if len(refs) != 2 {
+		t.Fatalf("Expected 2 references, got %+v", refs)
+	}
+	if refs[0].SHA256 != hash || refs[0].URL != "https://relay.example.com/"+hash+".png" {
+		t.Errorf("Expected the imeta blob first, got %+v", refs[0])
+	}
+	if refs[1].SHA256 != other || refs[1].URL != "https://media.example.com/"+other+".jpg" {
+		t.Errorf("Expected the linked blob, got %+v", refs[1])
+	}
+}
@@ -0,0 +1,136 @@
+package blossom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DetectType works out a blob's MIME type from its first bytes, only
+// trusting the type the uploader declared when the contents give nothing
+// away.
+func DetectType(head []byte, declared string) string {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if sniffed != "application/octet-stream" {
+		return sniffed
+	}
+	if declared, _, err := mime.ParseMediaType(declared); err == nil {
+		return declared
+	}
+	return sniffed
+}
+
+// TypeAllowed reports whether mimeType matches one of patterns, which are
+// types like "image/png" or "image/*".
+func TypeAllowed(mimeType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mimeType, prefix+"/") {
+				return true
+			}
+		} else if mimeType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Extension returns the usual file extension for a MIME type, if any.
+func Extension(mimeType string) string {
+	switch mimeType {
+	case "image/jpeg":
+		return ".jpg"
+	case "video/mp4":
+		return ".mp4"
+	}
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// Reference is a blob an event links to.
+type Reference struct {
+	URL    string
+	SHA256 string
+}
+
+// blobURL matches links to blobs, which end in their hash.
+var blobURL = regexp.MustCompile(`https?://[^\s"'<>]+/([0-9a-f]{64})(\.[0-9A-Za-z]+)?\b`)
+
+// References returns the blobs an event links to, from its NIP-92 imeta
+// tags and any blob URLs in its content.
+func References(event *nostr.Event) []Reference {
+	seen := make(map[string]bool)
+	var refs []Reference
+	add := func(url, hash string) {
+		if url != "" && ValidHash(hash) && !seen[hash] {
+			seen[hash] = true
+			refs = append(refs, Reference{URL: url, SHA256: hash})
+		}
+	}
+
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "imeta" {
+			continue
+		}
+		var url, hash string
+		for _, field := range tag[1:] {
+			if value, ok := strings.CutPrefix(field, "url "); ok {
+				url = value
+			} else if value, ok := strings.CutPrefix(field, "x "); ok {
+				hash = value
+			}
+		}
+		if hash == "" {
+			if m := blobURL.FindStringSubmatch(url); m != nil {
+				hash = m[1]
+			}
+		}
+		add(url, hash)
+	}
+	for _, m := range blobURL.FindAllStringSubmatch(event.Content, -1) {
+		add(m[0], m[1])
+	}
+	return refs
+}
+
+// ErrHashMismatch is returned when a fetched blob isn't the one expected.
+var ErrHashMismatch = errors.New("blob doesn't match its hash")
+
+// Fetch downloads a blob from another server, checking it matches its
+// hash, and returns it with the type the server gave. The upload still
+// has to be kept or discarded.
+func (s *Store) Fetch(ctx context.Context, client *http.Client, ref Reference, maxSize int64) (*Upload, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref.URL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s returned %s", ref.URL, resp.Status)
+	}
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		return nil, "", ErrTooLarge
+	}
+
+	upload, err := s.Write(resp.Body, maxSize)
+	if err != nil {
+		return nil, "", err
+	}
+	if upload.SHA256 != ref.SHA256 {
+		upload.Discard()
+		return nil, "", ErrHashMismatch
+	}
+	return upload, resp.Header.Get("Content-Type"), nil
+}
@@ -0,0 +1,358 @@
+// Package blossom keeps media blobs on disk for the relay's Blossom
+// server, each named by the SHA-256 of its contents, with a record of who
+// uploaded them.
+package blossom
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+// Keys are in the range storage keeps for the relay. A blob's descriptor
+// is kept under its hash, and every owner is recorded both ways round so
+// blobs can be listed by owner and owners by blob.
+const (
+	blobPrefix   = storage.MetaPrefix + 3
+	ownerPrefix  = storage.MetaPrefix + 4
+	holderPrefix = storage.MetaPrefix + 5
+)
+
+// ErrTooLarge is returned when an upload is over the size limit.
+var ErrTooLarge = errors.New("blob is too large")
+
+// Descriptor describes a stored blob, as in BUD-02. URL is filled in by
+// the server, which knows where it is served from.
+type Descriptor struct {
+	URL      string          `json:"url,omitempty"`
+	SHA256   string          `json:"sha256"`
+	Size     int64           `json:"size"`
+	Type     string          `json:"type"`
+	Uploaded nostr.Timestamp `json:"uploaded"`
+}
+
+// Store keeps blobs in a directory and their descriptors and owners in
+// the relay's Meta.
+type Store struct {
+	dir  string
+	meta storage.Meta
+	// mu keeps a blob from being removed while another owner keeps it
+	mu sync.Mutex
+}
+
+// Open keeps blobs in dir, creating it if needed, and their records in
+// meta.
+func Open(dir string, meta storage.Meta) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create media directory: %w", err)
+	}
+	return &Store{dir: dir, meta: meta}, nil
+}
+
+func (s *Store) path(hash string) string {
+	return filepath.Join(s.dir, hash)
+}
+
+// Upload is a blob that has been written to disk but not yet kept.
+type Upload struct {
+	SHA256 string
+	Size   int64
+	// Head is the start of the blob, to tell its type from
+	Head  []byte
+	store *Store
+	file  string
+}
+
+// Write copies r to a temporary file, hashing it on the way. Blobs larger
+// than maxSize are refused with ErrTooLarge, unless maxSize is zero.
+func (s *Store) Write(r io.Reader, maxSize int64) (*Upload, error) {
+	f, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	upload := &Upload{store: s, file: f.Name()}
+
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+	hash := sha256.New()
+	head := &headWriter{limit: 512}
+	upload.Size, err = io.Copy(io.MultiWriter(f, hash, head), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && maxSize > 0 && upload.Size > maxSize {
+		err = ErrTooLarge
+	}
+	if err != nil {
+		upload.Discard()
+		return nil, err
+	}
+	upload.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	upload.Head = head.buf
+	return upload, nil
+}
+
+// headWriter keeps the first limit bytes written to it.
+type headWriter struct {
+	buf   []byte
+	limit int
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if room := w.limit - len(w.buf); room > 0 {
+		w.buf = append(w.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// Discard deletes an upload that isn't going to be kept.
+func (u *Upload) Discard() {
+	os.Remove(u.file)
+}
+
+// Keep stores the upload as a blob of the given type, owned by pubkey. A
+// blob that is already stored gains another owner but keeps its type.
+func (u *Upload) Keep(pubkey, mimeType string) (Descriptor, error) {
+	s := u.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	descriptor, found, err := s.Get(u.SHA256)
+	if err != nil {
+		u.Discard()
+		return descriptor, err
+	}
+	if found {
+		u.Discard()
+	} else {
+		descriptor = Descriptor{SHA256: u.SHA256, Size: u.Size, Type: mimeType, Uploaded: nostr.Now()}
+		if err := os.Rename(u.file, s.path(u.SHA256)); err != nil {
+			u.Discard()
+			return descriptor, err
+		}
+	}
+
+	err = s.meta.Update(func(txn storage.MetaTxn) error {
+		owner, holder, err := ownerKeys(pubkey, u.SHA256)
+		if err != nil {
+			return err
+		}
+		if !found {
+			data, err := json.Marshal(descriptor)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(blobKey(u.SHA256), data); err != nil {
+				return err
+			}
+		}
+		if err := txn.Set(owner, nil); err != nil {
+			return err
+		}
+		return txn.Set(holder, nil)
+	})
+	return descriptor, err
+}
+
+func blobKey(hash string) []byte {
+	return append([]byte{blobPrefix}, hash...)
+}
+
+// ownerKeys returns the keys recording that pubkey owns the blob.
+func ownerKeys(pubkey, hash string) (owner, holder []byte, err error) {
+	pk, err := hex.DecodeString(pubkey)
+	if err != nil || len(pk) != 32 {
+		return nil, nil, fmt.Errorf("invalid pubkey %q", pubkey)
+	}
+	h, err := hex.DecodeString(hash)
+	if err != nil || len(h) != 32 {
+		return nil, nil, fmt.Errorf("invalid sha256 %q", hash)
+	}
+	owner = append(append([]byte{ownerPrefix}, pk...), h...)
+	holder = append(append([]byte{holderPrefix}, h...), pk...)
+	return owner, holder, nil
+}
+
+// ValidHash reports whether s looks like a SHA-256 hash, in lower case
+// hex as blobs are named.
+func ValidHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns a blob's descriptor, if it is stored.
+func (s *Store) Get(hash string) (Descriptor, bool, error) {
+	var descriptor Descriptor
+	found := false
+	err := s.meta.View(func(txn storage.MetaTxn) error {
+		value, err := txn.Get(blobKey(hash))
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		return json.Unmarshal(value, &descriptor)
+	})
+	return descriptor, found, err
+}
+
+// Open returns a blob's contents.
+func (s *Store) Open(hash string) (*os.File, error) {
+	if !ValidHash(hash) {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(s.path(hash))
+}
+
+// List returns the blobs pubkey owns, newest first.
+func (s *Store) List(pubkey string) ([]Descriptor, error) {
+	var hashes []string
+	err := s.scan(ownerPrefix, pubkey, func(hash string) {
+		hashes = append(hashes, hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	descriptors := make([]Descriptor, 0, len(hashes))
+	for _, hash := range hashes {
+		descriptor, found, err := s.Get(hash)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			descriptors = append(descriptors, descriptor)
+		}
+	}
+	sort.Slice(descriptors, func(i, j int) bool {
+		return descriptors[i].Uploaded > descriptors[j].Uploaded
+	})
+	return descriptors, nil
+}
+
+// Usage returns how many bytes of blobs pubkey owns. Blobs with several
+// owners count in full for each of them.
+func (s *Store) Usage(pubkey string) (int64, error) {
+	descriptors, err := s.List(pubkey)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, descriptor := range descriptors {
+		total += descriptor.Size
+	}
+	return total, nil
+}
+
+// Owners returns the pubkeys that own a blob.
+func (s *Store) Owners(hash string) ([]string, error) {
+	var owners []string
+	err := s.scan(holderPrefix, hash, func(pubkey string) {
+		owners = append(owners, pubkey)
+	})
+	return owners, err
+}
+
+// scan calls fn with the second half of every key under prefix and first.
+func (s *Store) scan(prefix byte, first string, fn func(second string)) error {
+	start, err := hex.DecodeString(first)
+	if err != nil || len(start) != 32 {
+		return fmt.Errorf("invalid key %q", first)
+	}
+	return s.meta.View(func(txn storage.MetaTxn) error {
+		return txn.Iterate(append([]byte{prefix}, start...), func(key, _ []byte) error {
+			fn(hex.EncodeToString(key[33:]))
+			return nil
+		})
+	})
+}
+
+// Remove takes pubkey's ownership of a blob away, deleting the blob once
+// nobody owns it. It reports whether the blob was deleted.
+func (s *Store) Remove(hash, pubkey string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	owner, holder, err := ownerKeys(pubkey, hash)
+	if err != nil {
+		return false, err
+	}
+	err = s.meta.Update(func(txn storage.MetaTxn) error {
+		if err := txn.Delete(owner); err != nil {
+			return err
+		}
+		return txn.Delete(holder)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	owners, err := s.Owners(hash)
+	if err != nil || len(owners) > 0 {
+		return false, err
+	}
+	return true, s.delete(hash)
+}
+
+// Delete removes a blob whoever owns it.
+func (s *Store) Delete(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	owners, err := s.Owners(hash)
+	if err != nil {
+		return err
+	}
+	err = s.meta.Update(func(txn storage.MetaTxn) error {
+		for _, pubkey := range owners {
+			owner, holder, err := ownerKeys(pubkey, hash)
+			if err != nil {
+				return err
+			}
+			if err := txn.Delete(owner); err != nil {
+				return err
+			}
+			if err := txn.Delete(holder); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.delete(hash)
+}
+
+func (s *Store) delete(hash string) error {
+	err := s.meta.Update(func(txn storage.MetaTxn) error {
+		return txn.Delete(blobKey(hash))
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
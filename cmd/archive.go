@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/cobra"
+	"github.crom/crbroughton/townsquares-relay/archive"
+	"github.crom/crbroughton/townsquares-relay/quota"
+	"github.crom/crbroughton/townsquares-relay/server"
+)
+
+var (
+	archiveConfigFile  string
+	archiveCommunity   string
+	archiveFilter      string
+	archiveCompression string
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export [file]",
+	Short: "Export a community's events as JSONL",
+	Long: `Write the events a community has stored to a file, or to stdout, one JSON
+event per line. Files ending in .gz or .zst are compressed to match.
+
+The relay has to be stopped first, as its database can only be opened once.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		filter := parseFilter()
+		db := openStorage()
+		defer db.Close()
+
+		var out io.Writer = os.Stdout
+		compression := archiveCompression
+		if len(args) == 1 && args[0] != "-" {
+			f, err := os.Create(args[0])
+			if err != nil {
+				log.Fatalf("Error creating %s: %v", args[0], err)
+			}
+			defer f.Close()
+			out = f
+			if compression == "" {
+				compression = archive.CompressionFor(args[0])
+			}
+		}
+
+		w, err := archive.NewWriter(out, compression)
+		if err != nil {
+			log.Fatalf("Error exporting: %v", err)
+		}
+		count, err := archive.Export(context.Background(), db, filter, w)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			log.Fatalf("Error exporting: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "✅ Exported %d events\n", count)
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Import events from a JSONL archive or another relay's dump",
+	Long: `Save the events in a file, or read from stdin, into a community. Besides
+our own exports this reads strfry's export, EVENT messages and nostr-rs-relay
+databases, compressed with gzip or zstd or not. Events with a bad id or
+signature are skipped.
+
+The relay has to be stopped first, as its database can only be opened once.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		filter := parseFilter()
+		db := openStorage()
+		defer db.Close()
+
+		ctx := context.Background()
+		progress := func(stats archive.Stats) {
+			fmt.Fprintf(os.Stderr, "\r%d read, %d imported", stats.Read, stats.Imported)
+		}
+
+		var stats archive.Stats
+		var err error
+		switch {
+		case len(args) == 0 || args[0] == "-":
+			stats, err = archive.Import(ctx, db, filter, os.Stdin, progress)
+		case archive.IsSQLite(args[0]):
+			stats, err = archive.ImportSQLite(ctx, db, filter, args[0], progress)
+		default:
+			f, ferr := os.Open(args[0])
+			if ferr != nil {
+				log.Fatalf("Error opening %s: %v", args[0], ferr)
+			}
+			defer f.Close()
+			stats, err = archive.Import(ctx, db, filter, f, progress)
+		}
+		if stats.Read >= 1000 {
+			fmt.Fprintln(os.Stderr)
+		}
+		if err != nil {
+			log.Fatalf("Error importing: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "✅ Imported %d of %d events (%d duplicates, %d skipped, %d invalid)\n",
+			stats.Imported, stats.Read, stats.Duplicates, stats.Skipped, stats.Invalid)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd, importCmd)
+
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd} {
+		cmd.Flags().StringVarP(&archiveConfigFile, "config", "c", "config.json", "Config file of the relay")
+		cmd.Flags().StringVar(&archiveCommunity, "community", "", "Name of the community, when the config hosts several")
+		cmd.Flags().StringVar(&archiveFilter, "filter", "", `Nostr filter events must match, like '{"kinds":[1]}'`)
+	}
+	exportCmd.Flags().StringVar(&archiveCompression, "compress", "", "Compression to use: none, gzip or zstd (default from the file name)")
+}
+
+func parseFilter() nostr.Filter {
+	var filter nostr.Filter
+	if archiveFilter == "" {
+		return filter
+	}
+	if err := filter.UnmarshalJSON([]byte(archiveFilter)); err != nil {
+		log.Fatalf("Error parsing filter: %v", err)
+	}
+	return filter
+}
+
+func openStorage() *quota.Store {
+	config, err := loadCommunity(archiveConfigFile, archiveCommunity)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	db, err := server.OpenStorage(config)
+	if err != nil {
+		log.Fatalf("Error opening storage (is the relay still running?): %v", err)
+	}
+	return db
+}
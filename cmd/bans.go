@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	bansConfigFile string
+	bansCommunity  string
+	bansReason     string
+)
+
+var bansCmd = &cobra.Command{
+	Use:   "bans",
+	Short: "Manage banned pubkeys",
+	Long: `Ban pubkeys from a community, or lift their bans. Changes are picked up
+by a running relay without restarting it, and shared with peers the next
+time the relay starts or an admin changes its bans.`,
+}
+
+var bansListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List banned pubkeys",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		_, store := loadModeration(bansConfigFile, bansCommunity)
+		banned, err := store.BannedPubKeys()
+		if err != nil {
+			log.Fatalf("Error listing bans: %v", err)
+		}
+		for _, ban := range banned {
+			fmt.Printf("%s  %s  %s\n", ban.Key, ban.At.Format(time.DateTime), ban.Reason)
+		}
+	},
+}
+
+var bansAddCmd = &cobra.Command{
+	Use:   "add <pubkey>",
+	Short: "Ban a pubkey by hex pubkey or npub",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		pubkey := parsePubKey(args[0])
+		_, store := loadModeration(bansConfigFile, bansCommunity)
+		if err := store.BanPubKey(pubkey, bansReason, "command line"); err != nil {
+			log.Fatalf("Error banning pubkey: %v", err)
+		}
+		fmt.Printf("✅ Banned %s\n", pubkey)
+	},
+}
+
+var bansRemoveCmd = &cobra.Command{
+	Use:   "remove <pubkey>",
+	Short: "Lift the ban on a pubkey",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		pubkey := parsePubKey(args[0])
+		_, store := loadModeration(bansConfigFile, bansCommunity)
+		banned, err := store.UnbanPubKey(pubkey)
+		if err != nil {
+			log.Fatalf("Error unbanning pubkey: %v", err)
+		}
+		if !banned {
+			log.Fatalf("%s is not banned", pubkey)
+		}
+		fmt.Printf("✅ Unbanned %s\n", pubkey)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(bansCmd)
+	bansCmd.AddCommand(bansListCmd, bansAddCmd, bansRemoveCmd)
+
+	bansCmd.PersistentFlags().StringVarP(&bansConfigFile, "config", "c", "config.json", "Config file of the relay")
+	bansCmd.PersistentFlags().StringVar(&bansCommunity, "community", "", "Name of the community, when the config hosts several")
+	bansAddCmd.Flags().StringVar(&bansReason, "reason", "", "Why the pubkey is banned")
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.crom/crbroughton/townsquares-relay/server"
+)
+
+// loadCommunity loads the config of one community from configFile. name
+// picks the community by its name and may be empty when only one is hosted.
+func loadCommunity(configFile, name string) (*server.Config, error) {
+	config, err := server.LoadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	communities, err := config.CommunityConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		if len(communities) > 1 {
+			return nil, fmt.Errorf("%s hosts %d communities, pick one with --community", configFile, len(communities))
+		}
+		return communities[0], nil
+	}
+	for _, community := range communities {
+		if community.Name == name {
+			return community, nil
+		}
+	}
+	return nil, fmt.Errorf("no community named %q in %s", name, configFile)
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+var (
+	dbConfigFile   string
+	dbCommunity    string
+	dbDiscardRatio float64
+)
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Look after a community's database",
+	Long: `Check how much disk a community's database uses and reclaim space left by
+deleted events. The relay has to be stopped first, as its database can only be
+opened once.`,
+}
+
+var dbSizeCmd = &cobra.Command{
+	Use:   "size",
+	Short: "Show how much disk the database uses",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		db := openDB()
+		defer db.Close()
+
+		size, err := db.Size()
+		if err != nil {
+			log.Fatalf("Error measuring database: %v", err)
+		}
+		printSize(db, size)
+	},
+}
+
+var dbCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Compact the database and garbage collect its value log",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		db := openDB()
+		defer db.Close()
+
+		report, err := db.Maintain(true, dbDiscardRatio)
+		if err != nil {
+			log.Fatalf("Error compacting database: %v", err)
+		}
+		fmt.Printf("✅ Compacted in %s, rewriting %d value log files\n", report.Took.Round(time.Millisecond), report.Rewritten)
+		fmt.Printf("   %d bytes before, %d bytes after\n", report.Before.Total, report.After.Total)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(dbCmd)
+	dbCmd.AddCommand(dbSizeCmd, dbCompactCmd)
+
+	dbCmd.PersistentFlags().StringVarP(&dbConfigFile, "config", "c", "config.json", "Config file of the relay")
+	dbCmd.PersistentFlags().StringVar(&dbCommunity, "community", "", "Name of the community, when the config hosts several")
+	dbCompactCmd.Flags().Float64Var(&dbDiscardRatio, "discard-ratio", storage.DefaultDiscardRatio, "How much of a value log file must be stale for it to be rewritten")
+}
+
+func openDB() *storage.DB {
+	config, err := loadCommunity(dbConfigFile, dbCommunity)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	db, err := storage.Open(config.DBBackend, config.DatabasePath(), config.DBSettings)
+	if err != nil {
+		log.Fatalf("Error opening storage (is the relay still running?): %v", err)
+	}
+	return db
+}
+
+func printSize(db *storage.DB, size storage.Size) {
+	fmt.Printf("%s database at %s\n", db.Backend, db.Path)
+	fmt.Printf("  events:    %d bytes\n", size.Events)
+	if db.Backend == storage.Badger {
+		fmt.Printf("  lsm:       %d bytes\n", size.LSM)
+		fmt.Printf("  value log: %d bytes\n", size.ValueLog)
+	} else if size.Meta > 0 {
+		fmt.Printf("  meta:      %d bytes\n", size.Meta)
+	}
+	fmt.Printf("  total:     %d bytes\n", size.Total)
+}
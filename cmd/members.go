@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/spf13/cobra"
+	"github.crom/crbroughton/townsquares-relay/membership"
+)
+
+var (
+	membersConfigFile string
+	membersCommunity  string
+	inviteUses        int
+	inviteExpires     time.Duration
+)
+
+var membersCmd = &cobra.Command{
+	Use:   "members",
+	Short: "Manage who can publish to the relay",
+	Long: `Manage the members of a community and the invite codes used to join it.
+Changes are picked up by a running relay without restarting it.`,
+}
+
+var membersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List members",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		members, err := openMembers().Members()
+		if err != nil {
+			log.Fatalf("Error listing members: %v", err)
+		}
+		for _, member := range members {
+			how := member.Reason
+			if member.Invite != "" {
+				how = "invite " + member.Invite
+			}
+			fmt.Printf("%s  %s  %s\n", member.PubKey, member.AddedAt.Format(time.DateTime), how)
+		}
+	},
+}
+
+var membersAddCmd = &cobra.Command{
+	Use:   "add <pubkey>",
+	Short: "Add a member by hex pubkey or npub",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		pubkey := parsePubKey(args[0])
+		if err := openMembers().AddMember(pubkey, "added from the command line"); err != nil {
+			log.Fatalf("Error adding member: %v", err)
+		}
+		fmt.Printf("✅ Added %s\n", pubkey)
+	},
+}
+
+var membersRemoveCmd = &cobra.Command{
+	Use:   "remove <pubkey>",
+	Short: "Remove a member by hex pubkey or npub",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		pubkey := parsePubKey(args[0])
+		if err := openMembers().RemoveMember(pubkey); err != nil {
+			log.Fatalf("Error removing member: %v", err)
+		}
+		fmt.Printf("✅ Removed %s\n", pubkey)
+	},
+}
+
+var membersInviteCmd = &cobra.Command{
+	Use:   "invite",
+	Short: "Create an invite code",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		invite, err := openMembers().CreateInvite(inviteUses, inviteExpires, "command line")
+		if err != nil {
+			log.Fatalf("Error creating invite: %v", err)
+		}
+		fmt.Println(invite.Code)
+	},
+}
+
+var membersInvitesCmd = &cobra.Command{
+	Use:   "invites",
+	Short: "List invite codes that can still be used",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		invites, err := openMembers().Invites()
+		if err != nil {
+			log.Fatalf("Error listing invites: %v", err)
+		}
+		for _, invite := range invites {
+			uses := "unlimited"
+			if invite.MaxUses > 0 {
+				uses = fmt.Sprintf("%d/%d used", invite.Uses, invite.MaxUses)
+			}
+			expires := "never expires"
+			if !invite.ExpiresAt.IsZero() {
+				expires = "expires " + invite.ExpiresAt.Format(time.DateTime)
+			}
+			fmt.Printf("%s  %s  %s\n", invite.Code, uses, expires)
+		}
+	},
+}
+
+var membersRevokeCmd = &cobra.Command{
+	Use:   "revoke <code>",
+	Short: "Revoke an invite code",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := openMembers().RevokeInvite(args[0]); err != nil {
+			log.Fatalf("Error revoking invite: %v", err)
+		}
+		fmt.Printf("✅ Revoked %s\n", args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(membersCmd)
+	membersCmd.AddCommand(membersListCmd, membersAddCmd, membersRemoveCmd, membersInviteCmd, membersInvitesCmd, membersRevokeCmd)
+
+	membersCmd.PersistentFlags().StringVarP(&membersConfigFile, "config", "c", "config.json", "Config file of the relay")
+	membersCmd.PersistentFlags().StringVar(&membersCommunity, "community", "", "Name of the community, when the config hosts several")
+	membersInviteCmd.Flags().IntVar(&inviteUses, "uses", 1, "How many people can join with the code (0 = unlimited)")
+	membersInviteCmd.Flags().DurationVar(&inviteExpires, "expires", 7*24*time.Hour, "How long the code is valid for (0 = forever)")
+}
+
+func openMembers() *membership.Store {
+	config, err := loadCommunity(membersConfigFile, membersCommunity)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if !config.MembershipEnabled {
+		fmt.Println("💡 membership_enabled is false, so members won't be enforced until it is set")
+	}
+
+	store, err := membership.Open(config.MembersFilePath())
+	if err != nil {
+		log.Fatalf("Error opening members file: %v", err)
+	}
+	return store
+}
+
+// parsePubKey accepts a pubkey as hex or as an npub.
+func parsePubKey(s string) string {
+	if prefix, value, err := nip19.Decode(s); err == nil && prefix == "npub" {
+		return value.(string)
+	}
+	if b, err := hex.DecodeString(s); err != nil || len(b) != 32 {
+		log.Fatalf("Invalid pubkey %q, expected hex or npub", s)
+	}
+	return s
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+var (
+	migrateFrom       string
+	migrateTo         string
+	migrateConfigFile string
+	migrateCommunity  string
+)
+
+// sidecarFiles are kept next to the database, unless the config says
+// otherwise, so they move with it. Media is a directory of blobs.
+var (
+	sidecarFiles = []string{"-members.json", "-moderation.json"}
+	sidecarDirs  = []string{"-media"}
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate --from <backend>:<path> --to <backend>:<path>",
+	Short: "Copy a relay's events to another storage backend",
+	Long: `Copy every event, and the relay's own records such as quota counts, from one
+storage backend to another, for example:
+
+  townsquares-relay migrate --from badger:db --to sqlite:relay.db
+
+The relay has to be stopped first. Both databases are opened with the
+community's db_settings, when its config is found. Progress is saved as events
+are copied, so an interrupted migration carries on when run again, and the
+number of events in both is checked at the end. Members and moderation files
+kept next to the old database, and its media, are copied next to the new one.
+The search index isn't, so run reindex afterwards if search is enabled.
+
+Events from peers, and where they came from, are only held in memory while the
+relay runs and are fetched from peers again, so there is nothing of them to copy.
+
+Point db_backend and db_path at the new database once it has finished.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		settings := migrateSettings(cmd)
+		source, sourcePath := openLocation(migrateFrom, settings)
+		defer source.Close()
+		destination, destinationPath := openLocation(migrateTo, settings)
+		defer destination.Close()
+
+		started := time.Now()
+		progress := func(p storage.MigrationProgress) {
+			fmt.Printf("\r%d events copied, down to %s", p.Copied, p.Until.Time().Format(time.DateTime))
+		}
+		state, err := storage.Migrate(context.Background(), source, destination, migrateFrom, progress)
+		if state.Copied > 0 {
+			fmt.Println()
+		}
+		if err != nil {
+			log.Fatalf("Error migrating: %v", err)
+		}
+
+		for _, suffix := range sidecarFiles {
+			copied, err := copySidecar(sourcePath+suffix, destinationPath+suffix)
+			if err != nil {
+				log.Fatalf("Error copying %s: %v", sourcePath+suffix, err)
+			}
+			if copied {
+				fmt.Printf("✅ Copied %s to %s\n", sourcePath+suffix, destinationPath+suffix)
+			}
+		}
+		for _, suffix := range sidecarDirs {
+			copied, err := copySidecarDir(sourcePath+suffix, destinationPath+suffix)
+			if err != nil {
+				log.Fatalf("Error copying %s: %v", sourcePath+suffix, err)
+			}
+			if copied > 0 {
+				fmt.Printf("✅ Copied %d files from %s to %s\n", copied, sourcePath+suffix, destinationPath+suffix)
+			}
+		}
+		fmt.Printf("✅ Migrated %d events to %s in %s\n", state.Copied, migrateTo, time.Since(started).Round(time.Second))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.Flags().StringVar(&migrateFrom, "from", "", "Database to copy from, like badger:db")
+	migrateCmd.Flags().StringVar(&migrateTo, "to", "", "Database to copy to, like sqlite:relay.db")
+	migrateCmd.Flags().StringVarP(&migrateConfigFile, "config", "c", "config.json", "Config file of the relay, for its db_settings")
+	migrateCmd.Flags().StringVar(&migrateCommunity, "community", "", "Name of the community, when the config hosts several")
+	migrateCmd.MarkFlagRequired("from")
+	migrateCmd.MarkFlagRequired("to")
+}
+
+// migrateSettings returns the community's db_settings, or the backends'
+// defaults when no config was given and there is none in the usual place.
+func migrateSettings(cmd *cobra.Command) storage.Settings {
+	if _, err := os.Stat(migrateConfigFile); os.IsNotExist(err) && !cmd.Flags().Changed("config") {
+		return storage.Settings{}
+	}
+	config, err := loadCommunity(migrateConfigFile, migrateCommunity)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	return config.DBSettings
+}
+
+func openLocation(location string, settings storage.Settings) (*storage.DB, string) {
+	backend, path, err := storage.ParseLocation(location)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	db, err := storage.Open(backend, path, settings)
+	if err != nil {
+		log.Fatalf("Error opening %s (is the relay still running?): %v", location, err)
+	}
+	return db, path
+}
+
+// copySidecar copies from to to, unless from is missing or to already
+// exists. The copy is written to a hidden temporary file and renamed into
+// place once it is on disk, so an interrupted copy is made again next time
+// rather than being taken for a finished one.
+func copySidecar(from, to string) (bool, error) {
+	in, err := os.Open(from)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	if _, err := os.Lstat(to); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(to), "."+filepath.Base(to)+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), to)
+}
+
+// copySidecarDir copies the files in from to to, leaving out any that are
+// hidden or already there.
+func copySidecarDir(from, to string) (int, error) {
+	entries, err := os.ReadDir(from)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(to, 0700); err != nil {
+		return 0, err
+	}
+
+	copied := 0
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		ok, err := copySidecar(filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name()))
+		if err != nil {
+			return copied, err
+		}
+		if ok {
+			copied++
+		}
+	}
+	return copied, nil
+}
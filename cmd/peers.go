@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	peersConfigFile string
+	peersCommunity  string
+	peersReason     string
+)
+
+var peersCmd = &cobra.Command{
+	Use:   "peers",
+	Short: "Manage the relays a community exchanges events with",
+	Long: `Add or remove peer relays without editing the config file. The relays in
+the config are the starting point, and changes made here are applied on top.
+A running relay picks them up within a minute.`,
+}
+
+var peersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List peers, including configured ones that were removed",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, store := loadModeration(peersConfigFile, peersCommunity)
+		peers, err := store.Peers(config.Relays)
+		if err != nil {
+			log.Fatalf("Error listing peers: %v", err)
+		}
+		for _, peer := range peers {
+			if slices.Contains(config.Relays, peer) {
+				fmt.Println(peer)
+			} else {
+				fmt.Printf("%s  (added)\n", peer)
+			}
+		}
+		for _, peer := range config.Relays {
+			if !slices.Contains(peers, peer) {
+				fmt.Printf("%s  (removed)\n", peer)
+			}
+		}
+	},
+}
+
+var peersAddCmd = &cobra.Command{
+	Use:   "add <url>",
+	Short: "Start exchanging events with a relay",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if u, err := url.Parse(args[0]); err != nil || !slices.Contains([]string{"ws", "wss", "http", "https"}, u.Scheme) || u.Host == "" {
+			log.Fatalf("Invalid peer %q, expected a ws:// or wss:// URL, or http:// on a tailnet", args[0])
+		}
+		_, store := loadModeration(peersConfigFile, peersCommunity)
+		if err := store.AddPeer(args[0], peersReason, "command line"); err != nil {
+			log.Fatalf("Error adding peer: %v", err)
+		}
+		fmt.Printf("✅ Added %s\n", args[0])
+	},
+}
+
+var peersRemoveCmd = &cobra.Command{
+	Use:   "remove <url>",
+	Short: "Stop exchanging events with a relay, even one in the config",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		_, store := loadModeration(peersConfigFile, peersCommunity)
+		if err := store.RemovePeer(args[0], peersReason, "command line"); err != nil {
+			log.Fatalf("Error removing peer: %v", err)
+		}
+		fmt.Printf("✅ Removed %s\n", args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(peersCmd)
+	peersCmd.AddCommand(peersListCmd, peersAddCmd, peersRemoveCmd)
+
+	peersCmd.PersistentFlags().StringVarP(&peersConfigFile, "config", "c", "config.json", "Config file of the relay")
+	peersCmd.PersistentFlags().StringVar(&peersCommunity, "community", "", "Name of the community, when the config hosts several")
+	peersCmd.PersistentFlags().StringVar(&peersReason, "reason", "", "Why the peer was added or removed")
+}
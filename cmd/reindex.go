@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.crom/crbroughton/townsquares-relay/search"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+var (
+	reindexConfigFile string
+	reindexCommunity  string
+)
+
+var reindexCmd = &cobra.Command{
+	Use:   "reindex",
+	Short: "Rebuild a community's search index",
+	Long: `Rebuild the NIP-50 search index from the events in a community's database,
+for example after turning search on, restoring a backup or migrating to
+another storage backend. Events from peers are only held while the relay runs,
+so they are indexed again as they arrive.
+
+The relay has to be stopped first.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadCommunity(reindexConfigFile, reindexCommunity)
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+		if !config.SearchEnabled {
+			log.Fatalf("Error: search_enabled isn't set for %s", config.Name)
+		}
+
+		db, err := storage.Open(config.DBBackend, config.DatabasePath(), config.DBSettings)
+		if err != nil {
+			log.Fatalf("Error opening storage (is the relay still running?): %v", err)
+		}
+		defer db.Close()
+		index, err := search.Open(config.SearchIndexPath())
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer index.Close()
+
+		started := time.Now()
+		count, err := index.Rebuild(context.Background(), db)
+		if err != nil {
+			log.Fatalf("Error rebuilding search index: %v", err)
+		}
+		fmt.Printf("✅ Indexed %d events in %s\n", count, time.Since(started).Round(time.Millisecond))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reindexCmd)
+	reindexCmd.Flags().StringVarP(&reindexConfigFile, "config", "c", "config.json", "Config file of the relay")
+	reindexCmd.Flags().StringVar(&reindexCommunity, "community", "", "Name of the community, when the config hosts several")
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.crom/crbroughton/townsquares-relay/moderation"
+	"github.crom/crbroughton/townsquares-relay/server"
+)
+
+var (
+	reportsConfigFile string
+	reportsCommunity  string
+	reportsAll        bool
+	reportsNote       string
+)
+
+var reportsCmd = &cobra.Command{
+	Use:   "reports",
+	Short: "Work through reported events",
+	Long: `List the NIP-56 reports sent to a community and deal with them.
+Changes are picked up by a running relay without restarting it.`,
+}
+
+var reportsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List reports waiting to be dealt with",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		reports, err := openModeration().Reports(reportsAll)
+		if err != nil {
+			log.Fatalf("Error listing reports: %v", err)
+		}
+		for _, report := range reports {
+			about := "pubkey " + report.PubKey
+			if report.Event != "" {
+				about = "event " + report.Event
+			}
+			reportType := report.Type
+			if reportType == "" {
+				reportType = "-"
+			}
+			fmt.Printf("%s  %s  %s  %s", report.ID, report.At.Format(time.DateTime), reportType, about)
+			if report.Resolution != nil {
+				fmt.Printf("  (%s)", report.Resolution.Action)
+			}
+			fmt.Println()
+			if report.Content != "" {
+				fmt.Printf("    %q\n", report.Content)
+			}
+		}
+	},
+}
+
+var reportsResolveCmd = &cobra.Command{
+	Use:   "resolve <report id>",
+	Short: "Close a report without acting on it",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := openModeration().ResolveReport(args[0], reportsNote, "command line"); err != nil {
+			log.Fatalf("Error resolving report: %v", err)
+		}
+		fmt.Printf("✅ Resolved %s\n", args[0])
+	},
+}
+
+var reportsHideEventCmd = &cobra.Command{
+	Use:   "hide-event <report id>",
+	Short: "Hide the reported event from clients and close the report",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := openModeration().HideReportedEvent(args[0], reportsNote, "command line")
+		if err != nil {
+			log.Fatalf("Error hiding event: %v", err)
+		}
+		fmt.Printf("✅ Hid %s\n", report.Event)
+	},
+}
+
+var reportsBanAuthorCmd = &cobra.Command{
+	Use:   "ban-author <report id>",
+	Short: "Ban the reported pubkey and close the report",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := openModeration().BanReportedAuthor(args[0], reportsNote, "command line")
+		if err != nil {
+			log.Fatalf("Error banning author: %v", err)
+		}
+		fmt.Printf("✅ Banned %s\n", report.PubKey)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reportsCmd)
+	reportsCmd.AddCommand(reportsListCmd, reportsResolveCmd, reportsHideEventCmd, reportsBanAuthorCmd)
+
+	reportsCmd.PersistentFlags().StringVarP(&reportsConfigFile, "config", "c", "config.json", "Config file of the relay")
+	reportsCmd.PersistentFlags().StringVar(&reportsCommunity, "community", "", "Name of the community, when the config hosts several")
+	reportsCmd.PersistentFlags().StringVar(&reportsNote, "note", "", "Why the report was dealt with this way")
+	reportsListCmd.Flags().BoolVar(&reportsAll, "all", false, "Include reports that have been dealt with")
+}
+
+func openModeration() *moderation.Store {
+	_, store := loadModeration(reportsConfigFile, reportsCommunity)
+	return store
+}
+
+// loadModeration loads a community's config and opens its moderation file.
+func loadModeration(configFile, community string) (*server.Config, *moderation.Store) {
+	config, err := loadCommunity(configFile, community)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	store, err := moderation.Open(config.ModerationFilePath())
+	if err != nil {
+		log.Fatalf("Error opening moderation file: %v", err)
+	}
+	return config, store
+}
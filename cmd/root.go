@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
+	"github.crom/crbroughton/townsquares-relay/server"
 )
 
 var rootCmd = &cobra.Command{
@@ -14,7 +15,7 @@ var rootCmd = &cobra.Command{
 Townsquares supports Tailscale networking for secure, private relay mesh networks.
 
 You can run the relay server or manage Tailscale authentication separately.`,
-	Version: "1.0.0",
+	Version: server.Version,
 }
 
 func Execute() {
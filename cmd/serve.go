@@ -2,35 +2,16 @@ package cmd
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"time"
 
-	"github.com/fiatjaf/eventstore/badger"
-	"github.com/fiatjaf/khatru"
-	"github.com/nbd-wtf/go-nostr"
 	"github.com/spf13/cobra"
 	"github.crom/crbroughton/townsquares-relay/manager"
+	"github.crom/crbroughton/townsquares-relay/server"
 	"github.crom/crbroughton/townsquares-relay/tsnet"
 )
 
-type Config struct {
-	Port              string   `json:"port"`
-	Name              string   `json:"name"`
-	PubKey            string   `json:"pubkey"`
-	Description       string   `json:"description"`
-	Relays            []string `json:"relays"`
-	DBPath            string   `json:"db_path"`
-	TailscaleEnabled  bool     `json:"tailscale_enabled,omitempty"`
-	TailscaleAuthKey  string   `json:"tailscale_auth_key,omitempty"`
-	TailscaleHostname string   `json:"tailscale_hostname,omitempty"`
-	TailscaleHTTPS    bool     `json:"tailscale_https,omitempty"`
-	TailscaleStateDir string   `json:"tailscale_state_dir,omitempty"`
-}
-
 var (
 	serveConfigFile string
 )
@@ -52,37 +33,24 @@ func init() {
 	serveCmd.Flags().StringVarP(&serveConfigFile, "config", "c", "config.json", "Config file to use for the relay server")
 }
 
-func loadConfig(filename string) (*Config, error) {
-	data, err := os.ReadFile(filename)
+func runServe(cmd *cobra.Command, args []string) {
+	config, err := server.LoadConfig(serveConfigFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
-	}
-
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+		log.Fatalf("Error loading config: %v", err)
 	}
 
-	return &config, nil
-}
-
-func runServe(cmd *cobra.Command, args []string) {
-	config, err := loadConfig(serveConfigFile)
+	communities, err := config.CommunityConfigs()
 	if err != nil {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
-	relay := khatru.NewRelay()
-	relay.Info.Name = config.Name
-	relay.Info.PubKey = config.PubKey
-	relay.Info.Description = config.Description
-
 	ctx := context.Background()
-	relayManager := manager.NewRelayManager()
 
-	// If Tailscale is enabled, set up the Tailscale HTTP client for inter-relay communication
+	// If Tailscale is enabled, one tsnet node is used by every community to reach peers and to serve clients
+	var tsServer *tsnet.Server
+	var tsConfig tsnet.Config
 	if config.TailscaleEnabled {
-		tsConfig := tsnet.Config{
+		tsConfig = tsnet.Config{
 			Hostname: config.TailscaleHostname,
 			AuthKey:  config.TailscaleAuthKey,
 			StateDir: config.TailscaleStateDir,
@@ -90,123 +58,40 @@ func runServe(cmd *cobra.Command, args []string) {
 			Port:     config.Port,
 		}
 
-		tsServer, err := tsnet.NewServer(tsConfig)
+		tsServer, err = tsnet.NewServer(tsConfig)
 		if err != nil {
 			log.Fatalf("Failed to create Tailscale server: %v", err)
 		}
-		relayManager.SetTailscaleClient(tsServer.HTTPClient())
-	}
-
-	for _, relayURL := range config.Relays {
-		go func(relayURL string) {
-			for {
-				err := relayManager.Connect(ctx, relayURL)
-				if err != nil {
-					time.Sleep(10 * time.Second)
-					continue
-				}
-				break
-			}
-		}(relayURL)
+		defer tsServer.Close()
 	}
 
-	defer relayManager.Close()
+	servers := make([]*server.Server, 0, len(communities))
+	for _, community := range communities {
+		srv, err := server.New(community)
+		if err != nil {
+			log.Fatalf("Failed to create relay %q: %v", community.Name, err)
+		}
+		defer srv.Close()
 
-	relayManager.StartSubscriptions(ctx)
+		if tsServer != nil {
+			srv.Manager.SetTransport(manager.NewTailscaleTransport(tsServer.Dial))
+			srv.SetHTTPClient(tsServer.HTTPClient())
+		}
+		srv.Start(ctx)
+		servers = append(servers, srv)
 
-	dbPath := config.DBPath
-	if dbPath == "" {
-		dbPath = "db"
+		if len(communities) > 1 {
+			fmt.Printf("hosting %q at %s%s\n", community.Name, community.Hostname, community.Path)
+		}
 	}
 
-	db := &badger.BadgerBackend{
-		Path: dbPath,
+	var handler http.Handler = servers[0]
+	if len(servers) > 1 {
+		handler = server.NewRouter(servers...)
 	}
-	if err := db.Init(); err != nil {
-		log.Fatalf("Failed to initialize BadgerDB: %v", err)
-	}
-	defer db.Close()
-
-	relay.StoreEvent = append(relay.StoreEvent, func(ctx context.Context, event *nostr.Event) error {
-		if err := db.SaveEvent(ctx, event); err != nil {
-			return err
-		}
-
-		clientIP := khatru.GetIP(ctx)
-		log.Printf("Received event %s from relay %s", event.ID[:8], clientIP)
-		relayManager.Broadcast(ctx, event)
-		return nil
-	})
-
-	relay.QueryEvents = append(relay.QueryEvents, func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
-		ch := make(chan *nostr.Event)
-		go func() {
-			defer close(ch)
-
-			// Query local BadgerDB storage
-			localCh, err := db.QueryEvents(ctx, filter)
-			if err != nil {
-				return
-			}
-
-			seenEvents := make(map[string]bool)
-
-			// Send events from local storage
-			for event := range localCh {
-				seenEvents[event.ID] = true
-				select {
-				case ch <- event:
-				case <-ctx.Done():
-					return
-				}
-			}
-
-			// Query events from connected relays
-			for _, event := range relayManager.GetAllEvents() {
-				if filter.Matches(event) {
-					if !seenEvents[event.ID] {
-						select {
-						case ch <- event:
-						case <-ctx.Done():
-							return
-						}
-					}
-				}
-			}
-		}()
-		return ch, nil
-	})
-
-	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
-		clientIP := khatru.GetIP(ctx)
-		log.Printf("New connection from %s", clientIP)
-	})
-	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
-		clientIP := khatru.GetIP(ctx)
-		log.Printf("Connection closed from %s", clientIP)
-	})
-
-	mux := relay.Router()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("content-type", "text/html")
-	})
 
 	// Start the server - either Tailscale or regular HTTP
 	if config.TailscaleEnabled {
-		tsConfig := tsnet.Config{
-			Hostname: config.TailscaleHostname,
-			AuthKey:  config.TailscaleAuthKey,
-			StateDir: config.TailscaleStateDir,
-			UseHTTPS: config.TailscaleHTTPS,
-			Port:     config.Port,
-		}
-
-		tsServer, err := tsnet.NewServer(tsConfig)
-		if err != nil {
-			log.Fatalf("Failed to create Tailscale server: %v", err)
-		}
-		defer tsServer.Close()
-
 		if err := tsServer.Listen(tsConfig); err != nil {
 			log.Fatalf("Failed to listen on Tailscale network: %v", err)
 		}
@@ -222,9 +107,9 @@ func runServe(cmd *cobra.Command, args []string) {
 		}
 
 		fmt.Printf("running on Tailscale network as %s://%s%s\n", protocol, hostname, config.Port)
-		log.Fatal(tsServer.Serve(relay))
+		log.Fatal(tsServer.Serve(handler))
 	} else {
 		fmt.Printf("running on %s\n", config.Port)
-		log.Fatal(http.ListenAndServe(config.Port, relay))
+		log.Fatal(http.ListenAndServe(config.Port, handler))
 	}
 }
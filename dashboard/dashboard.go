@@ -0,0 +1,21 @@
+// Package dashboard holds the admin dashboard the relay serves under
+// /admin. Like the web client it is plain HTML and JavaScript, and it only
+// shows what the admin API returns.
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed static
+var static embed.FS
+
+// Files returns the dashboard's files, with index.html at the root.
+func Files() fs.FS {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	return files
+}
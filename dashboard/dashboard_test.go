@@ -0,0 +1,26 @@
+package dashboard
+
+import (
+	"io/fs"
+	"regexp"
+	"testing"
+)
+
+func TestIndexReferencesBundledFiles(t *testing.T) {
+	files := Files()
+
+	index, err := fs.ReadFile(files, "index.html")
+	if err != nil {
+		t.Fatalf("Expected index.html, got %v", err)
+	}
+
+	refs := regexp.MustCompile(`(?:src|href)="([^":#]+)"`).FindAllSubmatch(index, -1)
+	if len(refs) == 0 {
+		t.Fatal("Expected index.html to load scripts and styles")
+	}
+	for _, ref := range refs {
+		if _, err := fs.Stat(files, string(ref[1])); err != nil {
+			t.Errorf("Expected %s to be bundled, got %v", ref[1], err)
+		}
+	}
+}
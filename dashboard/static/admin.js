@@ -0,0 +1,362 @@
+// The admin dashboard: shows what the admin API reports and acts through
+// it. Requests are signed with NIP-98 by a browser extension, or carry the
+// relay's admin token.
+
+const SAVED_AUTH = "townsquares.admin";
+const REFRESH_INTERVAL = 30000;
+
+// The API is the community's, /admin/ being mounted at its root
+const base = new URL("..", location.href);
+
+const $ = (selector) => document.querySelector(selector);
+
+// auth is { type: "nip07" } or { type: "token", token }
+let auth = null;
+let refreshTimer = null;
+
+// API requests.
+
+async function authorization(method, url) {
+  if (auth.type === "token") return "Bearer " + auth.token;
+  const event = await window.nostr.signEvent({
+    kind: 27235,
+    created_at: Math.floor(Date.now() / 1000),
+    tags: [["u", url], ["method", method]],
+    content: "",
+  });
+  const bytes = new TextEncoder().encode(JSON.stringify(event));
+  return "Nostr " + btoa(String.fromCharCode(...bytes));
+}
+
+// api calls an admin API endpoint. Requests never have a body, so NIP-98
+// events don't need a payload hash.
+async function api(method, path, params = {}) {
+  const url = new URL(path, base);
+  for (const [key, value] of Object.entries(params)) {
+    if (value) url.searchParams.set(key, value);
+  }
+  const response = await fetch(url, { method, headers: { Authorization: await authorization(method, url.href) } });
+  if (!response.ok) {
+    const body = await response.json().catch(() => ({}));
+    throw new Error(body.error ?? `${response.status} ${response.statusText}`);
+  }
+  return response.status === 204 ? null : response.json();
+}
+
+// Pubkeys.
+
+const BECH32 = "qpzry9x8gf2tvdw0s3jn54khce6mua7l";
+
+function polymod(values) {
+  const generator = [0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3];
+  let chk = 1;
+  for (const value of values) {
+    const top = chk >> 25;
+    chk = ((chk & 0x1ffffff) << 5) ^ value;
+    for (let i = 0; i < 5; i++) if ((top >> i) & 1) chk ^= generator[i];
+  }
+  return chk;
+}
+
+// parsePubKey accepts a pubkey as hex or as an npub, returning it as hex.
+function parsePubKey(input) {
+  const value = input.trim().toLowerCase();
+  if (/^[0-9a-f]{64}$/.test(value)) return value;
+  if (!value.startsWith("npub1")) return null;
+
+  const data = [...value.slice(5)].map((c) => BECH32.indexOf(c));
+  const prefix = [..."npub"].map((c) => c.charCodeAt(0));
+  const expanded = [...prefix.map((c) => c >> 5), 0, ...prefix.map((c) => c & 31), ...data];
+  if (data.includes(-1) || polymod(expanded) !== 1) return null;
+
+  let acc = 0;
+  let bits = 0;
+  const bytes = [];
+  for (const word of data.slice(0, -6)) {
+    acc = ((acc << 5) | word) & 0xfff;
+    bits += 5;
+    if (bits >= 8) {
+      bits -= 8;
+      bytes.push((acc >> bits) & 0xff);
+    }
+  }
+  if (bytes.length !== 32) return null;
+  return bytes.map((b) => b.toString(16).padStart(2, "0")).join("");
+}
+
+// Rendering.
+
+function el(tag, attributes = {}, ...children) {
+  const element = document.createElement(tag);
+  for (const [name, value] of Object.entries(attributes)) {
+    if (name.startsWith("on")) element.addEventListener(name.slice(2), value);
+    else if (name === "className") element.className = value;
+    else element.setAttribute(name, value);
+  }
+  element.append(...children.filter((child) => child !== null && child !== undefined));
+  return element;
+}
+
+function shortKey(pubkey) {
+  return el("code", { title: pubkey }, pubkey.slice(0, 12) + "…");
+}
+
+function when(iso) {
+  if (!iso) return "never";
+  const at = new Date(iso);
+  const seconds = Math.round((Date.now() - at) / 1000);
+  let ago;
+  if (seconds < 60) ago = "just now";
+  else if (seconds < 3600) ago = Math.round(seconds / 60) + " min ago";
+  else if (seconds < 86400) ago = Math.round(seconds / 3600) + " h ago";
+  else ago = at.toLocaleDateString();
+  return el("time", { datetime: at.toISOString(), title: at.toLocaleString() }, ago);
+}
+
+function bytes(n) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function emptyRow(columns, text) {
+  return el("tr", {}, el("td", { colspan: columns, className: "muted" }, text));
+}
+
+function button(text, onclick, className = "") {
+  return el("button", { type: "button", className, onclick }, text);
+}
+
+function renderPeers(peers) {
+  $("#peers").replaceChildren(
+    ...peers.map((peer) =>
+      el(
+        "tr",
+        {},
+        el("td", {}, el("code", {}, peer.url), peer.configured ? null : el("span", { className: "muted" }, " added")),
+        el("td", {}, peer.active ? el("span", { className: "up" }, "connected") : el("span", { className: "down" }, "not connected")),
+        el("td", {}, peer.events),
+        el("td", {}, when(peer.last_received)),
+        el(
+          "td",
+          {},
+          button(
+            "Remove",
+            () => confirm(`Stop exchanging events with ${peer.url}?`) && act("Removed " + peer.url, () => api("DELETE", "api/peers", { url: peer.url })),
+            "danger",
+          ),
+        ),
+      ),
+    ),
+  );
+  if (peers.length === 0) $("#peers").append(emptyRow(5, "No peers."));
+}
+
+function renderClients(clients) {
+  $("#client-count").textContent = `(${clients.length})`;
+  $("#clients").replaceChildren(
+    ...clients.map((client) =>
+      el(
+        "tr",
+        {},
+        el("td", {}, client.ip),
+        el("td", {}, client.pubkey ? shortKey(client.pubkey) : el("span", { className: "muted" }, "not signed in")),
+        el("td", { className: "muted" }, client.user_agent ?? ""),
+        el("td", {}, when(client.connected_at)),
+      ),
+    ),
+  );
+  if (clients.length === 0) $("#clients").append(emptyRow(4, "Nobody is connected."));
+}
+
+function renderRates(rates) {
+  $("#rates").replaceChildren(
+    ...rates.map((rate) => el("tr", {}, el("td", {}, rate.kind), el("td", {}, rate.last_minute), el("td", {}, rate.last_hour), el("td", {}, rate.from_peers))),
+  );
+  if (rates.length === 0) $("#rates").append(emptyRow(4, "No events in the last hour."));
+}
+
+function renderReports(reports) {
+  const resolve = (report, action, done) => () => act(done, () => api("POST", `api/reports/${report.id}/${action}`));
+  $("#reports").replaceChildren(
+    ...reports.map((report) =>
+      el(
+        "div",
+        { className: "report" },
+        el("strong", {}, report.type || "report"),
+        " about ",
+        report.event ? el("span", {}, "event ", el("code", { title: report.event }, report.event.slice(0, 12) + "…"), " by ") : null,
+        shortKey(report.pubkey),
+        el("span", { className: "muted" }, " reported by "),
+        shortKey(report.reporter),
+        " ",
+        when(report.at),
+        report.content ? el("p", {}, report.content) : null,
+        el(
+          "div",
+          {},
+          button("Resolve", resolve(report, "resolve", "Resolved the report")),
+          report.event ? button("Hide event", resolve(report, "hide-event", "Hid the event")) : null,
+          button("Ban author", resolve(report, "ban-author", "Banned the author"), "danger"),
+        ),
+      ),
+    ),
+  );
+  if (reports.length === 0) $("#reports").append(el("p", { className: "muted" }, "Nothing to review."));
+}
+
+function renderBans(bans) {
+  $("#bans").replaceChildren(
+    ...bans.map((ban) =>
+      el(
+        "tr",
+        {},
+        el("td", {}, shortKey(ban.key)),
+        el("td", {}, ban.reason ?? ""),
+        el("td", {}, ban.by && /^[0-9a-f]{64}$/.test(ban.by) ? shortKey(ban.by) : (ban.by ?? "")),
+        el("td", {}, when(ban.at)),
+        el("td", {}, button("Unban", () => act("Unbanned the pubkey", () => api("DELETE", "api/bans/" + ban.key)))),
+      ),
+    ),
+  );
+  if (bans.length === 0) $("#bans").append(emptyRow(5, "Nobody is banned."));
+}
+
+function renderStorage(storage) {
+  const rows = [
+    ["Backend", storage.backend],
+    ["Path", storage.path],
+    ["Total", bytes(storage.size.total)],
+    ["Events", bytes(storage.size.events)],
+    ["Metadata", bytes(storage.size.meta)],
+    ["Last maintenance", storage.last_maintenance ? when(storage.last_maintenance.at) : "not yet"],
+  ];
+  $("#storage").replaceChildren(...rows.flatMap(([name, value]) => [el("dt", {}, name), el("dd", {}, value)]));
+}
+
+function render(status) {
+  renderPeers(status.peers);
+  renderClients(status.clients);
+  renderRates(status.event_rates);
+  renderReports(status.reports);
+  renderBans(status.bans);
+  renderStorage(status.storage);
+  $("#config").textContent = JSON.stringify(status.config, null, 2);
+  if (status.config.name) {
+    $("#community").textContent = status.config.name;
+    document.title = status.config.name + " admin";
+  }
+  $("#updated").textContent = "Updated " + new Date().toLocaleTimeString();
+}
+
+function showMessage(text, isError = false) {
+  $("#message").textContent = text;
+  $("#message").className = isError ? "error" : "";
+}
+
+// Loading and acting.
+
+async function refresh() {
+  try {
+    render(await api("GET", "api/dashboard"));
+    $("#dashboard").hidden = false;
+  } catch (err) {
+    showMessage(err.message, true);
+  }
+}
+
+// act runs an action, then shows the result and what changed.
+async function act(done, action) {
+  try {
+    await action();
+    showMessage(done);
+  } catch (err) {
+    showMessage(err.message, true);
+    return;
+  }
+  await refresh();
+}
+
+// Signing in and out.
+
+async function signIn(newAuth) {
+  auth = newAuth;
+  sessionStorage.setItem(SAVED_AUTH, JSON.stringify(auth));
+  $("#signed-out").hidden = true;
+  $("#signed-in").hidden = false;
+  $("#whoami").textContent = auth.type === "token" ? "with the admin token" : "with your browser extension";
+  showMessage("");
+  await refresh();
+  // Extensions may ask before each signature, so only tokens refresh by
+  // themselves
+  if (auth.type === "token") refreshTimer = setInterval(refresh, REFRESH_INTERVAL);
+}
+
+function signOut() {
+  auth = null;
+  clearInterval(refreshTimer);
+  sessionStorage.removeItem(SAVED_AUTH);
+  $("#signed-out").hidden = false;
+  $("#signed-in").hidden = true;
+  $("#dashboard").hidden = true;
+  showMessage("");
+}
+
+$("#extension-sign-in").onclick = () => {
+  if (!window.nostr) {
+    showMessage("No nostr browser extension was found.", true);
+    return;
+  }
+  signIn({ type: "nip07" });
+};
+
+$("#token-form").onsubmit = (e) => {
+  e.preventDefault();
+  signIn({ type: "token", token: $("#token").value.trim() });
+  $("#token").value = "";
+};
+
+$("#sign-out").onclick = signOut;
+$("#refresh").onclick = refresh;
+
+$("#peer-form").onsubmit = (e) => {
+  e.preventDefault();
+  const url = $("#peer-url").value.trim();
+  act("Added " + url, async () => {
+    await api("PUT", "api/peers", { url });
+    $("#peer-url").value = "";
+  });
+};
+
+$("#ban-form").onsubmit = (e) => {
+  e.preventDefault();
+  const pubkey = parsePubKey($("#ban-pubkey").value);
+  if (!pubkey) {
+    showMessage("That isn't a valid npub or hex pubkey.", true);
+    return;
+  }
+  act("Banned the pubkey", async () => {
+    await api("PUT", "api/bans/" + pubkey, { reason: $("#ban-reason").value.trim() });
+    $("#ban-pubkey").value = "";
+    $("#ban-reason").value = "";
+  });
+};
+
+// Start up.
+
+try {
+  const saved = JSON.parse(sessionStorage.getItem(SAVED_AUTH) ?? "null");
+  if (saved?.type === "nip07") {
+    // Extensions may only add window.nostr once the page has loaded
+    if (!window.nostr) await new Promise((resolve) => window.addEventListener("load", resolve, { once: true }));
+    if (window.nostr) signIn(saved);
+  } else if (saved?.type === "token") {
+    signIn(saved);
+  }
+} catch {
+  sessionStorage.removeItem(SAVED_AUTH);
+}
@@ -0,0 +1,149 @@
+// Package filestore keeps a small piece of relay state in a JSON file. The
+// file is re-read whenever it changes on disk, so the CLI can edit it while
+// the relay is running, though reads only look for changes once every
+// CheckInterval.
+package filestore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CheckInterval is how often Read looks at the file for changes made by
+// someone else. Update always looks, so it never overwrites them.
+const CheckInterval = time.Second
+
+// File holds a value of type T backed by the JSON file at its path.
+type File[T any] struct {
+	path    string
+	init    func(*T)
+	mu      sync.RWMutex
+	value   T
+	modTime time.Time
+	// checked is when the file was last looked at, in Unix nanoseconds
+	checked atomic.Int64
+}
+
+// Open loads the file at path, or starts from an empty value if it doesn't
+// exist yet. init is called on every freshly loaded value, e.g. to make
+// sure its maps aren't nil.
+func Open[T any](path string, init func(*T)) (*File[T], error) {
+	f := &File[T]{path: path, init: init}
+	if init != nil {
+		init(&f.value)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Read calls fn with the current value. fn must not keep or change it.
+// Reads don't wait for each other.
+func (f *File[T]) Read(fn func(*T) error) error {
+	if f.due() {
+		f.mu.Lock()
+		var err error
+		if f.due() {
+			err = f.reload()
+		}
+		f.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return fn(&f.value)
+}
+
+// due reports whether it is time to look at the file again.
+func (f *File[T]) due() bool {
+	return time.Since(time.Unix(0, f.checked.Load())) >= CheckInterval
+}
+
+// Update calls fn with the current value and saves it if fn succeeds.
+func (f *File[T]) Update(fn func(*T) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.reload(); err != nil {
+		return err
+	}
+	if err := fn(&f.value); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// reload reads the file again if it has changed. The caller must hold f.mu.
+func (f *File[T]) reload() error {
+	f.checked.Store(time.Now().UnixNano())
+	info, err := os.Stat(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	var loaded T
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", f.path, err)
+	}
+	if f.init != nil {
+		f.init(&loaded)
+	}
+
+	f.value = loaded
+	f.modTime = info.ModTime()
+	return nil
+}
+
+// save writes the file through a temporary file so a crash never leaves it
+// half written. The caller must hold f.mu.
+func (f *File[T]) save() error {
+	data, err := json.MarshalIndent(f.value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(f.path); err == nil {
+		f.modTime = info.ModTime()
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type counter struct {
+	Count int `json:"count"`
+}
+
+func TestUpdatesArePersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	f, err := Open[counter](path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	if err := f.Update(func(c *counter) error {
+		c.Count++
+		return nil
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	reopened, err := Open[counter](path, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen file: %v", err)
+	}
+	reopened.Read(func(c *counter) error {
+		if c.Count != 1 {
+			t.Errorf("Expected count 1, got %d", c.Count)
+		}
+		return nil
+	})
+}
+
+func TestInvalidFilesAreReported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("not json"), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if _, err := Open[counter](path, nil); err == nil {
+		t.Error("Expected an error for an invalid file")
+	}
+}
+
+func TestChangesOnDiskAreNoticed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	f, err := Open[counter](path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	count := func() int {
+		var n int
+		f.Read(func(c *counter) error {
+			n = c.Count
+			return nil
+		})
+		return n
+	}
+	count()
+
+	// Someone else, like the CLI, changes the file
+	other, err := Open[counter](path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	if err := other.Update(func(c *counter) error {
+		c.Count = 5
+		return nil
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	if n := count(); n != 0 {
+		t.Errorf("Expected reads to wait for the next check, got %d", n)
+	}
+	time.Sleep(CheckInterval)
+	if n := count(); n != 5 {
+		t.Errorf("Expected the change to be noticed, got %d", n)
+	}
+
+	// Updates always start from what is on disk
+	other.Update(func(c *counter) error {
+		c.Count = 7
+		return nil
+	})
+	if err := f.Update(func(c *counter) error {
+		c.Count++
+		return nil
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if n := count(); n != 8 {
+		t.Errorf("Expected the update to build on the other change, got %d", n)
+	}
+}
@@ -0,0 +1,115 @@
+package geohash
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Area is a community's patch of ground, made up of one or more cells.
+type Area []string
+
+// NewArea validates the cells that make up an area.
+func NewArea(cells []string) (Area, error) {
+	area := make(Area, 0, len(cells))
+	for _, cell := range cells {
+		if !Valid(cell) {
+			return nil, fmt.Errorf("invalid geohash %q", cell)
+		}
+		area = append(area, strings.ToLower(cell))
+	}
+	return area, nil
+}
+
+// Contains reports whether hash overlaps any cell of the area.
+func (a Area) Contains(hash string) bool {
+	for _, cell := range a {
+		if Overlaps(cell, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithNeighbours returns the area grown by the cells bordering each of its
+// cells.
+func (a Area) WithNeighbours() Area {
+	grown := append(Area(nil), a...)
+	for _, cell := range a {
+		neighbours, err := Neighbours(cell)
+		if err != nil {
+			continue
+		}
+		grown = append(grown, neighbours...)
+	}
+	return grown
+}
+
+// EventCells returns the valid geohashes from an event's "g" tags.
+func EventCells(event *nostr.Event) []string {
+	var cells []string
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "g" && Valid(tag[1]) {
+			cells = append(cells, tag[1])
+		}
+	}
+	return cells
+}
+
+// ContainsEvent reports whether an event is tagged inside the area. Events
+// with no location at all are reported as inside, since there is nothing to
+// place them elsewhere.
+func (a Area) ContainsEvent(event *nostr.Event) bool {
+	cells := EventCells(event)
+	if len(cells) == 0 {
+		return true
+	}
+	for _, cell := range cells {
+		if a.Contains(cell) {
+			return true
+		}
+	}
+	return false
+}
+
+// Radius is a circle around the centre of a geohash cell.
+type Radius struct {
+	Lat, Lon float64
+	Km       float64
+}
+
+// ParseRadius parses "<geohash>:<km>", e.g. "gcpvj:2".
+func ParseRadius(value string) (Radius, error) {
+	hash, km, found := strings.Cut(value, ":")
+	if !found {
+		return Radius{}, fmt.Errorf("expected <geohash>:<km>, got %q", value)
+	}
+
+	lat, lon, err := Decode(hash)
+	if err != nil {
+		return Radius{}, err
+	}
+
+	var distance float64
+	if _, err := fmt.Sscanf(km, "%g", &distance); err != nil || distance < 0 {
+		return Radius{}, fmt.Errorf("invalid distance %q", km)
+	}
+
+	return Radius{Lat: lat, Lon: lon, Km: distance}, nil
+}
+
+// ContainsEvent reports whether any of the event's "g" tags has its centre
+// within the radius.
+func (r Radius) ContainsEvent(event *nostr.Event) bool {
+	for _, cell := range EventCells(event) {
+		lat, lon, err := Decode(cell)
+		if err != nil {
+			continue
+		}
+		if Distance(r.Lat, r.Lon, lat, lon) <= r.Km {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+// Package geohash implements the small part of the geohash system the relay
+// needs: decoding cells, finding their neighbours and measuring distance.
+package geohash
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const base32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+const earthRadiusKm = 6371.0
+
+// Box is the area covered by a geohash cell.
+type Box struct {
+	MinLat, MaxLat float64
+	MinLon, MaxLon float64
+}
+
+// Center returns the midpoint of the box.
+func (b Box) Center() (lat, lon float64) {
+	return (b.MinLat + b.MaxLat) / 2, (b.MinLon + b.MaxLon) / 2
+}
+
+// Valid reports whether hash is a non-empty geohash.
+func Valid(hash string) bool {
+	if hash == "" {
+		return false
+	}
+	for _, c := range strings.ToLower(hash) {
+		if !strings.ContainsRune(base32, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// DecodeBox returns the bounds of a geohash cell.
+func DecodeBox(hash string) (Box, error) {
+	box := Box{MinLat: -90, MaxLat: 90, MinLon: -180, MaxLon: 180}
+	even := true
+
+	for _, c := range strings.ToLower(hash) {
+		idx := strings.IndexRune(base32, c)
+		if idx < 0 {
+			return Box{}, fmt.Errorf("invalid geohash %q", hash)
+		}
+		for bit := 4; bit >= 0; bit-- {
+			set := idx&(1<<bit) != 0
+			if even {
+				mid := (box.MinLon + box.MaxLon) / 2
+				if set {
+					box.MinLon = mid
+				} else {
+					box.MaxLon = mid
+				}
+			} else {
+				mid := (box.MinLat + box.MaxLat) / 2
+				if set {
+					box.MinLat = mid
+				} else {
+					box.MaxLat = mid
+				}
+			}
+			even = !even
+		}
+	}
+
+	if hash == "" {
+		return Box{}, fmt.Errorf("empty geohash")
+	}
+	return box, nil
+}
+
+// Decode returns the centre point of a geohash cell.
+func Decode(hash string) (lat, lon float64, err error) {
+	box, err := DecodeBox(hash)
+	if err != nil {
+		return 0, 0, err
+	}
+	lat, lon = box.Center()
+	return lat, lon, nil
+}
+
+// Encode returns the geohash of a point at the given precision.
+func Encode(lat, lon float64, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLon, maxLon := -180.0, 180.0
+
+	var sb strings.Builder
+	even := true
+	bit, idx := 4, 0
+
+	for sb.Len() < precision {
+		if even {
+			mid := (minLon + maxLon) / 2
+			if lon >= mid {
+				idx |= 1 << bit
+				minLon = mid
+			} else {
+				maxLon = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if lat >= mid {
+				idx |= 1 << bit
+				minLat = mid
+			} else {
+				maxLat = mid
+			}
+		}
+		even = !even
+
+		if bit == 0 {
+			sb.WriteByte(base32[idx])
+			bit, idx = 4, 0
+		} else {
+			bit--
+		}
+	}
+
+	return sb.String()
+}
+
+// Neighbours returns the eight cells of the same precision surrounding hash.
+// Cells past the poles are left out.
+func Neighbours(hash string) ([]string, error) {
+	box, err := DecodeBox(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	lat, lon := box.Center()
+	height := box.MaxLat - box.MinLat
+	width := box.MaxLon - box.MinLon
+
+	var neighbours []string
+	for _, dLat := range []float64{-1, 0, 1} {
+		for _, dLon := range []float64{-1, 0, 1} {
+			if dLat == 0 && dLon == 0 {
+				continue
+			}
+			nLat := lat + dLat*height
+			if nLat > 90 || nLat < -90 {
+				continue
+			}
+			nLon := lon + dLon*width
+			if nLon > 180 {
+				nLon -= 360
+			} else if nLon < -180 {
+				nLon += 360
+			}
+			neighbours = append(neighbours, Encode(nLat, nLon, len(hash)))
+		}
+	}
+	return neighbours, nil
+}
+
+// Distance returns the great-circle distance in kilometres between two points.
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// Overlaps reports whether two cells share any ground, i.e. one is a
+// prefix of the other.
+func Overlaps(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
@@ -0,0 +1,126 @@
+package geohash
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDecodeKnownGeohash(t *testing.T) {
+	lat, lon, err := Decode("u4pruydqqvj")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if math.Abs(lat-57.64911) > 0.0001 || math.Abs(lon-10.40744) > 0.0001 {
+		t.Errorf("Expected 57.64911,10.40744 got %f,%f", lat, lon)
+	}
+}
+
+func TestEncodeRoundTrips(t *testing.T) {
+	for _, hash := range []string{"gcpvj", "u4pruydqqvj", "9q8yy", "r3gx2f"} {
+		lat, lon, err := Decode(hash)
+		if err != nil {
+			t.Fatalf("Unexpected error decoding %s: %v", hash, err)
+		}
+		if got := Encode(lat, lon, len(hash)); got != hash {
+			t.Errorf("Expected %s, got %s", hash, got)
+		}
+	}
+}
+
+func TestInvalidGeohashesAreRejected(t *testing.T) {
+	for _, hash := range []string{"", "abc", "gcpvi"} {
+		if Valid(hash) {
+			t.Errorf("Expected %q to be invalid", hash)
+		}
+	}
+
+	if _, err := NewArea([]string{"gcpvj", "nope!"}); err == nil {
+		t.Error("Expected area with an invalid cell to fail")
+	}
+}
+
+func TestNeighboursSurroundTheCell(t *testing.T) {
+	neighbours, err := Neighbours("gcpvj")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(neighbours) != 8 {
+		t.Fatalf("Expected 8 neighbours, got %d", len(neighbours))
+	}
+
+	seen := map[string]bool{"gcpvj": true}
+	for _, n := range neighbours {
+		if seen[n] {
+			t.Errorf("Neighbour %s repeated or equal to the cell", n)
+		}
+		seen[n] = true
+		if len(n) != 5 {
+			t.Errorf("Expected neighbour at the same precision, got %s", n)
+		}
+	}
+}
+
+func TestDistanceBetweenLondonAndParis(t *testing.T) {
+	km := Distance(51.5074, -0.1278, 48.8566, 2.3522)
+	if km < 340 || km > 350 {
+		t.Errorf("Expected roughly 344km, got %f", km)
+	}
+}
+
+func TestAreaContainsEvent(t *testing.T) {
+	area, _ := NewArea([]string{"gcpvj"})
+
+	tagged := func(hashes ...string) *nostr.Event {
+		event := &nostr.Event{}
+		for _, h := range hashes {
+			event.Tags = append(event.Tags, nostr.Tag{"g", h})
+		}
+		return event
+	}
+
+	if !area.ContainsEvent(tagged("gcpvjbm")) {
+		t.Error("Expected a more precise cell inside the area to be contained")
+	}
+	if !area.ContainsEvent(tagged("gcp")) {
+		t.Error("Expected a coarser overlapping cell to be contained")
+	}
+	if area.ContainsEvent(tagged("u4pru")) {
+		t.Error("Expected a distant cell to be outside the area")
+	}
+	if !area.ContainsEvent(tagged()) {
+		t.Error("Expected an untagged event to be treated as inside")
+	}
+
+	neighbour, _ := Neighbours("gcpvj")
+	if area.ContainsEvent(tagged(neighbour[0])) {
+		t.Error("Expected a neighbouring cell to be outside the area")
+	}
+	if !area.WithNeighbours().ContainsEvent(tagged(neighbour[0])) {
+		t.Error("Expected a neighbouring cell to be inside the grown area")
+	}
+}
+
+func TestRadiusContainsEvent(t *testing.T) {
+	radius, err := ParseRadius("gcpvj:5")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	near := &nostr.Event{Tags: nostr.Tags{{"g", "gcpvjbm"}}}
+	far := &nostr.Event{Tags: nostr.Tags{{"g", "u4pruydqqvj"}}}
+
+	if !radius.ContainsEvent(near) {
+		t.Error("Expected nearby event to be within the radius")
+	}
+	if radius.ContainsEvent(far) {
+		t.Error("Expected distant event to be outside the radius")
+	}
+
+	if _, err := ParseRadius("gcpvj"); err == nil {
+		t.Error("Expected radius without a distance to fail")
+	}
+}
@@ -0,0 +1,301 @@
+package groups
+
+import (
+	"context"
+	"log"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// RejectEvent enforces group rules on events written by clients.
+func (m *Manager) RejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if nip29.MetadataEventKinds.Includes(event.Kind) {
+		if event.PubKey == m.PublicKey {
+			return false, ""
+		}
+		return true, "blocked: group metadata can only be published by the relay"
+	}
+
+	id := GroupID(event)
+	if id == "" {
+		if IsStateEvent(event) {
+			return true, "invalid: missing group \"h\" tag"
+		}
+		return false, ""
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if event.Kind == nostr.KindSimpleGroupCreateGroup {
+		if _, exists := m.groups[id]; exists {
+			return true, "duplicate: group already exists"
+		}
+		if len(m.creators) > 0 && !slices.Contains(m.creators, event.PubKey) {
+			return true, "restricted: you are not allowed to create groups"
+		}
+		return false, ""
+	}
+
+	group, exists := m.groups[id]
+	if !exists {
+		return true, "invalid: group doesn't exist"
+	}
+
+	switch {
+	case event.Kind == nostr.KindSimpleGroupJoinRequest:
+		if m.isMember(id, event.PubKey) {
+			return true, "duplicate: already a member"
+		}
+		return false, ""
+	case event.Kind == nostr.KindSimpleGroupLeaveRequest:
+		if !m.isMember(id, event.PubKey) {
+			return true, "invalid: not a member"
+		}
+		return false, ""
+	case nip29.ModerationEventKinds.Includes(event.Kind):
+		if !m.isAdmin(id, event.PubKey) {
+			return true, "restricted: only group admins can moderate"
+		}
+		return false, ""
+	}
+
+	if _, member := group.Members[event.PubKey]; !member {
+		return true, "restricted: only members can post to this group"
+	}
+	return false, ""
+}
+
+// OnEventSaved applies a stored moderation event to the group state and
+// republishes the group's metadata.
+func (m *Manager) OnEventSaved(ctx context.Context, event *nostr.Event) {
+	id := GroupID(event)
+	if id == "" {
+		return
+	}
+
+	m.mu.Lock()
+	changed := m.apply(event)
+	m.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if event.Kind == nostr.KindSimpleGroupDeleteEvent {
+		m.deleteEvents(ctx, event)
+	}
+	m.publishMetadata(ctx, id)
+}
+
+// ApplyFederated applies a moderation, join or leave event a peer hosting
+// the same group sent us. It is held to the same rules as a client write
+// and stored so the group state survives a restart.
+func (m *Manager) ApplyFederated(ctx context.Context, event *nostr.Event) {
+	if !IsStateEvent(event) {
+		return
+	}
+	if reject, _ := m.RejectEvent(ctx, event); reject {
+		return
+	}
+	if err := m.store.SaveEvent(ctx, event); err != nil {
+		return
+	}
+	m.OnEventSaved(ctx, event)
+}
+
+// IsStateEvent reports whether an event changes group state rather than
+// being content posted to a group.
+func IsStateEvent(event *nostr.Event) bool {
+	return nip29.ModerationEventKinds.Includes(event.Kind) ||
+		event.Kind == nostr.KindSimpleGroupJoinRequest ||
+		event.Kind == nostr.KindSimpleGroupLeaveRequest
+}
+
+// apply updates group state from an event, returning whether anything
+// changed. The caller must hold m.mu.
+func (m *Manager) apply(event *nostr.Event) bool {
+	id := GroupID(event)
+	if id == "" {
+		return false
+	}
+
+	if event.Kind == nostr.KindSimpleGroupCreateGroup {
+		if _, exists := m.groups[id]; exists {
+			return false
+		}
+		m.groups[id] = &nip29.Group{
+			Address:            nip29.GroupAddress{ID: id},
+			Name:               id,
+			Members:            map[string][]*nip29.Role{event.PubKey: {AdminRole}},
+			Roles:              []*nip29.Role{AdminRole},
+			LastMetadataUpdate: event.CreatedAt,
+			LastAdminsUpdate:   event.CreatedAt,
+			LastMembersUpdate:  event.CreatedAt,
+		}
+		return true
+	}
+
+	group, exists := m.groups[id]
+	if !exists {
+		return false
+	}
+
+	switch event.Kind {
+	case nostr.KindSimpleGroupPutUser:
+		for _, tag := range event.Tags {
+			if len(tag) < 2 || tag[0] != "p" {
+				continue
+			}
+			var roles []*nip29.Role
+			if slices.Contains(tag[2:], AdminRole.Name) {
+				roles = append(roles, AdminRole)
+			}
+			group.Members[tag[1]] = roles
+		}
+		group.LastMembersUpdate = event.CreatedAt
+		group.LastAdminsUpdate = event.CreatedAt
+	case nostr.KindSimpleGroupRemoveUser:
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				delete(group.Members, tag[1])
+			}
+		}
+		group.LastMembersUpdate = event.CreatedAt
+		group.LastAdminsUpdate = event.CreatedAt
+	case nostr.KindSimpleGroupEditMetadata:
+		for _, tag := range event.Tags {
+			if len(tag) == 0 {
+				continue
+			}
+			switch {
+			case tag[0] == "name" && len(tag) >= 2:
+				group.Name = tag[1]
+			case tag[0] == "about" && len(tag) >= 2:
+				group.About = tag[1]
+			case tag[0] == "picture" && len(tag) >= 2:
+				group.Picture = tag[1]
+			case tag[0] == "private":
+				group.Private = true
+			case tag[0] == "public":
+				group.Private = false
+			case tag[0] == "closed":
+				group.Closed = true
+			case tag[0] == "open":
+				group.Closed = false
+			}
+		}
+		group.LastMetadataUpdate = event.CreatedAt
+	case nostr.KindSimpleGroupDeleteEvent:
+		// The events themselves are removed from storage by OnEventSaved
+	case nostr.KindSimpleGroupDeleteGroup:
+		delete(m.groups, id)
+	case nostr.KindSimpleGroupJoinRequest:
+		if group.Closed {
+			// Join requests to closed groups wait for an admin to add the user
+			return false
+		}
+		if _, member := group.Members[event.PubKey]; member {
+			return false
+		}
+		group.Members[event.PubKey] = nil
+		group.LastMembersUpdate = event.CreatedAt
+	case nostr.KindSimpleGroupLeaveRequest:
+		if _, member := group.Members[event.PubKey]; !member {
+			return false
+		}
+		delete(group.Members, event.PubKey)
+		group.LastMembersUpdate = event.CreatedAt
+		group.LastAdminsUpdate = event.CreatedAt
+	default:
+		return false
+	}
+	return true
+}
+
+func (m *Manager) deleteEvents(ctx context.Context, event *nostr.Event) {
+	var ids []string
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "e" {
+			ids = append(ids, tag[1])
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	ch, err := m.store.QueryEvents(ctx, nostr.Filter{IDs: ids})
+	if err != nil {
+		return
+	}
+	var targets []*nostr.Event
+	for target := range ch {
+		// Only events posted to this group can be deleted by its admins
+		if GroupID(target) == GroupID(event) {
+			targets = append(targets, target)
+		}
+	}
+	for _, target := range targets {
+		if err := m.store.DeleteEvent(ctx, target); err != nil {
+			log.Printf("Failed to delete group event %s: %v", target.ID[:8], err)
+		}
+	}
+}
+
+// publishMetadata signs and stores the current metadata, admins, members
+// and roles events for a group.
+func (m *Manager) publishMetadata(ctx context.Context, id string) {
+	group, exists := m.Group(id)
+	if !exists {
+		m.deleteMetadata(ctx, id)
+		return
+	}
+
+	// Several updates can land in the same second, and a replaceable event
+	// only replaces one with an older timestamp
+	m.mu.Lock()
+	createdAt := nostr.Now()
+	if createdAt <= m.published[id] {
+		createdAt = m.published[id] + 1
+	}
+	m.published[id] = createdAt
+	m.mu.Unlock()
+
+	for _, event := range []*nostr.Event{group.ToMetadataEvent(), group.ToAdminsEvent(), group.ToMembersEvent(), group.ToRolesEvent()} {
+		event.CreatedAt = createdAt
+		if err := event.Sign(m.secretKey); err != nil {
+			log.Printf("Failed to sign group metadata for %s: %v", id, err)
+			return
+		}
+		if err := m.store.ReplaceEvent(ctx, event); err != nil {
+			log.Printf("Failed to store group metadata for %s: %v", id, err)
+			continue
+		}
+		if m.OnMetadata != nil {
+			m.OnMetadata(event)
+		}
+	}
+}
+
+// deleteMetadata removes the metadata of a deleted group.
+func (m *Manager) deleteMetadata(ctx context.Context, id string) {
+	ch, err := m.store.QueryEvents(ctx, nostr.Filter{
+		Kinds:   nip29.MetadataEventKinds,
+		Authors: []string{m.PublicKey},
+		Tags:    nostr.TagMap{"d": []string{id}},
+	})
+	if err != nil {
+		return
+	}
+	var stale []*nostr.Event
+	for event := range ch {
+		stale = append(stale, event)
+	}
+	for _, event := range stale {
+		if err := m.store.DeleteEvent(ctx, event); err != nil {
+			log.Printf("Failed to delete group metadata for %s: %v", id, err)
+		}
+	}
+}
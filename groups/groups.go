@@ -0,0 +1,215 @@
+// Package groups implements NIP-29 relay-based groups: the relay keeps the
+// authoritative state of each group, enforces membership on "h" tagged
+// events and publishes signed group metadata.
+package groups
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// AdminRole is granted to group creators and lets a member moderate.
+var AdminRole = &nip29.Role{Name: "admin", Description: "can moderate the group"}
+
+// Store is the storage the group manager reads moderation history from and
+// writes relay-signed metadata to.
+type Store interface {
+	QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)
+	SaveEvent(ctx context.Context, event *nostr.Event) error
+	DeleteEvent(ctx context.Context, event *nostr.Event) error
+	ReplaceEvent(ctx context.Context, event *nostr.Event) error
+}
+
+// Manager holds the state of every group hosted on the relay.
+type Manager struct {
+	mu        sync.RWMutex
+	groups    map[string]*nip29.Group
+	published map[string]nostr.Timestamp
+	secretKey string
+	PublicKey string
+	creators  []string
+	store     Store
+
+	// OnMetadata is called with each freshly signed metadata event, so it
+	// can be sent to listeners and peers.
+	OnMetadata func(event *nostr.Event)
+}
+
+// NewManager creates a group manager that signs metadata with secretKey.
+// If creators is empty anyone may create a group.
+func NewManager(secretKey string, creators []string, store Store) (*Manager, error) {
+	pubkey, err := nostr.GetPublicKey(secretKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay secret key: %w", err)
+	}
+
+	return &Manager{
+		groups:    make(map[string]*nip29.Group),
+		published: make(map[string]nostr.Timestamp),
+		secretKey: secretKey,
+		PublicKey: pubkey,
+		creators:  creators,
+		store:     store,
+	}, nil
+}
+
+// GroupID returns the value of an event's "h" tag.
+func GroupID(event *nostr.Event) string {
+	if tag := event.Tags.Find("h"); tag != nil {
+		return tag[1]
+	}
+	return ""
+}
+
+// MetadataGroupID returns the group a relay-signed metadata event is about.
+func MetadataGroupID(event *nostr.Event) string {
+	if nip29.MetadataEventKinds.Includes(event.Kind) {
+		return event.Tags.GetD()
+	}
+	return ""
+}
+
+// Load rebuilds every group by replaying the moderation events in store.
+func (m *Manager) Load(ctx context.Context) error {
+	kinds := append([]int{nostr.KindSimpleGroupJoinRequest, nostr.KindSimpleGroupLeaveRequest}, nip29.ModerationEventKinds...)
+
+	var events []*nostr.Event
+	seen := make(map[string]bool)
+	filter := nostr.Filter{Kinds: kinds, Limit: 500}
+	for {
+		ch, err := m.store.QueryEvents(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		page := 0
+		var oldest nostr.Timestamp
+		for event := range ch {
+			page++
+			if seen[event.ID] {
+				continue
+			}
+			seen[event.ID] = true
+			events = append(events, event)
+			if oldest == 0 || event.CreatedAt < oldest {
+				oldest = event.CreatedAt
+			}
+		}
+
+		if page < filter.Limit {
+			break
+		}
+		filter.Until = &oldest
+	}
+
+	// Events from the same second can't be ordered reliably, but a group
+	// has to be created before anything else can happen to it
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].CreatedAt != events[j].CreatedAt {
+			return events[i].CreatedAt < events[j].CreatedAt
+		}
+		return events[i].Kind == nostr.KindSimpleGroupCreateGroup && events[j].Kind != nostr.KindSimpleGroupCreateGroup
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, event := range events {
+		m.apply(event)
+	}
+	return nil
+}
+
+// Hosts reports whether the group exists on this relay.
+func (m *Manager) Hosts(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, exists := m.groups[id]
+	return exists
+}
+
+// GroupIDs returns the ids of every hosted group.
+func (m *Manager) GroupIDs() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := make([]string, 0, len(m.groups))
+	for id := range m.groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Group returns a copy of a group's state.
+func (m *Manager) Group(id string) (nip29.Group, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	group, exists := m.groups[id]
+	if !exists {
+		return nip29.Group{}, false
+	}
+	copied := *group
+	copied.Members = make(map[string][]*nip29.Role, len(group.Members))
+	for pubkey, roles := range group.Members {
+		copied.Members[pubkey] = slices.Clone(roles)
+	}
+	return copied, true
+}
+
+// IsMember reports whether pubkey belongs to the group.
+func (m *Manager) IsMember(id, pubkey string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.isMember(id, pubkey)
+}
+
+func (m *Manager) isMember(id, pubkey string) bool {
+	group, exists := m.groups[id]
+	if !exists {
+		return false
+	}
+	_, member := group.Members[pubkey]
+	return member
+}
+
+func (m *Manager) isAdmin(id, pubkey string) bool {
+	group, exists := m.groups[id]
+	if !exists {
+		return false
+	}
+	return slices.Contains(group.Members[pubkey], AdminRole)
+}
+
+// CanRead reports whether pubkey may see an event. Content of private
+// groups is only shown to their members; everything else is public.
+func (m *Manager) CanRead(pubkey string, event *nostr.Event) bool {
+	id := GroupID(event)
+	if id == "" {
+		return true
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	group, exists := m.groups[id]
+	if !exists || !group.Private {
+		return true
+	}
+	_, member := group.Members[pubkey]
+	return member
+}
+
+// IsPrivate reports whether a hosted group only shows content to members.
+func (m *Manager) IsPrivate(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	group, exists := m.groups[id]
+	return exists && group.Private
+}
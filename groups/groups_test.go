@@ -0,0 +1,200 @@
+package groups
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/badger"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func newTestManager(t *testing.T, creators ...string) (*Manager, *badger.BadgerBackend) {
+	t.Helper()
+
+	db := &badger.BadgerBackend{Path: filepath.Join(t.TempDir(), "db")}
+	if err := db.Init(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	m, err := NewManager(nostr.GeneratePrivateKey(), creators, db)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	return m, db
+}
+
+func signed(t *testing.T, sk string, kind int, group string, tags ...nostr.Tag) *nostr.Event {
+	t.Helper()
+
+	event := &nostr.Event{
+		Kind:      kind,
+		CreatedAt: nostr.Now(),
+		Tags:      append(nostr.Tags{{"h", group}}, tags...),
+	}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	return event
+}
+
+// write runs an event through the same steps khatru does for a client.
+func write(t *testing.T, m *Manager, db *badger.BadgerBackend, event *nostr.Event) string {
+	t.Helper()
+
+	ctx := context.Background()
+	if reject, msg := m.RejectEvent(ctx, event); reject {
+		return msg
+	}
+	if err := db.SaveEvent(ctx, event); err != nil {
+		t.Fatalf("Failed to save event: %v", err)
+	}
+	m.OnEventSaved(ctx, event)
+	return ""
+}
+
+func TestCreatorBecomesAdmin(t *testing.T) {
+	m, db := newTestManager(t)
+	admin := nostr.GeneratePrivateKey()
+	adminPub, _ := nostr.GetPublicKey(admin)
+
+	if msg := write(t, m, db, signed(t, admin, nostr.KindSimpleGroupCreateGroup, "allotments")); msg != "" {
+		t.Fatalf("Expected group creation to be accepted, got %q", msg)
+	}
+
+	if !m.Hosts("allotments") {
+		t.Fatal("Expected group to exist")
+	}
+	if !m.isAdmin("allotments", adminPub) {
+		t.Error("Expected creator to be an admin")
+	}
+	if msg := write(t, m, db, signed(t, admin, nostr.KindSimpleGroupCreateGroup, "allotments")); !strings.HasPrefix(msg, "duplicate:") {
+		t.Errorf("Expected duplicate group to be rejected, got %q", msg)
+	}
+}
+
+func TestOnlyAllowedCreatorsCanCreateGroups(t *testing.T) {
+	creator := nostr.GeneratePrivateKey()
+	creatorPub, _ := nostr.GetPublicKey(creator)
+	m, db := newTestManager(t, creatorPub)
+
+	if msg := write(t, m, db, signed(t, nostr.GeneratePrivateKey(), nostr.KindSimpleGroupCreateGroup, "school")); !strings.HasPrefix(msg, "restricted:") {
+		t.Errorf("Expected unknown creator to be restricted, got %q", msg)
+	}
+	if msg := write(t, m, db, signed(t, creator, nostr.KindSimpleGroupCreateGroup, "school")); msg != "" {
+		t.Errorf("Expected allowed creator to be accepted, got %q", msg)
+	}
+}
+
+func TestMembershipIsEnforced(t *testing.T) {
+	m, db := newTestManager(t)
+	admin := nostr.GeneratePrivateKey()
+	user := nostr.GeneratePrivateKey()
+	write(t, m, db, signed(t, admin, nostr.KindSimpleGroupCreateGroup, "allotments"))
+
+	if msg := write(t, m, db, signed(t, user, nostr.KindTextNote, "allotments")); !strings.HasPrefix(msg, "restricted:") {
+		t.Errorf("Expected non-member post to be restricted, got %q", msg)
+	}
+	if msg := write(t, m, db, signed(t, user, nostr.KindTextNote, "missing")); !strings.HasPrefix(msg, "invalid:") {
+		t.Errorf("Expected post to unknown group to be invalid, got %q", msg)
+	}
+	if msg := write(t, m, db, signed(t, user, nostr.KindSimpleGroupPutUser, "allotments")); !strings.HasPrefix(msg, "restricted:") {
+		t.Errorf("Expected moderation by non-admin to be restricted, got %q", msg)
+	}
+
+	if msg := write(t, m, db, signed(t, user, nostr.KindSimpleGroupJoinRequest, "allotments")); msg != "" {
+		t.Fatalf("Expected join request to be accepted, got %q", msg)
+	}
+	if msg := write(t, m, db, signed(t, user, nostr.KindTextNote, "allotments")); msg != "" {
+		t.Errorf("Expected member post to be accepted, got %q", msg)
+	}
+
+	userPub, _ := nostr.GetPublicKey(user)
+	write(t, m, db, signed(t, admin, nostr.KindSimpleGroupRemoveUser, "allotments", nostr.Tag{"p", userPub}))
+	if msg := write(t, m, db, signed(t, user, nostr.KindTextNote, "allotments")); !strings.HasPrefix(msg, "restricted:") {
+		t.Errorf("Expected removed member to be restricted, got %q", msg)
+	}
+}
+
+func TestClientsCannotPublishGroupMetadata(t *testing.T) {
+	m, _ := newTestManager(t)
+
+	event := &nostr.Event{Kind: nostr.KindSimpleGroupMetadata, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"d", "allotments"}}}
+	event.Sign(nostr.GeneratePrivateKey())
+
+	if reject, _ := m.RejectEvent(context.Background(), event); !reject {
+		t.Error("Expected client-signed group metadata to be rejected")
+	}
+}
+
+func TestMetadataIsSignedByTheRelay(t *testing.T) {
+	m, db := newTestManager(t)
+	admin := nostr.GeneratePrivateKey()
+	write(t, m, db, signed(t, admin, nostr.KindSimpleGroupCreateGroup, "allotments"))
+	write(t, m, db, signed(t, admin, nostr.KindSimpleGroupEditMetadata, "allotments",
+		nostr.Tag{"name", "Allotment Society"}, nostr.Tag{"private"}))
+
+	ch, err := db.QueryEvents(context.Background(), nostr.Filter{
+		Kinds: []int{nostr.KindSimpleGroupMetadata},
+		Tags:  nostr.TagMap{"d": []string{"allotments"}},
+	})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	var events []*nostr.Event
+	for event := range ch {
+		events = append(events, event)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 metadata event, got %d", len(events))
+	}
+	if events[0].PubKey != m.PublicKey {
+		t.Errorf("Expected metadata signed by %s, got %s", m.PublicKey, events[0].PubKey)
+	}
+	if tag := events[0].Tags.Find("name"); tag == nil || tag[1] != "Allotment Society" {
+		t.Errorf("Expected latest name in metadata, got %v", events[0].Tags)
+	}
+	if events[0].Tags.GetFirst([]string{"private"}) == nil {
+		t.Error("Expected metadata to mark the group private")
+	}
+}
+
+func TestPrivateGroupsAreOnlyReadableByMembers(t *testing.T) {
+	m, db := newTestManager(t)
+	admin := nostr.GeneratePrivateKey()
+	adminPub, _ := nostr.GetPublicKey(admin)
+	write(t, m, db, signed(t, admin, nostr.KindSimpleGroupCreateGroup, "parents"))
+	write(t, m, db, signed(t, admin, nostr.KindSimpleGroupEditMetadata, "parents", nostr.Tag{"private"}))
+
+	post := signed(t, admin, nostr.KindTextNote, "parents")
+	if !m.CanRead(adminPub, post) {
+		t.Error("Expected member to read private group")
+	}
+	if m.CanRead("", post) {
+		t.Error("Expected anonymous reader to be refused")
+	}
+}
+
+func TestLoadReplaysGroupState(t *testing.T) {
+	m, db := newTestManager(t)
+	admin := nostr.GeneratePrivateKey()
+	user := nostr.GeneratePrivateKey()
+	userPub, _ := nostr.GetPublicKey(user)
+	write(t, m, db, signed(t, admin, nostr.KindSimpleGroupCreateGroup, "allotments"))
+	write(t, m, db, signed(t, admin, nostr.KindSimpleGroupPutUser, "allotments", nostr.Tag{"p", userPub}))
+
+	reloaded, err := NewManager(nostr.GeneratePrivateKey(), nil, db)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	if err := reloaded.Load(context.Background()); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if !reloaded.IsMember("allotments", userPub) {
+		t.Error("Expected membership to survive a reload")
+	}
+}
@@ -22,7 +22,7 @@ func main() {
 }
 
 func isKnownCommand(arg string) bool {
-	knownCommands := []string{"serve", "tailscale", "auth", "help", "--help", "-h", "--version", "-v"}
+	knownCommands := []string{"serve", "tailscale", "auth", "members", "reports", "peers", "bans", "export", "import", "migrate", "db", "reindex", "help", "--help", "-h", "--version", "-v"}
 	for _, cmd := range knownCommands {
 		if arg == cmd {
 			return true
@@ -3,7 +3,7 @@ package manager
 import (
 	"context"
 	"fmt"
-	"net/http"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,10 +12,13 @@ import (
 )
 
 type RelayConnection struct {
-	URL    string
-	Relay  *nostr.Relay
-	active bool
-	mu     sync.RWMutex
+	URL       string
+	Relay     Peer
+	active    bool
+	mu        sync.RWMutex
+	transport PeerTransport
+	// done is closed when the peer is disconnected for good
+	done chan struct{}
 }
 
 type EventMetadata struct {
@@ -24,16 +27,31 @@ type EventMetadata struct {
 	Local       bool
 }
 
+// peerEvents counts the events held from a peer, so Peers doesn't have to
+// look through every event.
+type peerEvents struct {
+	count        int
+	lastReceived time.Time
+}
+
 type RelayManager struct {
-	connections     map[string]*RelayConnection
-	mu              sync.RWMutex
-	eventStore      map[string]*nostr.Event
-	eventMetadata   map[string]*EventMetadata
-	storeMu         sync.RWMutex
-	seenEvents      map[string]bool
-	seenMu          sync.RWMutex
-	logger          *logger.RelayLogger
-	tailscaleClient *http.Client
+	connections   map[string]*RelayConnection
+	mu            sync.RWMutex
+	eventStore    map[string]*nostr.Event
+	eventMetadata map[string]*EventMetadata
+	peerEvents    map[string]*peerEvents
+	storeMu       sync.RWMutex
+	seenEvents    map[string]bool
+	seenMu        sync.RWMutex
+	logger        *logger.RelayLogger
+	transport     PeerTransport
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	federation    []FederationFilter
+	subscriptions []func() nostr.Filters
+	handlers      []func(sourceURL string, event *nostr.Event)
+	done          chan struct{}
+	closeOnce     sync.Once
 }
 
 func NewRelayManager() *RelayManager {
@@ -42,22 +60,123 @@ func NewRelayManager() *RelayManager {
 		panic(err)
 	}
 	return &RelayManager{
-		connections:     make(map[string]*RelayConnection),
-		eventStore:      make(map[string]*nostr.Event),
-		eventMetadata:   make(map[string]*EventMetadata),
-		seenEvents:      make(map[string]bool),
-		logger:          logger,
-		tailscaleClient: http.DefaultClient,
+		connections:   make(map[string]*RelayConnection),
+		eventStore:    make(map[string]*nostr.Event),
+		eventMetadata: make(map[string]*EventMetadata),
+		peerEvents:    make(map[string]*peerEvents),
+		seenEvents:    make(map[string]bool),
+		logger:        logger,
+		transport:     NewWebSocketTransport(),
+		minBackoff:    5 * time.Second,
+		maxBackoff:    60 * time.Second,
+		done:          make(chan struct{}),
+	}
+}
+
+// SetReconnectBackoff changes how long subscriptions wait before retrying a
+// lost peer. The wait doubles on each failure, from min up to max.
+func (rm *RelayManager) SetReconnectBackoff(min, max time.Duration) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.minBackoff = min
+	rm.maxBackoff = max
+}
+
+// FederationFilter decides whether an event may be exchanged with a peer.
+// It is asked both before broadcasting to a peer and before accepting an
+// event that peer sent us.
+type FederationFilter func(peerURL string, event *nostr.Event) bool
+
+// AddFederationFilter restricts which events are exchanged with peers. An
+// event is only exchanged if every filter allows it.
+func (rm *RelayManager) AddFederationFilter(filter FederationFilter) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.federation = append(rm.federation, filter)
+}
+
+func (rm *RelayManager) shouldFederate(peerURL string, event *nostr.Event) bool {
+	rm.mu.RLock()
+	filters := rm.federation
+	rm.mu.RUnlock()
+
+	for _, filter := range filters {
+		if !filter(peerURL, event) {
+			return false
+		}
+	}
+	return true
+}
+
+// AddSubscriptionFilters adds to what is requested from every peer, on top
+// of recent text notes. It is called each time a subscription is opened.
+func (rm *RelayManager) AddSubscriptionFilters(filters func() nostr.Filters) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.subscriptions = append(rm.subscriptions, filters)
+}
+
+func (rm *RelayManager) subscriptionFilters() nostr.Filters {
+	filters := nostr.Filters{
+		{
+			Kinds: []int{nostr.KindTextNote},
+			Limit: 100,
+		},
+	}
+
+	rm.mu.RLock()
+	extra := rm.subscriptions
+	rm.mu.RUnlock()
+
+	for _, f := range extra {
+		filters = append(filters, f()...)
 	}
+	return filters
 }
 
-func (rm *RelayManager) SetTailscaleClient(client *http.Client) {
+// AddIncomingEventHandler registers a function called with every new event
+// accepted from a peer, after it has been stored.
+func (rm *RelayManager) AddIncomingEventHandler(handler func(sourceURL string, event *nostr.Event)) {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
-	rm.tailscaleClient = client
+	rm.handlers = append(rm.handlers, handler)
+}
+
+// wait pauses for d, returning false if the manager is closed or ctx is
+// cancelled in the meantime.
+func (rm *RelayManager) wait(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-rm.done:
+		return false
+	}
+}
+
+// SetTransport changes how new peer connections are made. Existing
+// connections keep the transport they were opened with.
+func (rm *RelayManager) SetTransport(transport PeerTransport) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.transport = transport
 }
 
 func (rm *RelayManager) Connect(ctx context.Context, url string) error {
+	rm.mu.RLock()
+	transport := rm.transport
+	rm.mu.RUnlock()
+
+	return rm.ConnectWithTransport(ctx, url, transport)
+}
+
+// ConnectWithTransport connects to a peer over a specific transport, which is
+// also used for any reconnects to that peer.
+func (rm *RelayManager) ConnectWithTransport(ctx context.Context, url string, transport PeerTransport) error {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
@@ -67,16 +186,18 @@ func (rm *RelayManager) Connect(ctx context.Context, url string) error {
 	}
 
 	rm.logger.ConnectingToRelay(url)
-	relay, err := nostr.RelayConnect(ctx, url)
+	relay, err := transport.Connect(ctx, url)
 	if err != nil {
 		rm.logger.FailureToConnectToRelay(url, err)
 		return fmt.Errorf("failed to connect to relay %s: %w", url, err)
 	}
 
 	conn := &RelayConnection{
-		URL:    url,
-		Relay:  relay,
-		active: true,
+		URL:       url,
+		Relay:     relay,
+		active:    true,
+		transport: transport,
+		done:      make(chan struct{}),
 	}
 	rm.connections[url] = conn
 	rm.logger.RelayConnected(url)
@@ -87,6 +208,10 @@ func (rm *RelayManager) Connect(ctx context.Context, url string) error {
 }
 
 func (rm *RelayManager) handleIncomingEvent(event *nostr.Event, sourceURL string) {
+	if !rm.shouldFederate(sourceURL, event) {
+		return
+	}
+
 	// Make sure no dupes
 	rm.seenMu.Lock()
 	if rm.seenEvents[event.ID] {
@@ -96,42 +221,72 @@ func (rm *RelayManager) handleIncomingEvent(event *nostr.Event, sourceURL string
 	rm.seenEvents[event.ID] = true
 	rm.seenMu.Unlock()
 
+	receivedAt := time.Now()
 	rm.storeMu.Lock()
 	rm.eventStore[event.ID] = event
 	rm.eventMetadata[event.ID] = &EventMetadata{
 		SourceRelay: sourceURL,
-		ReceivedAt:  time.Now(),
+		ReceivedAt:  receivedAt,
 		Local:       false,
 	}
-
+	counts, ok := rm.peerEvents[sourceURL]
+	if !ok {
+		counts = &peerEvents{}
+		rm.peerEvents[sourceURL] = counts
+	}
+	counts.count++
+	counts.lastReceived = receivedAt
 	rm.storeMu.Unlock()
 	rm.logger.EventReceived(sourceURL, event.ID[:8])
+
+	rm.mu.RLock()
+	handlers := rm.handlers
+	rm.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(sourceURL, event)
+	}
 }
 
 func (rm *RelayManager) Subscribe(ctx context.Context, conn *RelayConnection) {
-	backoff := 5 * time.Second
-	maxBackoff := 60 * time.Second
+	// Disconnecting the peer stops its subscription and any reconnects
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-conn.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	rm.mu.RLock()
+	minBackoff, maxBackoff := rm.minBackoff, rm.maxBackoff
+	rm.mu.RUnlock()
+	backoff := minBackoff
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-rm.done:
+			return
 		default:
 		}
 
-		sub, err := conn.Relay.Subscribe(ctx, []nostr.Filter{
-			{
-				Kinds: []int{nostr.KindTextNote},
-				Limit: 100,
-			},
-		})
+		conn.mu.RLock()
+		peer := conn.Relay
+		conn.mu.RUnlock()
+
+		events, err := peer.Subscribe(ctx, rm.subscriptionFilters())
 		if err != nil {
 			rm.logger.SubscriptionFailed(conn.URL, err)
 			conn.mu.Lock()
 			conn.active = false
 			conn.mu.Unlock()
 
-			time.Sleep(backoff)
+			if !rm.wait(ctx, backoff) {
+				return
+			}
 			backoff = backoff * 2
 			if backoff > maxBackoff {
 				backoff = maxBackoff
@@ -141,16 +296,16 @@ func (rm *RelayManager) Subscribe(ctx context.Context, conn *RelayConnection) {
 				rm.logger.FailureToConnectToRelay(conn.URL, err)
 				continue
 			}
-			backoff = 5 * time.Second // Reset backoff on successful reconnect
+			backoff = minBackoff // Reset backoff on successful reconnect
 			continue
 		}
 
 		conn.mu.Lock()
 		conn.active = true
 		conn.mu.Unlock()
-		backoff = 5 * time.Second // Reset backoff on successful subscribe
+		backoff = minBackoff // Reset backoff on successful subscribe
 
-		for ev := range sub.Events {
+		for ev := range events {
 			select {
 			case <-ctx.Done():
 				return
@@ -164,20 +319,34 @@ func (rm *RelayManager) Subscribe(ctx context.Context, conn *RelayConnection) {
 		conn.active = false
 		conn.mu.Unlock()
 
-		time.Sleep(backoff)
+		if !rm.wait(ctx, backoff) {
+			return
+		}
 	}
 }
 
 func (rm *RelayManager) reconnect(ctx context.Context, conn *RelayConnection) error {
+	conn.mu.RLock()
 	if conn.Relay != nil {
 		conn.Relay.Close()
 	}
+	conn.mu.RUnlock()
 
-	relay, err := nostr.RelayConnect(ctx, conn.URL)
+	relay, err := conn.transport.Connect(ctx, conn.URL)
 	if err != nil {
 		return err
 	}
 
+	select {
+	case <-rm.done:
+		relay.Close()
+		return fmt.Errorf("relay manager closed")
+	case <-conn.done:
+		relay.Close()
+		return fmt.Errorf("relay %s was disconnected", conn.URL)
+	default:
+	}
+
 	conn.mu.Lock()
 	conn.Relay = relay
 	conn.active = true
@@ -206,17 +375,25 @@ func (rm *RelayManager) Broadcast(ctx context.Context, event *nostr.Event) {
 	defer rm.mu.RUnlock()
 
 	for url, conn := range rm.connections {
-		if !conn.active {
+		conn.mu.RLock()
+		active, peer := conn.active, conn.Relay
+		conn.mu.RUnlock()
+		if !active || !rm.shouldFederate(url, event) {
 			continue
 		}
 
-		go func(relay *nostr.Relay, relayURL string) {
-			if err := relay.Publish(ctx, *event); err != nil {
+		go func(relay Peer, relayURL string) {
+			// The event usually arrives on a client connection, which may close
+			// before the peer has acknowledged it
+			publishCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+			defer cancel()
+
+			if err := relay.Publish(publishCtx, *event); err != nil {
 				rm.logger.FailureToPublishEvent(relayURL, err)
 			} else {
 				rm.logger.EventPublished(relayURL, event.ID[:8])
 			}
-		}(conn.Relay, url)
+		}(peer, url)
 	}
 }
 
@@ -231,6 +408,102 @@ func (rm *RelayManager) GetAllEvents() []*nostr.Event {
 	return events
 }
 
+// GetEvent returns an event received from a peer, if it is still held.
+func (rm *RelayManager) GetEvent(id string) (*nostr.Event, bool) {
+	rm.storeMu.RLock()
+	defer rm.storeMu.RUnlock()
+
+	event, exists := rm.eventStore[id]
+	return event, exists
+}
+
+// RemoveEvent forgets an event received from a peer. It stays marked as
+// seen, so the peer can't send it again.
+func (rm *RelayManager) RemoveEvent(id string) bool {
+	rm.storeMu.Lock()
+	defer rm.storeMu.Unlock()
+
+	if _, exists := rm.eventStore[id]; !exists {
+		return false
+	}
+	if metadata, ok := rm.eventMetadata[id]; ok {
+		if counts, ok := rm.peerEvents[metadata.SourceRelay]; ok {
+			counts.count--
+		}
+	}
+	delete(rm.eventStore, id)
+	delete(rm.eventMetadata, id)
+	return true
+}
+
+// GetEventMetadata returns where an event came from, if the manager has
+// seen it.
+func (rm *RelayManager) GetEventMetadata(id string) (EventMetadata, bool) {
+	rm.storeMu.RLock()
+	defer rm.storeMu.RUnlock()
+
+	metadata, exists := rm.eventMetadata[id]
+	if !exists {
+		return EventMetadata{}, false
+	}
+	return *metadata, true
+}
+
+// PeerStatus is a peer the manager has connected to, whether it is
+// currently subscribed to it, and the events from it that are still held.
+type PeerStatus struct {
+	URL          string    `json:"url"`
+	Active       bool      `json:"active"`
+	Events       int       `json:"events"`
+	LastReceived time.Time `json:"last_received,omitzero"`
+}
+
+// Peers returns every peer the manager has connected to, sorted by URL.
+func (rm *RelayManager) Peers() []PeerStatus {
+	rm.mu.RLock()
+	peers := make([]PeerStatus, 0, len(rm.connections))
+	for url, conn := range rm.connections {
+		conn.mu.RLock()
+		peers = append(peers, PeerStatus{URL: url, Active: conn.active})
+		conn.mu.RUnlock()
+	}
+	rm.mu.RUnlock()
+
+	rm.storeMu.RLock()
+	for i := range peers {
+		if counts, ok := rm.peerEvents[peers[i].URL]; ok {
+			peers[i].Events = counts.count
+			peers[i].LastReceived = counts.lastReceived
+		}
+	}
+	rm.storeMu.RUnlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].URL < peers[j].URL
+	})
+	return peers
+}
+
+// Disconnect stops exchanging events with a peer and forgets it, so it can
+// be connected to again later. It reports whether the peer was connected.
+func (rm *RelayManager) Disconnect(url string) bool {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	conn, exists := rm.connections[url]
+	if !exists {
+		return false
+	}
+	delete(rm.connections, url)
+	close(conn.done)
+
+	conn.mu.RLock()
+	conn.Relay.Close()
+	conn.mu.RUnlock()
+	rm.logger.RelayDisconnected(url)
+	return true
+}
+
 func (rm *RelayManager) StartSubscriptions(ctx context.Context) {
 	rm.mu.RLock()
 	defer rm.mu.RUnlock()
@@ -242,12 +515,17 @@ func (rm *RelayManager) StartSubscriptions(ctx context.Context) {
 	}
 }
 
+// Close disconnects from every peer and stops any reconnect attempts.
 func (rm *RelayManager) Close() {
+	rm.closeOnce.Do(func() { close(rm.done) })
+
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
 	for url, conn := range rm.connections {
+		conn.mu.RLock()
 		conn.Relay.Close()
+		conn.mu.RUnlock()
 		rm.logger.RelayDisconnected(url)
 	}
 }
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
 )
 
 // This is a basic mock nostr relay server for testing
@@ -223,3 +224,240 @@ func TestNewRelayManager(t *testing.T) {
 		t.Errorf("Expected empty connections map, got %d entries", len(rm.connections))
 	}
 }
+
+func signedNote(t *testing.T, content string) *nostr.Event {
+	t.Helper()
+
+	event := &nostr.Event{
+		Kind:      nostr.KindTextNote,
+		CreatedAt: nostr.Now(),
+		Content:   content,
+		Tags:      nostr.Tags{},
+	}
+	if err := event.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	return event
+}
+
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool) bool {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestCanConnectOverMemoryTransport(t *testing.T) {
+	transport := NewMemoryTransport()
+	transport.Relay("mem://relay-1")
+
+	rm := NewRelayManager()
+	rm.SetTransport(transport)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := rm.Connect(ctx, "mem://relay-1"); err != nil {
+		t.Fatalf("Expected connection to succeed, got %v", err)
+	}
+
+	if err := rm.Connect(ctx, "mem://missing"); err == nil {
+		t.Error("Expected connection to an unregistered relay to fail")
+	}
+
+	rm.mu.RLock()
+	count := len(rm.connections)
+	rm.mu.RUnlock()
+
+	if count != 1 {
+		t.Errorf("Expected 1 connection, got %d", count)
+	}
+}
+
+func TestPeersAreListedByURL(t *testing.T) {
+	transport := NewMemoryTransport()
+	transport.Relay("mem://relay-2")
+	transport.Relay("mem://relay-1")
+
+	rm := NewRelayManager()
+	rm.SetTransport(transport)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rm.Connect(ctx, "mem://relay-2")
+	rm.Connect(ctx, "mem://relay-1")
+
+	peers := rm.Peers()
+	if len(peers) != 2 {
+		t.Fatalf("Expected 2 peers, got %d", len(peers))
+	}
+	if peers[0].URL != "mem://relay-1" || peers[1].URL != "mem://relay-2" {
+		t.Errorf("Expected peers sorted by URL, got %v", peers)
+	}
+	for _, peer := range peers {
+		if !peer.Active {
+			t.Errorf("Expected %s to be active", peer.URL)
+		}
+	}
+}
+
+func TestIncomingEventsAreStoredOnce(t *testing.T) {
+	transport := NewMemoryTransport()
+	relay1 := transport.Relay("mem://relay-1")
+	relay2 := transport.Relay("mem://relay-2")
+
+	rm := NewRelayManager()
+	rm.SetTransport(transport)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rm.Connect(ctx, "mem://relay-1")
+	rm.Connect(ctx, "mem://relay-2")
+
+	event := signedNote(t, "hello townsquare")
+	relay1.Publish(event)
+	relay2.Publish(event)
+
+	if !waitFor(t, 2*time.Second, func() bool { return len(rm.GetAllEvents()) == 1 }) {
+		t.Fatalf("Expected 1 stored event, got %d", len(rm.GetAllEvents()))
+	}
+
+	// Give the second relay a chance to deliver its copy
+	time.Sleep(50 * time.Millisecond)
+	if count := len(rm.GetAllEvents()); count != 1 {
+		t.Errorf("Expected duplicate event to be ignored, got %d events", count)
+	}
+
+	rm.storeMu.RLock()
+	metadata := rm.eventMetadata[event.ID]
+	rm.storeMu.RUnlock()
+
+	if metadata == nil || metadata.Local {
+		t.Error("Expected event to be recorded as coming from a peer")
+	}
+}
+
+func TestBroadcastPublishesToPeers(t *testing.T) {
+	transport := NewMemoryTransport()
+	relay1 := transport.Relay("mem://relay-1")
+	relay2 := transport.Relay("mem://relay-2")
+
+	rm := NewRelayManager()
+	rm.SetTransport(transport)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rm.Connect(ctx, "mem://relay-1")
+	rm.Connect(ctx, "mem://relay-2")
+
+	event := signedNote(t, "local news")
+	rm.Broadcast(ctx, event)
+
+	delivered := waitFor(t, 2*time.Second, func() bool {
+		return len(relay1.Events()) == 1 && len(relay2.Events()) == 1
+	})
+	if !delivered {
+		t.Fatalf("Expected event on both peers, got %d and %d", len(relay1.Events()), len(relay2.Events()))
+	}
+
+	// The manager must not re-ingest its own event when the peer echoes it back
+	time.Sleep(50 * time.Millisecond)
+	if count := len(rm.GetAllEvents()); count != 0 {
+		t.Errorf("Expected local event to stay out of the peer store, got %d events", count)
+	}
+}
+
+func TestPeersCountHeldEvents(t *testing.T) {
+	transport := NewMemoryTransport()
+	north := transport.Relay("mem://north")
+	transport.Relay("mem://south")
+
+	rm := NewRelayManager()
+	rm.SetTransport(transport)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rm.Connect(ctx, "mem://north")
+	rm.Connect(ctx, "mem://south")
+	first, second := signedNote(t, "first"), signedNote(t, "second")
+	north.Publish(first)
+	north.Publish(second)
+	if !waitFor(t, 2*time.Second, func() bool { return len(rm.GetAllEvents()) == 2 }) {
+		t.Fatalf("Expected 2 stored events, got %d", len(rm.GetAllEvents()))
+	}
+	last := time.Time{}
+	for _, event := range []*nostr.Event{first, second} {
+		if metadata, _ := rm.GetEventMetadata(event.ID); metadata.ReceivedAt.After(last) {
+			last = metadata.ReceivedAt
+		}
+	}
+
+	rm.RemoveEvent(second.ID)
+	rm.RemoveEvent(second.ID)
+	peers := rm.Peers()
+	if len(peers) != 2 || peers[0].Events != 1 || peers[1].Events != 0 {
+		t.Fatalf("Expected north to be credited with the event still held, got %+v", peers)
+	}
+	if !peers[0].LastReceived.Equal(last) {
+		t.Errorf("Expected the last event received to be remembered, got %v", peers[0].LastReceived)
+	}
+	if !peers[1].LastReceived.IsZero() {
+		t.Errorf("Expected nothing received from south, got %v", peers[1].LastReceived)
+	}
+}
+
+func TestDisconnectStopsReceivingFromPeer(t *testing.T) {
+	transport := NewMemoryTransport()
+	relay1 := transport.Relay("mem://relay-1")
+
+	rm := NewRelayManager()
+	rm.SetTransport(transport)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rm.Connect(ctx, "mem://relay-1")
+	relay1.Publish(signedNote(t, "before"))
+	if !waitFor(t, 2*time.Second, func() bool { return len(rm.GetAllEvents()) == 1 }) {
+		t.Fatalf("Expected 1 stored event, got %d", len(rm.GetAllEvents()))
+	}
+
+	peers := rm.Peers()
+	if len(peers) != 1 || peers[0].Events != 1 || peers[0].LastReceived.IsZero() {
+		t.Errorf("Expected the peer to be credited with 1 event, got %+v", peers)
+	}
+
+	if !rm.Disconnect("mem://relay-1") {
+		t.Fatal("Expected the peer to be disconnected")
+	}
+	if rm.Disconnect("mem://relay-1") {
+		t.Error("Expected a second disconnect to report no peer")
+	}
+	if peers := rm.Peers(); len(peers) != 0 {
+		t.Errorf("Expected no peers after disconnecting, got %v", peers)
+	}
+
+	relay1.Publish(signedNote(t, "after"))
+	time.Sleep(50 * time.Millisecond)
+	if count := len(rm.GetAllEvents()); count != 1 {
+		t.Errorf("Expected no events after disconnecting, got %d", count)
+	}
+
+	// The peer can be connected to again
+	if err := rm.Connect(ctx, "mem://relay-1"); err != nil {
+		t.Fatalf("Expected to reconnect, got %v", err)
+	}
+	if !waitFor(t, 2*time.Second, func() bool { return len(rm.GetAllEvents()) == 2 }) {
+		t.Errorf("Expected the missed event after reconnecting, got %d events", len(rm.GetAllEvents()))
+	}
+}
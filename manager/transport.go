@@ -0,0 +1,58 @@
+package manager
+
+import (
+	"context"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// PeerTransport is how the RelayManager reaches other relays in the mesh.
+// Swapping the transport lets the manager run over websockets, the tailnet
+// or entirely in-process for tests.
+type PeerTransport interface {
+	Connect(ctx context.Context, url string) (Peer, error)
+}
+
+// Peer is a single live connection to another relay.
+type Peer interface {
+	// Subscribe returns a channel of events matching filters. The channel is
+	// closed when the subscription ends or the connection is lost.
+	Subscribe(ctx context.Context, filters nostr.Filters) (<-chan *nostr.Event, error)
+	Publish(ctx context.Context, event nostr.Event) error
+	Close() error
+}
+
+// WebSocketTransport connects to peers using go-nostr's websocket client.
+type WebSocketTransport struct{}
+
+func NewWebSocketTransport() *WebSocketTransport {
+	return &WebSocketTransport{}
+}
+
+func (t *WebSocketTransport) Connect(ctx context.Context, url string) (Peer, error) {
+	relay, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return &webSocketPeer{relay: relay}, nil
+}
+
+type webSocketPeer struct {
+	relay *nostr.Relay
+}
+
+func (p *webSocketPeer) Subscribe(ctx context.Context, filters nostr.Filters) (<-chan *nostr.Event, error) {
+	sub, err := p.relay.Subscribe(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	return sub.Events, nil
+}
+
+func (p *webSocketPeer) Publish(ctx context.Context, event nostr.Event) error {
+	return p.relay.Publish(ctx, event)
+}
+
+func (p *webSocketPeer) Close() error {
+	return p.relay.Close()
+}
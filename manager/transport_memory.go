@@ -0,0 +1,234 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// MemoryTransport connects managers to in-process relays, which lets the
+// manager logic be exercised without any sockets.
+type MemoryTransport struct {
+	mu     sync.RWMutex
+	relays map[string]*MemoryRelay
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		relays: make(map[string]*MemoryRelay),
+	}
+}
+
+// Relay returns the in-memory relay registered at url, creating it if needed.
+func (t *MemoryTransport) Relay(url string) *MemoryRelay {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if relay, exists := t.relays[url]; exists {
+		return relay
+	}
+	relay := &MemoryRelay{
+		URL:  url,
+		subs: make(map[*memorySubscription]struct{}),
+	}
+	t.relays[url] = relay
+	return relay
+}
+
+func (t *MemoryTransport) Connect(ctx context.Context, url string) (Peer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	t.mu.RLock()
+	relay, exists := t.relays[url]
+	t.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("no in-memory relay at %s", url)
+	}
+
+	relay.mu.RLock()
+	down := relay.down
+	relay.mu.RUnlock()
+	if down {
+		return nil, fmt.Errorf("in-memory relay %s is down", url)
+	}
+
+	return &memoryPeer{relay: relay, done: make(chan struct{})}, nil
+}
+
+// MemoryRelay is a minimal relay that keeps events in memory and fans them
+// out to matching subscriptions.
+type MemoryRelay struct {
+	URL    string
+	mu     sync.RWMutex
+	events []*nostr.Event
+	subs   map[*memorySubscription]struct{}
+	down   bool
+}
+
+// Publish stores the event and delivers it to every live subscription.
+func (r *MemoryRelay) Publish(event *nostr.Event) error {
+	r.mu.Lock()
+	if r.down {
+		r.mu.Unlock()
+		return fmt.Errorf("in-memory relay %s is down", r.URL)
+	}
+	for _, existing := range r.events {
+		if existing.ID == event.ID {
+			r.mu.Unlock()
+			return nil
+		}
+	}
+	r.events = append(r.events, event)
+	subs := make([]*memorySubscription, 0, len(r.subs))
+	for sub := range r.subs {
+		subs = append(subs, sub)
+	}
+	r.mu.Unlock()
+
+	for _, sub := range subs {
+		if sub.filters.Match(event) {
+			sub.deliver(event)
+		}
+	}
+	return nil
+}
+
+// Events returns a copy of every event the relay has stored.
+func (r *MemoryRelay) Events() []*nostr.Event {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*nostr.Event(nil), r.events...)
+}
+
+// SetDown simulates the relay going offline. Existing subscriptions are
+// dropped and new connections are refused until it is brought back up.
+func (r *MemoryRelay) SetDown(down bool) {
+	r.mu.Lock()
+	r.down = down
+	var dropped []*memorySubscription
+	if down {
+		for sub := range r.subs {
+			dropped = append(dropped, sub)
+			delete(r.subs, sub)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, sub := range dropped {
+		sub.close()
+	}
+}
+
+func (r *MemoryRelay) removeSubscription(sub *memorySubscription) {
+	r.mu.Lock()
+	delete(r.subs, sub)
+	r.mu.Unlock()
+}
+
+type memorySubscription struct {
+	filters   nostr.Filters
+	events    chan *nostr.Event
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *memorySubscription) deliver(event *nostr.Event) {
+	select {
+	case s.events <- event:
+	case <-s.done:
+	}
+}
+
+func (s *memorySubscription) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+type memoryPeer struct {
+	relay     *MemoryRelay
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *memoryPeer) Subscribe(ctx context.Context, filters nostr.Filters) (<-chan *nostr.Event, error) {
+	sub := &memorySubscription{
+		filters: filters,
+		events:  make(chan *nostr.Event),
+		done:    make(chan struct{}),
+	}
+
+	p.relay.mu.Lock()
+	if p.relay.down {
+		p.relay.mu.Unlock()
+		return nil, fmt.Errorf("in-memory relay %s is down", p.relay.URL)
+	}
+	var stored []*nostr.Event
+	for _, event := range p.relay.events {
+		if filters.Match(event) {
+			stored = append(stored, event)
+		}
+	}
+	p.relay.subs[sub] = struct{}{}
+	p.relay.mu.Unlock()
+
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+		defer p.relay.removeSubscription(sub)
+		// Unblock a Publish already delivering to this subscription
+		defer sub.close()
+
+		for _, event := range stored {
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			case <-sub.done:
+				return
+			case <-p.done:
+				return
+			}
+		}
+
+		for {
+			select {
+			case event := <-sub.events:
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					return
+				case <-sub.done:
+					return
+				case <-p.done:
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-sub.done:
+				return
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (p *memoryPeer) Publish(ctx context.Context, event nostr.Event) error {
+	select {
+	case <-p.done:
+		return errors.New("connection closed")
+	default:
+	}
+	return p.relay.Publish(&event)
+}
+
+func (p *memoryPeer) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return nil
+}
@@ -0,0 +1,234 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DialFunc dials a network address, e.g. tsnet.Server.Dial.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// TailscaleTransport speaks nostr over websockets dialled through a tsnet
+// node, so peers can be addressed by their tailnet hostnames.
+type TailscaleTransport struct {
+	dial DialFunc
+}
+
+func NewTailscaleTransport(dial DialFunc) *TailscaleTransport {
+	return &TailscaleTransport{dial: dial}
+}
+
+func (t *TailscaleTransport) Connect(ctx context.Context, url string) (Peer, error) {
+	dialer := websocket.Dialer{
+		NetDialContext: t.dial,
+	}
+
+	conn, _, err := dialer.DialContext(ctx, nostr.NormalizeURL(url), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening websocket to '%s': %w", url, err)
+	}
+
+	peer := &tailscalePeer{
+		conn: conn,
+		subs: make(map[string]*tailscaleSubscription),
+		oks:  make(map[string]chan nostr.OKEnvelope),
+		done: make(chan struct{}),
+	}
+	go peer.readLoop()
+
+	return peer, nil
+}
+
+type tailscaleSubscription struct {
+	events    chan *nostr.Event
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *tailscaleSubscription) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+type tailscalePeer struct {
+	conn      *websocket.Conn
+	writeMu   sync.Mutex
+	mu        sync.Mutex
+	subs      map[string]*tailscaleSubscription
+	oks       map[string]chan nostr.OKEnvelope
+	counter   atomic.Int64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *tailscalePeer) readLoop() {
+	defer p.Close()
+
+	for {
+		_, message, err := p.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		switch env := nostr.ParseMessage(string(message)).(type) {
+		case *nostr.EventEnvelope:
+			if env.SubscriptionID == nil {
+				continue
+			}
+			if ok, _ := env.Event.CheckSignature(); !ok {
+				continue
+			}
+			p.mu.Lock()
+			sub, exists := p.subs[*env.SubscriptionID]
+			p.mu.Unlock()
+			if !exists {
+				continue
+			}
+			event := env.Event
+			select {
+			case sub.events <- &event:
+			case <-sub.done:
+			case <-p.done:
+				return
+			}
+		case *nostr.OKEnvelope:
+			p.mu.Lock()
+			ch, exists := p.oks[env.EventID]
+			p.mu.Unlock()
+			if exists {
+				select {
+				case ch <- *env:
+				default:
+				}
+			}
+		case *nostr.ClosedEnvelope:
+			p.unsubscribe(env.SubscriptionID)
+		}
+	}
+}
+
+func (p *tailscalePeer) write(env nostr.Envelope) error {
+	data, err := env.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (p *tailscalePeer) Subscribe(ctx context.Context, filters nostr.Filters) (<-chan *nostr.Event, error) {
+	id := strconv.FormatInt(p.counter.Add(1), 10)
+	sub := &tailscaleSubscription{
+		events: make(chan *nostr.Event),
+		done:   make(chan struct{}),
+	}
+
+	p.mu.Lock()
+	select {
+	case <-p.done:
+		p.mu.Unlock()
+		return nil, errors.New("connection closed")
+	default:
+	}
+	p.subs[id] = sub
+	p.mu.Unlock()
+
+	if err := p.write(&nostr.ReqEnvelope{SubscriptionID: id, Filters: filters}); err != nil {
+		p.unsubscribe(id)
+		return nil, err
+	}
+
+	// The read loop never closes sub.events, so this goroutine owns the
+	// channel handed to the caller and closes it once the subscription ends.
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case event := <-sub.events:
+				select {
+				case out <- event:
+				case <-ctx.Done():
+				case <-sub.done:
+					return
+				case <-p.done:
+					return
+				}
+			case <-ctx.Done():
+				closeEnv := nostr.CloseEnvelope(id)
+				p.write(&closeEnv)
+				p.unsubscribe(id)
+				return
+			case <-sub.done:
+				return
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (p *tailscalePeer) unsubscribe(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if sub, exists := p.subs[id]; exists {
+		delete(p.subs, id)
+		sub.close()
+	}
+}
+
+func (p *tailscalePeer) Publish(ctx context.Context, event nostr.Event) error {
+	ch := make(chan nostr.OKEnvelope, 1)
+
+	p.mu.Lock()
+	p.oks[event.ID] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.oks, event.ID)
+		p.mu.Unlock()
+	}()
+
+	if err := p.write(&nostr.EventEnvelope{Event: event}); err != nil {
+		return err
+	}
+
+	select {
+	case ok := <-ch:
+		if !ok.OK {
+			return fmt.Errorf("msg: %s", ok.Reason)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.done:
+		return errors.New("connection closed")
+	}
+}
+
+func (p *tailscalePeer) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		err = p.conn.Close()
+
+		p.mu.Lock()
+		close(p.done)
+		for id, sub := range p.subs {
+			delete(p.subs, id)
+			sub.close()
+		}
+		p.mu.Unlock()
+	})
+	return err
+}
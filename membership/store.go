@@ -0,0 +1,233 @@
+// Package membership keeps the list of pubkeys allowed to write to a relay
+// and the invite codes that let new people join.
+package membership
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.crom/crbroughton/townsquares-relay/filestore"
+)
+
+// KindJoinRequest is the NIP-43 event a user publishes to redeem an invite
+// code, carrying the code in a "claim" tag.
+const KindJoinRequest = 28934
+
+var (
+	ErrInvalidInvite = errors.New("invite code is not valid")
+	ErrInviteExpired = errors.New("invite code has expired")
+	ErrInviteUsed    = errors.New("invite code has already been used")
+	ErrAlreadyMember = errors.New("already a member")
+)
+
+type Member struct {
+	PubKey  string    `json:"pubkey"`
+	AddedAt time.Time `json:"added_at"`
+	// Invite is the code the member joined with, if any
+	Invite string `json:"invite,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type Invite struct {
+	Code      string    `json:"code"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// MaxUses is how many people can join with the code, 0 meaning no limit
+	MaxUses int `json:"max_uses"`
+	Uses    int `json:"uses"`
+}
+
+func (i *Invite) check(now time.Time) error {
+	if !i.ExpiresAt.IsZero() && now.After(i.ExpiresAt) {
+		return ErrInviteExpired
+	}
+	if i.MaxUses > 0 && i.Uses >= i.MaxUses {
+		return ErrInviteUsed
+	}
+	return nil
+}
+
+type state struct {
+	Members map[string]*Member `json:"members"`
+	Invites map[string]*Invite `json:"invites"`
+}
+
+func (st *state) init() {
+	if st.Members == nil {
+		st.Members = make(map[string]*Member)
+	}
+	if st.Invites == nil {
+		st.Invites = make(map[string]*Invite)
+	}
+}
+
+// Store keeps members and invites in a JSON file, which the CLI can edit
+// while the relay runs.
+type Store struct {
+	file *filestore.File[state]
+}
+
+// Open loads the store at path, creating an empty one if it doesn't exist.
+func Open(path string) (*Store, error) {
+	file, err := filestore.Open(path, (*state).init)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{file: file}, nil
+}
+
+func (s *Store) IsMember(pubkey string) bool {
+	var exists bool
+	s.file.Read(func(st *state) error {
+		_, exists = st.Members[pubkey]
+		return nil
+	})
+	return exists
+}
+
+// Members returns every member, oldest first.
+func (s *Store) Members() ([]Member, error) {
+	var members []Member
+	err := s.file.Read(func(st *state) error {
+		for _, member := range st.Members {
+			members = append(members, *member)
+		}
+		return nil
+	})
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].AddedAt.Before(members[j].AddedAt)
+	})
+	return members, err
+}
+
+func (s *Store) AddMember(pubkey, reason string) error {
+	return s.file.Update(func(st *state) error {
+		if _, exists := st.Members[pubkey]; exists {
+			return ErrAlreadyMember
+		}
+		st.Members[pubkey] = &Member{
+			PubKey:  pubkey,
+			AddedAt: time.Now(),
+			Reason:  reason,
+		}
+		return nil
+	})
+}
+
+func (s *Store) RemoveMember(pubkey string) error {
+	return s.file.Update(func(st *state) error {
+		if _, exists := st.Members[pubkey]; !exists {
+			return fmt.Errorf("%s is not a member", pubkey)
+		}
+		delete(st.Members, pubkey)
+		return nil
+	})
+}
+
+// CreateInvite makes a new invite code usable maxUses times, or without
+// limit if maxUses is 0. A zero ttl means the code never expires.
+func (s *Store) CreateInvite(maxUses int, ttl time.Duration, createdBy string) (Invite, error) {
+	code, err := newCode()
+	if err != nil {
+		return Invite{}, err
+	}
+
+	invite := &Invite{
+		Code:      code,
+		CreatedAt: time.Now(),
+		CreatedBy: createdBy,
+		MaxUses:   maxUses,
+	}
+	if ttl > 0 {
+		invite.ExpiresAt = invite.CreatedAt.Add(ttl)
+	}
+
+	err = s.file.Update(func(st *state) error {
+		st.Invites[code] = invite
+		return nil
+	})
+	return *invite, err
+}
+
+// Invites returns every invite that can still be redeemed, newest first.
+func (s *Store) Invites() ([]Invite, error) {
+	var invites []Invite
+	err := s.file.Read(func(st *state) error {
+		now := time.Now()
+		for _, invite := range st.Invites {
+			if invite.check(now) == nil {
+				invites = append(invites, *invite)
+			}
+		}
+		return nil
+	})
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].CreatedAt.After(invites[j].CreatedAt)
+	})
+	return invites, err
+}
+
+func (s *Store) RevokeInvite(code string) error {
+	return s.file.Update(func(st *state) error {
+		code = normaliseCode(code)
+		if _, exists := st.Invites[code]; !exists {
+			return ErrInvalidInvite
+		}
+		delete(st.Invites, code)
+		return nil
+	})
+}
+
+// CheckInvite reports whether code could be redeemed right now.
+func (s *Store) CheckInvite(code string) error {
+	return s.file.Read(func(st *state) error {
+		invite, exists := st.Invites[normaliseCode(code)]
+		if !exists {
+			return ErrInvalidInvite
+		}
+		return invite.check(time.Now())
+	})
+}
+
+// Redeem makes pubkey a member using an invite code.
+func (s *Store) Redeem(code, pubkey string) error {
+	return s.file.Update(func(st *state) error {
+		if _, exists := st.Members[pubkey]; exists {
+			return ErrAlreadyMember
+		}
+		invite, exists := st.Invites[normaliseCode(code)]
+		if !exists {
+			return ErrInvalidInvite
+		}
+		if err := invite.check(time.Now()); err != nil {
+			return err
+		}
+
+		invite.Uses++
+		st.Members[pubkey] = &Member{
+			PubKey:  pubkey,
+			AddedAt: time.Now(),
+			Invite:  invite.Code,
+		}
+		return nil
+	})
+}
+
+// Codes are base32 so they survive being read out or typed in by hand.
+func newCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(b), nil
+}
+
+func normaliseCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
@@ -0,0 +1,84 @@
+package membership
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.crom/crbroughton/townsquares-relay/filestore"
+)
+
+func openTestStore(t *testing.T) (*Store, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "members.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	return store, path
+}
+
+func TestRedeemInvite(t *testing.T) {
+	store, _ := openTestStore(t)
+
+	invite, err := store.CreateInvite(1, 0, "admin")
+	if err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+
+	if err := store.Redeem(strings.ToLower(invite.Code), "alice"); err != nil {
+		t.Fatalf("Expected invite to be redeemed, got %v", err)
+	}
+	if !store.IsMember("alice") {
+		t.Error("Expected alice to be a member")
+	}
+
+	if err := store.Redeem(invite.Code, "bob"); !errors.Is(err, ErrInviteUsed) {
+		t.Errorf("Expected ErrInviteUsed, got %v", err)
+	}
+	if store.IsMember("bob") {
+		t.Error("Expected bob not to be a member")
+	}
+}
+
+func TestExpiredInvitesAreRefused(t *testing.T) {
+	store, _ := openTestStore(t)
+
+	invite, err := store.CreateInvite(0, time.Nanosecond, "admin")
+	if err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	if err := store.Redeem(invite.Code, "alice"); !errors.Is(err, ErrInviteExpired) {
+		t.Errorf("Expected ErrInviteExpired, got %v", err)
+	}
+	if err := store.Redeem("NOTACODE", "alice"); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("Expected ErrInvalidInvite, got %v", err)
+	}
+}
+
+func TestChangesAreSeenByOtherStores(t *testing.T) {
+	relay, path := openTestStore(t)
+	if relay.IsMember("alice") {
+		t.Fatal("Expected empty store")
+	}
+
+	// The CLI opens the same file while the relay is running
+	cli, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	if err := cli.AddMember("alice", "added by hand"); err != nil {
+		t.Fatalf("Failed to add member: %v", err)
+	}
+
+	// The relay looks for changes once a check interval has passed
+	time.Sleep(filestore.CheckInterval)
+	if !relay.IsMember("alice") {
+		t.Error("Expected the relay to see the new member")
+	}
+}
@@ -0,0 +1,76 @@
+package meshtest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/server"
+)
+
+func TestBlobsAreMirroredFromPeers(t *testing.T) {
+	mesh := New(t, FullMesh(2), WithConfig(func(index int, config *server.Config) {
+		config.Blossom = server.Blossom{Enabled: true, MirrorPeers: index == 0}
+	}))
+	base := func(node int) string {
+		return "http" + strings.TrimPrefix(mesh.Nodes[node].URL, "ws")
+	}
+
+	photo := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), bytes.Repeat([]byte{7}, 64)...)
+	sum := sha256.Sum256(photo)
+	hash := hex.EncodeToString(sum[:])
+
+	sk := nostr.GeneratePrivateKey()
+	auth := &nostr.Event{Kind: 24242, CreatedAt: nostr.Now(), Tags: nostr.Tags{
+		{"t", "upload"}, {"x", hash}, {"expiration", strconv.FormatInt(int64(nostr.Now()+60), 10)},
+	}}
+	auth.Sign(sk)
+	data, _ := json.Marshal(auth)
+	req, _ := http.NewRequest(http.MethodPut, base(1)+"/upload", bytes.NewReader(photo))
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(data))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the upload to be accepted, got %s", resp.Status)
+	}
+
+	url := base(1) + "/" + hash + ".png"
+	note := &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Content: "Lost cat " + url, Tags: nostr.Tags{
+		{"imeta", "url " + url, "m image/png", "x " + hash},
+	}}
+	note.Sign(sk)
+	mesh.Publish(1, note)
+	mesh.AssertDelivered(note, 0)
+
+	served := func(node int) bool {
+		resp, err := http.Get(base(node) + "/" + hash)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+	deadline := time.Now().Add(mesh.Deadline)
+	for !served(0) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the blob to be mirrored to relay-0")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	mesh.Stop(1)
+	if !served(0) {
+		t.Error("Expected the mirrored blob to outlive its peer")
+	}
+}
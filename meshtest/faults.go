@@ -0,0 +1,265 @@
+package meshtest
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/manager"
+)
+
+// ErrPartitioned is returned for any traffic across a partitioned link.
+var ErrPartitioned = errors.New("meshtest: link partitioned")
+
+// ErrDropped is returned when a publish is lost by fault injection.
+var ErrDropped = errors.New("meshtest: message dropped")
+
+// Faults describes how often each kind of fault is applied to a message.
+// Rates are probabilities between 0 and 1.
+type Faults struct {
+	DropRate      float64
+	DuplicateRate float64
+	// ReorderRate holds an incoming event back until the one after it has
+	// been delivered.
+	ReorderRate float64
+	// Delay, plus up to Jitter more, is added before each message is passed
+	// on. Broadcasts publish concurrently, so jitter also reorders them.
+	Delay  time.Duration
+	Jitter time.Duration
+}
+
+type link struct {
+	from, to int
+}
+
+// FaultInjector wraps peer transports so messages between relays can be
+// dropped, delayed, duplicated, reordered or cut off entirely. Every
+// decision is drawn from one seeded source, so a failing seed can be rerun.
+type FaultInjector struct {
+	mu          sync.Mutex
+	rng         *rand.Rand
+	faults      Faults
+	partitioned map[link]bool
+	peers       map[link][]*faultyPeer
+}
+
+func NewFaultInjector(seed int64) *FaultInjector {
+	return &FaultInjector{
+		rng:         rand.New(rand.NewSource(seed)),
+		partitioned: make(map[link]bool),
+		peers:       make(map[link][]*faultyPeer),
+	}
+}
+
+// SetFaults changes the faults applied to all future messages.
+func (f *FaultInjector) SetFaults(faults Faults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = faults
+}
+
+// Partition cuts the link between two nodes in both directions, closing
+// any open connections across it.
+func (f *FaultInjector) Partition(a, b int) {
+	f.mu.Lock()
+	var severed []*faultyPeer
+	for _, l := range []link{{a, b}, {b, a}} {
+		f.partitioned[l] = true
+		severed = append(severed, f.peers[l]...)
+		delete(f.peers, l)
+	}
+	f.mu.Unlock()
+
+	for _, peer := range severed {
+		peer.Close()
+	}
+}
+
+// Heal restores the link between two nodes.
+func (f *FaultInjector) Heal(a, b int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.partitioned, link{a, b})
+	delete(f.partitioned, link{b, a})
+}
+
+// Transport returns a websocket transport for the link from one node to
+// another with faults applied. It matches the signature WithTransport wants.
+func (f *FaultInjector) Transport(from, to int) manager.PeerTransport {
+	return f.Wrap(from, to, manager.NewWebSocketTransport())
+}
+
+// Wrap applies faults to an existing transport for the link from one node
+// to another.
+func (f *FaultInjector) Wrap(from, to int, inner manager.PeerTransport) manager.PeerTransport {
+	return &faultyTransport{injector: f, link: link{from, to}, inner: inner}
+}
+
+func (f *FaultInjector) isPartitioned(l link) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.partitioned[l]
+}
+
+func (f *FaultInjector) chance(rate func(Faults) float64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := rate(f.faults)
+	return r > 0 && f.rng.Float64() < r
+}
+
+func (f *FaultInjector) delay() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.faults.Delay
+	if f.faults.Jitter > 0 {
+		d += time.Duration(f.rng.Int63n(int64(f.faults.Jitter)))
+	}
+	return d
+}
+
+func (f *FaultInjector) track(l link, peer *faultyPeer) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.partitioned[l] {
+		return false
+	}
+	f.peers[l] = append(f.peers[l], peer)
+	return true
+}
+
+func (f *FaultInjector) untrack(l link, peer *faultyPeer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	peers := f.peers[l]
+	for i, p := range peers {
+		if p == peer {
+			f.peers[l] = append(peers[:i], peers[i+1:]...)
+			return
+		}
+	}
+}
+
+type faultyTransport struct {
+	injector *FaultInjector
+	link     link
+	inner    manager.PeerTransport
+}
+
+func (t *faultyTransport) Connect(ctx context.Context, url string) (manager.Peer, error) {
+	if t.injector.isPartitioned(t.link) {
+		return nil, ErrPartitioned
+	}
+
+	inner, err := t.inner.Connect(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	peer := &faultyPeer{
+		injector: t.injector,
+		link:     t.link,
+		inner:    inner,
+	}
+	if !t.injector.track(t.link, peer) {
+		inner.Close()
+		return nil, ErrPartitioned
+	}
+	return peer, nil
+}
+
+type faultyPeer struct {
+	injector *FaultInjector
+	link     link
+	inner    manager.Peer
+}
+
+func (p *faultyPeer) Subscribe(ctx context.Context, filters nostr.Filters) (<-chan *nostr.Event, error) {
+	if p.injector.isPartitioned(p.link) {
+		return nil, ErrPartitioned
+	}
+
+	events, err := p.inner.Subscribe(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+
+		var held *nostr.Event
+		send := func(event *nostr.Event) bool {
+			select {
+			case out <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for event := range events {
+			if p.injector.isPartitioned(p.link) || p.injector.chance(func(f Faults) float64 { return f.DropRate }) {
+				continue
+			}
+			time.Sleep(p.injector.delay())
+
+			if held == nil && p.injector.chance(func(f Faults) float64 { return f.ReorderRate }) {
+				held = event
+				continue
+			}
+
+			if !send(event) {
+				return
+			}
+			if p.injector.chance(func(f Faults) float64 { return f.DuplicateRate }) {
+				if !send(event) {
+					return
+				}
+			}
+			if held != nil {
+				if !send(held) {
+					return
+				}
+				held = nil
+			}
+		}
+
+		if held != nil {
+			send(held)
+		}
+	}()
+
+	return out, nil
+}
+
+func (p *faultyPeer) Publish(ctx context.Context, event nostr.Event) error {
+	if p.injector.isPartitioned(p.link) {
+		return ErrPartitioned
+	}
+	if p.injector.chance(func(f Faults) float64 { return f.DropRate }) {
+		return ErrDropped
+	}
+
+	select {
+	case <-time.After(p.injector.delay()):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := p.inner.Publish(ctx, event); err != nil {
+		return err
+	}
+	if p.injector.chance(func(f Faults) float64 { return f.DuplicateRate }) {
+		return p.inner.Publish(ctx, event)
+	}
+	return nil
+}
+
+func (p *faultyPeer) Close() error {
+	p.injector.untrack(p.link, p)
+	return p.inner.Close()
+}
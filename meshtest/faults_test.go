@@ -0,0 +1,93 @@
+package meshtest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPartitionedRelaysCatchUpOnceHealed(t *testing.T) {
+	faults := NewFaultInjector(1)
+	mesh := New(t, FullMesh(2), WithTransport(faults.Transport))
+
+	faults.Partition(0, 1)
+	fromFirst := mesh.PublishNote(0, "sent during the partition")
+	fromSecond := mesh.PublishNote(1, "also sent during the partition")
+
+	mesh.Deadline = 500 * time.Millisecond
+	mesh.AssertNotDelivered(fromFirst, 1)
+	mesh.AssertNotDelivered(fromSecond, 0)
+
+	faults.Heal(0, 1)
+	mesh.Deadline = DefaultDeadline
+	mesh.AssertDelivered(fromFirst, 1)
+	mesh.AssertDelivered(fromSecond, 0)
+	mesh.AssertNoDuplicates(fromFirst, 0, 1)
+	mesh.AssertNoDuplicates(fromSecond, 0, 1)
+}
+
+func TestPeerRestartMidPublish(t *testing.T) {
+	mesh := New(t, FullMesh(2))
+
+	var mu sync.Mutex
+	var published []*nostr.Event
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 10 {
+			event := NewNote(t, fmt.Sprintf("note %d", i))
+			mesh.Publish(0, event)
+
+			mu.Lock()
+			published = append(published, event)
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	mesh.Restart(1)
+	wg.Wait()
+
+	for _, event := range published {
+		mesh.AssertDelivered(event, 1)
+		mesh.AssertNoDuplicates(event, 0, 1)
+	}
+}
+
+func TestDuplicatedMessagesAreServedOnce(t *testing.T) {
+	faults := NewFaultInjector(2)
+	faults.SetFaults(Faults{DuplicateRate: 1})
+	mesh := New(t, FullMesh(3), WithTransport(faults.Transport))
+
+	event := mesh.PublishNote(0, "say it twice")
+
+	mesh.AssertDelivered(event, 1, 2)
+	time.Sleep(200 * time.Millisecond)
+	mesh.AssertNoDuplicates(event, 0, 1, 2)
+}
+
+func TestDelayedAndReorderedMessagesAreAllDelivered(t *testing.T) {
+	faults := NewFaultInjector(3)
+	faults.SetFaults(Faults{
+		ReorderRate: 0.5,
+		Delay:       5 * time.Millisecond,
+		Jitter:      20 * time.Millisecond,
+	})
+	mesh := New(t, FullMesh(3), WithTransport(faults.Transport))
+
+	var events []*nostr.Event
+	for i := range 5 {
+		events = append(events, mesh.PublishNote(i%3, fmt.Sprintf("note %d", i)))
+	}
+
+	for _, event := range events {
+		mesh.AssertDelivered(event, 0, 1, 2)
+		mesh.AssertNoDuplicates(event, 0, 1, 2)
+	}
+}
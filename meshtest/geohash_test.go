@@ -0,0 +1,46 @@
+package meshtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/server"
+)
+
+func TestNeighbourFederationKeepsDistantEventsLocal(t *testing.T) {
+	mesh := New(t, FullMesh(2), WithConfig(func(index int, config *server.Config) {
+		config.Geohashes = []string{"gcpvj"}
+		config.GeohashFederation = server.GeohashFederationNeighbours
+	}))
+
+	local := mesh.PublishNote(0, "bin collection moved to tuesday", nostr.Tag{"g", "gcpvjbm"})
+	distant := mesh.PublishNote(0, "news from far away", nostr.Tag{"g", "u4pru"})
+
+	mesh.AssertDelivered(local, 1)
+
+	mesh.Deadline = 500 * time.Millisecond
+	mesh.AssertDelivered(distant, 0)
+	mesh.AssertNotDelivered(distant, 1)
+}
+
+func TestRadiusQueriesReturnNearbyEvents(t *testing.T) {
+	mesh := New(t, Isolated(1))
+
+	near := mesh.PublishNote(0, "lost cat", nostr.Tag{"g", "gcpvjbm"})
+	far := mesh.PublishNote(0, "lost dog", nostr.Tag{"g", "u4pru"})
+
+	events, err := mesh.Query(0, nostr.Filter{Search: "geohash:gcpvj radius:5"})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	if len(events) != 1 || events[0].ID != near.ID {
+		t.Errorf("Expected only the nearby event, got %d events", len(events))
+	}
+	for _, event := range events {
+		if event.ID == far.ID {
+			t.Error("Expected the distant event to be excluded")
+		}
+	}
+}
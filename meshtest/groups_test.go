@@ -0,0 +1,51 @@
+package meshtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/server"
+)
+
+func groupEvent(t *testing.T, sk string, kind int, group string) *nostr.Event {
+	t.Helper()
+
+	event := &nostr.Event{
+		Kind:      kind,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", group}},
+	}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	return event
+}
+
+func TestGroupsOnlyFederateToPeersHostingThem(t *testing.T) {
+	mesh := New(t, Isolated(2), WithConfig(func(index int, config *server.Config) {
+		config.GroupsEnabled = true
+		config.RelaySecretKey = nostr.GeneratePrivateKey()
+	}))
+
+	admin := nostr.GeneratePrivateKey()
+	mesh.Publish(0, groupEvent(t, admin, nostr.KindSimpleGroupCreateGroup, "allotments"))
+	mesh.Publish(1, groupEvent(t, admin, nostr.KindSimpleGroupCreateGroup, "allotments"))
+	mesh.Publish(0, groupEvent(t, admin, nostr.KindSimpleGroupCreateGroup, "school"))
+
+	mesh.Link(0, 1)
+	mesh.Link(1, 0)
+
+	user := nostr.GeneratePrivateKey()
+	mesh.Publish(0, groupEvent(t, user, nostr.KindSimpleGroupJoinRequest, "allotments"))
+
+	shared := groupEvent(t, user, nostr.KindTextNote, "allotments")
+	mesh.Publish(0, shared)
+	mesh.AssertDelivered(shared, 1)
+
+	local := groupEvent(t, admin, nostr.KindTextNote, "school")
+	mesh.Publish(0, local)
+
+	mesh.Deadline = 500 * time.Millisecond
+	mesh.AssertNotDelivered(local, 1)
+}
@@ -0,0 +1,329 @@
+// Package meshtest runs several complete townsquares relays in-process so
+// federation behaviour can be tested without containers.
+package meshtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/manager"
+	"github.crom/crbroughton/townsquares-relay/server"
+)
+
+// DefaultDeadline is how long assertions wait for the mesh to settle.
+const DefaultDeadline = 5 * time.Second
+
+// Node is one relay in the mesh.
+type Node struct {
+	Name    string
+	URL     string
+	Server  *server.Server
+	config  *server.Config
+	http    *httptest.Server
+	stopped bool
+}
+
+// Mesh is a set of relays wired together according to a Topology.
+type Mesh struct {
+	Nodes    []*Node
+	Deadline time.Duration
+	t        testing.TB
+	ctx      context.Context
+	topology Topology
+	opts     *options
+}
+
+// Option customises how a mesh is built.
+type Option func(*options)
+
+type options struct {
+	transport func(from, to int) manager.PeerTransport
+	configure func(index int, config *server.Config)
+}
+
+// WithTransport sets the transport each node uses to dial each of its
+// peers, e.g. to wrap the websocket transport with fault injection.
+func WithTransport(transport func(from, to int) manager.PeerTransport) Option {
+	return func(o *options) {
+		o.transport = transport
+	}
+}
+
+// WithConfig lets a test adjust each node's config before it starts.
+func WithConfig(configure func(index int, config *server.Config)) Option {
+	return func(o *options) {
+		o.configure = configure
+	}
+}
+
+// New starts one relay per entry in topology, each with its storage in its own
+// temp dir, and connects them. Everything is torn down when the test ends.
+func New(t testing.TB, topology Topology, opts ...Option) *Mesh {
+	t.Helper()
+
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mesh := &Mesh{
+		Deadline: DefaultDeadline,
+		t:        t,
+		ctx:      ctx,
+		topology: topology,
+		opts:     o,
+	}
+
+	// Temp dirs are removed by their own cleanups, which must run after the
+	// relays have closed their databases
+	dirs := make([]string, len(topology))
+	for i := range topology {
+		dirs[i] = t.TempDir()
+	}
+
+	t.Cleanup(func() {
+		cancel()
+		for i := range mesh.Nodes {
+			mesh.Stop(i)
+		}
+	})
+
+	for i := range topology {
+		name := fmt.Sprintf("relay-%d", i)
+		config := &server.Config{
+			Name:   name,
+			DBPath: filepath.Join(dirs[i], "db"),
+		}
+		if o.configure != nil {
+			o.configure(i, config)
+		}
+
+		node := &Node{Name: name, config: config}
+		mesh.Nodes = append(mesh.Nodes, node)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen for %s: %v", name, err)
+		}
+		mesh.serve(i, listener)
+		node.URL = "ws" + strings.TrimPrefix(node.http.URL, "http")
+	}
+
+	for i := range topology {
+		mesh.linkPeers(i)
+	}
+
+	return mesh
+}
+
+func (m *Mesh) serve(index int, listener net.Listener) {
+	m.t.Helper()
+
+	node := m.Nodes[index]
+	srv, err := server.New(node.config)
+	if err != nil {
+		listener.Close()
+		m.t.Fatalf("Failed to create %s: %v", node.Name, err)
+	}
+	// Retry lost peers quickly so reconnects happen within a test deadline
+	srv.Manager.SetReconnectBackoff(50*time.Millisecond, 500*time.Millisecond)
+
+	httpServer := httptest.NewUnstartedServer(srv)
+	httpServer.Listener.Close()
+	httpServer.Listener = listener
+	httpServer.Start()
+
+	node.Server = srv
+	node.http = httpServer
+	node.stopped = false
+}
+
+func (m *Mesh) linkPeers(index int) {
+	m.t.Helper()
+
+	for _, to := range m.topology[index] {
+		m.Link(index, to)
+	}
+}
+
+// Link makes node from dial node to, using the mesh's transport.
+func (m *Mesh) Link(from, to int) {
+	m.t.Helper()
+
+	var transport manager.PeerTransport = manager.NewWebSocketTransport()
+	if m.opts.transport != nil {
+		transport = m.opts.transport(from, to)
+	}
+
+	rm := m.Nodes[from].Server.Manager
+	if err := rm.ConnectWithTransport(m.ctx, m.Nodes[to].URL, transport); err != nil {
+		m.t.Fatalf("Failed to connect %s to %s: %v", m.Nodes[from].Name, m.Nodes[to].Name, err)
+	}
+}
+
+// Stop shuts a node down, dropping every connection to it. Its storage is
+// kept so it can be started again.
+func (m *Mesh) Stop(index int) {
+	node := m.Nodes[index]
+	if node.stopped || node.http == nil {
+		return
+	}
+
+	node.http.CloseClientConnections()
+	node.http.Close()
+	node.Server.Close()
+	node.stopped = true
+}
+
+// Start brings a stopped node back on the same URL with the same storage,
+// and reconnects it to its peers. Peers that dial it reconnect by
+// themselves.
+func (m *Mesh) Start(index int) {
+	m.t.Helper()
+
+	node := m.Nodes[index]
+	if !node.stopped {
+		return
+	}
+
+	addr := strings.TrimPrefix(node.http.URL, "http://")
+	var listener net.Listener
+	var err error
+	for range 50 {
+		if listener, err = net.Listen("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		m.t.Fatalf("Failed to listen again for %s: %v", node.Name, err)
+	}
+
+	m.serve(index, listener)
+	m.linkPeers(index)
+}
+
+// Restart stops and starts a node.
+func (m *Mesh) Restart(index int) {
+	m.t.Helper()
+
+	m.Stop(index)
+	m.Start(index)
+}
+
+// NewNote returns a text note with the given tags, signed by a fresh key.
+func NewNote(t testing.TB, content string, tags ...nostr.Tag) *nostr.Event {
+	t.Helper()
+
+	event := &nostr.Event{
+		Kind:      nostr.KindTextNote,
+		CreatedAt: nostr.Now(),
+		Content:   content,
+		Tags:      append(nostr.Tags{}, tags...),
+	}
+	if err := event.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	return event
+}
+
+// Publish sends event to a node as an ordinary client would.
+func (m *Mesh) Publish(node int, event *nostr.Event) {
+	m.t.Helper()
+
+	ctx, cancel := context.WithTimeout(m.ctx, m.Deadline)
+	defer cancel()
+
+	client, err := nostr.RelayConnect(ctx, m.Nodes[node].URL)
+	if err != nil {
+		m.t.Fatalf("Failed to connect client to %s: %v", m.Nodes[node].Name, err)
+	}
+	defer client.Close()
+
+	if err := client.Publish(ctx, *event); err != nil {
+		m.t.Fatalf("Failed to publish to %s: %v", m.Nodes[node].Name, err)
+	}
+}
+
+// PublishNote signs a new note and publishes it to node.
+func (m *Mesh) PublishNote(node int, content string, tags ...nostr.Tag) *nostr.Event {
+	m.t.Helper()
+
+	event := NewNote(m.t, content, tags...)
+	m.Publish(node, event)
+	return event
+}
+
+// Query asks a node for events matching filter as a client would, returning
+// everything sent before EOSE.
+func (m *Mesh) Query(node int, filter nostr.Filter) ([]*nostr.Event, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, m.Deadline)
+	defer cancel()
+
+	client, err := nostr.RelayConnect(ctx, m.Nodes[node].URL)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return client.QuerySync(ctx, filter)
+}
+
+// count returns how many copies of the event a node serves.
+func (m *Mesh) count(node int, eventID string) int {
+	events, err := m.Query(node, nostr.Filter{IDs: []string{eventID}})
+	if err != nil {
+		return -1
+	}
+	return len(events)
+}
+
+// AssertDelivered waits until every listed node serves the event.
+func (m *Mesh) AssertDelivered(event *nostr.Event, nodes ...int) {
+	m.t.Helper()
+
+	deadline := time.Now().Add(m.Deadline)
+	for _, node := range nodes {
+		for m.count(node, event.ID) < 1 {
+			if time.Now().After(deadline) {
+				m.t.Fatalf("Event %s was not delivered to %s within %s", event.ID[:8], m.Nodes[node].Name, m.Deadline)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+// AssertNoDuplicates checks every listed node serves the event at most once.
+func (m *Mesh) AssertNoDuplicates(event *nostr.Event, nodes ...int) {
+	m.t.Helper()
+
+	for _, node := range nodes {
+		if count := m.count(node, event.ID); count > 1 {
+			m.t.Errorf("Event %s served %d times by %s", event.ID[:8], count, m.Nodes[node].Name)
+		}
+	}
+}
+
+// AssertNotDelivered checks that none of the listed nodes serve the event at
+// any point before the deadline passes.
+func (m *Mesh) AssertNotDelivered(event *nostr.Event, nodes ...int) {
+	m.t.Helper()
+
+	deadline := time.Now().Add(m.Deadline)
+	for time.Now().Before(deadline) {
+		for _, node := range nodes {
+			if m.count(node, event.ID) > 0 {
+				m.t.Fatalf("Event %s leaked to %s", event.ID[:8], m.Nodes[node].Name)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
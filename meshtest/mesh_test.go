@@ -0,0 +1,63 @@
+package meshtest
+
+import (
+	"testing"
+	"time"
+
+	"github.crom/crbroughton/townsquares-relay/server"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+func TestEventPropagatesAcrossFullMesh(t *testing.T) {
+	mesh := New(t, FullMesh(3))
+
+	event := mesh.PublishNote(0, "hello from relay 0")
+
+	mesh.AssertDelivered(event, 0, 1, 2)
+	mesh.AssertNoDuplicates(event, 0, 1, 2)
+}
+
+func TestEventsFromEveryNodeReachTheHub(t *testing.T) {
+	mesh := New(t, Star(3))
+
+	first := mesh.PublishNote(1, "from the first spoke")
+	second := mesh.PublishNote(2, "from the second spoke")
+
+	mesh.AssertDelivered(first, 0)
+	mesh.AssertDelivered(second, 0)
+	mesh.AssertNoDuplicates(first, 0)
+	mesh.AssertNoDuplicates(second, 0)
+}
+
+func TestEchoedEventsAreServedOnce(t *testing.T) {
+	mesh := New(t, FullMesh(2))
+
+	event := mesh.PublishNote(0, "echo")
+	mesh.AssertDelivered(event, 1)
+
+	// Give relay 1 time to echo the event back to relay 0
+	time.Sleep(200 * time.Millisecond)
+	mesh.AssertNoDuplicates(event, 0, 1)
+}
+
+func TestUnconnectedRelaysDoNotReceiveEvents(t *testing.T) {
+	mesh := New(t, Isolated(2))
+	mesh.Deadline = time.Second
+
+	event := mesh.PublishNote(0, "keep this local")
+
+	mesh.AssertDelivered(event, 0)
+	mesh.AssertNotDelivered(event, 1)
+}
+
+func TestEventsFederateBetweenStorageBackends(t *testing.T) {
+	backends := []string{storage.Badger, storage.LMDB, storage.SQLite3, storage.Bolt}
+	mesh := New(t, FullMesh(len(backends)), WithConfig(func(index int, config *server.Config) {
+		config.DBBackend = backends[index]
+	}))
+
+	for i := range backends {
+		event := mesh.PublishNote(i, "stored in "+backends[i])
+		mesh.AssertDelivered(event, 0, 1, 2, 3)
+	}
+}
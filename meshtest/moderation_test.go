@@ -0,0 +1,64 @@
+package meshtest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/moderation"
+	"github.crom/crbroughton/townsquares-relay/server"
+)
+
+func TestTrustedPeerBansAreApplied(t *testing.T) {
+	relayKey := nostr.GeneratePrivateKey()
+	relayPubKey, _ := nostr.GetPublicKey(relayKey)
+	spammer := nostr.GeneratePrivateKey()
+	spammerPubKey, _ := nostr.GetPublicKey(spammer)
+
+	mesh := New(t, Isolated(2), WithConfig(func(index int, config *server.Config) {
+		if index == 0 {
+			config.RelaySecretKey = relayKey
+			store, err := moderation.Open(config.ModerationFilePath())
+			if err != nil {
+				t.Fatalf("Failed to open moderation store: %v", err)
+			}
+			store.BanPubKey(spammerPubKey, "spam", "admin")
+			return
+		}
+		config.TrustedPeers = []server.TrustedPeer{{URL: "wss://relay-0", PubKey: relayPubKey}}
+		config.ApplyPeerBans = true
+	}))
+	mesh.Link(1, 0)
+
+	deadline := time.Now().Add(mesh.Deadline)
+	for {
+		note := &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "buy now"}
+		note.Sign(spammer)
+
+		err := publish(mesh, 1, note)
+		if err != nil && strings.Contains(err.Error(), "banned by wss://relay-0") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the peer's ban to be applied, got %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Others can still post
+	mesh.PublishNote(1, "hello")
+}
+
+func publish(mesh *Mesh, node int, event *nostr.Event) error {
+	ctx, cancel := context.WithTimeout(mesh.ctx, mesh.Deadline)
+	defer cancel()
+
+	client, err := nostr.RelayConnect(ctx, mesh.Nodes[node].URL)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Publish(ctx, *event)
+}
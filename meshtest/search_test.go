@@ -0,0 +1,41 @@
+package meshtest
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/server"
+)
+
+func TestSearchCoversLocalAndFederatedEvents(t *testing.T) {
+	mesh := New(t, FullMesh(2), WithConfig(func(index int, config *server.Config) {
+		config.SearchEnabled = true
+	}))
+
+	local := mesh.PublishNote(0, "Lost cat, ginger, answers to Biscuit")
+	federated := mesh.PublishNote(1, "Has anyone lost a cat? Found one by the church")
+	other := mesh.PublishNote(1, "Bin collection moved to Tuesday")
+	mesh.AssertDelivered(federated, 0)
+	mesh.AssertDelivered(other, 0)
+
+	events, err := mesh.Query(0, nostr.Filter{Search: "lost cat"})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	if len(ids) != 2 || !slices.Contains(ids, local.ID) || !slices.Contains(ids, federated.ID) {
+		t.Errorf("Expected both lost cats, got %v", ids)
+	}
+
+	events, err = mesh.Query(0, nostr.Filter{Search: "bin collection", Limit: 1})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(events) != 1 || events[0].ID != other.ID {
+		t.Errorf("Expected the bin collection note, got %d events", len(events))
+	}
+}
@@ -0,0 +1,48 @@
+package meshtest
+
+// Topology lists, for each node, the indexes of the nodes it dials as peers.
+// Connections are one-way, just like the "relays" list in a relay config, so
+// a two-way link needs each node to list the other.
+type Topology [][]int
+
+// FullMesh connects every node to every other node.
+func FullMesh(n int) Topology {
+	topology := make(Topology, n)
+	for i := range n {
+		for j := range n {
+			if i != j {
+				topology[i] = append(topology[i], j)
+			}
+		}
+	}
+	return topology
+}
+
+// Line connects each node to its immediate neighbours.
+func Line(n int) Topology {
+	topology := make(Topology, n)
+	for i := range n {
+		if i > 0 {
+			topology[i] = append(topology[i], i-1)
+		}
+		if i < n-1 {
+			topology[i] = append(topology[i], i+1)
+		}
+	}
+	return topology
+}
+
+// Star connects node 0 to every other node, and every other node to node 0.
+func Star(n int) Topology {
+	topology := make(Topology, n)
+	for i := 1; i < n; i++ {
+		topology[0] = append(topology[0], i)
+		topology[i] = append(topology[i], 0)
+	}
+	return topology
+}
+
+// Isolated returns n nodes with no peers at all.
+func Isolated(n int) Topology {
+	return make(Topology, n)
+}
@@ -0,0 +1,74 @@
+package moderation
+
+import (
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Relays share their moderation decisions as NIP-78 application data
+// signed with the relay's key, one event per list.
+const (
+	KindList   = 30078
+	BanListID  = "townsquares/bans"
+	MuteListID = "townsquares/mutes"
+)
+
+// List is the content of a ban or mute list: the pubkeys and events it
+// covers.
+type List struct {
+	PubKeys []string `json:"pubkeys,omitempty"`
+	Events  []string `json:"events,omitempty"`
+}
+
+// Event returns an unsigned list event with the given d tag.
+func (l List) Event(id string) *nostr.Event {
+	event := &nostr.Event{
+		Kind:      KindList,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"d", id}},
+	}
+	for _, pubkey := range l.PubKeys {
+		event.Tags = append(event.Tags, nostr.Tag{"p", pubkey})
+	}
+	for _, id := range l.Events {
+		event.Tags = append(event.Tags, nostr.Tag{"e", id})
+	}
+	return event
+}
+
+// ParseList reads a list event, returning which list it is.
+func ParseList(event *nostr.Event) (string, List, bool) {
+	if event.Kind != KindList {
+		return "", List{}, false
+	}
+	id := event.Tags.GetD()
+	if id != BanListID && id != MuteListID {
+		return "", List{}, false
+	}
+
+	var list List
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "p":
+			list.PubKeys = append(list.PubKeys, tag[1])
+		case "e":
+			list.Events = append(list.Events, tag[1])
+		}
+	}
+	return id, list, true
+}
+
+// diff returns the entries in next that aren't in prev.
+func diff(prev, next []string) []string {
+	var added []string
+	for _, key := range next {
+		if !slices.Contains(prev, key) {
+			added = append(added, key)
+		}
+	}
+	return added
+}
@@ -0,0 +1,298 @@
+package moderation
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindReport is a NIP-56 report.
+const KindReport = 1984
+
+const (
+	// MaxOpenReports bounds the moderation queue. Further reports are
+	// refused until admins catch up.
+	MaxOpenReports = 1000
+	// MaxOpenReportsPerReporter stops one pubkey filling the queue
+	MaxOpenReportsPerReporter = 10
+	// ResolvedReportRetention is how long resolved reports are kept
+	ResolvedReportRetention = 30 * 24 * time.Hour
+)
+
+var (
+	ErrReportNotFound  = errors.New("report not found")
+	ErrNoEvent         = errors.New("report is not about an event")
+	ErrQueueFull       = errors.New("too many reports are waiting to be dealt with")
+	ErrTooManyReports  = errors.New("too many of your reports are waiting to be dealt with")
+	ErrAlreadyReported = errors.New("you have already reported this")
+)
+
+// reportQueue is kept in a file of its own, so that reports coming in
+// don't rewrite the rest of the moderation state.
+type reportQueue struct {
+	// Reports is the moderation queue, by report event id
+	Reports map[string]*Report `json:"reports"`
+}
+
+func (q *reportQueue) init() {
+	if q.Reports == nil {
+		q.Reports = make(map[string]*Report)
+	}
+}
+
+// expire drops reports resolved longer than ResolvedReportRetention ago.
+func (q *reportQueue) expire(now time.Time) {
+	for id, report := range q.Reports {
+		if report.Resolution != nil && now.Sub(report.Resolution.At) > ResolvedReportRetention {
+			delete(q.Reports, id)
+		}
+	}
+}
+
+// check returns why a report can't be queued, if it can't.
+func (q *reportQueue) check(report Report) error {
+	open, byReporter := 0, 0
+	for _, queued := range q.Reports {
+		if queued.Resolution != nil {
+			continue
+		}
+		open++
+		if queued.Reporter != report.Reporter {
+			continue
+		}
+		byReporter++
+		if queued.PubKey == report.PubKey && queued.Event == report.Event {
+			return ErrAlreadyReported
+		}
+	}
+	if byReporter >= MaxOpenReportsPerReporter {
+		return ErrTooManyReports
+	}
+	if open >= MaxOpenReports {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// ReportsPath returns where the moderation queue of the moderation file at
+// path is kept.
+func ReportsPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "-reports.json"
+}
+
+// How a report was resolved.
+const (
+	ResolutionResolved = "resolved"
+	ResolutionHidden   = "hidden"
+	ResolutionBanned   = "banned"
+)
+
+// Report is a NIP-56 report waiting in, or resolved from, the moderation
+// queue.
+type Report struct {
+	// ID is the id of the report event
+	ID       string    `json:"id"`
+	Reporter string    `json:"reporter"`
+	PubKey   string    `json:"pubkey"`
+	Event    string    `json:"event,omitempty"`
+	Type     string    `json:"type,omitempty"`
+	Content  string    `json:"content,omitempty"`
+	At       time.Time `json:"at"`
+	// Resolution is set once an admin has dealt with the report
+	Resolution *Resolution `json:"resolution,omitempty"`
+}
+
+// Resolution records what an admin did about a report.
+type Resolution struct {
+	Action string    `json:"action"`
+	Note   string    `json:"note,omitempty"`
+	At     time.Time `json:"at"`
+	By     string    `json:"by,omitempty"`
+}
+
+// ParseReport reads a kind 1984 event. The reported pubkey is required, and
+// the report type is taken from the e tag when there is one.
+func ParseReport(event *nostr.Event) (Report, bool) {
+	if event.Kind != KindReport {
+		return Report{}, false
+	}
+
+	report := Report{
+		ID:       event.ID,
+		Reporter: event.PubKey,
+		Content:  event.Content,
+		At:       event.CreatedAt.Time(),
+	}
+	if tag := event.Tags.GetFirst([]string{"p", ""}); tag != nil && nostr.IsValid32ByteHex((*tag)[1]) {
+		report.PubKey = (*tag)[1]
+		if len(*tag) > 2 {
+			report.Type = (*tag)[2]
+		}
+	}
+	if report.PubKey == "" {
+		return Report{}, false
+	}
+	if tag := event.Tags.GetFirst([]string{"e", ""}); tag != nil && nostr.IsValid32ByteHex((*tag)[1]) {
+		report.Event = (*tag)[1]
+		if len(*tag) > 2 {
+			report.Type = (*tag)[2]
+		}
+	}
+	return report, true
+}
+
+// CheckReport returns why a report couldn't be queued, if it couldn't:
+// the queue is full, the reporter has too many reports open or has already
+// reported the same thing.
+func (s *Store) CheckReport(report Report) error {
+	return s.reports.Read(func(q *reportQueue) error {
+		return q.check(report)
+	})
+}
+
+// AddReport queues a report, unless CheckReport refuses it. Reports
+// already in the queue are left alone.
+func (s *Store) AddReport(report Report) error {
+	return s.reports.Update(func(q *reportQueue) error {
+		if _, exists := q.Reports[report.ID]; exists {
+			return nil
+		}
+		q.expire(time.Now())
+		if err := q.check(report); err != nil {
+			return err
+		}
+		q.Reports[report.ID] = &report
+		return nil
+	})
+}
+
+// Reports returns the reports still waiting to be dealt with, oldest first,
+// or every report with all.
+func (s *Store) Reports(all bool) ([]Report, error) {
+	reports := []Report{}
+	err := s.reports.Read(func(q *reportQueue) error {
+		for _, report := range q.Reports {
+			if all || report.Resolution == nil {
+				reports = append(reports, *report)
+			}
+		}
+		return nil
+	})
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].At.Equal(reports[j].At) {
+			return reports[i].ID < reports[j].ID
+		}
+		return reports[i].At.Before(reports[j].At)
+	})
+	return reports, err
+}
+
+func (s *Store) Report(id string) (Report, bool) {
+	var report Report
+	var found bool
+	s.reports.Read(func(q *reportQueue) error {
+		if r, exists := q.Reports[id]; exists {
+			report, found = *r, true
+		}
+		return nil
+	})
+	return report, found
+}
+
+// ResolveReport closes a report without acting on it.
+func (s *Store) ResolveReport(id, note, by string) (Report, error) {
+	return s.resolve(id, ResolutionResolved, note, by, nil)
+}
+
+// HideReportedEvent hides the reported event from clients and closes the
+// report.
+func (s *Store) HideReportedEvent(id, note, by string) (Report, error) {
+	return s.resolve(id, ResolutionHidden, note, by, func(st *state, report *Report) error {
+		if report.Event == "" {
+			return ErrNoEvent
+		}
+		st.HiddenEvents[report.Event] = newEntry(reason(report, note), by)
+		return nil
+	})
+}
+
+// BanReportedAuthor bans the reported pubkey and closes the report.
+func (s *Store) BanReportedAuthor(id, note, by string) (Report, error) {
+	return s.resolve(id, ResolutionBanned, note, by, func(st *state, report *Report) error {
+		st.BannedPubKeys[report.PubKey] = newEntry(reason(report, note), by)
+		return nil
+	})
+}
+
+// resolve acts on a report and closes it. The action is taken before the
+// report is closed, so a report is never closed without it.
+func (s *Store) resolve(id, action, note, by string, act func(*state, *Report) error) (Report, error) {
+	report, found := s.Report(id)
+	if !found {
+		return Report{}, ErrReportNotFound
+	}
+	if act != nil {
+		if err := s.file.Update(func(st *state) error {
+			return act(st, &report)
+		}); err != nil {
+			return Report{}, err
+		}
+	}
+
+	var resolved Report
+	err := s.reports.Update(func(q *reportQueue) error {
+		queued, exists := q.Reports[id]
+		if !exists {
+			return ErrReportNotFound
+		}
+		now := time.Now()
+		queued.Resolution = &Resolution{Action: action, Note: note, At: now, By: by}
+		resolved = *queued
+		q.expire(now)
+		return nil
+	})
+	return resolved, err
+}
+
+// reason describes an action taken on a report, preferring the admin's
+// note over the report type.
+func reason(report *Report, note string) string {
+	if note != "" {
+		return note
+	}
+	if report.Type != "" {
+		return "reported for " + report.Type
+	}
+	return "reported"
+}
+
+// HideEvent keeps an event in storage but stops serving it.
+func (s *Store) HideEvent(id, reason, by string) error {
+	return s.file.Update(func(st *state) error {
+		st.HiddenEvents[id] = newEntry(reason, by)
+		return nil
+	})
+}
+
+// UnhideEvent serves a hidden event again, returning whether it was hidden.
+func (s *Store) UnhideEvent(id string) (bool, error) {
+	var hidden bool
+	err := s.file.Update(func(st *state) error {
+		_, hidden = st.HiddenEvents[id]
+		delete(st.HiddenEvents, id)
+		return nil
+	})
+	return hidden, err
+}
+
+func (s *Store) EventHidden(id string) (Entry, bool) {
+	return s.lookup(id, hiddenEvents)
+}
+
+func (s *Store) HiddenEvents() ([]Listed, error) {
+	return s.listOf(hiddenEvents)
+}
@@ -0,0 +1,111 @@
+package moderation
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseReport(t *testing.T) {
+	pubkey := nostr.GeneratePrivateKey()
+	eventID := nostr.GeneratePrivateKey()
+
+	report, ok := ParseReport(&nostr.Event{Kind: KindReport, Tags: nostr.Tags{{"p", pubkey, "impersonation"}}})
+	if !ok || report.PubKey != pubkey || report.Event != "" || report.Type != "impersonation" {
+		t.Errorf("Expected report about a pubkey, got %v %+v", ok, report)
+	}
+
+	report, ok = ParseReport(&nostr.Event{Kind: KindReport, Tags: nostr.Tags{{"e", eventID, "spam"}, {"p", pubkey}}})
+	if !ok || report.Event != eventID || report.Type != "spam" {
+		t.Errorf("Expected report about an event, got %v %+v", ok, report)
+	}
+
+	if _, ok := ParseReport(&nostr.Event{Kind: KindReport, Tags: nostr.Tags{{"e", eventID, "spam"}}}); ok {
+		t.Error("Expected report without a pubkey to be ignored")
+	}
+}
+
+func TestReportActions(t *testing.T) {
+	store := openTestStore(t)
+
+	store.AddReport(Report{ID: "r1", PubKey: "author", Type: "spam"})
+	store.AddReport(Report{ID: "r2", PubKey: "author", Event: "note"})
+
+	if _, err := store.HideReportedEvent("r1", "", "admin"); !errors.Is(err, ErrNoEvent) {
+		t.Errorf("Expected ErrNoEvent, got %v", err)
+	}
+	if _, err := store.BanReportedAuthor("r1", "", "admin"); err != nil {
+		t.Fatalf("BanReportedAuthor failed: %v", err)
+	}
+	if ban, banned := store.PubKeyBan("author"); !banned || ban.Reason != "reported for spam" {
+		t.Errorf("Expected author to be banned for spam, got %v %+v", banned, ban)
+	}
+
+	if _, err := store.HideReportedEvent("r2", "rude", "admin"); err != nil {
+		t.Fatalf("HideReportedEvent failed: %v", err)
+	}
+	if hidden, isHidden := store.EventHidden("note"); !isHidden || hidden.Reason != "rude" {
+		t.Errorf("Expected event to be hidden as rude, got %v %+v", isHidden, hidden)
+	}
+
+	if reports, _ := store.Reports(false); len(reports) != 0 {
+		t.Errorf("Expected no open reports, got %d", len(reports))
+	}
+	if reports, _ := store.Reports(true); len(reports) != 2 {
+		t.Errorf("Expected both reports to be kept, got %d", len(reports))
+	}
+	if _, err := store.ResolveReport("missing", "", "admin"); !errors.Is(err, ErrReportNotFound) {
+		t.Errorf("Expected ErrReportNotFound, got %v", err)
+	}
+}
+
+func TestReportQueueLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "moderation.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	for i := range MaxOpenReportsPerReporter {
+		if err := store.AddReport(Report{ID: fmt.Sprint("r", i), Reporter: "mallory", PubKey: fmt.Sprint("author", i)}); err != nil {
+			t.Fatalf("AddReport failed: %v", err)
+		}
+	}
+	if err := store.AddReport(Report{ID: "one-more", Reporter: "mallory", PubKey: "someone"}); !errors.Is(err, ErrTooManyReports) {
+		t.Errorf("Expected ErrTooManyReports, got %v", err)
+	}
+	if err := store.AddReport(Report{ID: "again", Reporter: "alice", PubKey: "author0"}); err != nil {
+		t.Errorf("Expected others to still be able to report, got %v", err)
+	}
+	if err := store.AddReport(Report{ID: "twice", Reporter: "alice", PubKey: "author0"}); !errors.Is(err, ErrAlreadyReported) {
+		t.Errorf("Expected ErrAlreadyReported, got %v", err)
+	}
+
+	// Dealing with a report makes room for another
+	store.ResolveReport("r0", "", "admin")
+	if err := store.AddReport(Report{ID: "one-more", Reporter: "mallory", PubKey: "someone"}); err != nil {
+		t.Errorf("Expected a resolved report to make room, got %v", err)
+	}
+
+	// Reports don't touch the moderation file
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "mallory") {
+		t.Error("Expected reports to be kept out of the moderation file")
+	}
+
+	// Long resolved reports are forgotten
+	store.reports.Update(func(q *reportQueue) error {
+		q.Reports["r0"].Resolution.At = time.Now().Add(-ResolvedReportRetention - time.Hour)
+		return nil
+	})
+	store.AddReport(Report{ID: "late", Reporter: "bob", PubKey: "author1"})
+	if _, found := store.Report("r0"); found {
+		t.Error("Expected the old resolved report to be dropped")
+	}
+}
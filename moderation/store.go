@@ -0,0 +1,607 @@
+// Package moderation keeps the decisions admins make about a relay: banned
+// pubkeys and events, allowed kinds, blocked IPs, reported events, peers
+// added or removed, and relay details changed through the management API.
+package moderation
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.crom/crbroughton/townsquares-relay/filestore"
+)
+
+// Entry records why and when something was banned, allowed or blocked.
+type Entry struct {
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+	By     string    `json:"by,omitempty"`
+}
+
+// Listed is an entry together with what it is about: a pubkey, an event id
+// or an IP address.
+type Listed struct {
+	Key string `json:"key"`
+	Entry
+}
+
+// RelayInfo holds relay details that admins changed at runtime, which
+// replace the ones from the config file.
+type RelayInfo struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Icon        string `json:"icon,omitempty"`
+}
+
+// PeerList is the latest ban or mute list received from a trusted peer.
+type PeerList struct {
+	List
+	EventID   string    `json:"event_id"`
+	CreatedAt int64     `json:"created_at"`
+	Received  time.Time `json:"received"`
+}
+
+// AuditEntry records a change to a peer's list, or an event that was
+// refused or hidden because of one.
+type AuditEntry struct {
+	At     time.Time `json:"at"`
+	Peer   string    `json:"peer"`
+	List   string    `json:"list"`
+	Action string    `json:"action"`
+	// Key is the pubkey or event id on the list
+	Key string `json:"key"`
+	// Event is the latest event that was blocked, and Count how many were,
+	// for "blocked" entries
+	Event string `json:"event,omitempty"`
+	Count int    `json:"count,omitempty"`
+}
+
+// Audit actions.
+const (
+	AuditAdded   = "added"
+	AuditRemoved = "removed"
+	AuditBlocked = "blocked"
+)
+
+// maxAudit bounds the audit trail, dropping the oldest entries first.
+const maxAudit = 1000
+
+type state struct {
+	BannedPubKeys   map[string]Entry    `json:"banned_pubkeys"`
+	BannedEvents    map[string]Entry    `json:"banned_events"`
+	AllowedEvents   map[string]Entry    `json:"allowed_events"`
+	BlockedIPs      map[string]Entry    `json:"blocked_ips"`
+	AllowedKinds    []int               `json:"allowed_kinds,omitempty"`
+	DisallowedKinds []int               `json:"disallowed_kinds,omitempty"`
+	MutedPubKeys    map[string]Entry    `json:"muted_pubkeys"`
+	Admins          map[string][]string `json:"admins,omitempty"`
+	Info            RelayInfo           `json:"info"`
+	// PeerLists holds the lists of each trusted peer, by list id
+	PeerLists    map[string]map[string]*PeerList `json:"peer_lists"`
+	Audit        []AuditEntry                    `json:"audit,omitempty"`
+	HiddenEvents map[string]Entry                `json:"hidden_events"`
+	// AddedPeers and RemovedPeers change the peers from the config file
+	AddedPeers   map[string]Entry `json:"added_peers"`
+	RemovedPeers map[string]Entry `json:"removed_peers"`
+}
+
+func (st *state) init() {
+	if st.BannedPubKeys == nil {
+		st.BannedPubKeys = make(map[string]Entry)
+	}
+	if st.BannedEvents == nil {
+		st.BannedEvents = make(map[string]Entry)
+	}
+	if st.AllowedEvents == nil {
+		st.AllowedEvents = make(map[string]Entry)
+	}
+	if st.BlockedIPs == nil {
+		st.BlockedIPs = make(map[string]Entry)
+	}
+	if st.MutedPubKeys == nil {
+		st.MutedPubKeys = make(map[string]Entry)
+	}
+	if st.Admins == nil {
+		st.Admins = make(map[string][]string)
+	}
+	if st.PeerLists == nil {
+		st.PeerLists = make(map[string]map[string]*PeerList)
+	}
+	if st.HiddenEvents == nil {
+		st.HiddenEvents = make(map[string]Entry)
+	}
+	if st.AddedPeers == nil {
+		st.AddedPeers = make(map[string]Entry)
+	}
+	if st.RemovedPeers == nil {
+		st.RemovedPeers = make(map[string]Entry)
+	}
+}
+
+func (st *state) audit(entry AuditEntry) {
+	st.Audit = append(st.Audit, entry)
+	if len(st.Audit) > maxAudit {
+		st.Audit = st.Audit[len(st.Audit)-maxAudit:]
+	}
+}
+
+// Store keeps moderation decisions in a JSON file, and reports waiting for
+// them in another.
+type Store struct {
+	file    *filestore.File[state]
+	reports *filestore.File[reportQueue]
+
+	// blocks are the events blocked since the audit trail was last
+	// written, counted by peer, list and key, so that a busy spammer
+	// doesn't cost a write for every event
+	blocksMu sync.Mutex
+	blocks   map[blockKey]*AuditEntry
+}
+
+type blockKey struct {
+	peer, list, key string
+}
+
+func Open(path string) (*Store, error) {
+	file, err := filestore.Open(path, (*state).init)
+	if err != nil {
+		return nil, err
+	}
+	reports, err := filestore.Open(ReportsPath(path), (*reportQueue).init)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{file: file, reports: reports, blocks: make(map[blockKey]*AuditEntry)}, nil
+}
+
+func newEntry(reason, by string) Entry {
+	return Entry{Reason: reason, At: time.Now(), By: by}
+}
+
+// sortedEntries returns the entries of m, newest first.
+func sortedEntries(m map[string]Entry) []Listed {
+	listed := make([]Listed, 0, len(m))
+	for key, entry := range m {
+		listed = append(listed, Listed{Key: key, Entry: entry})
+	}
+	sort.Slice(listed, func(i, j int) bool {
+		return listed[i].At.After(listed[j].At)
+	})
+	return listed
+}
+
+// lookup finds key in one of the maps of the store.
+func (s *Store) lookup(key string, m func(*state) map[string]Entry) (Entry, bool) {
+	var entry Entry
+	var exists bool
+	s.file.Read(func(st *state) error {
+		entry, exists = m(st)[key]
+		return nil
+	})
+	return entry, exists
+}
+
+func (s *Store) listOf(m func(*state) map[string]Entry) ([]Listed, error) {
+	var listed []Listed
+	err := s.file.Read(func(st *state) error {
+		listed = sortedEntries(m(st))
+		return nil
+	})
+	return listed, err
+}
+
+func bannedPubKeys(st *state) map[string]Entry { return st.BannedPubKeys }
+func bannedEvents(st *state) map[string]Entry  { return st.BannedEvents }
+func allowedEvents(st *state) map[string]Entry { return st.AllowedEvents }
+func blockedIPs(st *state) map[string]Entry    { return st.BlockedIPs }
+func mutedPubKeys(st *state) map[string]Entry  { return st.MutedPubKeys }
+func hiddenEvents(st *state) map[string]Entry  { return st.HiddenEvents }
+
+func (s *Store) BanPubKey(pubkey, reason, by string) error {
+	return s.file.Update(func(st *state) error {
+		st.BannedPubKeys[pubkey] = newEntry(reason, by)
+		return nil
+	})
+}
+
+// UnbanPubKey lifts a ban, returning whether there was one.
+func (s *Store) UnbanPubKey(pubkey string) (bool, error) {
+	var banned bool
+	err := s.file.Update(func(st *state) error {
+		_, banned = st.BannedPubKeys[pubkey]
+		delete(st.BannedPubKeys, pubkey)
+		return nil
+	})
+	return banned, err
+}
+
+func (s *Store) PubKeyBan(pubkey string) (Entry, bool) {
+	return s.lookup(pubkey, bannedPubKeys)
+}
+
+func (s *Store) BannedPubKeys() ([]Listed, error) {
+	return s.listOf(bannedPubKeys)
+}
+
+// MutePubKey hides a pubkey's events without refusing them.
+func (s *Store) MutePubKey(pubkey, reason, by string) error {
+	return s.file.Update(func(st *state) error {
+		st.MutedPubKeys[pubkey] = newEntry(reason, by)
+		return nil
+	})
+}
+
+func (s *Store) UnmutePubKey(pubkey string) error {
+	return s.file.Update(func(st *state) error {
+		delete(st.MutedPubKeys, pubkey)
+		return nil
+	})
+}
+
+func (s *Store) PubKeyMute(pubkey string) (Entry, bool) {
+	return s.lookup(pubkey, mutedPubKeys)
+}
+
+func (s *Store) MutedPubKeys() ([]Listed, error) {
+	return s.listOf(mutedPubKeys)
+}
+
+// BanEvent bans an event, undoing any earlier decision to allow it.
+func (s *Store) BanEvent(id, reason, by string) error {
+	return s.file.Update(func(st *state) error {
+		delete(st.AllowedEvents, id)
+		st.BannedEvents[id] = newEntry(reason, by)
+		return nil
+	})
+}
+
+// AllowEvent marks an event as reviewed and fine, lifting any ban.
+func (s *Store) AllowEvent(id, reason, by string) error {
+	return s.file.Update(func(st *state) error {
+		delete(st.BannedEvents, id)
+		st.AllowedEvents[id] = newEntry(reason, by)
+		return nil
+	})
+}
+
+func (s *Store) EventBan(id string) (Entry, bool) {
+	return s.lookup(id, bannedEvents)
+}
+
+func (s *Store) IsEventAllowed(id string) bool {
+	_, allowed := s.lookup(id, allowedEvents)
+	return allowed
+}
+
+func (s *Store) BannedEvents() ([]Listed, error) {
+	return s.listOf(bannedEvents)
+}
+
+func (s *Store) AllowedEvents() ([]Listed, error) {
+	return s.listOf(allowedEvents)
+}
+
+func (s *Store) BlockIP(ip, reason, by string) error {
+	return s.file.Update(func(st *state) error {
+		st.BlockedIPs[ip] = newEntry(reason, by)
+		return nil
+	})
+}
+
+func (s *Store) UnblockIP(ip string) error {
+	return s.file.Update(func(st *state) error {
+		delete(st.BlockedIPs, ip)
+		return nil
+	})
+}
+
+func (s *Store) IPBlock(ip string) (Entry, bool) {
+	return s.lookup(ip, blockedIPs)
+}
+
+func (s *Store) BlockedIPs() ([]Listed, error) {
+	return s.listOf(blockedIPs)
+}
+
+// AllowKind lets a kind through. Once any kind is allowed, only allowed
+// kinds are accepted.
+func (s *Store) AllowKind(kind int) error {
+	return s.file.Update(func(st *state) error {
+		st.DisallowedKinds = slices.DeleteFunc(st.DisallowedKinds, func(k int) bool { return k == kind })
+		if !slices.Contains(st.AllowedKinds, kind) {
+			st.AllowedKinds = append(st.AllowedKinds, kind)
+			slices.Sort(st.AllowedKinds)
+		}
+		return nil
+	})
+}
+
+func (s *Store) DisallowKind(kind int) error {
+	return s.file.Update(func(st *state) error {
+		st.AllowedKinds = slices.DeleteFunc(st.AllowedKinds, func(k int) bool { return k == kind })
+		if !slices.Contains(st.DisallowedKinds, kind) {
+			st.DisallowedKinds = append(st.DisallowedKinds, kind)
+			slices.Sort(st.DisallowedKinds)
+		}
+		return nil
+	})
+}
+
+func (s *Store) IsKindAllowed(kind int) bool {
+	allowed := true
+	s.file.Read(func(st *state) error {
+		if slices.Contains(st.DisallowedKinds, kind) {
+			allowed = false
+		} else if len(st.AllowedKinds) > 0 {
+			allowed = slices.Contains(st.AllowedKinds, kind)
+		}
+		return nil
+	})
+	return allowed
+}
+
+func (s *Store) AllowedKinds() ([]int, error) {
+	var kinds []int
+	err := s.file.Read(func(st *state) error {
+		kinds = slices.Clone(st.AllowedKinds)
+		return nil
+	})
+	return kinds, err
+}
+
+func (s *Store) DisallowedKinds() ([]int, error) {
+	var kinds []int
+	err := s.file.Read(func(st *state) error {
+		kinds = slices.Clone(st.DisallowedKinds)
+		return nil
+	})
+	return kinds, err
+}
+
+// GrantAdmin lets pubkey call the given management methods.
+func (s *Store) GrantAdmin(pubkey string, methods []string) error {
+	if len(methods) == 0 {
+		return errors.New("no methods to grant")
+	}
+	return s.file.Update(func(st *state) error {
+		for _, method := range methods {
+			if !slices.Contains(st.Admins[pubkey], method) {
+				st.Admins[pubkey] = append(st.Admins[pubkey], method)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) RevokeAdmin(pubkey string, methods []string) error {
+	return s.file.Update(func(st *state) error {
+		st.Admins[pubkey] = slices.DeleteFunc(st.Admins[pubkey], func(m string) bool {
+			return slices.Contains(methods, m)
+		})
+		if len(st.Admins[pubkey]) == 0 {
+			delete(st.Admins, pubkey)
+		}
+		return nil
+	})
+}
+
+// CanCall reports whether pubkey was granted a management method.
+func (s *Store) CanCall(pubkey, method string) bool {
+	var granted bool
+	s.file.Read(func(st *state) error {
+		granted = slices.Contains(st.Admins[pubkey], method)
+		return nil
+	})
+	return granted
+}
+
+func (s *Store) RelayInfo() RelayInfo {
+	var info RelayInfo
+	s.file.Read(func(st *state) error {
+		info = st.Info
+		return nil
+	})
+	return info
+}
+
+// UpdateRelayInfo changes the stored relay details.
+func (s *Store) UpdateRelayInfo(change func(info *RelayInfo)) error {
+	return s.file.Update(func(st *state) error {
+		change(&st.Info)
+		return nil
+	})
+}
+
+// AddPeer connects the relay to a peer, even one removed from the config.
+func (s *Store) AddPeer(url, reason, by string) error {
+	return s.file.Update(func(st *state) error {
+		delete(st.RemovedPeers, url)
+		st.AddedPeers[url] = newEntry(reason, by)
+		return nil
+	})
+}
+
+// RemovePeer stops the relay connecting to a peer, even one in the config.
+func (s *Store) RemovePeer(url, reason, by string) error {
+	return s.file.Update(func(st *state) error {
+		delete(st.AddedPeers, url)
+		st.RemovedPeers[url] = newEntry(reason, by)
+		return nil
+	})
+}
+
+// Peers returns the peers to connect to, starting from those in the config
+// and applying the changes admins have made since.
+func (s *Store) Peers(configured []string) ([]string, error) {
+	var peers []string
+	err := s.file.Read(func(st *state) error {
+		for _, url := range configured {
+			if _, removed := st.RemovedPeers[url]; !removed && !slices.Contains(peers, url) {
+				peers = append(peers, url)
+			}
+		}
+		for _, added := range sortedEntries(st.AddedPeers) {
+			if !slices.Contains(peers, added.Key) {
+				peers = append(peers, added.Key)
+			}
+		}
+		return nil
+	})
+	return peers, err
+}
+
+// OwnList returns the relay's own bans or mutes, to be shared with peers.
+func (s *Store) OwnList(id string) List {
+	var list List
+	s.file.Read(func(st *state) error {
+		switch id {
+		case BanListID:
+			for _, l := range sortedEntries(st.BannedPubKeys) {
+				list.PubKeys = append(list.PubKeys, l.Key)
+			}
+			for _, l := range sortedEntries(st.BannedEvents) {
+				list.Events = append(list.Events, l.Key)
+			}
+		case MuteListID:
+			for _, l := range sortedEntries(st.MutedPubKeys) {
+				list.PubKeys = append(list.PubKeys, l.Key)
+			}
+		}
+		return nil
+	})
+	return list
+}
+
+// SetPeerList stores a list received from a trusted peer, recording what
+// changed in the audit trail. Lists older than the one held are ignored.
+func (s *Store) SetPeerList(peer, id string, list PeerList) error {
+	return s.file.Update(func(st *state) error {
+		if st.PeerLists[peer] == nil {
+			st.PeerLists[peer] = make(map[string]*PeerList)
+		}
+		prev := st.PeerLists[peer][id]
+		if prev == nil {
+			prev = &PeerList{}
+		} else if prev.CreatedAt >= list.CreatedAt {
+			return nil
+		}
+
+		now := time.Now()
+		record := func(action string, keys []string) {
+			for _, key := range keys {
+				st.audit(AuditEntry{At: now, Peer: peer, List: id, Action: action, Key: key})
+			}
+		}
+		record(AuditAdded, diff(prev.PubKeys, list.PubKeys))
+		record(AuditAdded, diff(prev.Events, list.Events))
+		record(AuditRemoved, diff(list.PubKeys, prev.PubKeys))
+		record(AuditRemoved, diff(list.Events, prev.Events))
+
+		st.PeerLists[peer][id] = &list
+		return nil
+	})
+}
+
+// PeerLists returns every list held from trusted peers, by peer and list id.
+func (s *Store) PeerLists() (map[string]map[string]PeerList, error) {
+	lists := make(map[string]map[string]PeerList)
+	err := s.file.Read(func(st *state) error {
+		for peer, byID := range st.PeerLists {
+			lists[peer] = make(map[string]PeerList)
+			for id, list := range byID {
+				lists[peer][id] = *list
+			}
+		}
+		return nil
+	})
+	return lists, err
+}
+
+// FindInPeerLists returns the first trusted peer, in peers order, whose
+// list id covers the pubkey or the event.
+func (s *Store) FindInPeerLists(peers []string, id, pubkey, eventID string) (peer, key string, found bool) {
+	s.file.Read(func(st *state) error {
+		for _, p := range peers {
+			list := st.PeerLists[p][id]
+			if list == nil {
+				continue
+			}
+			if slices.Contains(list.PubKeys, pubkey) {
+				peer, key, found = p, pubkey, true
+				return nil
+			}
+			if slices.Contains(list.Events, eventID) {
+				peer, key, found = p, eventID, true
+				return nil
+			}
+		}
+		return nil
+	})
+	return peer, key, found
+}
+
+// RecordBlock counts an event blocked because of a peer's list. Blocks are
+// kept in memory until FlushBlocks adds them to the audit trail.
+func (s *Store) RecordBlock(peer, id, key, eventID string) {
+	s.blocksMu.Lock()
+	defer s.blocksMu.Unlock()
+
+	k := blockKey{peer: peer, list: id, key: key}
+	entry := s.blocks[k]
+	if entry == nil {
+		entry = &AuditEntry{Peer: peer, List: id, Action: AuditBlocked, Key: key}
+		s.blocks[k] = entry
+	}
+	entry.At = time.Now()
+	entry.Event = eventID
+	entry.Count++
+}
+
+// pendingBlocks returns the blocks not yet in the audit trail, oldest
+// first. The caller must hold s.blocksMu.
+func (s *Store) pendingBlocks() []AuditEntry {
+	entries := make([]AuditEntry, 0, len(s.blocks))
+	for _, entry := range s.blocks {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].At.Before(entries[j].At)
+	})
+	return entries
+}
+
+// FlushBlocks adds the blocks counted since the last flush to the audit
+// trail.
+func (s *Store) FlushBlocks() error {
+	s.blocksMu.Lock()
+	pending := s.pendingBlocks()
+	clear(s.blocks)
+	s.blocksMu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	return s.file.Update(func(st *state) error {
+		for _, entry := range pending {
+			st.audit(entry)
+		}
+		return nil
+	})
+}
+
+// Audit returns the audit trail, newest first, including blocks not yet
+// flushed.
+func (s *Store) Audit() ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := s.file.Read(func(st *state) error {
+		entries = slices.Clone(st.Audit)
+		return nil
+	})
+	s.blocksMu.Lock()
+	entries = append(entries, s.pendingBlocks()...)
+	s.blocksMu.Unlock()
+	slices.Reverse(entries)
+	return entries, err
+}
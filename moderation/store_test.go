@@ -0,0 +1,161 @@
+package moderation
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	store, err := Open(filepath.Join(t.TempDir(), "moderation.json"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	return store
+}
+
+func TestAllowedKinds(t *testing.T) {
+	store := openTestStore(t)
+
+	if !store.IsKindAllowed(1) {
+		t.Error("Expected every kind to be allowed by default")
+	}
+
+	store.DisallowKind(4)
+	if store.IsKindAllowed(4) {
+		t.Error("Expected disallowed kind to be refused")
+	}
+
+	store.AllowKind(1)
+	if !store.IsKindAllowed(1) {
+		t.Error("Expected allowed kind to be accepted")
+	}
+	if store.IsKindAllowed(7) {
+		t.Error("Expected kinds missing from the allowed list to be refused")
+	}
+
+	store.AllowKind(4)
+	if !store.IsKindAllowed(4) {
+		t.Error("Expected allowing a kind to undo disallowing it")
+	}
+}
+
+func TestAllowingAnEventLiftsItsBan(t *testing.T) {
+	store := openTestStore(t)
+
+	store.BanEvent("abc", "spam", "admin")
+	if ban, banned := store.EventBan("abc"); !banned || ban.Reason != "spam" {
+		t.Errorf("Expected event to be banned for spam, got %v %+v", banned, ban)
+	}
+
+	store.AllowEvent("abc", "reviewed", "admin")
+	if _, banned := store.EventBan("abc"); banned {
+		t.Error("Expected ban to be lifted")
+	}
+	if !store.IsEventAllowed("abc") {
+		t.Error("Expected event to be allowed")
+	}
+}
+
+func TestGrantedMethods(t *testing.T) {
+	store := openTestStore(t)
+
+	if err := store.GrantAdmin("mod", []string{"banevent"}); err != nil {
+		t.Fatalf("GrantAdmin failed: %v", err)
+	}
+	if !store.CanCall("mod", "banevent") {
+		t.Error("Expected granted method to be callable")
+	}
+	if store.CanCall("mod", "banpubkey") {
+		t.Error("Expected other methods to stay restricted")
+	}
+
+	store.RevokeAdmin("mod", []string{"banevent"})
+	if store.CanCall("mod", "banevent") {
+		t.Error("Expected revoked method to be restricted")
+	}
+}
+
+func TestPeerListChangesAreAudited(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "moderation.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	store.SetPeerList("wss://peer", BanListID, PeerList{List: List{PubKeys: []string{"a", "b"}}, CreatedAt: 2})
+	store.SetPeerList("wss://peer", BanListID, PeerList{List: List{PubKeys: []string{"a"}}, CreatedAt: 1})
+	if _, _, found := store.FindInPeerLists([]string{"wss://peer"}, BanListID, "b", ""); !found {
+		t.Error("Expected an older list to be ignored")
+	}
+
+	store.SetPeerList("wss://peer", BanListID, PeerList{List: List{PubKeys: []string{"a", "c"}}, CreatedAt: 3})
+	if _, _, found := store.FindInPeerLists([]string{"wss://peer"}, BanListID, "b", ""); found {
+		t.Error("Expected pubkey dropped from the peer's list to be unbanned")
+	}
+	if _, _, found := store.FindInPeerLists([]string{"wss://other"}, BanListID, "a", ""); found {
+		t.Error("Expected lists to only apply for the peers asked about")
+	}
+
+	store.RecordBlock("wss://peer", BanListID, "c", "event")
+	store.RecordBlock("wss://peer", BanListID, "c", "another")
+
+	actions := func(store *Store) []string {
+		entries, err := store.Audit()
+		if err != nil {
+			t.Fatalf("Audit failed: %v", err)
+		}
+		var actions []string
+		for _, entry := range entries {
+			actions = append(actions, entry.Action+" "+entry.Key)
+		}
+		return actions
+	}
+	expected := []string{"blocked c", "removed b", "added c", "added b", "added a"}
+	if got := actions(store); !slices.Equal(got, expected) {
+		t.Errorf("Expected audit %v, got %v", expected, got)
+	}
+
+	// Blocks only reach the file once flushed
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	if got := actions(reopened); !slices.Equal(got, expected[1:]) {
+		t.Errorf("Expected audit %v before flushing, got %v", expected[1:], got)
+	}
+	if err := store.FlushBlocks(); err != nil {
+		t.Fatalf("FlushBlocks failed: %v", err)
+	}
+	reopened, _ = Open(path)
+	entries, _ := reopened.Audit()
+	if len(entries) != len(expected) || entries[0].Count != 2 || entries[0].Event != "another" {
+		t.Errorf("Expected both blocks counted in one entry, got %+v", entries)
+	}
+}
+
+func TestPeerChanges(t *testing.T) {
+	store := openTestStore(t)
+	configured := []string{"wss://north.example", "wss://south.example"}
+
+	peers, _ := store.Peers(configured)
+	if !slices.Equal(peers, configured) {
+		t.Errorf("Expected the configured peers, got %v", peers)
+	}
+
+	store.AddPeer("wss://east.example", "", "admin")
+	store.RemovePeer("wss://north.example", "too noisy", "admin")
+	peers, _ = store.Peers(configured)
+	if want := []string{"wss://south.example", "wss://east.example"}; !slices.Equal(peers, want) {
+		t.Errorf("Expected %v, got %v", want, peers)
+	}
+
+	store.AddPeer("wss://north.example", "", "admin")
+	store.RemovePeer("wss://east.example", "", "admin")
+	peers, _ = store.Peers(configured)
+	if !slices.Equal(peers, configured) {
+		t.Errorf("Expected re-adding and removing to undo the changes, got %v", peers)
+	}
+}
@@ -0,0 +1,258 @@
+// Package quota keeps track of how much each pubkey has stored, counted
+// as events are saved and deleted.
+package quota
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+// Keys are in the range storage keeps for the relay, well clear of the
+// prefixes eventstore uses for events and indexes.
+const (
+	usagePrefix = storage.MetaPrefix
+	builtKey    = storage.MetaPrefix + 1
+)
+
+// rebuildBatch is how many counters are written in one transaction when
+// building them from what is stored.
+const rebuildBatch = 1000
+
+// Usage is how many events a pubkey has stored and their size in bytes.
+type Usage struct {
+	Events int64 `json:"events"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// Size is what an event counts towards a quota: its JSON encoding.
+func Size(event *nostr.Event) int64 {
+	return int64(len(event.String()))
+}
+
+// Store wraps an event store, updating usage counters kept in the
+// backend's Meta whenever events are saved, replaced or deleted.
+type Store struct {
+	eventstore.Store
+	meta storage.Meta
+	mu   sync.Mutex
+}
+
+// New wraps store, keeping counters in meta. Counters are built from
+// what is already stored the first time a database is used.
+func New(store eventstore.Store, meta storage.Meta) (*Store, error) {
+	s := &Store{Store: store, meta: meta}
+
+	built := false
+	err := meta.View(func(txn storage.MetaTxn) error {
+		_, err := txn.Get([]byte{builtKey})
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		built = err == nil
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !built {
+		if err := s.rebuild(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) rebuild() error {
+	usage := make(map[string]Usage)
+	ch, err := s.Store.QueryEvents(eventstore.SetNegentropy(context.Background()), nostr.Filter{})
+	if err != nil {
+		return err
+	}
+	for event := range ch {
+		u := usage[event.PubKey]
+		u.Events++
+		u.Bytes += Size(event)
+		usage[event.PubKey] = u
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Counters are written a batch at a time, and marked built once all
+	// of them are
+	pubkeys := slices.Collect(maps.Keys(usage))
+	for batch := range slices.Chunk(pubkeys, rebuildBatch) {
+		err := s.meta.Update(func(txn storage.MetaTxn) error {
+			for _, pubkey := range batch {
+				key, err := usageKey(pubkey)
+				if err != nil {
+					continue
+				}
+				if err := txn.Set(key, encode(usage[pubkey])); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.meta.Update(func(txn storage.MetaTxn) error {
+		return txn.Set([]byte{builtKey}, nil)
+	})
+}
+
+func usageKey(pubkey string) ([]byte, error) {
+	b, err := hex.DecodeString(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{usagePrefix}, b...), nil
+}
+
+func encode(u Usage) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(u.Events))
+	binary.BigEndian.PutUint64(b[8:], uint64(u.Bytes))
+	return b
+}
+
+func decode(b []byte) Usage {
+	if len(b) != 16 {
+		return Usage{}
+	}
+	return Usage{
+		Events: int64(binary.BigEndian.Uint64(b)),
+		Bytes:  int64(binary.BigEndian.Uint64(b[8:])),
+	}
+}
+
+// add changes a pubkey's usage, which never drops below zero.
+func (s *Store) add(pubkey string, events, bytes int64) error {
+	key, err := usageKey(pubkey)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.meta.Update(func(txn storage.MetaTxn) error {
+		value, err := txn.Get(key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		u := decode(value)
+
+		u.Events = max(0, u.Events+events)
+		u.Bytes = max(0, u.Bytes+bytes)
+		if u.Events == 0 {
+			return txn.Delete(key)
+		}
+		return txn.Set(key, encode(u))
+	})
+}
+
+// Usage returns how much a pubkey has stored.
+func (s *Store) Usage(pubkey string) (Usage, error) {
+	key, err := usageKey(pubkey)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	var u Usage
+	err = s.meta.View(func(txn storage.MetaTxn) error {
+		value, err := txn.Get(key)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		u = decode(value)
+		return err
+	})
+	return u, err
+}
+
+// AllUsage returns the usage of every pubkey with something stored.
+func (s *Store) AllUsage() (map[string]Usage, error) {
+	usage := make(map[string]Usage)
+	err := s.meta.View(func(txn storage.MetaTxn) error {
+		return txn.Iterate([]byte{usagePrefix}, func(key, value []byte) error {
+			usage[hex.EncodeToString(key[1:])] = decode(value)
+			return nil
+		})
+	})
+	return usage, err
+}
+
+func (s *Store) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	if err := s.Store.SaveEvent(ctx, event); err != nil {
+		return err
+	}
+	return s.add(event.PubKey, 1, Size(event))
+}
+
+func (s *Store) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	if err := s.Store.DeleteEvent(ctx, event); err != nil {
+		return err
+	}
+	return s.add(event.PubKey, -1, -Size(event))
+}
+
+// ReplaceEvent compares what is stored at the event's address before and
+// after replacing, as the replaced versions aren't otherwise reported.
+func (s *Store) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	filter := nostr.Filter{Kinds: []int{event.Kind}, Authors: []string{event.PubKey}}
+	if nostr.IsAddressableKind(event.Kind) {
+		filter.Tags = nostr.TagMap{"d": []string{event.Tags.GetD()}}
+	}
+
+	before, err := s.stored(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.ReplaceEvent(ctx, event); err != nil {
+		return err
+	}
+	after, err := s.stored(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	var events, bytes int64
+	for id, size := range after {
+		if _, existed := before[id]; !existed {
+			events, bytes = events+1, bytes+size
+		}
+	}
+	for id, size := range before {
+		if _, exists := after[id]; !exists {
+			events, bytes = events-1, bytes-size
+		}
+	}
+	if events == 0 && bytes == 0 {
+		return nil
+	}
+	return s.add(event.PubKey, events, bytes)
+}
+
+func (s *Store) stored(ctx context.Context, filter nostr.Filter) (map[string]int64, error) {
+	ch, err := s.Store.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64)
+	for event := range ch {
+		sizes[event.ID] = Size(event)
+	}
+	return sizes, nil
+}
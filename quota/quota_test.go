@@ -0,0 +1,78 @@
+package quota
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+func openTestStore(t *testing.T, path string) (*Store, *storage.DB) {
+	t.Helper()
+
+	backend, err := storage.Open(storage.Badger, path, storage.Settings{})
+	if err != nil {
+		t.Fatalf("Failed to open badger: %v", err)
+	}
+	store, err := New(backend, backend.Meta)
+	if err != nil {
+		t.Fatalf("Failed to open quota store: %v", err)
+	}
+	return store, backend
+}
+
+func signed(t *testing.T, sk string, kind int, createdAt nostr.Timestamp) *nostr.Event {
+	t.Helper()
+
+	event := &nostr.Event{Kind: kind, CreatedAt: createdAt}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	return event
+}
+
+func TestUsageFollowsSavesAndDeletes(t *testing.T) {
+	store, backend := openTestStore(t, t.TempDir())
+	defer backend.Close()
+	ctx := context.Background()
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	note := signed(t, sk, 1, 1)
+	store.SaveEvent(ctx, note)
+	store.SaveEvent(ctx, signed(t, sk, 1, 2))
+	store.SaveEvent(ctx, note)
+
+	usage, _ := store.Usage(pubkey)
+	if usage.Events != 2 || usage.Bytes != Size(note)*2 {
+		t.Errorf("Expected 2 events, got %+v", usage)
+	}
+
+	store.DeleteEvent(ctx, note)
+	store.ReplaceEvent(ctx, signed(t, sk, 0, 3))
+	store.ReplaceEvent(ctx, signed(t, sk, 0, 4))
+	if usage, _ := store.Usage(pubkey); usage.Events != 2 {
+		t.Errorf("Expected replaced profile not to count, got %+v", usage)
+	}
+}
+
+func TestUsageIsBuiltFromExistingEvents(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := storage.Open(storage.Badger, dir, storage.Settings{})
+	if err != nil {
+		t.Fatalf("Failed to open badger: %v", err)
+	}
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	for i := range 3 {
+		backend.SaveEvent(context.Background(), signed(t, sk, 1, nostr.Timestamp(i+1)))
+	}
+	backend.Close()
+
+	store, backend := openTestStore(t, dir)
+	defer backend.Close()
+	if usage, _ := store.Usage(pubkey); usage.Events != 3 {
+		t.Errorf("Expected 3 existing events to be counted, got %+v", usage)
+	}
+}
@@ -0,0 +1,127 @@
+// Package ratelimit keeps a token bucket per key, such as per IP address or
+// per pubkey.
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limit is how quickly a bucket refills and how many tokens it holds. A
+// limit with no rate is not enforced.
+type Limit struct {
+	PerMinute float64 `json:"per_minute"`
+	// Burst defaults to one minute's worth of tokens
+	Burst int `json:"burst,omitempty"`
+}
+
+func (l Limit) Enabled() bool {
+	return l.PerMinute > 0
+}
+
+// Stats counts what a limiter has let through and what it has refused.
+type Stats struct {
+	Allowed uint64 `json:"allowed"`
+	Limited uint64 `json:"limited"`
+}
+
+// sweepInterval is how often full buckets are dropped, since a full bucket
+// is the same as no bucket at all.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// Limiter hands out tokens from a bucket per key. A nil Limiter allows
+// everything.
+type Limiter struct {
+	rate    float64 // tokens per second
+	burst   float64
+	now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	allowed atomic.Uint64
+	limited atomic.Uint64
+}
+
+// New returns a limiter for limit, or nil if the limit isn't enabled.
+func New(limit Limit) *Limiter {
+	if !limit.Enabled() {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = max(1, limit.PerMinute)
+	}
+	return &Limiter{
+		rate:    limit.PerMinute / 60,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from key's bucket, reporting false if it is empty.
+func (l *Limiter) Allow(key string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.swept) > sweepInterval {
+		l.sweep(now)
+	}
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.burst, at: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.at = now
+
+	if b.tokens < 1 {
+		l.limited.Add(1)
+		return false
+	}
+	b.tokens--
+	l.allowed.Add(1)
+	return true
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	return min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// Forget drops key's bucket, for keys that won't be seen again.
+func (l *Limiter) Forget(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, key)
+}
+
+func (l *Limiter) Stats() Stats {
+	if l == nil {
+		return Stats{}
+	}
+	return Stats{Allowed: l.allowed.Load(), Limited: l.limited.Load()}
+}
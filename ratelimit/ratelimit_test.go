@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketRefills(t *testing.T) {
+	now := time.Now()
+	l := New(Limit{PerMinute: 60, Burst: 2})
+	l.now = func() time.Time { return now }
+
+	if !l.Allow("a") || !l.Allow("a") {
+		t.Fatal("Expected burst to be allowed")
+	}
+	if l.Allow("a") {
+		t.Error("Expected empty bucket to be limited")
+	}
+	if !l.Allow("b") {
+		t.Error("Expected other keys to have their own bucket")
+	}
+
+	now = now.Add(time.Second)
+	if !l.Allow("a") {
+		t.Error("Expected a token after a second")
+	}
+	if l.Allow("a") {
+		t.Error("Expected only one token after a second")
+	}
+
+	if stats := l.Stats(); stats.Allowed != 4 || stats.Limited != 2 {
+		t.Errorf("Expected 4 allowed and 2 limited, got %+v", stats)
+	}
+}
+
+func TestFullBucketsAreSwept(t *testing.T) {
+	now := time.Now()
+	l := New(Limit{PerMinute: 60})
+	l.now = func() time.Time { return now }
+
+	l.Allow("a")
+	now = now.Add(2 * time.Minute)
+	l.Allow("b")
+
+	if _, exists := l.buckets["a"]; exists {
+		t.Error("Expected refilled bucket to be dropped")
+	}
+}
+
+func TestDisabledLimitAllowsEverything(t *testing.T) {
+	l := New(Limit{})
+	if l != nil {
+		t.Fatal("Expected no limiter for a limit without a rate")
+	}
+	for range 100 {
+		if !l.Allow("a") {
+			t.Fatal("Expected nil limiter to allow everything")
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Package search keeps a full-text index of events for NIP-50 queries.
+// Only ids are kept in the index, so events are looked up elsewhere.
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/blugelabs/bluge"
+	"github.com/blugelabs/bluge/analysis"
+	"github.com/blugelabs/bluge/analysis/analyzer"
+	"github.com/blugelabs/bluge/analysis/token"
+	blugesearch "github.com/blugelabs/bluge/search"
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/storage"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	textField      = "text"
+	kindField      = "kind"
+	pubkeyField    = "pubkey"
+	createdAtField = "created_at"
+)
+
+// MaxResults is the most ids one search returns.
+const MaxResults = 500
+
+// rebuildPage is how many events are indexed at a time when rebuilding.
+const rebuildPage = 1000
+
+// SearchableKinds are the kinds written for people to read, and so worth
+// searching. Other kinds are often encrypted or machine readable.
+var SearchableKinds = []int{
+	0,     // profiles
+	1,     // notes
+	9,     // group chat
+	11,    // threads
+	20,    // pictures
+	1111,  // comments
+	30023, // long-form articles
+	30402, // classifieds
+	31922, // date-based calendar events
+	31923, // time-based calendar events
+}
+
+// searchableTags are the tags whose values are indexed along with the
+// content.
+var searchableTags = []string{"title", "summary", "name", "location", "t", "alt"}
+
+// extension matches NIP-50 extensions like "language:en", which aren't
+// supported and so are left out of the query.
+var extension = regexp.MustCompile(`\b[a-z_]+:\S+`)
+
+// textAnalyzer splits text into words for both indexing and searching. It
+// is bluge's standard analyzer with text normalised to NFKC first, so that
+// full-width and other compatibility forms match their plain equivalents.
+var textAnalyzer = func() *analysis.Analyzer {
+	a := analyzer.NewStandardAnalyzer()
+	a.TokenFilters = append([]analysis.TokenFilter{token.NewUnicodeNormalizeFilter(norm.NFKC)}, a.TokenFilters...)
+	return a
+}()
+
+// Index is a bluge index of searchable events.
+type Index struct {
+	writer *bluge.Writer
+}
+
+// Open opens the index at path, creating it if needed.
+func Open(path string) (*Index, error) {
+	config := bluge.DefaultConfig(path)
+	config.DefaultSearchAnalyzer = textAnalyzer
+	writer, err := bluge.OpenWriter(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open search index: %w", err)
+	}
+	return &Index{writer: writer}, nil
+}
+
+func (i *Index) Close() error {
+	return i.writer.Close()
+}
+
+// Searchable reports whether an event is indexed.
+func Searchable(event *nostr.Event) bool {
+	return slices.Contains(SearchableKinds, event.Kind)
+}
+
+// Add indexes an event, if its kind is searchable.
+func (i *Index) Add(event *nostr.Event) error {
+	if !Searchable(event) {
+		return nil
+	}
+	doc := document(event)
+	return i.writer.Update(doc.ID(), doc)
+}
+
+func document(event *nostr.Event) *bluge.Document {
+	return bluge.NewDocument(event.ID).
+		AddField(bluge.NewTextField(textField, text(event)).WithAnalyzer(textAnalyzer)).
+		AddField(bluge.NewKeywordField(kindField, strconv.Itoa(event.Kind))).
+		AddField(bluge.NewKeywordField(pubkeyField, event.PubKey)).
+		AddField(bluge.NewNumericField(createdAtField, float64(event.CreatedAt)).Sortable())
+}
+
+// Remove takes an event out of the index.
+func (i *Index) Remove(id string) error {
+	return i.writer.Delete(bluge.Identifier(id))
+}
+
+// text returns what is searchable in an event: its content, or the
+// readable fields of a profile, and the values of a few tags.
+func text(event *nostr.Event) string {
+	var parts []string
+	if event.Kind == nostr.KindProfileMetadata {
+		var profile map[string]any
+		json.Unmarshal([]byte(event.Content), &profile)
+		for _, field := range []string{"name", "display_name", "about", "nip05"} {
+			if value, ok := profile[field].(string); ok {
+				parts = append(parts, value)
+			}
+		}
+	} else {
+		parts = append(parts, event.Content)
+	}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && slices.Contains(searchableTags, tag[0]) {
+			parts = append(parts, tag[1])
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Search returns the ids of up to limit events matching filter.Search,
+// best match first and then newest first. The filter's kinds, authors,
+// since and until are applied too, but everything else is left to the
+// caller.
+func (i *Index) Search(ctx context.Context, filter nostr.Filter, limit int) ([]string, error) {
+	terms := strings.TrimSpace(extension.ReplaceAllString(filter.Search, ""))
+	if terms == "" {
+		return nil, nil
+	}
+	if limit <= 0 || limit > MaxResults {
+		limit = MaxResults
+	}
+
+	query := bluge.NewBooleanQuery().AddMust(
+		bluge.NewMatchQuery(terms).SetField(textField).SetOperator(bluge.MatchQueryOperatorAnd),
+	)
+	if len(filter.Kinds) > 0 {
+		kinds := bluge.NewBooleanQuery().SetMinShould(1)
+		for _, kind := range filter.Kinds {
+			kinds.AddShould(bluge.NewTermQuery(strconv.Itoa(kind)).SetField(kindField))
+		}
+		query.AddMust(kinds)
+	}
+	if len(filter.Authors) > 0 {
+		authors := bluge.NewBooleanQuery().SetMinShould(1)
+		for _, author := range filter.Authors {
+			authors.AddShould(bluge.NewTermQuery(author).SetField(pubkeyField))
+		}
+		query.AddMust(authors)
+	}
+	if filter.Since != nil || filter.Until != nil {
+		since, until := bluge.MinNumeric, bluge.MaxNumeric
+		if filter.Since != nil {
+			since = float64(*filter.Since)
+		}
+		if filter.Until != nil {
+			until = float64(*filter.Until)
+		}
+		query.AddMust(bluge.NewNumericRangeInclusiveQuery(since, until, true, true).SetField(createdAtField))
+	}
+
+	reader, err := i.writer.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	request := bluge.NewTopNSearch(limit, query).SortBy([]string{"-_score", "-" + createdAtField})
+	matches, err := reader.Search(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return ids(matches)
+}
+
+func ids(matches blugesearch.DocumentMatchIterator) ([]string, error) {
+	var ids []string
+	match, err := matches.Next()
+	for err == nil && match != nil {
+		match.VisitStoredFields(func(field string, value []byte) bool {
+			if field == "_id" {
+				ids = append(ids, string(value))
+				return false
+			}
+			return true
+		})
+		match, err = matches.Next()
+	}
+	return ids, err
+}
+
+// Count returns how many events are indexed.
+func (i *Index) Count() (uint64, error) {
+	reader, err := i.writer.Reader()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	return reader.Count()
+}
+
+// Rebuild empties the index and indexes every event in store. It returns
+// how many events were indexed.
+func (i *Index) Rebuild(ctx context.Context, store eventstore.Store) (int, error) {
+	if err := i.clear(ctx); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	filter := nostr.Filter{Kinds: SearchableKinds}
+	err := storage.Walk(ctx, store, filter, rebuildPage, func(page []*nostr.Event, _ nostr.Timestamp) error {
+		batch := bluge.NewBatch()
+		for _, event := range page {
+			if Searchable(event) {
+				doc := document(event)
+				batch.Update(doc.ID(), doc)
+				count++
+			}
+		}
+		return i.writer.Batch(batch)
+	})
+	return count, err
+}
+
+// clear removes every event from the index.
+func (i *Index) clear(ctx context.Context) error {
+	reader, err := i.writer.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	matches, err := reader.Search(ctx, bluge.NewAllMatches(bluge.NewMatchAllQuery()))
+	if err != nil {
+		return err
+	}
+	all, err := ids(matches)
+	if err != nil {
+		return err
+	}
+	batch := bluge.NewBatch()
+	for _, id := range all {
+		batch.Delete(bluge.Identifier(id))
+	}
+	return i.writer.Batch(batch)
+}
@@ -0,0 +1,162 @@
+package search
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := storage.Open(storage.Badger, filepath.Join(dir, "db"), storage.Settings{})
+	if err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	index, err := Open(filepath.Join(dir, "search"))
+	if err != nil {
+		db.Close()
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	store := NewStore(db, index)
+	t.Cleanup(store.Close)
+	return store
+}
+
+func note(t *testing.T, sk string, kind int, createdAt nostr.Timestamp, content string, tags ...nostr.Tag) *nostr.Event {
+	t.Helper()
+
+	event := &nostr.Event{Kind: kind, CreatedAt: createdAt, Content: content, Tags: tags}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	return event
+}
+
+func search(t *testing.T, index *Index, filter nostr.Filter) []string {
+	t.Helper()
+
+	ids, err := index.Search(context.Background(), filter, 0)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+	store := openTestStore(t)
+	ctx := context.Background()
+
+	alice := nostr.GeneratePrivateKey()
+	bob := nostr.GeneratePrivateKey()
+	market := note(t, alice, 1, 100, "The farmers market opens on Saturday")
+	busy := note(t, bob, 1, 200, "Market day! The market is busy, come to the market")
+	bakery := note(t, alice, 1, 300, "New bakery on the high street")
+	article := note(t, bob, 30023, 400, "Notes from the meeting", nostr.Tag{"d", "minutes"}, nostr.Tag{"title", "Village market plans"})
+	profile := note(t, alice, 0, 500, `{"name":"Alice","about":"Runs the bakery"}`)
+	reaction := note(t, bob, 7, 600, "market")
+	wide := note(t, bob, 1, 700, "Ｆｅｓｔｉｖａｌ tonight")
+	for _, event := range []*nostr.Event{market, busy, bakery, profile, reaction, wide} {
+		if err := store.SaveEvent(ctx, event); err != nil {
+			t.Fatalf("Failed to save event: %v", err)
+		}
+	}
+	if err := store.ReplaceEvent(ctx, article); err != nil {
+		t.Fatalf("Failed to replace event: %v", err)
+	}
+
+	since := nostr.Timestamp(150)
+	tests := []struct {
+		name     string
+		filter   nostr.Filter
+		expected []string
+	}{
+		{"best match first", nostr.Filter{Search: "market"}, []string{busy.ID, market.ID, article.ID}},
+		{"every word", nostr.Filter{Search: "farmers market"}, []string{market.ID}},
+		{"case and extensions", nostr.Filter{Search: "BAKERY language:en"}, []string{profile.ID, bakery.ID}},
+		{"full-width text", nostr.Filter{Search: "festival"}, []string{wide.ID}},
+		{"full-width query", nostr.Filter{Search: "ｂａｋｅｒｙ"}, []string{profile.ID, bakery.ID}},
+		{"kinds", nostr.Filter{Search: "market", Kinds: []int{30023}}, []string{article.ID}},
+		{"authors", nostr.Filter{Search: "market", Authors: []string{market.PubKey}}, []string{market.ID}},
+		{"since", nostr.Filter{Search: "market", Since: &since}, []string{busy.ID, article.ID}},
+		{"no match", nostr.Filter{Search: "library"}, nil},
+		{"only extensions", nostr.Filter{Search: "nsfw:false"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := search(t, store.Index, tt.filter)
+			if !slices.Equal(ids, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, ids)
+			}
+		})
+	}
+}
+
+func TestStoreKeepsIndexInStep(t *testing.T) {
+	store := openTestStore(t)
+	ctx := context.Background()
+
+	alice := nostr.GeneratePrivateKey()
+	first := note(t, alice, 30023, 100, "Draft about the harvest festival", nostr.Tag{"d", "festival"})
+	second := note(t, alice, 30023, 200, "Final plans for the harvest fair", nostr.Tag{"d", "festival"})
+	for _, event := range []*nostr.Event{first, second} {
+		if err := store.ReplaceEvent(ctx, event); err != nil {
+			t.Fatalf("Failed to replace event: %v", err)
+		}
+	}
+
+	if ids := search(t, store.Index, nostr.Filter{Search: "harvest"}); !slices.Equal(ids, []string{second.ID}) {
+		t.Errorf("Expected only the latest version, got %v", ids)
+	}
+	if ids := search(t, store.Index, nostr.Filter{Search: "festival"}); len(ids) != 0 {
+		t.Errorf("Expected the replaced version to be gone, got %v", ids)
+	}
+
+	if err := store.DeleteEvent(ctx, second); err != nil {
+		t.Fatalf("Failed to delete event: %v", err)
+	}
+	if ids := search(t, store.Index, nostr.Filter{Search: "harvest"}); len(ids) != 0 {
+		t.Errorf("Expected the deleted event to be gone, got %v", ids)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	store := openTestStore(t)
+	ctx := context.Background()
+
+	alice := nostr.GeneratePrivateKey()
+	local := note(t, alice, 1, 100, "Lost cat near the church")
+	stale := note(t, alice, 1, 200, "Lost keys by the pond")
+	found := note(t, alice, 1, 300, "Found cat by the park")
+	// Saved past the index, as if the index was new
+	for _, event := range []*nostr.Event{local, found} {
+		if err := store.Store.SaveEvent(ctx, event); err != nil {
+			t.Fatalf("Failed to save event: %v", err)
+		}
+	}
+	if err := store.Index.Add(stale); err != nil {
+		t.Fatalf("Failed to index event: %v", err)
+	}
+
+	count, err := store.Index.Rebuild(ctx, store.Store)
+	if err != nil {
+		t.Fatalf("Rebuild failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 events indexed, got %d", count)
+	}
+	if ids := search(t, store.Index, nostr.Filter{Search: "cat"}); !slices.Equal(ids, []string{found.ID, local.ID}) {
+		t.Errorf("Expected both cats, got %v", ids)
+	}
+	if ids := search(t, store.Index, nostr.Filter{Search: "keys"}); len(ids) != 0 {
+		t.Errorf("Expected events no longer stored to be dropped, got %v", ids)
+	}
+	if indexed, err := store.Index.Count(); err != nil || indexed != 2 {
+		t.Errorf("Expected 2 events in the index, got %d (%v)", indexed, err)
+	}
+}
@@ -0,0 +1,103 @@
+package search
+
+import (
+	"context"
+	"log"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Store wraps an event store, keeping an index in step as events are
+// saved, replaced or deleted. Events are stored even if indexing them
+// fails, as search is less important than keeping them.
+type Store struct {
+	eventstore.Store
+	Index *Index
+}
+
+// NewStore wraps store, indexing its events in index.
+func NewStore(store eventstore.Store, index *Index) *Store {
+	return &Store{Store: store, Index: index}
+}
+
+func (s *Store) Close() {
+	s.Store.Close()
+	if err := s.Index.Close(); err != nil {
+		log.Printf("Error closing search index: %v", err)
+	}
+}
+
+func (s *Store) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	if err := s.Store.SaveEvent(ctx, event); err != nil {
+		return err
+	}
+	if err := s.Index.Add(event); err != nil {
+		log.Printf("Error indexing event %s: %v", event.ID, err)
+	}
+	return nil
+}
+
+func (s *Store) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	if err := s.Store.DeleteEvent(ctx, event); err != nil {
+		return err
+	}
+	if !Searchable(event) {
+		return nil
+	}
+	if err := s.Index.Remove(event.ID); err != nil {
+		log.Printf("Error removing event %s from search index: %v", event.ID, err)
+	}
+	return nil
+}
+
+// ReplaceEvent compares what is stored at the event's address before and
+// after replacing, as the replaced versions aren't otherwise reported.
+func (s *Store) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	if !Searchable(event) {
+		return s.Store.ReplaceEvent(ctx, event)
+	}
+
+	filter := nostr.Filter{Kinds: []int{event.Kind}, Authors: []string{event.PubKey}}
+	if nostr.IsAddressableKind(event.Kind) {
+		filter.Tags = nostr.TagMap{"d": []string{event.Tags.GetD()}}
+	}
+
+	before, err := s.stored(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.ReplaceEvent(ctx, event); err != nil {
+		return err
+	}
+	after, err := s.stored(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	for id := range before {
+		if _, exists := after[id]; !exists {
+			if err := s.Index.Remove(id); err != nil {
+				log.Printf("Error removing event %s from search index: %v", id, err)
+			}
+		}
+	}
+	if _, stored := after[event.ID]; stored {
+		if err := s.Index.Add(event); err != nil {
+			log.Printf("Error indexing event %s: %v", event.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) stored(ctx context.Context, filter nostr.Filter) (map[string]bool, error) {
+	ch, err := s.Store.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool)
+	for event := range ch {
+		ids[event.ID] = true
+	}
+	return ids, nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// tokenAdmin is who changes made with the admin token are recorded as.
+const tokenAdmin = "admin token"
+
+// isAdmin reports whether pubkey is one of the community's admins.
+func (s *Server) isAdmin(pubkey string) bool {
+	return pubkey != "" && slices.Contains(s.config.AdminPubKeys, pubkey)
+}
+
+// adminHandler wraps an admin API endpoint, only letting through requests
+// signed with NIP-98 by one of the community's admins, or carrying the
+// admin token.
+func (s *Server) adminHandler(handle func(w http.ResponseWriter, r *http.Request, admin string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			if !s.validAdminToken(token) {
+				writeError(w, http.StatusUnauthorized, "invalid admin token")
+				return
+			}
+			handle(w, r, tokenAdmin)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "failed to read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		event, err := authenticateNIP98(r, body)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if !s.isAdmin(event.PubKey) {
+			writeError(w, http.StatusForbidden, "not an admin of this relay")
+			return
+		}
+		// Only admins' authorizations are remembered, so others can't
+		// fill up the list
+		if !s.usedAuth.use(event) {
+			writeError(w, http.StatusUnauthorized, "authorization has already been used")
+			return
+		}
+
+		handle(w, r, event.PubKey)
+	}
+}
+
+// validAdminToken reports whether token is the configured admin token.
+func (s *Server) validAdminToken(token string) bool {
+	return s.config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,473 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/blossom"
+)
+
+// Defaults for the Blossom server. Only types browsers show safely are
+// allowed by default, so SVG and HTML are left out.
+var (
+	defaultBlossomMaxSize int64 = 16 << 20
+	defaultBlossomTypes         = []string{
+		"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif",
+		"video/mp4", "video/webm", "audio/mpeg", "audio/ogg",
+	}
+)
+
+const (
+	// mirrorTimeout is how long fetching a blob from a peer may take.
+	mirrorTimeout = 2 * time.Minute
+	// mirrorWorkers is how many blobs are fetched from peers at once
+	mirrorWorkers = 4
+	// mirrorQueue is how many blobs can wait to be fetched. Blobs linked
+	// while it is full are skipped.
+	mirrorQueue = 256
+)
+
+// mirrorJob is a blob to fetch from a peer and keep for owner.
+type mirrorJob struct {
+	ref   blossom.Reference
+	owner string
+}
+
+// blossomPolicy serves the community's media. Uploads are checked here,
+// and blobs and who owns them are kept by the blossom store.
+type blossomPolicy struct {
+	Blossom
+	store     *blossom.Store
+	canUpload func(pubkey string) bool
+	isAdmin   func(pubkey string) bool
+	// client fetches blobs from peers, and can be swapped for one that
+	// reaches them over Tailscale
+	client *http.Client
+	// keepMu makes checking a quota and keeping a blob one step, so
+	// uploads at the same time can't each fit in what is left of it
+	keepMu sync.Mutex
+
+	// mirrors are waiting to be fetched by the workers, and mirroring
+	// has the hashes queued or being fetched. The workers start with the
+	// first blob queued and stop when the server is closed.
+	mirrors      chan mirrorJob
+	mirrorMu     sync.Mutex
+	mirroring    map[string]bool
+	startMirrors sync.Once
+	stopMirrors  context.CancelFunc
+	mirrorCtx    context.Context
+}
+
+// newBlossomPolicy returns nil unless blossom is enabled.
+func newBlossomPolicy(config *Config, s *Server) (*blossomPolicy, error) {
+	if !config.Blossom.Enabled {
+		return nil, nil
+	}
+
+	p := &blossomPolicy{
+		Blossom:   config.Blossom,
+		canUpload: s.canUpload,
+		isAdmin:   s.isAdmin,
+		client:    &http.Client{Timeout: mirrorTimeout},
+		mirrors:   make(chan mirrorJob, mirrorQueue),
+		mirroring: make(map[string]bool),
+	}
+	p.mirrorCtx, p.stopMirrors = context.WithCancel(context.Background())
+	if p.MaxSize < 0 || p.MaxBytesPerUser < 0 {
+		return nil, fmt.Errorf("blossom limits cannot be negative")
+	}
+	if p.MaxSize == 0 {
+		p.MaxSize = defaultBlossomMaxSize
+	}
+	if len(p.AllowedTypes) == 0 {
+		p.AllowedTypes = defaultBlossomTypes
+	}
+	p.PublicURL = strings.TrimSuffix(p.PublicURL, "/")
+
+	var err error
+	p.store, err = blossom.Open(config.BlossomDirPath(), s.backend().Meta)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// canUpload reports whether pubkey may upload media: admins, and members
+// when membership is enabled, as long as they aren't banned.
+func (s *Server) canUpload(pubkey string) bool {
+	if s.isAdmin(pubkey) {
+		return true
+	}
+	if _, banned := s.moderation.store.PubKeyBan(pubkey); banned {
+		return false
+	}
+	return s.membership == nil || s.membership.isMember(pubkey)
+}
+
+// SetHTTPClient changes how blobs are fetched from peers, e.g. to reach
+// them over Tailscale.
+func (s *Server) SetHTTPClient(client *http.Client) {
+	if s.blossom != nil {
+		s.blossom.client = client
+	}
+}
+
+// baseURL is where blobs are served from, as seen by the client making
+// the request.
+func (p *blossomPolicy) baseURL(r *http.Request) string {
+	if p.PublicURL != "" {
+		return p.PublicURL
+	}
+	u, err := url.Parse(requestURL(r))
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = ""
+	u.Path = strings.TrimSuffix(u.Path, r.URL.Path)
+	u.RawPath = ""
+	return u.String()
+}
+
+func (p *blossomPolicy) describe(r *http.Request, descriptor blossom.Descriptor) blossom.Descriptor {
+	descriptor.URL = p.baseURL(r) + "/" + descriptor.SHA256 + blossom.Extension(descriptor.Type)
+	return descriptor
+}
+
+// checkUpload refuses uploads pubkey can't make, returning the status and
+// reason to give.
+func (p *blossomPolicy) checkUpload(pubkey, hash string, size int64, mimeType string) (int, string) {
+	if !p.canUpload(pubkey) {
+		return http.StatusForbidden, "only members can upload to this relay"
+	}
+	if size > p.MaxSize {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("blobs can be at most %d bytes", p.MaxSize)
+	}
+	if mimeType != "" && !blossom.TypeAllowed(mimeType, p.AllowedTypes) {
+		return http.StatusUnsupportedMediaType, fmt.Sprintf("%s files are not accepted", mimeType)
+	}
+	return p.checkQuota(pubkey, hash, size)
+}
+
+func (p *blossomPolicy) checkQuota(pubkey, hash string, size int64) (int, string) {
+	if p.MaxBytesPerUser == 0 || p.isAdmin(pubkey) {
+		return 0, ""
+	}
+	if hash != "" {
+		if owners, err := p.store.Owners(hash); err == nil && slices.Contains(owners, pubkey) {
+			return 0, ""
+		}
+	}
+	usage, err := p.store.Usage(pubkey)
+	if err != nil {
+		return http.StatusInternalServerError, "failed to check storage quota"
+	}
+	if usage+size > p.MaxBytesPerUser {
+		return http.StatusRequestEntityTooLarge, "storage quota reached"
+	}
+	return 0, ""
+}
+
+// keep keeps an upload for pubkey if check still allows it once the lock
+// is held, discarding it otherwise.
+func (p *blossomPolicy) keep(upload *blossom.Upload, pubkey, mimeType string, check func() (int, string)) (blossom.Descriptor, int, string, error) {
+	p.keepMu.Lock()
+	defer p.keepMu.Unlock()
+
+	if status, reason := check(); status != 0 {
+		upload.Discard()
+		return blossom.Descriptor{}, status, reason, nil
+	}
+	descriptor, err := upload.Keep(pubkey, mimeType)
+	return descriptor, 0, "", err
+}
+
+// blossomError reports an error in the X-Reason header, as BUD-01 asks,
+// and in the body for people reading it.
+func blossomError(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("X-Reason", reason)
+	writeError(w, status, reason)
+}
+
+func (p *blossomPolicy) handleUpload(w http.ResponseWriter, r *http.Request) {
+	auth, err := blossom.Authorize(r, blossom.VerbUpload)
+	if err != nil {
+		blossomError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if status, reason := p.checkUpload(auth.PubKey, "", max(r.ContentLength, 0), ""); status != 0 {
+		blossomError(w, status, reason)
+		return
+	}
+
+	upload, err := p.store.Write(http.MaxBytesReader(w, r.Body, p.MaxSize+1), p.MaxSize)
+	if errors.Is(err, blossom.ErrTooLarge) {
+		blossomError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("blobs can be at most %d bytes", p.MaxSize))
+		return
+	}
+	if err != nil {
+		blossomError(w, http.StatusBadRequest, "failed to read upload")
+		return
+	}
+	if !blossom.Covers(auth, upload.SHA256) {
+		upload.Discard()
+		blossomError(w, http.StatusForbidden, "authorization is for a different blob")
+		return
+	}
+	mimeType := blossom.DetectType(upload.Head, r.Header.Get("Content-Type"))
+	descriptor, status, reason, err := p.keep(upload, auth.PubKey, mimeType, func() (int, string) {
+		return p.checkUpload(auth.PubKey, upload.SHA256, upload.Size, mimeType)
+	})
+	if status != 0 {
+		blossomError(w, status, reason)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to keep blob %s: %v", upload.SHA256, err)
+		blossomError(w, http.StatusInternalServerError, "failed to store blob")
+		return
+	}
+	writeJSON(w, http.StatusOK, p.describe(r, descriptor))
+}
+
+// handleUploadCheck tells a client whether an upload would be accepted
+// before it is sent, as in BUD-06.
+func (p *blossomPolicy) handleUploadCheck(w http.ResponseWriter, r *http.Request) {
+	auth, err := blossom.Authorize(r, blossom.VerbUpload)
+	if err != nil {
+		blossomError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	hash := r.Header.Get("X-SHA-256")
+	if hash != "" && (!blossom.ValidHash(hash) || !blossom.Covers(auth, hash)) {
+		blossomError(w, http.StatusForbidden, "authorization is for a different blob")
+		return
+	}
+	size, _ := strconv.ParseInt(r.Header.Get("X-Content-Length"), 10, 64)
+	if status, reason := p.checkUpload(auth.PubKey, hash, size, r.Header.Get("X-Content-Type")); status != 0 {
+		blossomError(w, status, reason)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// splitBlobPath returns the hash from a path like "<sha256>.png", and
+// whether it is valid.
+func splitBlobPath(path string) (string, bool) {
+	hash, _, _ := strings.Cut(path, ".")
+	return hash, blossom.ValidHash(hash)
+}
+
+func (p *blossomPolicy) handleGet(w http.ResponseWriter, r *http.Request) {
+	hash, ok := splitBlobPath(r.PathValue("blob"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	descriptor, found, err := p.store.Get(hash)
+	if err != nil {
+		blossomError(w, http.StatusInternalServerError, "failed to look up blob")
+		return
+	}
+	if !found {
+		blossomError(w, http.StatusNotFound, "blob not found")
+		return
+	}
+	f, err := p.store.Open(hash)
+	if err != nil {
+		blossomError(w, http.StatusNotFound, "blob not found")
+		return
+	}
+	defer f.Close()
+
+	// Blobs are only ever shown as media, never run as pages
+	w.Header().Set("Content-Type", descriptor.Type)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	http.ServeContent(w, r, "", descriptor.Uploaded.Time(), f)
+}
+
+func (p *blossomPolicy) handleList(w http.ResponseWriter, r *http.Request) {
+	pubkey := r.PathValue("pubkey")
+	if !nostr.IsValidPublicKey(pubkey) {
+		blossomError(w, http.StatusBadRequest, "invalid pubkey")
+		return
+	}
+	descriptors, err := p.store.List(pubkey)
+	if err != nil {
+		blossomError(w, http.StatusInternalServerError, "failed to list blobs")
+		return
+	}
+
+	since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	until, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+	if err != nil {
+		until = 1<<63 - 1
+	}
+	listed := make([]blossom.Descriptor, 0, len(descriptors))
+	for _, descriptor := range descriptors {
+		if int64(descriptor.Uploaded) >= since && int64(descriptor.Uploaded) <= until {
+			listed = append(listed, p.describe(r, descriptor))
+		}
+	}
+	writeJSON(w, http.StatusOK, listed)
+}
+
+// handleDelete removes the signer's ownership of a blob, deleting it once
+// nobody owns it. Admins can delete any blob outright.
+func (p *blossomPolicy) handleDelete(w http.ResponseWriter, r *http.Request) {
+	hash, ok := splitBlobPath(r.PathValue("blob"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	auth, err := blossom.Authorize(r, blossom.VerbDelete)
+	if err != nil {
+		blossomError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if auth.Tags.FindWithValue("x", hash) == nil {
+		blossomError(w, http.StatusForbidden, "authorization is for a different blob")
+		return
+	}
+
+	owners, err := p.store.Owners(hash)
+	if err != nil {
+		blossomError(w, http.StatusInternalServerError, "failed to look up blob")
+		return
+	}
+	switch {
+	case slices.Contains(owners, auth.PubKey):
+		_, err = p.store.Remove(hash, auth.PubKey)
+	case len(owners) > 0 && p.isAdmin(auth.PubKey):
+		err = p.store.Delete(hash)
+		if err == nil {
+			log.Printf("Admin %s deleted blob %s", auth.PubKey[:8], hash)
+		}
+	default:
+		blossomError(w, http.StatusNotFound, "blob not found")
+		return
+	}
+	if err != nil {
+		blossomError(w, http.StatusInternalServerError, "failed to delete blob")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// onIncomingEvent queues blobs that an event from a peer links to on that
+// peer to be copied, so they can still be served here if the peer goes
+// away. Links to anywhere else are left alone.
+func (p *blossomPolicy) onIncomingEvent(sourceURL string, event *nostr.Event) {
+	// Mirrored blobs belong to the author, who must be able to upload them
+	if !p.MirrorPeers || !p.canUpload(event.PubKey) {
+		return
+	}
+	source, err := url.Parse(sourceURL)
+	if err != nil {
+		return
+	}
+	for _, ref := range blossom.References(event) {
+		u, err := url.Parse(ref.URL)
+		if err != nil || !strings.EqualFold(u.Hostname(), source.Hostname()) {
+			continue
+		}
+		if _, found, _ := p.store.Get(ref.SHA256); found {
+			continue
+		}
+		p.queueMirror(mirrorJob{ref: ref, owner: event.PubKey})
+	}
+}
+
+// queueMirror queues a blob to be fetched, unless it already is or the
+// queue is full.
+func (p *blossomPolicy) queueMirror(job mirrorJob) {
+	p.mirrorMu.Lock()
+	defer p.mirrorMu.Unlock()
+
+	if p.mirroring[job.ref.SHA256] {
+		return
+	}
+	select {
+	case p.mirrors <- job:
+		p.mirroring[job.ref.SHA256] = true
+	default:
+		log.Printf("Too many blobs waiting to be mirrored, skipping %s", job.ref.SHA256[:8])
+	}
+	p.startMirrors.Do(func() { p.runMirrors(p.mirrorCtx) })
+}
+
+// runMirrors starts a fixed number of workers fetching queued blobs until
+// ctx is cancelled.
+func (p *blossomPolicy) runMirrors(ctx context.Context) {
+	for range mirrorWorkers {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-p.mirrors:
+					p.mirror(ctx, job.ref, job.owner)
+					p.mirrorMu.Lock()
+					delete(p.mirroring, job.ref.SHA256)
+					p.mirrorMu.Unlock()
+				}
+			}
+		}()
+	}
+}
+
+// mirror fetches a blob and keeps it for owner, if it would be accepted
+// as an upload from them.
+func (p *blossomPolicy) mirror(ctx context.Context, ref blossom.Reference, owner string) {
+	// The author may have been banned while the blob was queued
+	if !p.canUpload(owner) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, mirrorTimeout)
+	defer cancel()
+
+	upload, declared, err := p.store.Fetch(ctx, p.client, ref, p.MaxSize)
+	if err != nil {
+		log.Printf("Failed to mirror blob %s: %v", ref.SHA256[:8], err)
+		return
+	}
+	mimeType := blossom.DetectType(upload.Head, declared)
+	if !blossom.TypeAllowed(mimeType, p.AllowedTypes) {
+		upload.Discard()
+		return
+	}
+	_, status, _, err := p.keep(upload, owner, mimeType, func() (int, string) {
+		return p.checkQuota(owner, ref.SHA256, upload.Size)
+	})
+	if status != 0 {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to keep mirrored blob %s: %v", ref.SHA256[:8], err)
+		return
+	}
+	log.Printf("Mirrored blob %s from %s", ref.SHA256[:8], ref.URL)
+}
+
+// registerBlossomAPI serves the media endpoints of BUD-01 and BUD-02 next
+// to the relay.
+func (s *Server) registerBlossomAPI(mux *http.ServeMux) {
+	p := s.blossom
+	mux.HandleFunc("PUT /upload", p.handleUpload)
+	mux.HandleFunc("HEAD /upload", p.handleUploadCheck)
+	mux.HandleFunc("GET /list/{pubkey}", p.handleList)
+	mux.HandleFunc("GET /{blob}", p.handleGet)
+	mux.HandleFunc("DELETE /{blob}", p.handleDelete)
+}
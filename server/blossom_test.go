@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/blossom"
+)
+
+var testPNG = append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), bytes.Repeat([]byte{1}, 100)...)
+
+func blossomAuth(t *testing.T, sk, verb string, tags ...nostr.Tag) string {
+	t.Helper()
+
+	tags = append(nostr.Tags{{"t", verb}, {"expiration", strconv.FormatInt(int64(nostr.Now()+60), 10)}}, tags...)
+	event := signedEvent(t, sk, blossom.KindAuthorization, tags...)
+	data, _ := json.Marshal(event)
+	return "Nostr " + base64.StdEncoding.EncodeToString(data)
+}
+
+func blossomRequest(t *testing.T, srv *Server, method, path, auth string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, "http://relay.example"+path, bytes.NewReader(body))
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestBlossomUploads(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	memberKey := nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberKey)
+	srv := newTestServer(t, &Config{
+		AdminPubKeys:      []string{admin},
+		MembershipEnabled: true,
+		MembersFile:       filepath.Join(t.TempDir(), "members.json"),
+		Blossom:           Blossom{Enabled: true, MaxSize: 1000, MaxBytesPerUser: 200},
+	})
+	if err := srv.membership.store.AddMember(member, "test"); err != nil {
+		t.Fatalf("Failed to add member: %v", err)
+	}
+
+	sum := sha256.Sum256(testPNG)
+	hash := hex.EncodeToString(sum[:])
+
+	rec := blossomRequest(t, srv, http.MethodPut, "/upload", blossomAuth(t, nostr.GeneratePrivateKey(), "upload"), testPNG)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected strangers to be refused, got %d", rec.Code)
+	}
+	rec = blossomRequest(t, srv, http.MethodPut, "/upload", "", testPNG)
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("X-Reason") == "" {
+		t.Errorf("Expected unsigned uploads to be refused with a reason, got %d", rec.Code)
+	}
+	rec = blossomRequest(t, srv, http.MethodPut, "/upload", blossomAuth(t, memberKey, "upload"), []byte("<html><script>alert(1)</script>"))
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected HTML to be refused, got %d", rec.Code)
+	}
+	rec = blossomRequest(t, srv, http.MethodPut, "/upload", blossomAuth(t, memberKey, "upload"), append(testPNG, make([]byte, 1000)...))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected large blobs to be refused, got %d", rec.Code)
+	}
+
+	rec = blossomRequest(t, srv, http.MethodPut, "/upload", blossomAuth(t, memberKey, "upload", nostr.Tag{"x", hash}), testPNG)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the upload to be accepted, got %d: %s", rec.Code, rec.Header().Get("X-Reason"))
+	}
+	var descriptor blossom.Descriptor
+	json.Unmarshal(rec.Body.Bytes(), &descriptor)
+	if descriptor.SHA256 != hash || descriptor.Type != "image/png" || descriptor.URL != "http://relay.example/"+hash+".png" {
+		t.Errorf("Expected a descriptor of the PNG, got %+v", descriptor)
+	}
+
+	rec = blossomRequest(t, srv, http.MethodGet, "/"+hash+".png", "", nil)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), testPNG) {
+		t.Errorf("Expected the blob to be served, got %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Type") != "image/png" || rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Expected the blob's type to be fixed, got %v", rec.Header())
+	}
+
+	other := append(bytes.Clone(testPNG), 2)
+	rec = blossomRequest(t, srv, http.MethodPut, "/upload", blossomAuth(t, memberKey, "upload"), other)
+	if rec.Code != http.StatusRequestEntityTooLarge || rec.Header().Get("X-Reason") != "storage quota reached" {
+		t.Errorf("Expected the quota to be enforced, got %d", rec.Code)
+	}
+	rec = blossomRequest(t, srv, http.MethodPut, "/upload", blossomAuth(t, adminKey, "upload"), other)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected admins to have no quota, got %d", rec.Code)
+	}
+
+	rec = blossomRequest(t, srv, http.MethodGet, "/list/"+member, "", nil)
+	var listed []blossom.Descriptor
+	json.Unmarshal(rec.Body.Bytes(), &listed)
+	if len(listed) != 1 || listed[0].SHA256 != hash {
+		t.Errorf("Expected the member's blob to be listed, got %+v", listed)
+	}
+
+	rec = blossomRequest(t, srv, http.MethodDelete, "/"+hash, blossomAuth(t, memberKey, "delete"), nil)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected deletes without an x tag to be refused, got %d", rec.Code)
+	}
+	rec = blossomRequest(t, srv, http.MethodDelete, "/"+hash, blossomAuth(t, memberKey, "delete", nostr.Tag{"x", hash}), nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected the owner to delete the blob, got %d", rec.Code)
+	}
+	rec = blossomRequest(t, srv, http.MethodGet, "/"+hash, "", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected the blob to be gone, got %d", rec.Code)
+	}
+}
+
+func TestBlossomDisabled(t *testing.T) {
+	srv := newTestServer(t, &Config{})
+
+	if srv.blossom != nil {
+		t.Error("Expected no media server")
+	}
+	rec := blossomRequest(t, srv, http.MethodPut, "/upload", blossomAuth(t, nostr.GeneratePrivateKey(), "upload"), testPNG)
+	if rec.Header().Get("Content-Type") == "application/json" {
+		t.Error("Expected uploads not to be handled")
+	}
+}
+
+func TestBlossomQuotaHoldsForConcurrentUploads(t *testing.T) {
+	memberKey := nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberKey)
+	srv := newTestServer(t, &Config{
+		MembershipEnabled: true,
+		MembersFile:       filepath.Join(t.TempDir(), "members.json"),
+		Blossom:           Blossom{Enabled: true, MaxSize: 1000, MaxBytesPerUser: 200},
+	})
+	if err := srv.membership.store.AddMember(member, "test"); err != nil {
+		t.Fatalf("Failed to add member: %v", err)
+	}
+
+	// Each blob fits in the quota, but no two of them do
+	var wg sync.WaitGroup
+	var accepted atomic.Int32
+	for i := range 32 {
+		blob := append(bytes.Clone(testPNG), byte(i))
+		auth := blossomAuth(t, memberKey, "upload")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec := blossomRequest(t, srv, http.MethodPut, "/upload", auth, blob); rec.Code == http.StatusOK {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("Expected one upload to fit in the quota, got %d", n)
+	}
+	if usage, _ := srv.blossom.store.Usage(member); usage > 200 {
+		t.Errorf("Expected usage within the quota, got %d bytes", usage)
+	}
+}
+
+func TestBlossomMirrorsEachBlobOnce(t *testing.T) {
+	sum := sha256.Sum256(testPNG)
+	hash := hex.EncodeToString(sum[:])
+	var fetches atomic.Int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer peer.Close()
+
+	srv := newTestServer(t, &Config{Blossom: Blossom{Enabled: true, MirrorPeers: true}})
+	event := signedEvent(t, nostr.GeneratePrivateKey(), 1)
+	event.Content = "Look " + peer.URL + "/" + hash + ".png"
+	peerURL := "ws" + strings.TrimPrefix(peer.URL, "http")
+	for range 3 {
+		srv.blossom.onIncomingEvent(peerURL, event)
+	}
+
+	mirrored := func() bool {
+		_, found, _ := srv.blossom.store.Get(hash)
+		srv.blossom.mirrorMu.Lock()
+		defer srv.blossom.mirrorMu.Unlock()
+		return found && len(srv.blossom.mirroring) == 0
+	}
+	if !waitUntil(t, mirrored) {
+		t.Fatal("Expected the blob to be mirrored")
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("Expected the blob to be fetched once, got %d", n)
+	}
+}
+
+func TestBlossomDoesntMirrorForAuthorsWhoCantUpload(t *testing.T) {
+	sum := sha256.Sum256(testPNG)
+	hash := hex.EncodeToString(sum[:])
+	var fetches atomic.Int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer peer.Close()
+	peerURL := "ws" + strings.TrimPrefix(peer.URL, "http")
+
+	banned := nostr.GeneratePrivateKey()
+	bannedPubKey, _ := nostr.GetPublicKey(banned)
+	open := newTestServer(t, &Config{Blossom: Blossom{Enabled: true, MirrorPeers: true}})
+	if err := open.moderation.store.BanPubKey(bannedPubKey, "spam", "test"); err != nil {
+		t.Fatalf("Failed to ban pubkey: %v", err)
+	}
+	members := newTestServer(t, &Config{
+		Blossom:           Blossom{Enabled: true, MirrorPeers: true},
+		MembershipEnabled: true,
+	})
+
+	cases := []struct {
+		name string
+		srv  *Server
+		sk   string
+	}{
+		{"banned author", open, banned},
+		{"non-member", members, nostr.GeneratePrivateKey()},
+	}
+	for _, c := range cases {
+		event := signedEvent(t, c.sk, 1)
+		event.Content = "Look " + peer.URL + "/" + hash + ".png"
+		c.srv.blossom.onIncomingEvent(peerURL, event)
+
+		c.srv.blossom.mirrorMu.Lock()
+		queued := len(c.srv.blossom.mirroring)
+		c.srv.blossom.mirrorMu.Unlock()
+		if queued != 0 {
+			t.Errorf("%s: expected nothing to be queued, got %d blobs", c.name, queued)
+		}
+
+		// A job queued before the author was banned is dropped too
+		ref := blossom.References(event)[0]
+		c.srv.blossom.mirror(context.Background(), ref, event.PubKey)
+		if _, found, _ := c.srv.blossom.store.Get(hash); found {
+			t.Errorf("%s: expected the blob not to be mirrored", c.name)
+		}
+	}
+	if n := fetches.Load(); n != 0 {
+		t.Errorf("Expected no fetches, got %d", n)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// clientTracker keeps the websocket connections that are open, for admins
+// to see who is connected.
+type clientTracker struct {
+	mu      sync.Mutex
+	clients map[*khatru.WebSocket]trackedClient
+}
+
+type trackedClient struct {
+	ctx         context.Context
+	connectedAt time.Time
+}
+
+// ClientStatus is a connected client as the admin API shows it. PubKey is
+// set once the client has authenticated.
+type ClientStatus struct {
+	IP          string    `json:"ip"`
+	PubKey      string    `json:"pubkey,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+func newClientTracker() *clientTracker {
+	return &clientTracker{clients: make(map[*khatru.WebSocket]trackedClient)}
+}
+
+func (t *clientTracker) onConnect(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+	t.mu.Lock()
+	t.clients[ws] = trackedClient{ctx: ctx, connectedAt: time.Now()}
+	t.mu.Unlock()
+}
+
+func (t *clientTracker) onDisconnect(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.clients, ws)
+	t.mu.Unlock()
+}
+
+// list returns the connected clients, longest connected first.
+func (t *clientTracker) list() []ClientStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	clients := make([]ClientStatus, 0, len(t.clients))
+	for ws, client := range t.clients {
+		clients = append(clients, ClientStatus{
+			IP:          khatru.GetIP(client.ctx),
+			PubKey:      khatru.GetAuthed(client.ctx),
+			UserAgent:   ws.Request.UserAgent(),
+			ConnectedAt: client.connectedAt,
+		})
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+	})
+	return clients
+}
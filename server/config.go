@@ -0,0 +1,330 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.crom/crbroughton/townsquares-relay/ratelimit"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+type Config struct {
+	Port              string   `json:"port"`
+	Name              string   `json:"name"`
+	PubKey            string   `json:"pubkey"`
+	Description       string   `json:"description"`
+	Relays            []string `json:"relays"`
+	DBPath            string   `json:"db_path"`
+	TailscaleEnabled  bool     `json:"tailscale_enabled,omitempty"`
+	TailscaleAuthKey  string   `json:"tailscale_auth_key,omitempty"`
+	TailscaleHostname string   `json:"tailscale_hostname,omitempty"`
+	TailscaleHTTPS    bool     `json:"tailscale_https,omitempty"`
+	TailscaleStateDir string   `json:"tailscale_state_dir,omitempty"`
+	Geohashes         []string `json:"geohashes,omitempty"`
+	GeohashPolicy     string   `json:"geohash_policy,omitempty"`
+	GeohashFederation string   `json:"geohash_federation,omitempty"`
+	// Contact, Icon, Banner and PostingPolicy are published in the relay's
+	// NIP-11 document. Icon and Banner may be relative to the relay's URL.
+	Contact       string `json:"contact,omitempty"`
+	Icon          string `json:"icon,omitempty"`
+	Banner        string `json:"banner,omitempty"`
+	PostingPolicy string `json:"posting_policy,omitempty"`
+	// Software and Version describe what the relay runs, this project
+	// unless set
+	Software string `json:"software,omitempty"`
+	Version  string `json:"version,omitempty"`
+	// Limitation limits queries and messages, and is advertised in NIP-11
+	// along with limits set by other policies
+	Limitation Limitation `json:"limitation,omitzero"`
+	// TemplatesDir holds templates that replace the built-in ones of the
+	// same name, such as landing.html for the page served at the root URL
+	TemplatesDir string `json:"templates_dir,omitempty"`
+	// WebClientEnabled serves a small web client under /app for members
+	// without a nostr client of their own
+	WebClientEnabled bool `json:"web_client_enabled,omitempty"`
+	// DBBackend is the eventstore backend events are kept in, badger by
+	// default, and DBSettings tune it
+	DBBackend  string           `json:"db_backend,omitempty"`
+	DBSettings storage.Settings `json:"db_settings,omitzero"`
+	// SearchEnabled answers NIP-50 search queries from a full-text index
+	// kept in SearchIndex
+	SearchEnabled bool   `json:"search_enabled,omitempty"`
+	SearchIndex   string `json:"search_index,omitempty"`
+	// RelaySecretKey signs the relay's own events, like group metadata and
+	// moderation lists
+	RelaySecretKey string `json:"relay_secret_key,omitempty"`
+	// GroupsEnabled turns on NIP-29 groups. GroupCreators limits who may
+	// create groups.
+	GroupsEnabled bool     `json:"groups_enabled,omitempty"`
+	GroupCreators []string `json:"group_creators,omitempty"`
+	// AdminPubKeys may use the admin API. With MembershipEnabled only
+	// members and admins can publish, and members are kept in MembersFile.
+	AdminPubKeys      []string `json:"admin_pubkeys,omitempty"`
+	MembershipEnabled bool     `json:"membership_enabled,omitempty"`
+	MembersFile       string   `json:"members_file,omitempty"`
+	// AdminToken lets tools and the admin dashboard use the admin API with
+	// a bearer token rather than a nostr key
+	AdminToken string `json:"admin_token,omitempty"`
+	// ModerationFile keeps bans and other management API decisions
+	ModerationFile string `json:"moderation_file,omitempty"`
+	// TrustedPeers share their ban and mute lists with us, which are only
+	// enforced with ApplyPeerBans
+	TrustedPeers  []TrustedPeer `json:"trusted_peers,omitempty"`
+	ApplyPeerBans bool          `json:"apply_peer_bans,omitempty"`
+	// WritePolicy limits what events are accepted, from clients and peers
+	WritePolicy WritePolicy `json:"write_policy,omitzero"`
+	// Retention deletes events once they are old enough, and honours NIP-40
+	// expiration
+	Retention Retention `json:"retention,omitzero"`
+	// Maintenance reclaims Badger's disk space after deletions
+	Maintenance Maintenance `json:"maintenance,omitzero"`
+	// Quota limits how much each pubkey can store
+	Quota Quota `json:"quota,omitzero"`
+	// Blossom serves media uploaded by members
+	Blossom Blossom `json:"blossom,omitzero"`
+	// PoW asks writers for NIP-13 proof of work
+	PoW PoWPolicy `json:"pow,omitzero"`
+	// RateLimits throttle clients, and limits left out aren't enforced
+	RateLimits RateLimits `json:"rate_limits,omitzero"`
+	// TrustedProxies are the addresses, or CIDR ranges, of the reverse
+	// proxies in front of the relay. X-Forwarded-* headers are ignored on
+	// requests from anywhere else.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	// Path and Hostname pick out this community when several share a listener
+	Path        string   `json:"path,omitempty"`
+	Hostname    string   `json:"hostname,omitempty"`
+	Communities []Config `json:"communities,omitempty"`
+}
+
+// Limitation holds the NIP-11 limits that aren't part of another policy.
+// Limits left at zero aren't enforced.
+type Limitation struct {
+	// MaxMessageLength is the largest websocket message accepted, in bytes
+	MaxMessageLength int `json:"max_message_length,omitempty"`
+	// MaxLimit caps the limit of a filter, and DefaultLimit is used for
+	// filters that don't give one
+	MaxLimit     int `json:"max_limit,omitempty"`
+	DefaultLimit int `json:"default_limit,omitempty"`
+}
+
+// TrustedPeer is a relay whose moderation lists we follow, identified by
+// the key it signs them with.
+type TrustedPeer struct {
+	URL    string `json:"url"`
+	PubKey string `json:"pubkey"`
+}
+
+// WritePolicy limits the events a relay accepts. Zero values are not
+// enforced, and the created_at limits are seconds either side of now.
+type WritePolicy struct {
+	AllowedKinds        []int `json:"allowed_kinds,omitempty"`
+	DeniedKinds         []int `json:"denied_kinds,omitempty"`
+	MaxContentLength    int   `json:"max_content_length,omitempty"`
+	MaxTags             int   `json:"max_tags,omitempty"`
+	MaxEventSize        int   `json:"max_event_size,omitempty"`
+	CreatedAtLowerLimit int64 `json:"created_at_lower_limit,omitempty"`
+	CreatedAtUpperLimit int64 `json:"created_at_upper_limit,omitempty"`
+}
+
+// Retention rules delete events matching their kinds and authors once they
+// are older than MaxAge. Rules without kinds or authors match any.
+type Retention struct {
+	Rules []RetentionRule `json:"rules,omitempty"`
+	// Interval is how often events are checked, hourly by default
+	Interval Duration `json:"interval,omitzero"`
+	// DryRun only logs what would be deleted
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+type RetentionRule struct {
+	Kinds   []int    `json:"kinds,omitempty"`
+	Authors []string `json:"authors,omitempty"`
+	MaxAge  Duration `json:"max_age"`
+}
+
+// Duration is a time.Duration written like "720h" in the config.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"24h\": %w", err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// Maintenance garbage collects Badger value logs every Interval, hourly by
+// default, and compacts the LSM tree too every CompactInterval, daily by
+// default. Value log files are rewritten once DiscardRatio of them is
+// stale.
+type Maintenance struct {
+	Interval        Duration `json:"interval,omitzero"`
+	CompactInterval Duration `json:"compact_interval,omitzero"`
+	DiscardRatio    float64  `json:"discard_ratio,omitempty"`
+	Disabled        bool     `json:"disabled,omitempty"`
+}
+
+// Quota limits the events and bytes each pubkey stores. In "reject" mode
+// writes over quota are refused, and in "evict" mode the pubkey's oldest
+// events are deleted to make room. Admins have no quota.
+type Quota struct {
+	MaxEvents int64  `json:"max_events,omitempty"`
+	MaxBytes  int64  `json:"max_bytes,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+}
+
+// Blossom is a BUD-01/02 media server for the community. Only members
+// and admins may upload when membership is enabled. Blobs of AllowedTypes
+// up to MaxSize bytes are accepted, and each pubkey may keep up to
+// MaxBytesPerUser bytes of them, unless it is an admin. With MirrorPeers,
+// blobs that events from peers link to on those peers are copied here.
+type Blossom struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Dir is where blobs are kept, next to the database by default
+	Dir string `json:"dir,omitempty"`
+	// PublicURL is where blobs are served from, worked out from each
+	// request by default
+	PublicURL       string   `json:"public_url,omitempty"`
+	MaxSize         int64    `json:"max_size,omitempty"`
+	MaxBytesPerUser int64    `json:"max_bytes_per_user,omitempty"`
+	AllowedTypes    []string `json:"allowed_types,omitempty"`
+	MirrorPeers     bool     `json:"mirror_peers,omitempty"`
+}
+
+// PoWPolicy sets the NIP-13 difficulty asked of writers. Kinds overrides
+// MinDifficulty for particular kinds, and events pulled from peers only
+// need FederatedDifficulty. Admins, and members with WaiveForMembers, never
+// need any.
+type PoWPolicy struct {
+	MinDifficulty       int         `json:"min_difficulty,omitempty"`
+	Kinds               map[int]int `json:"kinds,omitempty"`
+	FederatedDifficulty int         `json:"federated_difficulty,omitempty"`
+	WaiveForMembers     bool        `json:"waive_for_members,omitempty"`
+}
+
+// RateLimits are token buckets refilled at a rate per minute.
+type RateLimits struct {
+	ConnectionsPerIP  ratelimit.Limit `json:"connections_per_ip,omitzero"`
+	EventsPerPubKey   ratelimit.Limit `json:"events_per_pubkey,omitzero"`
+	REQsPerConnection ratelimit.Limit `json:"reqs_per_connection,omitzero"`
+	MaxFiltersPerREQ  int             `json:"max_filters_per_req,omitempty"`
+}
+
+// CommunityConfigs returns the config of every community to host. A config
+// without a "communities" list describes a single community.
+func (c *Config) CommunityConfigs() ([]*Config, error) {
+	if len(c.Communities) == 0 {
+		return []*Config{c}, nil
+	}
+
+	configs := make([]*Config, 0, len(c.Communities))
+	dbPaths := make(map[string]bool)
+	routes := make(map[string]bool)
+	for i := range c.Communities {
+		community := &c.Communities[i]
+		if len(community.Communities) > 0 {
+			return nil, fmt.Errorf("community %d: communities cannot be nested", i)
+		}
+
+		community.Path = normalisePath(community.Path)
+		if community.DBPath == "" {
+			return nil, fmt.Errorf("community %d: db_path is required when hosting several communities", i)
+		}
+		if dbPaths[community.DBPath] {
+			return nil, fmt.Errorf("community %d: db_path %q is used by another community", i, community.DBPath)
+		}
+		dbPaths[community.DBPath] = true
+
+		route := community.Hostname + community.Path
+		if routes[route] {
+			if route == "" {
+				return nil, fmt.Errorf("community %d: only one community can leave both path and hostname empty", i)
+			}
+			return nil, fmt.Errorf("community %d: %q is used by another community", i, route)
+		}
+		routes[route] = true
+
+		configs = append(configs, community)
+	}
+	return configs, nil
+}
+
+func normalisePath(path string) string {
+	path = strings.TrimSuffix(path, "/")
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// DatabasePath returns where the community's events are stored.
+func (c *Config) DatabasePath() string {
+	if c.DBPath == "" {
+		return "db"
+	}
+	return c.DBPath
+}
+
+// SearchIndexPath returns where the community's search index is kept,
+// which defaults to a directory next to its database.
+func (c *Config) SearchIndexPath() string {
+	if c.SearchIndex != "" {
+		return c.SearchIndex
+	}
+	return c.DatabasePath() + "-search"
+}
+
+// BlossomDirPath returns where the community's media is kept, which
+// defaults to a directory next to its database.
+func (c *Config) BlossomDirPath() string {
+	if c.Blossom.Dir != "" {
+		return c.Blossom.Dir
+	}
+	return c.DatabasePath() + "-media"
+}
+
+// MembersFilePath returns where the community's members and invites are
+// kept, which defaults to a file next to its database.
+func (c *Config) MembersFilePath() string {
+	if c.MembersFile != "" {
+		return c.MembersFile
+	}
+	return c.DatabasePath() + "-members.json"
+}
+
+// ModerationFilePath returns where the community's moderation decisions
+// are kept, which defaults to a file next to its database.
+func (c *Config) ModerationFilePath() string {
+	if c.ModerationFile != "" {
+		return c.ModerationFile
+	}
+	return c.DatabasePath() + "-moderation.json"
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	return &config, nil
+}
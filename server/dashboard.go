@@ -0,0 +1,111 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.crom/crbroughton/townsquares-relay/dashboard"
+	"github.crom/crbroughton/townsquares-relay/moderation"
+)
+
+// dashboardPolicy keeps the admin dashboard to its own files and the
+// relay's API.
+const dashboardPolicy = "default-src 'self'; connect-src 'self'; img-src 'self' data:; " +
+	"base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+
+// redacted replaces secrets in the config, so it can be shown to admins.
+const redacted = "(redacted)"
+
+// Dashboard is everything the admin dashboard shows, fetched in one
+// request so admins signing with an extension only sign once per refresh.
+type Dashboard struct {
+	Peers      []PeerStatus        `json:"peers"`
+	Clients    []ClientStatus      `json:"clients"`
+	EventRates []KindRate          `json:"event_rates"`
+	Reports    []moderation.Report `json:"reports"`
+	Bans       []moderation.Listed `json:"bans"`
+	Storage    StorageStatus       `json:"storage"`
+	Config     Config              `json:"config"`
+}
+
+// redactConfig returns a copy of config with its secrets replaced.
+func redactConfig(config Config) Config {
+	for _, secret := range []*string{&config.TailscaleAuthKey, &config.RelaySecretKey, &config.AdminToken} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	if len(config.Communities) > 0 {
+		communities := make([]Config, len(config.Communities))
+		for i, community := range config.Communities {
+			communities[i] = redactConfig(community)
+		}
+		config.Communities = communities
+	}
+	return config
+}
+
+func (s *Server) dashboardStatus() (Dashboard, error) {
+	reports, err := s.moderation.store.Reports(false)
+	if err != nil {
+		return Dashboard{}, err
+	}
+	bans, err := s.moderation.store.BannedPubKeys()
+	if err != nil {
+		return Dashboard{}, err
+	}
+	// The rest of the status is still worth showing without disk sizes
+	storage, err := s.storageStatus()
+	if err != nil {
+		log.Printf("Failed to measure storage: %v", err)
+	}
+
+	return Dashboard{
+		Peers:      s.peerStatuses(),
+		Clients:    s.clients.list(),
+		EventRates: s.rates.rates(time.Now()),
+		Reports:    reports,
+		Bans:       bans,
+		Storage:    storage,
+		Config:     redactConfig(*s.config),
+	}, nil
+}
+
+// registerDashboardAPI exposes what the relay is doing through the admin
+// API: connected clients, event rates and the config it runs with.
+func (s *Server) registerDashboardAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/clients", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		writeJSON(w, http.StatusOK, s.clients.list())
+	}))
+	mux.HandleFunc("GET /api/event-rates", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		writeJSON(w, http.StatusOK, s.rates.rates(time.Now()))
+	}))
+	mux.HandleFunc("GET /api/config", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		writeJSON(w, http.StatusOK, redactConfig(*s.config))
+	}))
+	mux.HandleFunc("GET /api/dashboard", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		status, err := s.dashboardStatus()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	}))
+}
+
+// registerDashboard serves the admin dashboard under /admin. Its files are
+// public, and everything it shows comes from the admin API.
+func (s *Server) registerDashboard(mux *http.ServeMux) {
+	files := http.StripPrefix("/admin", http.FileServerFS(dashboard.Files()))
+	mux.HandleFunc("GET /admin/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", dashboardPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		files.ServeHTTP(w, r)
+	})
+	// Left relative so it works under a community's path, as for /app
+	mux.HandleFunc("GET /admin", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "admin/")
+		w.WriteHeader(http.StatusMovedPermanently)
+	})
+}
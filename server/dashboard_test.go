@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/manager"
+)
+
+func adminCall(t *testing.T, srv *Server, method, url, auth string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, url, nil)
+	req.Header.Set("Authorization", auth)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func waitUntil(t *testing.T, condition func() bool) bool {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestAdminToken(t *testing.T) {
+	srv := newTestServer(t, &Config{AdminToken: "s3cret", RelaySecretKey: nostr.GeneratePrivateKey()})
+
+	rec := adminCall(t, srv, http.MethodGet, "http://relay.example/api/dashboard", "Bearer wrong")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong token to be refused, got %d", rec.Code)
+	}
+
+	rec = adminCall(t, srv, http.MethodGet, "http://relay.example/api/dashboard", "Bearer s3cret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var status Dashboard
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to decode dashboard: %v", err)
+	}
+	if status.Config.AdminToken != redacted || status.Config.RelaySecretKey != redacted {
+		t.Errorf("Expected secrets to be redacted, got %q and %q", status.Config.AdminToken, status.Config.RelaySecretKey)
+	}
+	if srv.config.AdminToken != "s3cret" {
+		t.Error("Expected the running config to keep its token")
+	}
+
+	noToken := newTestServer(t, &Config{})
+	if rec := adminCall(t, noToken, http.MethodGet, "http://relay.example/api/dashboard", "Bearer "); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an empty token to be refused, got %d", rec.Code)
+	}
+}
+
+func TestPeersAPI(t *testing.T) {
+	transport := manager.NewMemoryTransport()
+	transport.Relay("wss://north.example")
+	transport.Relay("wss://south.example")
+
+	srv := newTestServer(t, &Config{AdminToken: "s3cret", Relays: []string{"wss://north.example"}})
+	srv.Manager.SetTransport(transport)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv.Start(ctx)
+
+	connected := func(want ...string) func() bool {
+		return func() bool {
+			var urls []string
+			for _, peer := range srv.Manager.Peers() {
+				urls = append(urls, peer.URL)
+			}
+			return slices.Equal(urls, want)
+		}
+	}
+	if !waitUntil(t, connected("wss://north.example")) {
+		t.Fatalf("Expected the configured peer to be connected, got %v", srv.Manager.Peers())
+	}
+
+	if rec := adminCall(t, srv, http.MethodPut, "http://relay.example/api/peers?url=ftp://east.example", "Bearer s3cret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a URL the manager can't dial to be refused, got %d", rec.Code)
+	}
+	if rec := adminCall(t, srv, http.MethodPut, "http://relay.example/api/peers?url=wss://south.example", "Bearer s3cret"); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected the peer to be added, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := adminCall(t, srv, http.MethodDelete, "http://relay.example/api/peers?url=wss://north.example", "Bearer s3cret"); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected the peer to be removed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !waitUntil(t, connected("wss://south.example")) {
+		t.Fatalf("Expected only the added peer to be connected, got %v", srv.Manager.Peers())
+	}
+
+	rec := adminCall(t, srv, http.MethodGet, "http://relay.example/api/peers", "Bearer s3cret")
+	var peers []PeerStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &peers); err != nil {
+		t.Fatalf("Failed to decode peers: %v", err)
+	}
+	if len(peers) != 1 || peers[0].URL != "wss://south.example" || !peers[0].Active || peers[0].Configured {
+		t.Errorf("Expected the added peer alone, got %+v", peers)
+	}
+}
+
+func TestBansAPI(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	srv := newTestServer(t, &Config{AdminPubKeys: []string{admin}})
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	url := "http://relay.example/api/bans/" + pubkey + "?reason=spam"
+	if rec := adminCall(t, srv, http.MethodPut, url, nip98Header(t, adminKey, http.MethodPut, url, nil)); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected the pubkey to be banned, got %d: %s", rec.Code, rec.Body.String())
+	}
+	ban, banned := srv.moderation.store.PubKeyBan(pubkey)
+	if !banned || ban.Reason != "spam" || ban.By != admin {
+		t.Errorf("Expected a ban for spam by the admin, got %+v", ban)
+	}
+
+	url = "http://relay.example/api/bans/" + pubkey
+	for i, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		auth := nip98HeaderAt(t, adminKey, http.MethodDelete, url, nil, nostr.Now()-nostr.Timestamp(i))
+		if rec := adminCall(t, srv, http.MethodDelete, url, auth); rec.Code != want {
+			t.Errorf("Expected status %d, got %d", want, rec.Code)
+		}
+	}
+
+	url = "http://relay.example/api/bans/not-a-pubkey"
+	if rec := adminCall(t, srv, http.MethodPut, url, nip98Header(t, adminKey, http.MethodPut, url, nil)); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid pubkey to be refused, got %d", rec.Code)
+	}
+}
+
+func TestConnectedClientsAreListed(t *testing.T) {
+	srv := newTestServer(t, &Config{AdminToken: "s3cret"})
+	httpServer := httptest.NewServer(srv)
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := nostr.RelayConnect(ctx, "ws"+strings.TrimPrefix(httpServer.URL, "http"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := client.Publish(ctx, *signedEvent(t, nostr.GeneratePrivateKey(), 1)); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	clients := srv.clients.list()
+	if len(clients) != 1 || clients[0].IP == "" {
+		t.Errorf("Expected one connected client, got %+v", clients)
+	}
+	if rates := srv.rates.rates(time.Now()); len(rates) != 1 || rates[0].Kind != 1 || rates[0].LastMinute != 1 {
+		t.Errorf("Expected the note to be counted, got %+v", rates)
+	}
+
+	client.Close()
+	if !waitUntil(t, func() bool { return len(srv.clients.list()) == 0 }) {
+		t.Errorf("Expected the client to be gone after disconnecting, got %+v", srv.clients.list())
+	}
+}
+
+func TestEventRates(t *testing.T) {
+	rates := newEventRates()
+	now := time.Now()
+
+	rates.record(1, false, now.Add(-2*time.Hour))
+	rates.record(1, false, now.Add(-30*time.Minute))
+	rates.record(1, true, now.Add(-10*time.Second))
+	rates.record(7, false, now)
+	rates.record(7, false, now)
+	rates.record(7, true, now)
+
+	want := []KindRate{
+		{Kind: 7, LastMinute: 3, LastHour: 3, FromPeers: 1},
+		{Kind: 1, LastMinute: 1, LastHour: 2, FromPeers: 1},
+	}
+	if got := rates.rates(now); !slices.Equal(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestDashboardIsServed(t *testing.T) {
+	srv := newTestServer(t, &Config{AdminToken: "s3cret"})
+
+	rec := getPage(t, srv, "http://relay.example/admin/")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `src="admin.js"`) {
+		t.Fatalf("Expected the dashboard, got %d", rec.Code)
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "connect-src 'self'") {
+		t.Errorf("Expected a content security policy, got %q", csp)
+	}
+	rec = getPage(t, srv, "http://relay.example/admin")
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "admin/" {
+		t.Errorf("Expected a relative redirect to admin/, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// Without admins nobody could use it
+	if rec := getPage(t, newTestServer(t, &Config{}), "http://relay.example/admin/"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", rec.Code)
+	}
+}
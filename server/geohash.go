@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/geohash"
+)
+
+// What happens to events tagged outside the community's area.
+const (
+	GeohashPolicyAccept     = "accept"
+	GeohashPolicyReject     = "reject"
+	GeohashPolicyQuarantine = "quarantine"
+)
+
+// Which events are exchanged with peer relays.
+const (
+	GeohashFederationAll        = "all"
+	GeohashFederationNeighbours = "neighbours"
+)
+
+type geohashPolicy struct {
+	area           geohash.Area
+	federationArea geohash.Area
+	policy         string
+	federation     string
+}
+
+func newGeohashPolicy(config *Config) (*geohashPolicy, error) {
+	area, err := geohash.NewArea(config.Geohashes)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &geohashPolicy{
+		area:       area,
+		policy:     config.GeohashPolicy,
+		federation: config.GeohashFederation,
+	}
+	if p.policy == "" {
+		p.policy = GeohashPolicyAccept
+	}
+	if p.federation == "" {
+		p.federation = GeohashFederationAll
+	}
+
+	switch p.policy {
+	case GeohashPolicyAccept, GeohashPolicyReject, GeohashPolicyQuarantine:
+	default:
+		return nil, fmt.Errorf("unknown geohash_policy %q", p.policy)
+	}
+	switch p.federation {
+	case GeohashFederationAll:
+	case GeohashFederationNeighbours:
+		p.federationArea = area.WithNeighbours()
+	default:
+		return nil, fmt.Errorf("unknown geohash_federation %q", p.federation)
+	}
+
+	if len(area) == 0 && (p.policy != GeohashPolicyAccept || p.federation != GeohashFederationAll) {
+		return nil, fmt.Errorf("geohash_policy and geohash_federation need at least one entry in geohashes")
+	}
+
+	return p, nil
+}
+
+func (p *geohashPolicy) rejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if p.policy == GeohashPolicyReject && !p.area.ContainsEvent(event) {
+		return true, "blocked: this relay only accepts events tagged inside its community area"
+	}
+	return false, ""
+}
+
+// visible reports whether an event may be served to clients. Quarantined
+// events are kept in storage but hidden.
+func (p *geohashPolicy) visible(event *nostr.Event) bool {
+	return p.policy != GeohashPolicyQuarantine || p.area.ContainsEvent(event)
+}
+
+func (p *geohashPolicy) preventBroadcast(ws *khatru.WebSocket, event *nostr.Event) bool {
+	return !p.visible(event)
+}
+
+// federates reports whether an event may be exchanged with peer relays.
+func (p *geohashPolicy) federates(peerURL string, event *nostr.Event) bool {
+	if p.policy == GeohashPolicyReject && !p.area.ContainsEvent(event) {
+		return false
+	}
+	if p.federation == GeohashFederationNeighbours {
+		return p.federationArea.ContainsEvent(event)
+	}
+	return true
+}
+
+// geoQuery is a location constraint given as NIP-50 search extensions:
+// "geohash:<cell>" alone matches events tagged inside that cell, and adding
+// "radius:<km>" matches events within that distance of the cell's centre.
+type geoQuery struct {
+	cell   string
+	radius *geohash.Radius
+}
+
+func (q *geoQuery) matches(event *nostr.Event) bool {
+	if q.radius != nil {
+		return q.radius.ContainsEvent(event)
+	}
+	for _, cell := range geohash.EventCells(event) {
+		if geohash.Overlaps(q.cell, cell) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractGeoQuery pulls the location extensions out of a filter's search
+// string. Storage doesn't understand them, so the returned filter has them
+// removed and the caller checks the location itself.
+func extractGeoQuery(filter nostr.Filter) (nostr.Filter, *geoQuery, error) {
+	if filter.Search == "" {
+		return filter, nil, nil
+	}
+
+	var cell, km string
+	var rest []string
+	for _, term := range strings.Fields(filter.Search) {
+		if value, found := strings.CutPrefix(term, "geohash:"); found {
+			cell = value
+		} else if value, found := strings.CutPrefix(term, "radius:"); found {
+			km = value
+		} else {
+			rest = append(rest, term)
+		}
+	}
+
+	if cell == "" && km == "" {
+		return filter, nil, nil
+	}
+	if cell == "" {
+		return filter, nil, fmt.Errorf("invalid: radius needs a geohash to measure from")
+	}
+	if !geohash.Valid(cell) {
+		return filter, nil, fmt.Errorf("invalid: bad geohash %q", cell)
+	}
+
+	query := &geoQuery{cell: cell}
+	if km != "" {
+		radius, err := geohash.ParseRadius(cell + ":" + strings.TrimSuffix(km, "km"))
+		if err != nil {
+			return filter, nil, fmt.Errorf("invalid: %w", err)
+		}
+		query.radius = &radius
+	}
+
+	filter.Search = strings.Join(rest, " ")
+	return filter, query, nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func taggedEvent(hashes ...string) *nostr.Event {
+	event := &nostr.Event{Kind: nostr.KindTextNote}
+	for _, h := range hashes {
+		event.Tags = append(event.Tags, nostr.Tag{"g", h})
+	}
+	return event
+}
+
+func TestGeohashPolicyRejectsEventsOutsideTheArea(t *testing.T) {
+	policy, err := newGeohashPolicy(&Config{
+		Geohashes:     []string{"gcpvj"},
+		GeohashPolicy: GeohashPolicyReject,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if reject, _ := policy.rejectEvent(context.Background(), taggedEvent("gcpvjbm")); reject {
+		t.Error("Expected event inside the area to be accepted")
+	}
+	if reject, _ := policy.rejectEvent(context.Background(), taggedEvent("u4pru")); !reject {
+		t.Error("Expected event outside the area to be rejected")
+	}
+	if policy.federates("ws://peer", taggedEvent("u4pru")) {
+		t.Error("Expected rejected events not to be federated")
+	}
+}
+
+func TestGeohashPolicyQuarantineHidesEvents(t *testing.T) {
+	policy, err := newGeohashPolicy(&Config{
+		Geohashes:     []string{"gcpvj"},
+		GeohashPolicy: GeohashPolicyQuarantine,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if reject, _ := policy.rejectEvent(context.Background(), taggedEvent("u4pru")); reject {
+		t.Error("Expected quarantined event to be accepted for storage")
+	}
+	if policy.visible(taggedEvent("u4pru")) {
+		t.Error("Expected quarantined event to be hidden")
+	}
+	if !policy.visible(taggedEvent("gcpvj")) {
+		t.Error("Expected event inside the area to be visible")
+	}
+}
+
+func TestGeohashPolicyValidatesConfig(t *testing.T) {
+	if _, err := newGeohashPolicy(&Config{GeohashPolicy: GeohashPolicyReject}); err == nil {
+		t.Error("Expected reject policy without geohashes to fail")
+	}
+	if _, err := newGeohashPolicy(&Config{Geohashes: []string{"gcpvj"}, GeohashPolicy: "ignore"}); err == nil {
+		t.Error("Expected unknown policy to fail")
+	}
+	if _, err := newGeohashPolicy(&Config{}); err != nil {
+		t.Errorf("Expected empty config to be valid, got %v", err)
+	}
+}
+
+func TestExtractGeoQuery(t *testing.T) {
+	filter := nostr.Filter{
+		Kinds:  []int{nostr.KindTextNote},
+		Search: "lost cat geohash:gcpvj radius:5km",
+	}
+
+	stripped, geo, err := extractGeoQuery(filter)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if geo == nil || geo.radius == nil {
+		t.Fatal("Expected a radius query")
+	}
+	if stripped.Search != "lost cat" {
+		t.Errorf("Expected search terms to be kept, got %q", stripped.Search)
+	}
+	if !geo.matches(taggedEvent("gcpvjbm")) || geo.matches(taggedEvent("u4pru")) {
+		t.Error("Expected only nearby events to match")
+	}
+
+	_, cellOnly, err := extractGeoQuery(nostr.Filter{Search: "geohash:gcpvj"})
+	if err != nil || cellOnly == nil || cellOnly.radius != nil {
+		t.Fatal("Expected a cell query without a radius")
+	}
+	if !cellOnly.matches(taggedEvent("gcpvjbm")) || cellOnly.matches(taggedEvent()) {
+		t.Error("Expected only events tagged inside the cell to match")
+	}
+
+	if _, _, err := extractGeoQuery(nostr.Filter{Search: "radius:5"}); err == nil {
+		t.Error("Expected a radius without a geohash to fail")
+	}
+	if _, geo, _ := extractGeoQuery(nostr.Filter{Search: "bin collection"}); geo != nil {
+		t.Error("Expected plain searches to be left alone")
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.crom/crbroughton/townsquares-relay/groups"
+)
+
+// groupPolicy wires NIP-29 groups into the relay. Group content and state
+// are only exchanged with peers that host a group with the same id, which
+// they announce through their own relay-signed group metadata.
+type groupPolicy struct {
+	groups *groups.Manager
+
+	mu sync.RWMutex
+	// peerGroups records which groups each peer hosts
+	peerGroups map[string]map[string]bool
+}
+
+func newGroupPolicy(config *Config, store groups.Store) (*groupPolicy, error) {
+	if !config.GroupsEnabled {
+		return nil, nil
+	}
+	if config.RelaySecretKey == "" {
+		return nil, fmt.Errorf("relay_secret_key is required when groups_enabled is set")
+	}
+
+	manager, err := groups.NewManager(config.RelaySecretKey, config.GroupCreators, store)
+	if err != nil {
+		return nil, err
+	}
+	if err := manager.Load(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to load groups: %w", err)
+	}
+
+	return &groupPolicy{
+		groups:     manager,
+		peerGroups: make(map[string]map[string]bool),
+	}, nil
+}
+
+// rejectFilter asks for authentication before serving a private group to
+// someone who may not be a member.
+func (p *groupPolicy) rejectFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	pubkey := khatru.GetAuthed(ctx)
+	for _, id := range filter.Tags["h"] {
+		if p.groups.IsPrivate(id) && !p.groups.IsMember(id, pubkey) {
+			if pubkey == "" {
+				return true, "auth-required: this group is private"
+			}
+			return true, "restricted: this group is private"
+		}
+	}
+	return false, ""
+}
+
+func (p *groupPolicy) visible(ctx context.Context, event *nostr.Event) bool {
+	return p.groups.CanRead(khatru.GetAuthed(ctx), event)
+}
+
+func (p *groupPolicy) preventBroadcast(ws *khatru.WebSocket, event *nostr.Event) bool {
+	return !p.groups.CanRead(ws.AuthedPublicKey, event)
+}
+
+// federates only lets group events through to peers hosting the same
+// group. Group metadata from peers is never stored, but it is how we
+// learn which groups they host.
+func (p *groupPolicy) federates(peerURL string, event *nostr.Event) bool {
+	if nip29.MetadataEventKinds.Includes(event.Kind) {
+		if event.Kind == nostr.KindSimpleGroupMetadata && event.PubKey != p.groups.PublicKey {
+			p.recordPeerGroup(peerURL, event.Tags.GetD())
+		}
+		return false
+	}
+
+	id := groups.GroupID(event)
+	if id == "" {
+		return true
+	}
+	if !p.groups.Hosts(id) || !p.hostedBy(peerURL, id) {
+		return false
+	}
+	// Content is only exchanged for members, while state changes are
+	// checked in full once they arrive
+	return groups.IsStateEvent(event) || p.groups.IsMember(id, event.PubKey)
+}
+
+func (p *groupPolicy) recordPeerGroup(peerURL, id string) {
+	if id == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peerGroups[peerURL] == nil {
+		p.peerGroups[peerURL] = make(map[string]bool)
+	}
+	p.peerGroups[peerURL][id] = true
+}
+
+func (p *groupPolicy) hostedBy(peerURL, id string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.peerGroups[peerURL][id]
+}
+
+// subscriptionFilters asks peers for the groups they host and for events
+// in the groups we host.
+func (p *groupPolicy) subscriptionFilters() nostr.Filters {
+	filters := nostr.Filters{
+		{Kinds: []int{nostr.KindSimpleGroupMetadata}},
+	}
+	if ids := p.groups.GroupIDs(); len(ids) > 0 {
+		filters = append(filters, nostr.Filter{
+			Tags:  nostr.TagMap{"h": ids},
+			Limit: 100,
+		})
+	}
+	return filters
+}
+
+// onIncomingEvent applies group state changes made on a peer.
+func (p *groupPolicy) onIncomingEvent(sourceURL string, event *nostr.Event) {
+	p.groups.ApplyFederated(context.Background(), event)
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+//go:embed templates/*.html
+var builtinTemplates embed.FS
+
+// Limits on what the landing page shows.
+const (
+	landingNotes  = 20
+	landingEvents = 10
+)
+
+// NIP-52 calendar events.
+const (
+	kindDateEvent = 31922
+	kindTimeEvent = 31923
+)
+
+// loadTemplates parses the built-in templates, then any in dir, which
+// replace built-in templates with the same file name.
+func loadTemplates(dir string) (*template.Template, error) {
+	t, err := template.ParseFS(builtinTemplates, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return t, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no templates found in %s", dir)
+	}
+	if t, err = t.ParseFiles(files...); err != nil {
+		return nil, fmt.Errorf("failed to parse templates in %s: %w", dir, err)
+	}
+	return t, nil
+}
+
+// landingPage is what templates/landing.html is rendered with.
+type landingPage struct {
+	Name        string
+	Description string
+	Icon        string
+	Banner      string
+	Contact     string
+	Geohashes   []string
+	// RelayURL is the websocket URL clients connect to, and AppURL the
+	// web client's when it is enabled
+	RelayURL string
+	AppURL   string
+	Notes    []landingNote
+	Events   []calendarEvent
+	Peers    []PeerStatus
+}
+
+type landingNote struct {
+	Author    string
+	Content   string
+	CreatedAt time.Time
+}
+
+// calendarEvent is a NIP-52 event. All-day events have no time of day.
+type calendarEvent struct {
+	Title    string
+	Summary  string
+	Location string
+	Start    time.Time
+	AllDay   bool
+}
+
+// serveLanding renders the community's landing page at the root URL.
+func (s *Server) serveLanding(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	info := *s.Relay.Info
+	for _, overwrite := range s.Relay.OverwriteRelayInformation {
+		info = overwrite(r.Context(), r, info)
+	}
+
+	page := landingPage{
+		Name:        info.Name,
+		Description: info.Description,
+		Icon:        absoluteURL(r, info.Icon),
+		Banner:      absoluteURL(r, info.Banner),
+		Contact:     info.Contact,
+		Geohashes:   s.config.Geohashes,
+		RelayURL:    relayURL(r),
+		Notes:       s.recentNotes(r.Context()),
+		Events:      s.upcomingEvents(r.Context(), time.Now()),
+		Peers:       s.peerStatuses(),
+	}
+	if s.config.WebClientEnabled {
+		page.AppURL = communityURL(r).String() + "/app/"
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := s.templates.ExecuteTemplate(w, "landing.html", page); err != nil {
+		log.Printf("Error rendering landing page: %v", err)
+	}
+}
+
+// communityURL returns the URL of the community a request was for.
+func communityURL(r *http.Request) *url.URL {
+	u, err := url.Parse(requestURL(r))
+	if err != nil {
+		return &url.URL{}
+	}
+	u.RawQuery = ""
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, r.URL.Path), "/")
+	u.RawPath = ""
+	return u
+}
+
+// relayURL returns the websocket URL of the community a request was for.
+func relayURL(r *http.Request) string {
+	u := communityURL(r)
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	return u.String()
+}
+
+// recentNotes returns the newest notes clients would be shown, with their
+// authors' names where known.
+func (s *Server) recentNotes(ctx context.Context) []landingNote {
+	events := s.collect(ctx, nostr.Filter{Kinds: []int{nostr.KindTextNote}, Limit: landingNotes})
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].CreatedAt > events[j].CreatedAt
+	})
+	if len(events) > landingNotes {
+		events = events[:landingNotes]
+	}
+
+	authors := make([]string, 0, len(events))
+	for _, event := range events {
+		authors = append(authors, event.PubKey)
+	}
+	names := s.displayNames(ctx, authors)
+
+	notes := make([]landingNote, 0, len(events))
+	for _, event := range events {
+		notes = append(notes, landingNote{
+			Author:    names[event.PubKey],
+			Content:   event.Content,
+			CreatedAt: event.CreatedAt.Time(),
+		})
+	}
+	return notes
+}
+
+// displayNames maps pubkeys to the names in their profiles, falling back
+// to a shortened npub.
+func (s *Server) displayNames(ctx context.Context, pubkeys []string) map[string]string {
+	names := make(map[string]string, len(pubkeys))
+	for _, pubkey := range pubkeys {
+		if npub, err := nip19.EncodePublicKey(pubkey); err == nil {
+			names[pubkey] = npub[:12] + "…" + npub[len(npub)-4:]
+		}
+	}
+	if len(pubkeys) == 0 {
+		return names
+	}
+
+	for _, profile := range s.collect(ctx, nostr.Filter{Kinds: []int{nostr.KindProfileMetadata}, Authors: pubkeys}) {
+		var metadata struct {
+			Name        string `json:"name"`
+			DisplayName string `json:"display_name"`
+		}
+		if json.Unmarshal([]byte(profile.Content), &metadata) != nil {
+			continue
+		}
+		if metadata.DisplayName != "" {
+			names[profile.PubKey] = metadata.DisplayName
+		} else if metadata.Name != "" {
+			names[profile.PubKey] = metadata.Name
+		}
+	}
+	return names
+}
+
+// upcomingEvents returns the calendar events that haven't started yet,
+// soonest first. All-day events are shown until their day is over.
+func (s *Server) upcomingEvents(ctx context.Context, now time.Time) []calendarEvent {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	var upcoming []calendarEvent
+	for _, event := range s.collect(ctx, nostr.Filter{Kinds: []int{kindDateEvent, kindTimeEvent}}) {
+		calendar, ok := parseCalendarEvent(event)
+		if !ok {
+			continue
+		}
+		if calendar.AllDay && calendar.Start.Before(today) || !calendar.AllDay && calendar.Start.Before(now) {
+			continue
+		}
+		upcoming = append(upcoming, calendar)
+	}
+	sort.Slice(upcoming, func(i, j int) bool {
+		return upcoming[i].Start.Before(upcoming[j].Start)
+	})
+	if len(upcoming) > landingEvents {
+		upcoming = upcoming[:landingEvents]
+	}
+	return upcoming
+}
+
+func parseCalendarEvent(event *nostr.Event) (calendarEvent, bool) {
+	calendar := calendarEvent{Summary: event.Content}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "title":
+			calendar.Title = tag[1]
+		case "name":
+			// Used before NIP-52 settled on title
+			if calendar.Title == "" {
+				calendar.Title = tag[1]
+			}
+		case "summary":
+			calendar.Summary = tag[1]
+		case "location":
+			if calendar.Location == "" {
+				calendar.Location = tag[1]
+			}
+		}
+	}
+
+	start := event.Tags.Find("start")
+	if start == nil || calendar.Title == "" {
+		return calendar, false
+	}
+	if event.Kind == kindDateEvent {
+		day, err := time.Parse(time.DateOnly, start[1])
+		if err != nil {
+			return calendar, false
+		}
+		calendar.Start = day
+		calendar.AllDay = true
+		return calendar, true
+	}
+	at, err := strconv.ParseInt(start[1], 10, 64)
+	if err != nil {
+		return calendar, false
+	}
+	calendar.Start = time.Unix(at, 0).UTC()
+	return calendar, true
+}
+
+// collect runs a query as a client would see it.
+func (s *Server) collect(ctx context.Context, filter nostr.Filter) []*nostr.Event {
+	ch, err := s.queryEvents(ctx, filter)
+	if err != nil {
+		log.Printf("Error querying events for landing page: %v", err)
+		return nil
+	}
+	var events []*nostr.Event
+	for event := range ch {
+		events = append(events, event)
+	}
+	return events
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func getPage(t *testing.T, handler http.Handler, url string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func saveSigned(t *testing.T, srv *Server, sk string, event *nostr.Event) {
+	t.Helper()
+
+	if event.CreatedAt == 0 {
+		event.CreatedAt = nostr.Now()
+	}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	if err := srv.db.SaveEvent(context.Background(), event); err != nil {
+		t.Fatalf("Failed to save event: %v", err)
+	}
+}
+
+func TestLandingPage(t *testing.T) {
+	srv := newTestServer(t, &Config{
+		Name:        "Harbour",
+		Description: "Boats & neighbours",
+		Relays:      []string{"ws://lighthouse.example"},
+		Geohashes:   []string{"gcpvj"},
+	})
+
+	sk := nostr.GeneratePrivateKey()
+	saveSigned(t, srv, sk, &nostr.Event{Kind: 0, Content: `{"name":"harbourmaster"}`})
+	saveSigned(t, srv, sk, &nostr.Event{Kind: 1, Content: "Tide is out <b>early</b> today"})
+
+	tomorrow := time.Now().Add(24 * time.Hour)
+	saveSigned(t, srv, sk, &nostr.Event{Kind: kindTimeEvent, Tags: nostr.Tags{
+		{"d", "regatta"}, {"title", "Harbour regatta"}, {"location", "The quay"},
+		{"start", strconv.FormatInt(tomorrow.Unix(), 10)},
+	}})
+	saveSigned(t, srv, sk, &nostr.Event{Kind: kindDateEvent, Tags: nostr.Tags{
+		{"d", "fete"}, {"title", "Old summer fete"}, {"start", "2020-06-01"},
+	}})
+
+	rec := getPage(t, srv, "http://harbour.example/")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Expected HTML, got %q", ct)
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"Harbour",
+		"Boats &amp; neighbours",
+		"harbourmaster",
+		"Tide is out &lt;b&gt;early&lt;/b&gt; today",
+		"Harbour regatta",
+		"The quay",
+		"ws://harbour.example",
+		"ws://lighthouse.example",
+		"gcpvj",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected landing page to contain %q", want)
+		}
+	}
+	if strings.Contains(body, "Old summer fete") {
+		t.Error("Expected past events to be left out")
+	}
+}
+
+func TestLandingPageOnlyAtRoot(t *testing.T) {
+	srv := newTestServer(t, &Config{})
+
+	if rec := getPage(t, srv, "http://relay.example/missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", rec.Code)
+	}
+}
+
+func TestLandingPageUnderCommunityPath(t *testing.T) {
+	router := NewRouter(newTestServer(t, &Config{Name: "North", Path: "/north"}))
+
+	rec := getPage(t, router, "https://relay.example/north")
+	if !strings.Contains(rec.Body.String(), "wss://relay.example/north") {
+		t.Error("Expected the community's own relay URL")
+	}
+}
+
+func TestLandingPageTemplateOverride(t *testing.T) {
+	dir := t.TempDir()
+	template := `<h1>Welcome to {{.Name}}</h1>`
+	if err := os.WriteFile(filepath.Join(dir, "landing.html"), []byte(template), 0600); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+	srv := newTestServer(t, &Config{Name: "Harbour", TemplatesDir: dir})
+
+	if body := getPage(t, srv, "http://relay.example/").Body.String(); body != "<h1>Welcome to Harbour</h1>" {
+		t.Errorf("Expected the overriding template, got %q", body)
+	}
+}
+
+func TestLandingPageTemplateErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "landing.html"), []byte("{{.Name"), 0600); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+
+	if _, err := New(&Config{DBPath: filepath.Join(t.TempDir(), "db"), TemplatesDir: dir}); err == nil {
+		t.Error("Expected a broken template to be refused")
+	}
+	if _, err := New(&Config{DBPath: filepath.Join(t.TempDir(), "db"), TemplatesDir: t.TempDir()}); err == nil {
+		t.Error("Expected an empty templates directory to be refused")
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.crom/crbroughton/townsquares-relay/search"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+// storageSize reports the disk used by every community's database, keyed
+// by its path, for anything reading expvar.
+var storageSize = expvar.NewMap("storage_bytes")
+
+// maintenancePolicy schedules Badger's value log GC and compaction.
+type maintenancePolicy struct {
+	interval        time.Duration
+	compactInterval time.Duration
+	discardRatio    float64
+	disabled        bool
+
+	// mu keeps maintenance runs from overlapping, and guards last
+	mu          sync.Mutex
+	last        *storage.MaintenanceReport
+	lastCompact time.Time
+}
+
+func newMaintenancePolicy(config *Config) (*maintenancePolicy, error) {
+	maintenance := config.Maintenance
+	if maintenance.DiscardRatio < 0 || maintenance.DiscardRatio >= 1 {
+		return nil, fmt.Errorf("maintenance: discard_ratio must be between 0 and 1")
+	}
+	p := &maintenancePolicy{
+		interval:        maintenance.Interval.Duration,
+		compactInterval: maintenance.CompactInterval.Duration,
+		discardRatio:    maintenance.DiscardRatio,
+		disabled:        maintenance.Disabled,
+		lastCompact:     time.Now(),
+	}
+	if p.interval <= 0 {
+		p.interval = time.Hour
+	}
+	if p.compactInterval <= 0 {
+		p.compactInterval = 24 * time.Hour
+	}
+	return p, nil
+}
+
+// backend returns the storage under the quota counters and search index.
+func (s *Server) backend() *storage.DB {
+	if indexed, ok := s.db.Store.(*search.Store); ok {
+		return indexed.Store.(*storage.DB)
+	}
+	return s.db.Store.(*storage.DB)
+}
+
+// maintainStorage runs value log GC, compacting first when asked to or
+// when compaction is due.
+func (s *Server) maintainStorage(compact bool) (storage.MaintenanceReport, error) {
+	p := s.maintenance
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	compact = compact || time.Since(p.lastCompact) >= p.compactInterval
+	report, err := s.backend().Maintain(compact, p.discardRatio)
+	if err != nil {
+		return report, err
+	}
+	if compact {
+		p.lastCompact = report.At
+	}
+	p.last = &report
+
+	if reclaimed := report.Before.Total - report.After.Total; reclaimed > 0 {
+		log.Printf("Storage maintenance reclaimed %d bytes in %s", reclaimed, report.Took.Round(time.Millisecond))
+	}
+	return report, nil
+}
+
+// runMaintenance maintains storage on the configured interval until ctx
+// is cancelled.
+func (s *Server) runMaintenance(ctx context.Context) {
+	if s.maintenance.disabled {
+		return
+	}
+	ticker := time.NewTicker(s.maintenance.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := s.maintainStorage(false); err != nil {
+			log.Printf("Storage maintenance failed: %v", err)
+		}
+	}
+}
+
+// StorageStatus is what the storage API reports.
+type StorageStatus struct {
+	Backend         string                     `json:"backend"`
+	Path            string                     `json:"path"`
+	Size            storage.Size               `json:"size"`
+	LastMaintenance *storage.MaintenanceReport `json:"last_maintenance"`
+}
+
+func (s *Server) storageStatus() (StorageStatus, error) {
+	backend := s.backend()
+	size, err := backend.Size()
+
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+	return StorageStatus{
+		Backend:         backend.Backend,
+		Path:            backend.Path,
+		Size:            size,
+		LastMaintenance: s.maintenance.last,
+	}, err
+}
+
+// registerStorageAPI shows admins how much disk storage uses and lets
+// them run maintenance, compacting with ?compact=true. Sizes are also
+// published through expvar.
+func (s *Server) registerStorageAPI(mux *http.ServeMux) {
+	backend := s.backend()
+	storageSize.Set(backend.Path, expvar.Func(func() any {
+		size, _ := backend.Size()
+		return size
+	}))
+
+	mux.HandleFunc("GET /api/storage", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		status, err := s.storageStatus()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	}))
+	mux.HandleFunc("POST /api/storage/maintain", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		report, err := s.maintainStorage(r.URL.Query().Get("compact") == "true")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}))
+}
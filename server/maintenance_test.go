@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+func TestStorageMaintenance(t *testing.T) {
+	ctx := context.Background()
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	srv := newTestServer(t, &Config{AdminPubKeys: []string{admin}})
+
+	sk := nostr.GeneratePrivateKey()
+	for i := range 50 {
+		event := signedEvent(t, sk, 1, nostr.Tag{"i", string(rune('a' + i))})
+		srv.db.SaveEvent(ctx, event)
+		srv.db.DeleteEvent(ctx, event)
+	}
+
+	url := "http://relay.example/api/storage/maintain?compact=true"
+	req := httptest.NewRequest(http.MethodPost, url, nil)
+	req.Header.Set("Authorization", nip98Header(t, adminKey, http.MethodPost, url, nil))
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected maintenance to run, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	url = "http://relay.example/api/storage"
+	req = httptest.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", nip98Header(t, adminKey, http.MethodGet, url, nil))
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	var status StorageStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to decode storage status: %v", err)
+	}
+	if status.Backend != storage.Badger || status.Size.Total == 0 {
+		t.Errorf("Expected badger's size to be reported, got %+v", status)
+	}
+	if status.LastMaintenance == nil || !status.LastMaintenance.Compacted {
+		t.Errorf("Expected the compaction to be reported, got %+v", status.LastMaintenance)
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.crom/crbroughton/townsquares-relay/membership"
+	"github.crom/crbroughton/townsquares-relay/moderation"
+)
+
+type nip86MethodKey struct{}
+
+// checkNIP86 checks the authorization of a NIP-86 request for what
+// khatru's own handler doesn't: that it is a NIP-98 event, made within
+// authWindow of now, and not used before. It reports false once it has
+// refused the request.
+//
+// It also records the method in the request's context. khatru answers
+// listbannedevents by calling ListEventsNeedingModeration, so that function
+// needs to know which of the two was asked for.
+func (s *Server) checkNIP86(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/nostr+json+rpc" {
+		return r, true
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeNIP86Error(w, "failed to read request body")
+		return r, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	// khatru checks the u tag against the relay's URL
+	event, err := authorizationEvent(r)
+	if err == nil && !commitsTo(event, body) {
+		err = errors.New("authorization doesn't match the request body")
+	}
+	if err != nil {
+		writeNIP86Error(w, err.Error())
+		return r, false
+	}
+
+	var req nip86.Request
+	json.Unmarshal(body, &req)
+	// Only authorizations that could be accepted are remembered, so others
+	// can't fill up the list
+	allowed := s.isAdmin(event.PubKey) || s.moderation.store.CanCall(event.PubKey, req.Method)
+	if allowed && !s.usedAuth.use(event) {
+		writeNIP86Error(w, "authorization has already been used")
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), nip86MethodKey{}, req.Method)), true
+}
+
+func writeNIP86Error(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/nostr+json+rpc")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(nip86.Response{Error: message})
+}
+
+func nip86Method(ctx context.Context) string {
+	method, _ := ctx.Value(nip86MethodKey{}).(string)
+	return method
+}
+
+// rejectAPICall keeps NIP-86 management calls to the community's admins and
+// to pubkeys that were granted the method.
+func (s *Server) rejectAPICall(ctx context.Context, mp nip86.MethodParams) (bool, string) {
+	pubkey := khatru.GetAuthed(ctx)
+	if s.isAdmin(pubkey) {
+		return false, ""
+	}
+	if _, supported := mp.(nip86.SupportedMethods); !supported && s.moderation.store.CanCall(pubkey, mp.MethodName()) {
+		return false, ""
+	}
+	return true, "restricted: not an admin of this relay"
+}
+
+func toPubKeyReasons(listed []moderation.Listed) []nip86.PubKeyReason {
+	result := make([]nip86.PubKeyReason, 0, len(listed))
+	for _, l := range listed {
+		result = append(result, nip86.PubKeyReason{PubKey: l.Key, Reason: l.Reason})
+	}
+	return result
+}
+
+func toIDReasons(listed []moderation.Listed) []nip86.IDReason {
+	result := make([]nip86.IDReason, 0, len(listed))
+	for _, l := range listed {
+		result = append(result, nip86.IDReason{ID: l.Key, Reason: l.Reason})
+	}
+	return result
+}
+
+// setupManagementAPI implements the NIP-86 methods on top of the
+// moderation and membership stores.
+func (s *Server) setupManagementAPI() {
+	api := &s.Relay.ManagementAPI
+	store := s.moderation.store
+
+	api.RejectAPICall = append(api.RejectAPICall, s.rejectAPICall)
+
+	api.BanPubKey = func(ctx context.Context, pubkey string, reason string) error {
+		return s.banPubKey(ctx, pubkey, reason, khatru.GetAuthed(ctx))
+	}
+	api.ListBannedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+		banned, err := store.BannedPubKeys()
+		return toPubKeyReasons(banned), err
+	}
+	// Allowing a pubkey lifts any ban, and makes it a member if membership
+	// is enforced
+	api.AllowPubKey = func(ctx context.Context, pubkey string, reason string) error {
+		if _, err := s.unbanPubKey(ctx, pubkey); err != nil {
+			return err
+		}
+		if s.membership == nil {
+			return nil
+		}
+		err := s.membership.store.AddMember(pubkey, reason)
+		if errors.Is(err, membership.ErrAlreadyMember) {
+			return nil
+		}
+		return err
+	}
+	if s.membership != nil {
+		api.ListAllowedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+			members, err := s.membership.store.Members()
+			if err != nil {
+				return nil, err
+			}
+			result := make([]nip86.PubKeyReason, 0, len(members))
+			for _, member := range members {
+				reason := member.Reason
+				if member.Invite != "" {
+					reason = "invite " + member.Invite
+				}
+				result = append(result, nip86.PubKeyReason{PubKey: member.PubKey, Reason: reason})
+			}
+			return result, nil
+		}
+	}
+
+	api.BanEvent = func(ctx context.Context, id string, reason string) error {
+		if err := store.BanEvent(id, reason, khatru.GetAuthed(ctx)); err != nil {
+			return err
+		}
+		s.publishModerationLists(ctx)
+		return s.deleteEvent(ctx, id)
+	}
+	api.AllowEvent = func(ctx context.Context, id string, reason string) error {
+		if err := store.AllowEvent(id, reason, khatru.GetAuthed(ctx)); err != nil {
+			return err
+		}
+		s.publishModerationLists(ctx)
+		return nil
+	}
+	api.ListBannedEvents = func(ctx context.Context) ([]nip86.IDReason, error) {
+		banned, err := store.BannedEvents()
+		return toIDReasons(banned), err
+	}
+	api.ListEventsNeedingModeration = func(ctx context.Context) ([]nip86.IDReason, error) {
+		if nip86Method(ctx) == "listbannedevents" {
+			return api.ListBannedEvents(ctx)
+		}
+		reports, err := store.Reports(false)
+		if err != nil {
+			return nil, err
+		}
+		needing := []nip86.IDReason{}
+		seen := make(map[string]bool)
+		for _, report := range reports {
+			if report.Event != "" && !seen[report.Event] {
+				seen[report.Event] = true
+				needing = append(needing, nip86.IDReason{ID: report.Event, Reason: report.Type})
+			}
+		}
+		return needing, nil
+	}
+	api.ListAllowedEvents = func(ctx context.Context) ([]nip86.IDReason, error) {
+		allowed, err := store.AllowedEvents()
+		return toIDReasons(allowed), err
+	}
+
+	api.AllowKind = func(ctx context.Context, kind int) error {
+		return store.AllowKind(kind)
+	}
+	api.DisallowKind = func(ctx context.Context, kind int) error {
+		return store.DisallowKind(kind)
+	}
+	api.ListAllowedKinds = func(ctx context.Context) ([]int, error) {
+		return store.AllowedKinds()
+	}
+	api.ListDisAllowedKinds = func(ctx context.Context) ([]int, error) {
+		return store.DisallowedKinds()
+	}
+
+	api.BlockIP = func(ctx context.Context, ip net.IP, reason string) error {
+		return store.BlockIP(ip.String(), reason, khatru.GetAuthed(ctx))
+	}
+	api.UnblockIP = func(ctx context.Context, ip net.IP, reason string) error {
+		return store.UnblockIP(ip.String())
+	}
+	api.ListBlockedIPs = func(ctx context.Context) ([]nip86.IPReason, error) {
+		blocked, err := store.BlockedIPs()
+		result := make([]nip86.IPReason, 0, len(blocked))
+		for _, b := range blocked {
+			result = append(result, nip86.IPReason{IP: b.Key, Reason: b.Reason})
+		}
+		return result, err
+	}
+
+	api.ChangeRelayName = func(ctx context.Context, name string) error {
+		return store.UpdateRelayInfo(func(info *moderation.RelayInfo) { info.Name = name })
+	}
+	api.ChangeRelayDescription = func(ctx context.Context, desc string) error {
+		return store.UpdateRelayInfo(func(info *moderation.RelayInfo) { info.Description = desc })
+	}
+	api.ChangeRelayIcon = func(ctx context.Context, icon string) error {
+		return store.UpdateRelayInfo(func(info *moderation.RelayInfo) { info.Icon = icon })
+	}
+
+	api.GrantAdmin = func(ctx context.Context, pubkey string, methods []string) error {
+		return store.GrantAdmin(pubkey, methods)
+	}
+	api.RevokeAdmin = func(ctx context.Context, pubkey string, methods []string) error {
+		return store.RevokeAdmin(pubkey, methods)
+	}
+}
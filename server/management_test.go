@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// callNIP86 sends a management request signed by sk, as a NIP-86 client
+// would.
+func callNIP86(t *testing.T, srv *Server, sk string, method string, params ...any) nip86.Response {
+	t.Helper()
+
+	if params == nil {
+		params = []any{}
+	}
+	body, _ := json.Marshal(nip86.Request{Method: method, Params: params})
+
+	req := httptest.NewRequest(http.MethodPost, "http://relay.example/", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/nostr+json+rpc")
+	req.Header.Set("Authorization", nip98Header(t, sk, http.MethodPost, "https://relay.example", body))
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	var resp nip86.Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode %s response: %v", method, err)
+	}
+	return resp
+}
+
+func TestManagementAPIIsAdminOnly(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	srv := newTestServer(t, &Config{AdminPubKeys: []string{admin}})
+
+	resp := callNIP86(t, srv, nostr.GeneratePrivateKey(), "banpubkey", admin, "nope")
+	if !strings.HasPrefix(resp.Error, "restricted:") {
+		t.Errorf("Expected non-admin to be restricted, got %+v", resp)
+	}
+}
+
+func TestManagementAuthorizationsCantBeReplayed(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	srv := newTestServer(t, &Config{AdminPubKeys: []string{admin}})
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	body, _ := json.Marshal(nip86.Request{Method: "banpubkey", Params: []any{pubkey, "spam"}})
+
+	call := func(auth string) nip86.Response {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "http://relay.example/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/nostr+json+rpc")
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		var resp nip86.Response
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return resp
+	}
+
+	auth := nip98Header(t, adminKey, http.MethodPost, "https://relay.example", body)
+	if resp := call(auth); resp.Error != "" {
+		t.Fatalf("Expected the first call to succeed, got %q", resp.Error)
+	}
+	if resp := call(auth); resp.Error != "authorization has already been used" {
+		t.Errorf("Expected a replayed authorization to be refused, got %+v", resp)
+	}
+
+	future := nip98HeaderAt(t, adminKey, http.MethodPost, "https://relay.example", body, nostr.Now()+365*24*60*60)
+	if resp := call(future); resp.Error != "authorization event is in the future" {
+		t.Errorf("Expected a post-dated authorization to be refused, got %+v", resp)
+	}
+
+	note := &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"u", "https://relay.example"}, {"payload", sha256Hex(body)}}}
+	note.Sign(adminKey)
+	data, _ := json.Marshal(note)
+	if resp := call("Nostr " + base64.StdEncoding.EncodeToString(data)); resp.Error != "authorization event has the wrong kind" {
+		t.Errorf("Expected an event of another kind to be refused, got %+v", resp)
+	}
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func TestBannedPubKeysAreRejected(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	srv := newTestServer(t, &Config{AdminPubKeys: []string{admin}})
+
+	spammerKey := nostr.GeneratePrivateKey()
+	spammer, _ := nostr.GetPublicKey(spammerKey)
+	if resp := callNIP86(t, srv, adminKey, "banpubkey", spammer, "spam"); resp.Error != "" {
+		t.Fatalf("banpubkey failed: %s", resp.Error)
+	}
+
+	reject, msg := srv.moderation.rejectEvent(context.Background(), signedEvent(t, spammerKey, 1))
+	if !reject || msg != "blocked: pubkey is banned: spam" {
+		t.Errorf("Expected banned pubkey to be blocked, got %v %q", reject, msg)
+	}
+}
+
+func TestBannedEventsAreDeletedAndListed(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	srv := newTestServer(t, &Config{AdminPubKeys: []string{admin}})
+	ctx := context.Background()
+
+	event := signedEvent(t, nostr.GeneratePrivateKey(), 1)
+	if err := srv.db.SaveEvent(ctx, event); err != nil {
+		t.Fatalf("Failed to save event: %v", err)
+	}
+
+	if resp := callNIP86(t, srv, adminKey, "banevent", event.ID, "abuse"); resp.Error != "" {
+		t.Fatalf("banevent failed: %s", resp.Error)
+	}
+
+	ch, _ := srv.queryEvents(ctx, nostr.Filter{IDs: []string{event.ID}})
+	for range ch {
+		t.Error("Expected banned event to be gone")
+	}
+
+	resp := callNIP86(t, srv, adminKey, "listbannedevents")
+	banned, _ := json.Marshal(resp.Result)
+	if !strings.Contains(string(banned), event.ID) {
+		t.Errorf("Expected banned event to be listed, got %s", banned)
+	}
+}
+
+func TestDisallowedKindsAreRejected(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	srv := newTestServer(t, &Config{AdminPubKeys: []string{admin}})
+
+	if resp := callNIP86(t, srv, adminKey, "disallowkind", 4); resp.Error != "" {
+		t.Fatalf("disallowkind failed: %s", resp.Error)
+	}
+
+	if reject, _ := srv.moderation.rejectEvent(context.Background(), signedEvent(t, nostr.GeneratePrivateKey(), 4)); !reject {
+		t.Error("Expected disallowed kind to be rejected")
+	}
+	if reject, msg := srv.moderation.rejectEvent(context.Background(), signedEvent(t, nostr.GeneratePrivateKey(), 1)); reject {
+		t.Errorf("Expected other kinds to be accepted, got %q", msg)
+	}
+}
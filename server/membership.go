@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/membership"
+)
+
+// membershipPolicy only lets members and admins publish. New members join
+// by redeeming an invite code, either in a NIP-43 join request or by
+// connecting with ?invite=<code> and authenticating with NIP-42.
+type membershipPolicy struct {
+	store   *membership.Store
+	isAdmin func(pubkey string) bool
+}
+
+func newMembershipPolicy(config *Config, isAdmin func(string) bool) (*membershipPolicy, error) {
+	if !config.MembershipEnabled {
+		return nil, nil
+	}
+
+	store, err := membership.Open(config.MembersFilePath())
+	if err != nil {
+		return nil, err
+	}
+	return &membershipPolicy{store: store, isAdmin: isAdmin}, nil
+}
+
+func (p *membershipPolicy) isMember(pubkey string) bool {
+	return p.isAdmin(pubkey) || p.store.IsMember(pubkey)
+}
+
+func (p *membershipPolicy) rejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if event.Kind == membership.KindJoinRequest {
+		claim := event.Tags.Find("claim")
+		if claim == nil {
+			return true, "invalid: join request has no \"claim\" tag"
+		}
+		if p.isMember(event.PubKey) {
+			return true, "duplicate: already a member"
+		}
+		if err := p.store.CheckInvite(claim[1]); err != nil {
+			return true, "restricted: " + err.Error()
+		}
+		return false, ""
+	}
+
+	if p.isMember(event.PubKey) {
+		return false, ""
+	}
+
+	if inviteCode(ctx) != "" {
+		if khatru.GetAuthed(ctx) == "" {
+			return true, "auth-required: authenticate to redeem your invite"
+		}
+		if err := p.redeemConnectionInvite(ctx); err != nil {
+			return true, "restricted: " + err.Error()
+		}
+		if p.isMember(event.PubKey) {
+			return false, ""
+		}
+	}
+
+	return true, "restricted: only members can publish to this relay"
+}
+
+// rejectFilter never refuses a query, but redeems the invite of a
+// connection as soon as it has authenticated.
+func (p *membershipPolicy) rejectFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	if inviteCode(ctx) != "" && khatru.GetAuthed(ctx) != "" {
+		p.redeemConnectionInvite(ctx)
+	}
+	return false, ""
+}
+
+// onConnect asks connections carrying an invite to authenticate straight
+// away, so the invite is redeemed without waiting for them to publish.
+func (p *membershipPolicy) onConnect(ctx context.Context) {
+	if inviteCode(ctx) != "" {
+		khatru.RequestAuth(ctx)
+	}
+}
+
+// onEphemeralEvent redeems join requests once every other policy has
+// accepted them.
+func (p *membershipPolicy) onEphemeralEvent(ctx context.Context, event *nostr.Event) {
+	if event.Kind != membership.KindJoinRequest {
+		return
+	}
+	if err := p.store.Redeem(event.Tags.Find("claim")[1], event.PubKey); err != nil {
+		log.Printf("Failed to redeem invite for %s: %v", event.PubKey[:8], err)
+		return
+	}
+	log.Printf("New member %s joined with an invite", event.PubKey[:8])
+}
+
+// Join requests carry an invite code, so they are never shown to anyone.
+func (p *membershipPolicy) preventBroadcast(ws *khatru.WebSocket, event *nostr.Event) bool {
+	return event.Kind == membership.KindJoinRequest
+}
+
+func (p *membershipPolicy) redeemConnectionInvite(ctx context.Context) error {
+	pubkey := khatru.GetAuthed(ctx)
+	if p.isMember(pubkey) {
+		return nil
+	}
+	if err := p.store.Redeem(inviteCode(ctx), pubkey); err != nil {
+		return err
+	}
+	log.Printf("New member %s joined with an invite", pubkey[:8])
+	return nil
+}
+
+// inviteCode returns the invite a client connected with, if any.
+func inviteCode(ctx context.Context) string {
+	conn := khatru.GetConnection(ctx)
+	if conn == nil || conn.Request == nil {
+		return ""
+	}
+	return conn.Request.URL.Query().Get("invite")
+}
+
+// registerMembershipAPI exposes members and invites through the admin API.
+func (s *Server) registerMembershipAPI(mux *http.ServeMux) {
+	store := s.membership.store
+	mux.HandleFunc("GET /api/members", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		members, err := store.Members()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, members)
+	}))
+	mux.HandleFunc("DELETE /api/members/{pubkey}", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		if err := store.RemoveMember(r.PathValue("pubkey")); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("GET /api/invites", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		invites, err := store.Invites()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, invites)
+	}))
+	mux.HandleFunc("POST /api/invites", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		var req struct {
+			MaxUses   int `json:"max_uses"`
+			ExpiresIn int `json:"expires_in"`
+		}
+		req.MaxUses = 1
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+		}
+
+		invite, err := store.CreateInvite(req.MaxUses, time.Duration(req.ExpiresIn)*time.Second, admin)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, invite)
+	}))
+	mux.HandleFunc("DELETE /api/invites/{code}", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		if err := store.RevokeInvite(r.PathValue("code")); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/membership"
+)
+
+func newMembershipServer(t *testing.T, admins ...string) *Server {
+	t.Helper()
+
+	return newTestServer(t, &Config{
+		MembershipEnabled: true,
+		MembersFile:       filepath.Join(t.TempDir(), "members.json"),
+		AdminPubKeys:      admins,
+	})
+}
+
+func signedEvent(t *testing.T, sk string, kind int, tags ...nostr.Tag) *nostr.Event {
+	t.Helper()
+
+	event := &nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Tags: tags}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	return event
+}
+
+func TestOnlyMembersCanPublish(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	srv := newMembershipServer(t, admin)
+	ctx := context.Background()
+
+	if reject, msg := srv.membership.rejectEvent(ctx, signedEvent(t, nostr.GeneratePrivateKey(), 1)); !reject || !strings.HasPrefix(msg, "restricted:") {
+		t.Errorf("Expected non-member to be restricted, got %v %q", reject, msg)
+	}
+	if reject, msg := srv.membership.rejectEvent(ctx, signedEvent(t, adminKey, 1)); reject {
+		t.Errorf("Expected admin to be accepted, got %q", msg)
+	}
+}
+
+func TestJoinRequestRedeemsInvite(t *testing.T) {
+	srv := newMembershipServer(t)
+	ctx := context.Background()
+
+	invite, err := srv.membership.store.CreateInvite(1, 0, "test")
+	if err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+
+	userKey := nostr.GeneratePrivateKey()
+	join := signedEvent(t, userKey, membership.KindJoinRequest, nostr.Tag{"claim", invite.Code})
+	if reject, msg := srv.membership.rejectEvent(ctx, join); reject {
+		t.Fatalf("Expected join request to be accepted, got %q", msg)
+	}
+	srv.membership.onEphemeralEvent(ctx, join)
+
+	if reject, msg := srv.membership.rejectEvent(ctx, signedEvent(t, userKey, 1)); reject {
+		t.Errorf("Expected new member to be accepted, got %q", msg)
+	}
+
+	again := signedEvent(t, nostr.GeneratePrivateKey(), membership.KindJoinRequest, nostr.Tag{"claim", invite.Code})
+	if reject, msg := srv.membership.rejectEvent(ctx, again); !reject || !strings.HasPrefix(msg, "restricted:") {
+		t.Errorf("Expected used invite to be restricted, got %v %q", reject, msg)
+	}
+}
+
+func nip98Header(t *testing.T, sk, method, url string, body []byte) string {
+	t.Helper()
+	return nip98HeaderAt(t, sk, method, url, body, nostr.Now())
+}
+
+// nip98HeaderAt signs an authorization made at createdAt, which tells
+// apart authorizations for the same request made within a second.
+func nip98HeaderAt(t *testing.T, sk, method, url string, body []byte, createdAt nostr.Timestamp) string {
+	t.Helper()
+
+	tags := nostr.Tags{{"u", url}, {"method", method}}
+	if len(body) > 0 {
+		hash := sha256.Sum256(body)
+		tags = append(tags, nostr.Tag{"payload", hex.EncodeToString(hash[:])})
+	}
+	event := &nostr.Event{Kind: KindHTTPAuth, CreatedAt: createdAt, Tags: tags}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	data, _ := json.Marshal(event)
+	return "Nostr " + base64.StdEncoding.EncodeToString(data)
+}
+
+func TestAdminAPICreatesInvites(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	srv := newMembershipServer(t, admin)
+
+	body := []byte(`{"max_uses": 3}`)
+	url := "http://relay.example/api/invites"
+
+	req := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req.Header.Set("Authorization", nip98Header(t, nostr.GeneratePrivateKey(), http.MethodPost, url, body))
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected non-admin to be forbidden, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req.Header.Set("Authorization", nip98Header(t, adminKey, http.MethodPost, url, body))
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected invite to be created, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var invite membership.Invite
+	if err := json.Unmarshal(rec.Body.Bytes(), &invite); err != nil {
+		t.Fatalf("Failed to decode invite: %v", err)
+	}
+	if invite.MaxUses != 3 || invite.CreatedBy != admin {
+		t.Errorf("Expected invite for 3 uses by the admin, got %+v", invite)
+	}
+	if err := srv.membership.store.CheckInvite(invite.Code); err != nil {
+		t.Errorf("Expected invite to be usable, got %v", err)
+	}
+}
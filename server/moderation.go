@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.crom/crbroughton/townsquares-relay/moderation"
+)
+
+// moderationPolicy enforces the decisions admins make through the
+// management API.
+type moderationPolicy struct {
+	store *moderation.Store
+	lists *peerLists
+}
+
+func newModerationPolicy(config *Config) (*moderationPolicy, error) {
+	store, err := moderation.Open(config.ModerationFilePath())
+	if err != nil {
+		return nil, err
+	}
+	return &moderationPolicy{store: store, lists: newPeerLists(config, store)}, nil
+}
+
+func (p *moderationPolicy) rejectConnection(r *http.Request) bool {
+	_, blocked := p.store.IPBlock(khatru.GetIPFromRequest(r))
+	return blocked
+}
+
+func (p *moderationPolicy) rejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if ip := khatru.GetIP(ctx); ip != "" {
+		if _, blocked := p.store.IPBlock(ip); blocked {
+			return true, "blocked: your IP address is blocked"
+		}
+	}
+	if reject, msg := p.check(event); reject {
+		return true, msg
+	}
+	return p.checkReport(event)
+}
+
+// check applies the decisions that are about the event itself, which hold
+// for events from peers as well as from clients.
+func (p *moderationPolicy) check(event *nostr.Event) (bool, string) {
+	if ban, banned := p.store.PubKeyBan(event.PubKey); banned {
+		return true, withReason("blocked: pubkey is banned", ban.Reason)
+	}
+	if ban, banned := p.store.EventBan(event.ID); banned {
+		return true, withReason("blocked: event is banned", ban.Reason)
+	}
+	if !p.store.IsKindAllowed(event.Kind) {
+		return true, fmt.Sprintf("blocked: kind %d is not allowed", event.Kind)
+	}
+	return p.lists.block(event)
+}
+
+func withReason(msg, reason string) string {
+	if reason == "" {
+		return msg
+	}
+	return msg + ": " + reason
+}
+
+// visible hides banned and hidden events and everything from banned or
+// muted pubkeys, which stay in storage so a ban can be lifted.
+func (p *moderationPolicy) visible(event *nostr.Event) bool {
+	if _, banned := p.store.PubKeyBan(event.PubKey); banned {
+		return false
+	}
+	if _, muted := p.store.PubKeyMute(event.PubKey); muted {
+		return false
+	}
+	if _, banned := p.store.EventBan(event.ID); banned {
+		return false
+	}
+	if _, hidden := p.store.EventHidden(event.ID); hidden {
+		return false
+	}
+	if _, _, found := p.lists.find(moderation.BanListID, event); found {
+		return false
+	}
+	return !p.lists.muted(event)
+}
+
+// federates keeps refused, hidden and muted events from being exchanged
+// with peers.
+func (p *moderationPolicy) federates(peerURL string, event *nostr.Event) bool {
+	if reject, _ := p.check(event); reject {
+		return false
+	}
+	if _, hidden := p.store.EventHidden(event.ID); hidden {
+		return false
+	}
+	if _, muted := p.store.PubKeyMute(event.PubKey); muted {
+		return false
+	}
+	return !p.lists.muted(event)
+}
+
+// overwriteRelayInformation replaces the config's relay details with any
+// changed through the management API.
+func (p *moderationPolicy) overwriteRelayInformation(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+	changed := p.store.RelayInfo()
+	if changed.Name != "" {
+		info.Name = changed.Name
+	}
+	if changed.Description != "" {
+		info.Description = changed.Description
+	}
+	if changed.Icon != "" {
+		info.Icon = changed.Icon
+	}
+	return info
+}
+
+// deleteEvent removes a banned event from local storage.
+func (s *Server) deleteEvent(ctx context.Context, id string) error {
+	ch, err := s.db.QueryEvents(ctx, nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		return err
+	}
+	var found []*nostr.Event
+	for event := range ch {
+		found = append(found, event)
+	}
+	for _, event := range found {
+		if err := s.db.DeleteEvent(ctx, event); err != nil {
+			return err
+		}
+		log.Printf("Deleted banned event %s", id[:8])
+	}
+	return nil
+}
+
+// banPubKey bans a pubkey and shares the updated ban list with peers.
+func (s *Server) banPubKey(ctx context.Context, pubkey, reason, by string) error {
+	if err := s.moderation.store.BanPubKey(pubkey, reason, by); err != nil {
+		return err
+	}
+	s.publishModerationLists(ctx)
+	return nil
+}
+
+// unbanPubKey lifts a ban, reporting whether there was one.
+func (s *Server) unbanPubKey(ctx context.Context, pubkey string) (bool, error) {
+	banned, err := s.moderation.store.UnbanPubKey(pubkey)
+	if err != nil || !banned {
+		return banned, err
+	}
+	s.publishModerationLists(ctx)
+	return true, nil
+}
+
+// registerBansAPI lets admins ban and unban pubkeys, as NIP-86 does for
+// clients that support it.
+func (s *Server) registerBansAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/bans", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		banned, err := s.moderation.store.BannedPubKeys()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, banned)
+	}))
+	mux.HandleFunc("PUT /api/bans/{pubkey}", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		pubkey := r.PathValue("pubkey")
+		if !nostr.IsValidPublicKey(pubkey) {
+			writeError(w, http.StatusBadRequest, "invalid pubkey")
+			return
+		}
+		if err := s.banPubKey(r.Context(), pubkey, r.URL.Query().Get("reason"), admin); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("DELETE /api/bans/{pubkey}", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		banned, err := s.unbanPubKey(r.Context(), r.PathValue("pubkey"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !banned {
+			writeError(w, http.StatusNotFound, "pubkey is not banned")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
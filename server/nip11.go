@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// Software is published in NIP-11 as what the relay runs.
+const Software = "https://github.com/CRBroughton/townsquares-relay"
+
+// Version is the relay's version, reported by the CLI and in NIP-11.
+var Version = "1.0.0"
+
+// relayInformation is the NIP-11 document with the community's area added,
+// so clients and peers can tell where the community is.
+type relayInformation struct {
+	nip11.RelayInformationDocument
+	Geohashes []string `json:"geohashes,omitempty"`
+}
+
+// setupRelayInformation fills in the NIP-11 document from the config.
+// Limits set by other policies are already in place.
+func (s *Server) setupRelayInformation() {
+	info := s.Relay.Info
+	config := s.config
+	info.Name = config.Name
+	info.PubKey = config.PubKey
+	info.Description = config.Description
+	info.Contact = config.Contact
+	info.Icon = config.Icon
+	info.Banner = config.Banner
+	info.PostingPolicy = config.PostingPolicy
+
+	info.Software = Software
+	if config.Software != "" {
+		info.Software = config.Software
+	}
+	info.Version = Version
+	if config.Version != "" {
+		info.Version = config.Version
+	}
+
+	if limits := config.Limitation; limits.MaxMessageLength > 0 {
+		s.Relay.MaxMessageSize = int64(limits.MaxMessageLength)
+		s.limitation().MaxMessageLength = limits.MaxMessageLength
+	}
+	if config.Limitation.MaxLimit > 0 {
+		s.limitation().MaxLimit = config.Limitation.MaxLimit
+	}
+	if config.Limitation.DefaultLimit > 0 {
+		s.limitation().DefaultLimit = config.Limitation.DefaultLimit
+	}
+	if s.membership != nil || s.pow != nil {
+		s.limitation().RestrictedWrites = true
+	}
+
+	info.SupportedNIPs = s.supportedNIPs()
+}
+
+// supportedNIPs lists the NIPs the relay supports with the features its
+// config enables, in order.
+func (s *Server) supportedNIPs() []any {
+	// Reports, expiration, NIP-98 auth for the HTTP APIs and the management
+	// API are always available, as are the NIPs khatru handles itself
+	nips := []int{1, 11, 40, 42, 56, 70, 86, 98}
+	if len(s.Relay.DeleteEvent) > 0 {
+		nips = append(nips, 9)
+	}
+	if len(s.Relay.CountEvents) > 0 {
+		nips = append(nips, 45)
+	}
+	if s.Relay.Negentropy {
+		nips = append(nips, 77)
+	}
+	if s.pow != nil {
+		nips = append(nips, 13)
+	}
+	if s.groups != nil {
+		nips = append(nips, 29)
+	}
+	if s.search != nil {
+		nips = append(nips, 50)
+	}
+	slices.Sort(nips)
+
+	supported := make([]any, len(nips))
+	for i, nip := range nips {
+		supported[i] = nip
+	}
+	return supported
+}
+
+// serveRelayInformation answers NIP-11 requests in place of khatru, which
+// has no room for the community's area in its document.
+func (s *Server) serveRelayInformation(w http.ResponseWriter, r *http.Request) {
+	info := *s.Relay.Info
+	for _, overwrite := range s.Relay.OverwriteRelayInformation {
+		info = overwrite(r.Context(), r, info)
+	}
+	info.Icon = absoluteURL(r, info.Icon)
+	info.Banner = absoluteURL(r, info.Banner)
+
+	w.Header().Set("Content-Type", "application/nostr+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(relayInformation{
+		RelayInformationDocument: info,
+		Geohashes:                s.config.Geohashes,
+	})
+}
+
+// absoluteURL resolves a link relative to the relay's own URL.
+func absoluteURL(r *http.Request, link string) string {
+	if link == "" || strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://") {
+		return link
+	}
+	base := strings.TrimSuffix(requestURL(r), r.URL.RequestURI())
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(link, "/")
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func fetchRelayInformation(t *testing.T, srv *Server, url string) relayInformation {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept", "application/nostr+json")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("Expected CORS to allow any origin, got %q", origin)
+	}
+	var info relayInformation
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to decode NIP-11 response: %v", err)
+	}
+	return info
+}
+
+func TestRelayInformationFromConfig(t *testing.T) {
+	srv := newTestServer(t, &Config{
+		Name:          "Harbour",
+		Description:   "The harbour community",
+		Contact:       "mailto:admin@harbour.example",
+		Icon:          "/icon.png",
+		Banner:        "https://cdn.example/banner.jpg",
+		PostingPolicy: "https://harbour.example/rules",
+		Geohashes:     []string{"gcpvj"},
+		Limitation:    Limitation{MaxMessageLength: 65536, MaxLimit: 200, DefaultLimit: 50},
+	})
+
+	info := fetchRelayInformation(t, srv, "http://harbour.example:3334/")
+
+	if info.Name != "Harbour" || info.Description != "The harbour community" {
+		t.Errorf("Expected name and description from config, got %q and %q", info.Name, info.Description)
+	}
+	if info.Contact != "mailto:admin@harbour.example" {
+		t.Errorf("Expected contact from config, got %q", info.Contact)
+	}
+	if info.Icon != "http://harbour.example:3334/icon.png" {
+		t.Errorf("Expected icon resolved against the relay's URL, got %q", info.Icon)
+	}
+	if info.Banner != "https://cdn.example/banner.jpg" {
+		t.Errorf("Expected banner unchanged, got %q", info.Banner)
+	}
+	if info.PostingPolicy != "https://harbour.example/rules" {
+		t.Errorf("Expected posting policy from config, got %q", info.PostingPolicy)
+	}
+	if info.Software != Software || info.Version != Version {
+		t.Errorf("Expected software %s %s, got %s %s", Software, Version, info.Software, info.Version)
+	}
+	if !reflect.DeepEqual(info.Geohashes, []string{"gcpvj"}) {
+		t.Errorf("Expected geohashes [gcpvj], got %v", info.Geohashes)
+	}
+
+	limitation := info.Limitation
+	if limitation == nil {
+		t.Fatal("Expected limitation to be advertised")
+	}
+	if limitation.MaxMessageLength != 65536 || limitation.MaxLimit != 200 || limitation.DefaultLimit != 50 {
+		t.Errorf("Expected limits 65536, 200 and 50, got %d, %d and %d",
+			limitation.MaxMessageLength, limitation.MaxLimit, limitation.DefaultLimit)
+	}
+	if srv.Relay.MaxMessageSize != 65536 {
+		t.Errorf("Expected max message size 65536 to be enforced, got %d", srv.Relay.MaxMessageSize)
+	}
+}
+
+func TestRelayInformationSoftwareOverride(t *testing.T) {
+	srv := newTestServer(t, &Config{Software: "https://git.example/fork", Version: "1.2.3-harbour"})
+
+	info := fetchRelayInformation(t, srv, "http://relay.example/")
+	if info.Software != "https://git.example/fork" || info.Version != "1.2.3-harbour" {
+		t.Errorf("Expected software from config, got %s %s", info.Software, info.Version)
+	}
+}
+
+func TestSupportedNIPsFollowConfig(t *testing.T) {
+	plain := newTestServer(t, &Config{})
+	info := fetchRelayInformation(t, plain, "http://relay.example/")
+
+	var nips []int
+	for _, nip := range info.SupportedNIPs {
+		nips = append(nips, int(nip.(float64)))
+	}
+	if !slices.IsSorted(nips) || len(slices.Compact(slices.Clone(nips))) != len(nips) {
+		t.Errorf("Expected sorted NIPs without duplicates, got %v", nips)
+	}
+	for _, nip := range []int{1, 11, 40, 56, 86} {
+		if !slices.Contains(nips, nip) {
+			t.Errorf("Expected NIP-%d to be supported, got %v", nip, nips)
+		}
+	}
+	for _, nip := range []int{13, 29, 50} {
+		if slices.Contains(nips, nip) {
+			t.Errorf("Expected NIP-%d to be off by default, got %v", nip, nips)
+		}
+	}
+	if info.Limitation != nil && info.Limitation.RestrictedWrites {
+		t.Error("Expected writes to be unrestricted without membership or proof of work")
+	}
+
+	sk := nostr.GeneratePrivateKey()
+	featured := newTestServer(t, &Config{
+		RelaySecretKey: sk,
+		GroupsEnabled:  true,
+		SearchEnabled:  true,
+		PoW:            PoWPolicy{MinDifficulty: 8},
+	})
+	for _, nip := range []int{13, 29, 50} {
+		if !slices.Contains(featured.Relay.Info.SupportedNIPs, any(nip)) {
+			t.Errorf("Expected NIP-%d to be supported, got %v", nip, featured.Relay.Info.SupportedNIPs)
+		}
+	}
+	if !featured.Relay.Info.Limitation.RestrictedWrites {
+		t.Error("Expected proof of work to restrict writes")
+	}
+}
+
+func TestQueryLimitsFromConfig(t *testing.T) {
+	srv := newTestServer(t, &Config{Limitation: Limitation{MaxLimit: 3, DefaultLimit: 2}})
+	ctx := context.Background()
+
+	sk := nostr.GeneratePrivateKey()
+	for i := range 5 {
+		event := &nostr.Event{Kind: 1, Content: "note", CreatedAt: nostr.Timestamp(1700000000 + i)}
+		event.Sign(sk)
+		if err := srv.db.SaveEvent(ctx, event); err != nil {
+			t.Fatalf("Failed to save event: %v", err)
+		}
+	}
+
+	count := func(filter nostr.Filter) int {
+		ch, err := srv.queryEvents(ctx, filter)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		n := 0
+		for range ch {
+			n++
+		}
+		return n
+	}
+
+	if got := count(nostr.Filter{Kinds: []int{1}}); got != 2 {
+		t.Errorf("Expected the default limit of 2, got %d", got)
+	}
+	if got := count(nostr.Filter{Kinds: []int{1}, Limit: 100}); got != 3 {
+		t.Errorf("Expected the max limit of 3, got %d", got)
+	}
+	if got := count(nostr.Filter{Kinds: []int{1}, Limit: 1}); got != 1 {
+		t.Errorf("Expected a limit of 1, got %d", got)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindHTTPAuth is the NIP-98 event that authorises an HTTP request.
+const KindHTTPAuth = 27235
+
+// authWindow is how far either side of now an authorization event's
+// created_at may be.
+const authWindow = 60
+
+// authenticateNIP98 checks the NIP-98 Authorization header of r, returning
+// the event that authorises it. body is the request body the event must
+// commit to, if there is one.
+func authenticateNIP98(r *http.Request, body []byte) (*nostr.Event, error) {
+	event, err := authorizationEvent(r)
+	if err != nil {
+		return nil, err
+	}
+
+	u := event.Tags.Find("u")
+	if u == nil || strings.TrimSuffix(u[1], "/") != strings.TrimSuffix(requestURL(r), "/") {
+		return nil, errors.New("authorization is for a different URL")
+	}
+	method := event.Tags.Find("method")
+	if method == nil || !strings.EqualFold(method[1], r.Method) {
+		return nil, errors.New("authorization is for a different method")
+	}
+	if len(body) > 0 && !commitsTo(event, body) {
+		return nil, errors.New("authorization doesn't match the request body")
+	}
+
+	return event, nil
+}
+
+// authorizationEvent reads the event from r's NIP-98 Authorization header,
+// checking its kind, signature and that it was made within authWindow of
+// now, but not what it authorises.
+func authorizationEvent(r *http.Request) (*nostr.Event, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !found {
+		return nil, errors.New("missing Nostr authorization")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("invalid base64 in authorization")
+	}
+	var event nostr.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, errors.New("invalid authorization event")
+	}
+
+	if event.Kind != KindHTTPAuth {
+		return nil, errors.New("authorization event has the wrong kind")
+	}
+	if ok, _ := event.CheckSignature(); !ok {
+		return nil, errors.New("invalid authorization signature")
+	}
+	if delta := nostr.Now() - event.CreatedAt; delta > authWindow {
+		return nil, errors.New("authorization event is too old")
+	} else if delta < -authWindow {
+		return nil, errors.New("authorization event is in the future")
+	}
+	return &event, nil
+}
+
+// commitsTo reports whether an authorization event's payload tag is the
+// hash of body.
+func commitsTo(event *nostr.Event, body []byte) bool {
+	hash := sha256.Sum256(body)
+	payload := event.Tags.Find("payload")
+	return payload != nil && payload[1] == hex.EncodeToString(hash[:])
+}
+
+// usedAuthorizations remembers the authorization events that have been
+// used until they are too old to be accepted anyway, so that one seen by
+// someone else can't be replayed.
+type usedAuthorizations struct {
+	mu sync.Mutex
+	// expires is when each event ID can be forgotten
+	expires map[string]nostr.Timestamp
+}
+
+func newUsedAuthorizations() *usedAuthorizations {
+	return &usedAuthorizations{expires: make(map[string]nostr.Timestamp)}
+}
+
+// use records an authorization event as used, reporting false if it
+// already was.
+func (u *usedAuthorizations) use(event *nostr.Event) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := nostr.Now()
+	for id, expires := range u.expires {
+		if expires < now {
+			delete(u.expires, id)
+		}
+	}
+	if _, used := u.expires[event.ID]; used {
+		return false
+	}
+	u.expires[event.ID] = event.CreatedAt + authWindow
+	return true
+}
+
+// requestURL rebuilds the URL a client used, before any community prefix
+// was stripped. Forwarded headers are only left on requests from trusted
+// proxies by the time it is called.
+func requestURL(r *http.Request) string {
+	// Requests made through a proxy carry the whole URL
+	if u, err := url.Parse(r.RequestURI); err == nil && u.IsAbs() {
+		return r.RequestURI
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+	return scheme + "://" + host + r.RequestURI
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestNIP98AuthorizationCannotBeReplayed(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	srv := newTestServer(t, &Config{AdminPubKeys: []string{admin}})
+
+	url := "http://relay.example/api/bans"
+	auth := nip98Header(t, adminKey, http.MethodGet, url, nil)
+	if rec := adminCall(t, srv, http.MethodGet, url, auth); rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := adminCall(t, srv, http.MethodGet, url, auth); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a replayed authorization to be refused, got %d", rec.Code)
+	}
+}
+
+func TestForwardedHeadersNeedTrustedProxy(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+
+	// The event is signed for a URL the relay is only reachable at through
+	// the proxy
+	call := func(srv *Server, remoteAddr string) int {
+		t.Helper()
+
+		url := "https://relay.example/api/bans"
+		req := httptest.NewRequest(http.MethodGet, "/api/bans", nil)
+		req.Host = "10.0.0.2:3334"
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "relay.example")
+		req.Header.Set("Authorization", nip98Header(t, adminKey, http.MethodGet, url, nil))
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	untrusted := newTestServer(t, &Config{AdminPubKeys: []string{admin}})
+	if code := call(untrusted, "203.0.113.9:4000"); code != http.StatusUnauthorized {
+		t.Errorf("Expected forwarded headers from anyone to be ignored, got %d", code)
+	}
+
+	proxied := newTestServer(t, &Config{AdminPubKeys: []string{admin}, TrustedProxies: []string{"127.0.0.1", "10.0.0.0/8"}})
+	if code := call(proxied, "203.0.113.9:4000"); code != http.StatusUnauthorized {
+		t.Errorf("Expected forwarded headers from outside the proxies to be ignored, got %d", code)
+	}
+	if code := call(proxied, "10.1.2.3:4000"); code != http.StatusOK {
+		t.Errorf("Expected forwarded headers from a trusted proxy to be used, got %d", code)
+	}
+
+	if _, err := New(&Config{DBPath: t.TempDir() + "/db", TrustedProxies: []string{"proxy.example"}}); err == nil {
+		t.Error("Expected an invalid proxy address to be refused")
+	}
+}
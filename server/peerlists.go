@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/moderation"
+)
+
+// blockFlushInterval is how often blocked events are written to the audit
+// trail.
+const blockFlushInterval = time.Minute
+
+// peerLists shares the relay's bans and mutes with its peers, and follows
+// the lists of the peers it trusts.
+type peerLists struct {
+	store     *moderation.Store
+	peers     []TrustedPeer
+	apply     bool
+	secretKey string
+
+	mu        sync.Mutex
+	published nostr.Timestamp
+}
+
+func newPeerLists(config *Config, store *moderation.Store) *peerLists {
+	peers := make([]TrustedPeer, 0, len(config.TrustedPeers))
+	for _, peer := range config.TrustedPeers {
+		peers = append(peers, TrustedPeer{URL: nostr.NormalizeURL(peer.URL), PubKey: peer.PubKey})
+	}
+	return &peerLists{
+		store:     store,
+		peers:     peers,
+		apply:     config.ApplyPeerBans,
+		secretKey: config.RelaySecretKey,
+	}
+}
+
+func (p *peerLists) urls() []string {
+	urls := make([]string, 0, len(p.peers))
+	for _, peer := range p.peers {
+		urls = append(urls, peer.URL)
+	}
+	return urls
+}
+
+// find returns which trusted peer's list covers an event. Peer lists are
+// only consulted when applying them was opted in to.
+func (p *peerLists) find(id string, event *nostr.Event) (peer, key string, found bool) {
+	if !p.apply || len(p.peers) == 0 {
+		return "", "", false
+	}
+	return p.store.FindInPeerLists(p.urls(), id, event.PubKey, event.ID)
+}
+
+// block checks an event against the trusted peers' ban lists, recording
+// any block in the audit trail.
+func (p *peerLists) block(event *nostr.Event) (bool, string) {
+	peer, key, found := p.find(moderation.BanListID, event)
+	if !found {
+		return false, ""
+	}
+	p.store.RecordBlock(peer, moderation.BanListID, key, event.ID)
+	return true, "blocked: banned by " + peer
+}
+
+func (p *peerLists) muted(event *nostr.Event) bool {
+	_, _, found := p.find(moderation.MuteListID, event)
+	return found
+}
+
+// runBlockFlush writes the blocks counted by block to the audit trail
+// every blockFlushInterval, and once more when ctx is cancelled.
+func (p *peerLists) runBlockFlush(ctx context.Context) {
+	ticker := time.NewTicker(blockFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.flushBlocks()
+			return
+		case <-ticker.C:
+			p.flushBlocks()
+		}
+	}
+}
+
+func (p *peerLists) flushBlocks() {
+	if err := p.store.FlushBlocks(); err != nil {
+		log.Printf("Failed to record blocked events: %v", err)
+	}
+}
+
+// trusted reports whether an event is a moderation list signed by one of
+// the peers we trust.
+func (p *peerLists) trusted(event *nostr.Event) bool {
+	if _, _, ok := moderation.ParseList(event); !ok {
+		return false
+	}
+	return slices.ContainsFunc(p.peers, func(peer TrustedPeer) bool {
+		return peer.PubKey == event.PubKey
+	})
+}
+
+// subscriptionFilters asks peers for the lists of the relays we trust.
+func (p *peerLists) subscriptionFilters() nostr.Filters {
+	if len(p.peers) == 0 {
+		return nil
+	}
+	authors := make([]string, 0, len(p.peers))
+	for _, peer := range p.peers {
+		authors = append(authors, peer.PubKey)
+	}
+	return nostr.Filters{{
+		Kinds:   []int{moderation.KindList},
+		Authors: authors,
+		Tags:    nostr.TagMap{"d": []string{moderation.BanListID, moderation.MuteListID}},
+	}}
+}
+
+// onIncomingEvent stores lists signed by a trusted peer, whichever relay
+// they reached us through.
+func (p *peerLists) onIncomingEvent(sourceURL string, event *nostr.Event) {
+	id, list, ok := moderation.ParseList(event)
+	if !ok {
+		return
+	}
+	for _, peer := range p.peers {
+		if peer.PubKey != event.PubKey {
+			continue
+		}
+		err := p.store.SetPeerList(peer.URL, id, moderation.PeerList{
+			List:      list,
+			EventID:   event.ID,
+			CreatedAt: int64(event.CreatedAt),
+		})
+		if err != nil {
+			log.Printf("Failed to store %s from %s: %v", id, peer.URL, err)
+		}
+	}
+}
+
+// publishModerationLists signs the relay's current bans and mutes and
+// makes them available to peers. Nothing is shared without a relay key.
+func (s *Server) publishModerationLists(ctx context.Context) {
+	p := s.moderation.lists
+	if p.secretKey == "" {
+		return
+	}
+
+	// Replaceable events only replace older ones, so two updates in the
+	// same second need distinct timestamps
+	p.mu.Lock()
+	createdAt := nostr.Now()
+	if createdAt <= p.published {
+		createdAt = p.published + 1
+	}
+	p.published = createdAt
+	p.mu.Unlock()
+
+	for _, id := range []string{moderation.BanListID, moderation.MuteListID} {
+		event := s.moderation.store.OwnList(id).Event(id)
+		event.CreatedAt = createdAt
+		if err := event.Sign(p.secretKey); err != nil {
+			log.Printf("Failed to sign %s: %v", id, err)
+			return
+		}
+		if err := s.db.ReplaceEvent(ctx, event); err != nil {
+			log.Printf("Failed to store %s: %v", id, err)
+			continue
+		}
+		s.Relay.BroadcastEvent(event)
+	}
+}
+
+// registerPeerListsAPI exposes mutes, peer lists and the audit trail
+// through the admin API.
+func (s *Server) registerPeerListsAPI(mux *http.ServeMux) {
+	store := s.moderation.store
+
+	mux.HandleFunc("GET /api/mutes", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		muted, err := store.MutedPubKeys()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, muted)
+	}))
+	mux.HandleFunc("PUT /api/mutes/{pubkey}", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		if err := store.MutePubKey(r.PathValue("pubkey"), r.URL.Query().Get("reason"), admin); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.publishModerationLists(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("DELETE /api/mutes/{pubkey}", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		if err := store.UnmutePubKey(r.PathValue("pubkey")); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.publishModerationLists(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("GET /api/peer-lists", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		lists, err := store.PeerLists()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, lists)
+	}))
+	mux.HandleFunc("GET /api/audit", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		entries, err := store.Audit()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}))
+}
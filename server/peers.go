@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.crom/crbroughton/townsquares-relay/manager"
+)
+
+const (
+	// peerRetryInterval is how long to wait before dialling a peer again
+	peerRetryInterval = 10 * time.Second
+	// peerSyncInterval is how often peers added or removed from the
+	// command line are picked up
+	peerSyncInterval = 30 * time.Second
+)
+
+// peerSync keeps the manager connected to the peers the community wants:
+// those in the config, with the changes admins made since applied.
+type peerSync struct {
+	mu sync.Mutex
+	// ctx is the one Start was called with, nil until then
+	ctx     context.Context
+	dialing map[string]bool
+}
+
+// PeerStatus is a peer as the admin API shows it.
+type PeerStatus struct {
+	manager.PeerStatus
+	// Configured peers come from the config file rather than an admin
+	Configured bool `json:"configured"`
+}
+
+// wantedPeers returns the peers to connect to.
+func (s *Server) wantedPeers() []string {
+	peers, err := s.moderation.store.Peers(s.config.Relays)
+	if err != nil {
+		log.Printf("Failed to read peer changes: %v", err)
+		return s.config.Relays
+	}
+	return peers
+}
+
+// peerStatuses returns the wanted peers, connected or not, followed by any
+// others the manager is still connected to.
+func (s *Server) peerStatuses() []PeerStatus {
+	known := make(map[string]manager.PeerStatus)
+	connected := s.Manager.Peers()
+	for _, peer := range connected {
+		known[peer.URL] = peer
+	}
+
+	wanted := s.wantedPeers()
+	peers := make([]PeerStatus, 0, len(wanted))
+	for _, peerURL := range wanted {
+		status, ok := known[peerURL]
+		if !ok {
+			status = manager.PeerStatus{URL: peerURL}
+		}
+		peers = append(peers, PeerStatus{PeerStatus: status, Configured: slices.Contains(s.config.Relays, peerURL)})
+	}
+	for _, peer := range connected {
+		if !slices.Contains(wanted, peer.URL) {
+			peers = append(peers, PeerStatus{PeerStatus: peer})
+		}
+	}
+	return peers
+}
+
+// syncPeers dials wanted peers that aren't connected and disconnects the
+// ones no longer wanted. It does nothing before Start.
+func (s *Server) syncPeers() {
+	s.peers.mu.Lock()
+	defer s.peers.mu.Unlock()
+	ctx := s.peers.ctx
+	if ctx == nil {
+		return
+	}
+
+	wanted := s.wantedPeers()
+	for _, peerURL := range wanted {
+		if !s.peers.dialing[peerURL] {
+			s.peers.dialing[peerURL] = true
+			go s.dialPeer(ctx, peerURL)
+		}
+	}
+	for _, peer := range s.Manager.Peers() {
+		if !slices.Contains(wanted, peer.URL) {
+			s.Manager.Disconnect(peer.URL)
+		}
+	}
+}
+
+// dialPeer connects to a peer, retrying until it succeeds, the peer is no
+// longer wanted or ctx is cancelled.
+func (s *Server) dialPeer(ctx context.Context, peerURL string) {
+	defer func() {
+		s.peers.mu.Lock()
+		delete(s.peers.dialing, peerURL)
+		s.peers.mu.Unlock()
+	}()
+
+	for slices.Contains(s.wantedPeers(), peerURL) {
+		if err := s.Manager.Connect(ctx, peerURL); err == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(peerRetryInterval):
+		}
+	}
+}
+
+// runPeerSync picks up peer changes made while the relay is running.
+func (s *Server) runPeerSync(ctx context.Context) {
+	ticker := time.NewTicker(peerSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.syncPeers()
+		}
+	}
+}
+
+// validPeerURL reports whether a peer URL is one the manager can dial:
+// a websocket URL, or an HTTP one for peers on the tailnet.
+func validPeerURL(peerURL string) bool {
+	u, err := url.Parse(peerURL)
+	return err == nil && slices.Contains([]string{"ws", "wss", "http", "https"}, u.Scheme) && u.Host != ""
+}
+
+// registerPeersAPI lets admins see how peers are doing, and add or remove
+// them without editing the config. The peer is given as ?url=.
+func (s *Server) registerPeersAPI(mux *http.ServeMux) {
+	store := s.moderation.store
+
+	mux.HandleFunc("GET /api/peers", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		writeJSON(w, http.StatusOK, s.peerStatuses())
+	}))
+	mux.HandleFunc("PUT /api/peers", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		peerURL := r.URL.Query().Get("url")
+		if !validPeerURL(peerURL) {
+			writeError(w, http.StatusBadRequest, "url must be a ws:// or wss:// URL, or http:// on a tailnet")
+			return
+		}
+		if err := store.AddPeer(peerURL, r.URL.Query().Get("reason"), admin); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.syncPeers()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("DELETE /api/peers", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		peerURL := r.URL.Query().Get("url")
+		if peerURL == "" {
+			writeError(w, http.StatusBadRequest, "url is required")
+			return
+		}
+		if err := store.RemovePeer(peerURL, r.URL.Query().Get("reason"), admin); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.syncPeers()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// powPolicy requires NIP-13 proof of work, so open relays can ask for a
+// little effort instead of accounts.
+type powPolicy struct {
+	min       int
+	kinds     map[int]int
+	federated int
+	waived    func(pubkey string) bool
+	// control reports the events peers send about themselves, which
+	// need no work
+	control func(*nostr.Event) bool
+}
+
+func newPoWPolicy(config *Config, waived func(string) bool, control func(*nostr.Event) bool) (*powPolicy, error) {
+	pow := config.PoW
+	if pow.MinDifficulty < 0 || pow.FederatedDifficulty < 0 {
+		return nil, fmt.Errorf("pow difficulties cannot be negative")
+	}
+	for kind, difficulty := range pow.Kinds {
+		if difficulty < 0 {
+			return nil, fmt.Errorf("pow difficulty for kind %d cannot be negative", kind)
+		}
+	}
+	if pow.MinDifficulty == 0 && len(pow.Kinds) == 0 && pow.FederatedDifficulty == 0 {
+		return nil, nil
+	}
+	return &powPolicy{
+		min:       pow.MinDifficulty,
+		kinds:     pow.Kinds,
+		federated: pow.FederatedDifficulty,
+		waived:    waived,
+		control:   control,
+	}, nil
+}
+
+// required returns the difficulty asked of clients for a kind.
+func (p *powPolicy) required(kind int) int {
+	if difficulty, set := p.kinds[kind]; set {
+		return difficulty
+	}
+	return p.min
+}
+
+// difficulty only counts work the nonce tag commits to, so a lucky id
+// without a target doesn't pass.
+func difficulty(event *nostr.Event) int {
+	return nip13.CommittedDifficulty(event)
+}
+
+func (p *powPolicy) rejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	required := p.required(event.Kind)
+	if required == 0 || p.waived(event.PubKey) {
+		return false, ""
+	}
+	if difficulty(event) < required {
+		return true, fmt.Sprintf("pow: difficulty %d is required", required)
+	}
+	return false, ""
+}
+
+// federates checks events pulled from peers, which have their own
+// threshold and are exempt when it is zero. Peers' moderation lists and
+// group metadata are always let through.
+func (p *powPolicy) federates(peerURL string, event *nostr.Event) bool {
+	return p.federated == 0 || p.control(event) || difficulty(event) >= p.federated
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+	"github.crom/crbroughton/townsquares-relay/manager"
+	"github.crom/crbroughton/townsquares-relay/moderation"
+)
+
+func minedEvent(t *testing.T, sk string, kind int, target int) *nostr.Event {
+	t.Helper()
+
+	event := &nostr.Event{Kind: kind, CreatedAt: nostr.Now()}
+	event.PubKey, _ = nostr.GetPublicKey(sk)
+	nonce, err := nip13.DoWork(context.Background(), *event, target)
+	if err != nil {
+		t.Fatalf("Failed to do work: %v", err)
+	}
+	event.Tags = append(event.Tags, nonce)
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	return event
+}
+
+func TestPoWIsRequiredFromStrangers(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	srv := newTestServer(t, &Config{
+		AdminPubKeys: []string{admin},
+		PoW:          PoWPolicy{MinDifficulty: 8, Kinds: map[int]int{7: 0}, FederatedDifficulty: 4},
+	})
+	ctx := context.Background()
+
+	if srv.Relay.Info.Limitation.MinPowDifficulty != 8 {
+		t.Errorf("Expected NIP-11 to advertise difficulty 8, got %d", srv.Relay.Info.Limitation.MinPowDifficulty)
+	}
+
+	stranger := nostr.GeneratePrivateKey()
+	if reject, msg := srv.pow.rejectEvent(ctx, signedEvent(t, stranger, 1)); !reject || !strings.HasPrefix(msg, "pow:") {
+		t.Errorf("Expected event without work to be refused, got %v %q", reject, msg)
+	}
+	if reject, msg := srv.pow.rejectEvent(ctx, minedEvent(t, stranger, 1, 8)); reject {
+		t.Errorf("Expected mined event to be accepted, got %q", msg)
+	}
+	if reject, msg := srv.pow.rejectEvent(ctx, signedEvent(t, stranger, 7)); reject {
+		t.Errorf("Expected kind without a requirement to be accepted, got %q", msg)
+	}
+	if reject, msg := srv.pow.rejectEvent(ctx, signedEvent(t, adminKey, 1)); reject {
+		t.Errorf("Expected admin to be waived, got %q", msg)
+	}
+
+	if srv.pow.federates("wss://peer", signedEvent(t, stranger, 1)) {
+		t.Error("Expected federated event without work to be refused")
+	}
+	if !srv.pow.federates("wss://peer", minedEvent(t, stranger, 1, 4)) {
+		t.Error("Expected federated event to only need the federated difficulty")
+	}
+}
+
+func TestPoWCanBeWaivedForMembers(t *testing.T) {
+	srv := newTestServer(t, &Config{
+		MembershipEnabled: true,
+		MembersFile:       filepath.Join(t.TempDir(), "members.json"),
+		PoW:               PoWPolicy{MinDifficulty: 8, WaiveForMembers: true},
+	})
+
+	memberKey := nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberKey)
+	srv.membership.store.AddMember(member, "test")
+
+	if reject, msg := srv.pow.rejectEvent(context.Background(), signedEvent(t, memberKey, 1)); reject {
+		t.Errorf("Expected member to be waived, got %q", msg)
+	}
+}
+
+// peerControlEvents publishes a trusted peer's ban list and the metadata
+// of a group it hosts, neither carrying any work.
+func peerControlEvents(t *testing.T, peerKey string) []*nostr.Event {
+	t.Helper()
+
+	banned, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	list := moderation.List{PubKeys: []string{banned}}.Event(moderation.BanListID)
+	if err := list.Sign(peerKey); err != nil {
+		t.Fatalf("Failed to sign list: %v", err)
+	}
+	metadata := signedEvent(t, peerKey, nostr.KindSimpleGroupMetadata, nostr.Tag{"d", "garden"})
+	return []*nostr.Event{list, metadata}
+}
+
+// assertPeerControlEventsHandled checks that a server following the peer at
+// peerURL took in the events from peerControlEvents.
+func assertPeerControlEventsHandled(t *testing.T, srv *Server, peerURL string) {
+	t.Helper()
+
+	if !waitUntil(t, func() bool {
+		lists, _ := srv.moderation.store.PeerLists()
+		return len(lists[peerURL]) == 1
+	}) {
+		t.Error("Expected the peer's ban list to be kept")
+	}
+	if !waitUntil(t, func() bool { return srv.groups.hostedBy(peerURL, "garden") }) {
+		t.Error("Expected the peer's group to be recorded")
+	}
+}
+
+func TestPeerControlEventsNeedNoWork(t *testing.T) {
+	peerKey := nostr.GeneratePrivateKey()
+	peerPubKey, _ := nostr.GetPublicKey(peerKey)
+	peerURL := "wss://peer.example"
+
+	transport := manager.NewMemoryTransport()
+	peer := transport.Relay(peerURL)
+	for _, event := range peerControlEvents(t, peerKey) {
+		peer.Publish(event)
+	}
+
+	srv := newTestServer(t, &Config{
+		Relays:         []string{peerURL},
+		TrustedPeers:   []TrustedPeer{{URL: peerURL, PubKey: peerPubKey}},
+		RelaySecretKey: nostr.GeneratePrivateKey(),
+		GroupsEnabled:  true,
+		PoW:            PoWPolicy{FederatedDifficulty: 20},
+	})
+	srv.Manager.SetTransport(transport)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv.Start(ctx)
+
+	assertPeerControlEventsHandled(t, srv, peerURL)
+	if srv.pow.federates(peerURL, signedEvent(t, peerKey, 1)) {
+		t.Error("Expected the peer's other events to still need work")
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// forwardedHeaders are the headers a reverse proxy sets to say what its
+// client asked for. khatru and requestURL believe them, so they are
+// dropped from requests that didn't come through a trusted proxy.
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// parseTrustedProxies parses the trusted_proxies config, where each entry
+// is an IP address or a CIDR range.
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("trusted_proxies: %w", err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: %w", err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// trustedProxy reports whether a request's remote address is one of the
+// configured proxies.
+func (s *Server) trustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && s.trustedAddr(addr)
+}
+
+func (s *Server) trustedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient returns who a trusted proxy says it is forwarding for:
+// the last address in X-Forwarded-For that isn't a trusted proxy. Each
+// proxy appends the address it was connected from, so the addresses
+// before that were sent by the client and could be anything.
+func (s *Server) forwardedClient(r *http.Request) (string, bool) {
+	client, found := "", false
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client, found = addr.Unmap().String(), true
+		if !s.trustedAddr(addr) {
+			break
+		}
+	}
+	return client, found
+}
+
+// withoutUntrustedForwarding returns r without its forwarded headers,
+// unless it came from a trusted proxy. Requests from a trusted proxy get
+// the address it forwarded for as their remote address instead, which is
+// where khatru.GetIP and everything else that looks at clients' addresses
+// find it.
+func (s *Server) withoutUntrustedForwarding(r *http.Request) *http.Request {
+	if s.trustedProxy(r.RemoteAddr) {
+		client, found := s.forwardedClient(r)
+		if !found {
+			return r
+		}
+		r = r.Clone(r.Context())
+		r.RemoteAddr = net.JoinHostPort(client, "0")
+		r.Header.Del("X-Forwarded-For")
+		return r
+	}
+	forwarded := false
+	for _, header := range forwardedHeaders {
+		if _, ok := r.Header[header]; ok {
+			forwarded = true
+		}
+	}
+	if !forwarded {
+		return r
+	}
+
+	r = r.Clone(r.Context())
+	for _, header := range forwardedHeaders {
+		r.Header.Del(header)
+	}
+	return r
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+)
+
+func TestClientIPIsTheLastHopBeforeTheProxies(t *testing.T) {
+	srv := newTestServer(t, &Config{TrustedProxies: []string{"10.0.0.0/8"}})
+
+	cases := []struct {
+		remoteAddr, forwardedFor, want string
+	}{
+		// Clients can put anything in front of what the proxy appends
+		{"10.0.0.1:4000", "1.2.3.4, 198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1:4000", "1.2.3.4, 198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"10.0.0.1:4000", "nonsense, 198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1:4000", "192.168.1.5", "192.168.1.5"},
+		{"10.0.0.1:4000", "", "10.0.0.1"},
+		{"203.0.113.9:4000", "198.51.100.7", "203.0.113.9"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+		if ip := khatru.GetIPFromRequest(srv.withoutUntrustedForwarding(req)); ip != c.want {
+			t.Errorf("%s forwarding %q: expected %s, got %s", c.remoteAddr, c.forwardedFor, c.want, ip)
+		}
+	}
+}
+
+func TestSpoofedForwardingDoesntGetPastIPBlocks(t *testing.T) {
+	srv := newTestServer(t, &Config{TrustedProxies: []string{"10.0.0.0/8"}})
+	if err := srv.moderation.store.BlockIP("198.51.100.7", "spam", "test"); err != nil {
+		t.Fatalf("Failed to block IP: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:4000"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 198.51.100.7")
+	if !srv.moderation.rejectConnection(srv.withoutUntrustedForwarding(req)) {
+		t.Error("Expected the blocked address to be refused despite the spoofed hop")
+	}
+}
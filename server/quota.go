@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/quota"
+)
+
+// What happens when a pubkey's next event would take it over quota.
+const (
+	QuotaModeReject = "reject"
+	QuotaModeEvict  = "evict"
+)
+
+// quotaPolicy limits how much each pubkey stores. Usage is always tracked
+// by the quota store wrapping storage, and only enforced here.
+type quotaPolicy struct {
+	Quota
+	store   *quota.Store
+	isAdmin func(pubkey string) bool
+}
+
+func newQuotaPolicy(config *Config, store *quota.Store, isAdmin func(string) bool) (*quotaPolicy, error) {
+	p := &quotaPolicy{Quota: config.Quota, store: store, isAdmin: isAdmin}
+	if p.Mode == "" {
+		p.Mode = QuotaModeReject
+	}
+	switch p.Mode {
+	case QuotaModeReject, QuotaModeEvict:
+	default:
+		return nil, fmt.Errorf("unknown quota mode %q", p.Mode)
+	}
+	if p.MaxEvents < 0 || p.MaxBytes < 0 {
+		return nil, fmt.Errorf("quota limits cannot be negative")
+	}
+	return p, nil
+}
+
+func (p *quotaPolicy) enabled() bool {
+	return p.MaxEvents > 0 || p.MaxBytes > 0
+}
+
+func (p *quotaPolicy) over(usage quota.Usage) bool {
+	return (p.MaxEvents > 0 && usage.Events > p.MaxEvents) || (p.MaxBytes > 0 && usage.Bytes > p.MaxBytes)
+}
+
+func (p *quotaPolicy) exempt(event *nostr.Event) bool {
+	return !p.enabled() || nostr.IsEphemeralKind(event.Kind) || p.isAdmin(event.PubKey)
+}
+
+func (p *quotaPolicy) rejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if p.exempt(event) {
+		return false, ""
+	}
+
+	size := quota.Size(event)
+	if p.MaxBytes > 0 && size > p.MaxBytes {
+		return true, "invalid: event is larger than the storage quota"
+	}
+	if p.Mode == QuotaModeEvict {
+		return false, ""
+	}
+
+	usage, err := p.store.Usage(event.PubKey)
+	if err != nil {
+		return true, "error: failed to check storage quota"
+	}
+	if p.over(quota.Usage{Events: usage.Events + 1, Bytes: usage.Bytes + size}) {
+		return true, "blocked: storage quota reached"
+	}
+	return false, ""
+}
+
+// onEventSaved makes room in evict mode by deleting the pubkey's oldest
+// events. Replaceable events are kept, as they hold things like profiles.
+func (p *quotaPolicy) onEventSaved(ctx context.Context, event *nostr.Event) {
+	if p.Mode != QuotaModeEvict || p.exempt(event) {
+		return
+	}
+
+	usage, err := p.store.Usage(event.PubKey)
+	if err != nil || !p.over(usage) {
+		return
+	}
+
+	ch, err := p.store.QueryEvents(eventstore.SetNegentropy(ctx), nostr.Filter{Authors: []string{event.PubKey}})
+	if err != nil {
+		log.Printf("Failed to find events to evict for %s: %v", event.PubKey[:8], err)
+		return
+	}
+	var stored []*nostr.Event
+	for ev := range ch {
+		if ev.ID != event.ID && !nostr.IsReplaceableKind(ev.Kind) && !nostr.IsAddressableKind(ev.Kind) {
+			stored = append(stored, ev)
+		}
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].CreatedAt < stored[j].CreatedAt
+	})
+
+	evicted := 0
+	for _, ev := range stored {
+		if !p.over(usage) {
+			break
+		}
+		if err := p.store.DeleteEvent(ctx, ev); err != nil {
+			log.Printf("Failed to evict %s: %v", ev.ID[:8], err)
+			return
+		}
+		usage.Events--
+		usage.Bytes -= quota.Size(ev)
+		evicted++
+	}
+	if evicted > 0 {
+		log.Printf("Evicted %d events from %s to stay within quota", evicted, event.PubKey[:8])
+	}
+}
+
+// QuotaUsage is a pubkey's usage as reported by the admin API.
+type QuotaUsage struct {
+	PubKey string `json:"pubkey"`
+	quota.Usage
+	Over bool `json:"over"`
+}
+
+// registerQuotaAPI exposes each pubkey's storage usage through the admin
+// API, largest first.
+func (s *Server) registerQuotaAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/quotas", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		all, err := s.db.AllUsage()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		usage := make([]QuotaUsage, 0, len(all))
+		for pubkey, u := range all {
+			usage = append(usage, QuotaUsage{PubKey: pubkey, Usage: u, Over: s.quota.enabled() && s.quota.over(u)})
+		}
+		sort.Slice(usage, func(i, j int) bool {
+			if usage[i].Bytes == usage[j].Bytes {
+				return usage[i].PubKey < usage[j].PubKey
+			}
+			return usage[i].Bytes > usage[j].Bytes
+		})
+		writeJSON(w, http.StatusOK, map[string]any{
+			"limits": s.quota.Quota,
+			"usage":  usage,
+		})
+	}))
+	mux.HandleFunc("GET /api/quotas/{pubkey}", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		pubkey := r.PathValue("pubkey")
+		u, err := s.db.Usage(pubkey)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid pubkey")
+			return
+		}
+		writeJSON(w, http.StatusOK, QuotaUsage{PubKey: pubkey, Usage: u, Over: s.quota.enabled() && s.quota.over(u)})
+	}))
+}
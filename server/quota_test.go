@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestQuotaRejectsOrEvicts(t *testing.T) {
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+
+	srv := newTestServer(t, &Config{Quota: Quota{MaxEvents: 2}})
+	for i := range 2 {
+		srv.db.SaveEvent(ctx, signedEvent(t, sk, 1, nostr.Tag{"i", string(rune('a' + i))}))
+	}
+	if reject, msg := srv.quota.rejectEvent(ctx, signedEvent(t, sk, 1)); !reject || msg != "blocked: storage quota reached" {
+		t.Errorf("Expected write over quota to be refused, got %v %q", reject, msg)
+	}
+
+	srv = newTestServer(t, &Config{Quota: Quota{MaxEvents: 2, Mode: QuotaModeEvict}})
+	profile := &nostr.Event{Kind: 0, CreatedAt: 1}
+	profile.Sign(sk)
+	oldest := &nostr.Event{Kind: 1, CreatedAt: 2}
+	oldest.Sign(sk)
+	latest := signedEvent(t, sk, 1)
+	for _, ev := range []*nostr.Event{profile, oldest, latest} {
+		if reject, msg := srv.quota.rejectEvent(ctx, ev); reject {
+			t.Fatalf("Expected evict mode to accept writes, got %q", msg)
+		}
+		srv.db.SaveEvent(ctx, ev)
+		srv.quota.onEventSaved(ctx, ev)
+	}
+
+	if countEvents(t, srv, oldest.ID) != 0 {
+		t.Error("Expected oldest note to be evicted")
+	}
+	if countEvents(t, srv, profile.ID) != 1 || countEvents(t, srv, latest.ID) != 1 {
+		t.Error("Expected profile and latest note to be kept")
+	}
+	if usage, _ := srv.db.Usage(pubkey); usage.Events != 2 {
+		t.Errorf("Expected usage of 2 events, got %+v", usage)
+	}
+}
+
+func TestReplacedAndDeletedEventsStopCounting(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	srv := newTestServer(t, &Config{Quota: Quota{MaxEvents: 3}})
+	httpServer := httptest.NewServer(srv)
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := nostr.RelayConnect(ctx, "ws"+strings.TrimPrefix(httpServer.URL, "http"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	for i := range 2 {
+		profile := nostr.Event{Kind: 0, CreatedAt: nostr.Timestamp(i + 1), Content: fmt.Sprintf(`{"name":"v%d"}`, i)}
+		profile.Sign(sk)
+		if err := client.Publish(ctx, profile); err != nil {
+			t.Fatalf("Failed to publish profile: %v", err)
+		}
+	}
+	if usage, _ := srv.db.Usage(pubkey); usage.Events != 1 {
+		t.Errorf("Expected the older profile to stop counting, got %+v", usage)
+	}
+
+	note := signedEvent(t, sk, 1)
+	if err := client.Publish(ctx, *note); err != nil {
+		t.Fatalf("Failed to publish note: %v", err)
+	}
+	if err := client.Publish(ctx, *signedEvent(t, sk, 5, nostr.Tag{"e", note.ID})); err != nil {
+		t.Fatalf("Failed to delete note: %v", err)
+	}
+	if countEvents(t, srv, note.ID) != 0 {
+		t.Error("Expected the note to be deleted")
+	}
+	// The profile and the deletion itself are left
+	if usage, _ := srv.db.Usage(pubkey); usage.Events != 2 {
+		t.Errorf("Expected the deleted note to stop counting, got %+v", usage)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/ratelimit"
+)
+
+// rateLimited counts refusals across every community in the process, for
+// anything reading expvar.
+var rateLimited = expvar.NewMap("rate_limited")
+
+// Names of the limits, as used in stats and counters.
+const (
+	limitConnections = "connections_per_ip"
+	limitEvents      = "events_per_pubkey"
+	limitREQs        = "reqs_per_connection"
+	limitFilters     = "filters_per_req"
+)
+
+type rateLimitPolicy struct {
+	connections *ratelimit.Limiter
+	events      *ratelimit.Limiter
+	reqs        *ratelimit.Limiter
+	maxFilters  int
+	// tooManyFilters counts REQs refused for having too many filters
+	tooManyFilters atomic.Uint64
+
+	mu    sync.Mutex
+	conns map[*khatru.WebSocket]*connRequests
+}
+
+// connRequests tracks the REQ a connection is currently sending, since
+// khatru checks the filters of a REQ one at a time.
+type connRequests struct {
+	req     <-chan struct{}
+	filters int
+	// refused is why the REQ is refused, if it is
+	refused string
+}
+
+func newRateLimitPolicy(config *Config) *rateLimitPolicy {
+	limits := config.RateLimits
+	return &rateLimitPolicy{
+		connections: ratelimit.New(limits.ConnectionsPerIP),
+		events:      ratelimit.New(limits.EventsPerPubKey),
+		reqs:        ratelimit.New(limits.REQsPerConnection),
+		maxFilters:  limits.MaxFiltersPerREQ,
+		conns:       make(map[*khatru.WebSocket]*connRequests),
+	}
+}
+
+func (p *rateLimitPolicy) rejectConnection(r *http.Request) bool {
+	if !p.connections.Allow(khatru.GetIPFromRequest(r)) {
+		rateLimited.Add(limitConnections, 1)
+		return true
+	}
+	return false
+}
+
+func (p *rateLimitPolicy) rejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if !p.events.Allow(event.PubKey) {
+		rateLimited.Add(limitEvents, 1)
+		return true, "rate-limited: slow down, too many events from this pubkey"
+	}
+	return false, ""
+}
+
+// countFilter counts a filter against the connection's limits. khatru
+// skips RejectFilter for filters with limit 0, so the counting is done as
+// an OverwriteFilter hook, and a filter over a limit loses its limit 0 for
+// rejectFilter to refuse it.
+func (p *rateLimitPolicy) countFilter(ctx context.Context, filter *nostr.Filter) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn, exists := p.conns[ws]
+	if !exists {
+		conn = &connRequests{}
+		p.conns[ws] = conn
+	}
+	// Every filter of a REQ shares the REQ's context, so a new context
+	// means a new REQ
+	if conn.req != ctx.Done() {
+		conn.req = ctx.Done()
+		conn.filters = 0
+		conn.refused = ""
+		if !p.reqs.Allow(fmt.Sprintf("%p", ws)) {
+			rateLimited.Add(limitREQs, 1)
+			conn.refused = "rate-limited: too many requests on this connection"
+		}
+	}
+	conn.filters++
+	if conn.refused == "" && p.maxFilters > 0 && conn.filters > p.maxFilters {
+		// khatru closes the REQ at the first refused filter
+		p.tooManyFilters.Add(1)
+		rateLimited.Add(limitFilters, 1)
+		conn.refused = fmt.Sprintf("rate-limited: at most %d filters per request", p.maxFilters)
+	}
+	if conn.refused != "" {
+		filter.LimitZero = false
+	}
+}
+
+// rejectFilter refuses the filters of a REQ countFilter found over a limit.
+func (p *rateLimitPolicy) rejectFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return false, ""
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn, exists := p.conns[ws]; exists && conn.req == ctx.Done() && conn.refused != "" {
+		return true, conn.refused
+	}
+	return false, ""
+}
+
+func (p *rateLimitPolicy) onDisconnect(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+	p.mu.Lock()
+	delete(p.conns, ws)
+	p.mu.Unlock()
+	p.reqs.Forget(fmt.Sprintf("%p", ws))
+}
+
+// stats returns what each limit has allowed and refused.
+func (p *rateLimitPolicy) stats() map[string]ratelimit.Stats {
+	return map[string]ratelimit.Stats{
+		limitConnections: p.connections.Stats(),
+		limitEvents:      p.events.Stats(),
+		limitREQs:        p.reqs.Stats(),
+		limitFilters:     {Limited: p.tooManyFilters.Load()},
+	}
+}
+
+// registerRateLimitAPI exposes the limit counters through the admin API,
+// both for this community and, through expvar, for the whole process.
+func (s *Server) registerRateLimitAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/rate-limits", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		writeJSON(w, http.StatusOK, s.rateLimits.stats())
+	}))
+	mux.HandleFunc("GET /debug/vars", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		expvar.Handler().ServeHTTP(w, r)
+	}))
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/ratelimit"
+)
+
+func TestRateLimitsAnswerWithRateLimited(t *testing.T) {
+	srv := newTestServer(t, &Config{RateLimits: RateLimits{
+		EventsPerPubKey:  ratelimit.Limit{PerMinute: 1, Burst: 2},
+		MaxFiltersPerREQ: 2,
+	}})
+	httpServer := httptest.NewServer(srv)
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := nostr.RelayConnect(ctx, "ws"+strings.TrimPrefix(httpServer.URL, "http"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	for i := range 3 {
+		err := client.Publish(ctx, *signedEvent(t, sk, 1, nostr.Tag{"n", string(rune('a' + i))}))
+		if i < 2 && err != nil {
+			t.Fatalf("Expected event %d to be accepted, got %v", i, err)
+		}
+		if i == 2 && (err == nil || !strings.Contains(err.Error(), "rate-limited:")) {
+			t.Errorf("Expected third event to be rate-limited, got %v", err)
+		}
+	}
+
+	sub, err := client.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}, {Kinds: []int{2}}, {Kinds: []int{3}}})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	select {
+	case reason := <-sub.ClosedReason:
+		if !strings.HasPrefix(reason, "rate-limited:") {
+			t.Errorf("Expected REQ to be closed as rate-limited, got %q", reason)
+		}
+	case <-sub.EndOfStoredEvents:
+		t.Error("Expected REQ with too many filters to be closed")
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for CLOSED")
+	}
+
+	stats := srv.rateLimits.stats()
+	if stats[limitEvents].Limited != 1 || stats[limitFilters].Limited != 1 {
+		t.Errorf("Expected one refusal of each, got %+v", stats)
+	}
+}
+
+func TestRateLimitsCoverFiltersWithLimitZero(t *testing.T) {
+	srv := newTestServer(t, &Config{RateLimits: RateLimits{
+		REQsPerConnection: ratelimit.Limit{PerMinute: 1, Burst: 1},
+		MaxFiltersPerREQ:  2,
+	}})
+	httpServer := httptest.NewServer(srv)
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := nostr.RelayConnect(ctx, "ws"+strings.TrimPrefix(httpServer.URL, "http"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	// Filters with limit 0 only ask for new events, which khatru doesn't
+	// check against RejectFilter
+	onlyNew := func(kinds ...int) nostr.Filters {
+		var filters nostr.Filters
+		for _, kind := range kinds {
+			filters = append(filters, nostr.Filter{Kinds: []int{kind}, LimitZero: true})
+		}
+		return filters
+	}
+	for _, filters := range []nostr.Filters{onlyNew(1, 2, 3), onlyNew(1)} {
+		sub, err := client.Subscribe(ctx, filters)
+		if err != nil {
+			t.Fatalf("Failed to subscribe: %v", err)
+		}
+		select {
+		case reason := <-sub.ClosedReason:
+			if !strings.HasPrefix(reason, "rate-limited:") {
+				t.Errorf("Expected REQ to be closed as rate-limited, got %q", reason)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected REQ with %d filters to be closed", len(filters))
+		}
+	}
+
+	stats := srv.rateLimits.stats()
+	if stats[limitREQs].Limited != 1 || stats[limitFilters].Limited != 1 {
+		t.Errorf("Expected one refusal of each, got %+v", stats)
+	}
+}
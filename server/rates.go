@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Event rates are counted in buckets of rateBucket over the last
+// rateWindow.
+const (
+	rateBucket = 10 * time.Second
+	rateWindow = time.Hour
+)
+
+// eventRates counts the events stored from clients and received from
+// peers, by kind.
+type eventRates struct {
+	mu      sync.Mutex
+	buckets [rateWindow / rateBucket]rateCounts
+}
+
+type rateCounts struct {
+	// slot is the bucket's start in units of rateBucket since the epoch
+	slot  int64
+	local map[int]int
+	peers map[int]int
+}
+
+// KindRate is how many events of a kind arrived recently.
+type KindRate struct {
+	Kind       int `json:"kind"`
+	LastMinute int `json:"last_minute"`
+	LastHour   int `json:"last_hour"`
+	// FromPeers is how many of the last hour's came from peers
+	FromPeers int `json:"from_peers"`
+}
+
+func newEventRates() *eventRates {
+	return &eventRates{}
+}
+
+func (r *eventRates) record(kind int, fromPeer bool, now time.Time) {
+	slot := now.UnixNano() / int64(rateBucket)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bucket := &r.buckets[slot%int64(len(r.buckets))]
+	if bucket.slot != slot || bucket.local == nil {
+		*bucket = rateCounts{slot: slot, local: make(map[int]int), peers: make(map[int]int)}
+	}
+	if fromPeer {
+		bucket.peers[kind]++
+	} else {
+		bucket.local[kind]++
+	}
+}
+
+func (r *eventRates) onEventSaved(ctx context.Context, event *nostr.Event) {
+	r.record(event.Kind, false, time.Now())
+}
+
+func (r *eventRates) onIncomingEvent(sourceURL string, event *nostr.Event) {
+	r.record(event.Kind, true, time.Now())
+}
+
+// rates returns the counts of each kind seen in the last hour, busiest
+// first.
+func (r *eventRates) rates(now time.Time) []KindRate {
+	slot := now.UnixNano() / int64(rateBucket)
+	minute := int64(time.Minute / rateBucket)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byKind := make(map[int]*KindRate)
+	for _, bucket := range r.buckets {
+		age := slot - bucket.slot
+		if bucket.local == nil || age < 0 || age >= int64(len(r.buckets)) {
+			continue
+		}
+		for _, counts := range []map[int]int{bucket.local, bucket.peers} {
+			for kind, n := range counts {
+				rate, ok := byKind[kind]
+				if !ok {
+					rate = &KindRate{Kind: kind}
+					byKind[kind] = rate
+				}
+				rate.LastHour += n
+				if age < minute {
+					rate.LastMinute += n
+				}
+			}
+		}
+		for kind, n := range bucket.peers {
+			byKind[kind].FromPeers += n
+		}
+	}
+
+	rates := make([]KindRate, 0, len(byKind))
+	for _, rate := range byKind {
+		rates = append(rates, *rate)
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].LastHour != rates[j].LastHour {
+			return rates[i].LastHour > rates[j].LastHour
+		}
+		return rates[i].Kind < rates[j].Kind
+	})
+	return rates
+}
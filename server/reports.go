@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/moderation"
+)
+
+// checkReport refuses NIP-56 reports the moderation queue has no room for,
+// before they are stored.
+func (p *moderationPolicy) checkReport(event *nostr.Event) (bool, string) {
+	report, ok := moderation.ParseReport(event)
+	if !ok {
+		return false, ""
+	}
+	err := p.store.CheckReport(report)
+	switch {
+	case errors.Is(err, moderation.ErrAlreadyReported):
+		return true, "duplicate: " + err.Error()
+	case err != nil:
+		return true, "rate-limited: " + err.Error()
+	}
+	return false, ""
+}
+
+// onEventSaved puts NIP-56 reports into the moderation queue.
+func (p *moderationPolicy) onEventSaved(ctx context.Context, event *nostr.Event) {
+	report, ok := moderation.ParseReport(event)
+	if !ok {
+		return
+	}
+	if err := p.store.AddReport(report); err != nil {
+		log.Printf("Failed to queue report %s: %v", event.ID[:8], err)
+	}
+}
+
+// registerReportsAPI exposes the moderation queue through the admin API.
+func (s *Server) registerReportsAPI(mux *http.ServeMux) {
+	store := s.moderation.store
+
+	mux.HandleFunc("GET /api/reports", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		reports, err := store.Reports(r.URL.Query().Get("all") == "true")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, reports)
+	}))
+
+	resolve := func(action func(id, note, by string) (moderation.Report, error), banned bool) http.HandlerFunc {
+		return s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+			var req struct {
+				Note string `json:"note"`
+			}
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					writeError(w, http.StatusBadRequest, "invalid request body")
+					return
+				}
+			}
+
+			report, err := action(r.PathValue("id"), req.Note, admin)
+			switch {
+			case errors.Is(err, moderation.ErrReportNotFound):
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			case errors.Is(err, moderation.ErrNoEvent):
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			case err != nil:
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if banned {
+				s.publishModerationLists(r.Context())
+			}
+			writeJSON(w, http.StatusOK, report)
+		})
+	}
+	mux.HandleFunc("POST /api/reports/{id}/resolve", resolve(store.ResolveReport, false))
+	mux.HandleFunc("POST /api/reports/{id}/hide-event", resolve(store.HideReportedEvent, false))
+	mux.HandleFunc("POST /api/reports/{id}/ban-author", resolve(store.BanReportedAuthor, true))
+
+	mux.HandleFunc("GET /api/hidden-events", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		hidden, err := store.HiddenEvents()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, hidden)
+	}))
+	mux.HandleFunc("DELETE /api/hidden-events/{id}", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		hidden, err := store.UnhideEvent(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !hidden {
+			writeError(w, http.StatusNotFound, "event is not hidden")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/moderation"
+)
+
+func TestHiddenReportedEventsAreKept(t *testing.T) {
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+	srv := newTestServer(t, &Config{AdminPubKeys: []string{admin}})
+	ctx := context.Background()
+
+	event := signedEvent(t, nostr.GeneratePrivateKey(), 1)
+	report := signedEvent(t, nostr.GeneratePrivateKey(), moderation.KindReport,
+		nostr.Tag{"e", event.ID, "spam"}, nostr.Tag{"p", event.PubKey})
+	for _, ev := range []*nostr.Event{event, report} {
+		if err := srv.db.SaveEvent(ctx, ev); err != nil {
+			t.Fatalf("Failed to save event: %v", err)
+		}
+	}
+	srv.moderation.onEventSaved(ctx, report)
+
+	url := "http://relay.example/api/reports/" + report.ID + "/hide-event"
+	req := httptest.NewRequest(http.MethodPost, url, nil)
+	req.Header.Set("Authorization", nip98Header(t, adminKey, http.MethodPost, url, nil))
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected event to be hidden, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	ch, _ := srv.queryEvents(ctx, nostr.Filter{IDs: []string{event.ID}})
+	for range ch {
+		t.Error("Expected hidden event not to be served")
+	}
+
+	stored, err := srv.db.QueryEvents(ctx, nostr.Filter{IDs: []string{event.ID}})
+	if err != nil {
+		t.Fatalf("Failed to query storage: %v", err)
+	}
+	count := 0
+	for range stored {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("Expected hidden event to stay in storage, got %d", count)
+	}
+
+	if reports, _ := srv.moderation.store.Reports(false); len(reports) != 0 {
+		t.Errorf("Expected report to leave the queue, got %d", len(reports))
+	}
+}
+
+func TestReportsAreLimitedPerReporter(t *testing.T) {
+	srv := newTestServer(t, &Config{})
+	ctx := context.Background()
+	reporterKey := nostr.GeneratePrivateKey()
+
+	for i := range moderation.MaxOpenReportsPerReporter + 1 {
+		author, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+		report := signedEvent(t, reporterKey, moderation.KindReport, nostr.Tag{"p", author, "spam"})
+		reject, msg := srv.moderation.rejectEvent(ctx, report)
+		if i < moderation.MaxOpenReportsPerReporter {
+			if reject {
+				t.Fatalf("Expected report %d to be accepted, got %q", i, msg)
+			}
+			srv.moderation.onEventSaved(ctx, report)
+		} else if !reject || !strings.HasPrefix(msg, "rate-limited:") {
+			t.Errorf("Expected the reporter to be rate limited, got %v %q", reject, msg)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip40"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+// retentionBatch is how many stored events are checked at a time.
+const retentionBatch = 500
+
+// maxReported bounds how many deleted events a retention report lists.
+const maxReported = 1000
+
+// retentionPolicy removes events once a retention rule or their NIP-40
+// expiration says they are no longer wanted, both from storage and from
+// what peers sent us.
+type retentionPolicy struct {
+	rules    []RetentionRule
+	interval time.Duration
+	dryRun   bool
+	// kept reports the events the relay's own state depends on, which
+	// rules never delete
+	kept func(*nostr.Event) bool
+}
+
+func newRetentionPolicy(config *Config, kept func(*nostr.Event) bool) (*retentionPolicy, error) {
+	retention := config.Retention
+	for i, rule := range retention.Rules {
+		if rule.MaxAge.Duration <= 0 {
+			return nil, fmt.Errorf("retention rule %d: max_age is required", i+1)
+		}
+	}
+	p := &retentionPolicy{
+		rules:    retention.Rules,
+		interval: retention.Interval.Duration,
+		dryRun:   retention.DryRun,
+		kept:     kept,
+	}
+	if p.interval <= 0 {
+		p.interval = time.Hour
+	}
+	return p, nil
+}
+
+// expired returns why an event should no longer be kept. Retention rules
+// are ignored when only rehearsing them.
+func (p *retentionPolicy) expired(event *nostr.Event, now nostr.Timestamp, dryRun bool) (bool, string) {
+	if expiration := nip40.GetExpiration(event.Tags); expiration != -1 && expiration <= now {
+		return true, "expired"
+	}
+	if dryRun {
+		return false, ""
+	}
+	return p.matchRule(event, now)
+}
+
+// matchRule returns the first rule an event is too old for. Rules without
+// kinds only cover regular events, as replaceable and addressable ones are
+// someone's current profile, contacts or settings however old they are.
+func (p *retentionPolicy) matchRule(event *nostr.Event, now nostr.Timestamp) (bool, string) {
+	if len(p.rules) == 0 || p.kept(event) {
+		return false, ""
+	}
+	for i, rule := range p.rules {
+		if len(rule.Kinds) == 0 && !nostr.IsRegularKind(event.Kind) {
+			continue
+		}
+		if len(rule.Kinds) > 0 && !slices.Contains(rule.Kinds, event.Kind) {
+			continue
+		}
+		if len(rule.Authors) > 0 && !slices.Contains(rule.Authors, event.PubKey) {
+			continue
+		}
+		if event.CreatedAt < now-nostr.Timestamp(rule.MaxAge.Seconds()) {
+			return true, fmt.Sprintf("retention rule %d", i+1)
+		}
+	}
+	return false, ""
+}
+
+func (p *retentionPolicy) rejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if expired, reason := p.expired(event, nostr.Now(), p.dryRun); expired {
+		if reason == "expired" {
+			return true, "invalid: event has expired"
+		}
+		return true, "blocked: event is older than this relay keeps"
+	}
+	return false, ""
+}
+
+func (p *retentionPolicy) visible(event *nostr.Event) bool {
+	expired, _ := p.expired(event, nostr.Now(), p.dryRun)
+	return !expired
+}
+
+func (p *retentionPolicy) federates(peerURL string, event *nostr.Event) bool {
+	return p.visible(event)
+}
+
+// RetentionReport describes what a sweep deleted, or would have deleted.
+type RetentionReport struct {
+	DryRun  bool          `json:"dry_run"`
+	Checked int           `json:"checked"`
+	Total   int           `json:"total"`
+	Deleted []PurgedEvent `json:"deleted"`
+}
+
+type PurgedEvent struct {
+	ID        string `json:"id"`
+	Kind      int    `json:"kind"`
+	PubKey    string `json:"pubkey"`
+	Reason    string `json:"reason"`
+	Federated bool   `json:"federated,omitempty"`
+}
+
+func (r *RetentionReport) add(event *nostr.Event, reason string, federated bool) {
+	r.Total++
+	if len(r.Deleted) < maxReported {
+		r.Deleted = append(r.Deleted, PurgedEvent{
+			ID:        event.ID,
+			Kind:      event.Kind,
+			PubKey:    event.PubKey,
+			Reason:    reason,
+			Federated: federated,
+		})
+	}
+	if r.DryRun {
+		log.Printf("Retention would delete %s (%s)", event.ID[:8], reason)
+	}
+}
+
+// sweepRetention checks every stored and federated event against the
+// retention rules and NIP-40 expiration, deleting the ones that are due
+// unless dryRun is set.
+func (s *Server) sweepRetention(ctx context.Context, dryRun bool) (RetentionReport, error) {
+	p := s.retention
+	report := RetentionReport{DryRun: dryRun, Deleted: []PurgedEvent{}}
+	now := nostr.Now()
+
+	due := func(event *nostr.Event) (bool, string) {
+		return p.expired(event, now, false)
+	}
+
+	// Storage is walked a page at a time, newest first
+	err := storage.Walk(ctx, s.db, nostr.Filter{Until: &now}, retentionBatch, func(events []*nostr.Event, _ nostr.Timestamp) error {
+		for _, event := range events {
+			report.Checked++
+			expired, reason := due(event)
+			if !expired {
+				continue
+			}
+			report.add(event, reason, false)
+			if !dryRun {
+				if err := s.db.DeleteEvent(ctx, event); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for _, event := range s.Manager.GetAllEvents() {
+		report.Checked++
+		if expired, reason := due(event); expired {
+			report.add(event, reason, true)
+			if !dryRun {
+				s.Manager.RemoveEvent(event.ID)
+				s.search.forget(event)
+			}
+		}
+	}
+
+	if report.Total > 0 {
+		if dryRun {
+			log.Printf("Retention would delete %d of %d events", report.Total, report.Checked)
+		} else {
+			log.Printf("Retention deleted %d of %d events", report.Total, report.Checked)
+		}
+	}
+	return report, nil
+}
+
+// runRetention sweeps straight away and then on the configured interval
+// until ctx is cancelled.
+func (s *Server) runRetention(ctx context.Context) {
+	ticker := time.NewTicker(s.retention.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.sweepRetention(ctx, s.retention.dryRun); err != nil {
+			log.Printf("Retention sweep failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// registerRetentionAPI lets admins run a sweep, or rehearse one with
+// ?dry_run=true.
+func (s *Server) registerRetentionAPI(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/retention/sweep", s.adminHandler(func(w http.ResponseWriter, r *http.Request, admin string) {
+		dryRun := s.retention.dryRun
+		switch r.URL.Query().Get("dry_run") {
+		case "true":
+			dryRun = true
+		case "false":
+			dryRun = false
+		}
+
+		report, err := s.sweepRetention(r.Context(), dryRun)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}))
+}
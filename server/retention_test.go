@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRetentionSweep(t *testing.T) {
+	srv := newTestServer(t, &Config{Retention: Retention{Rules: []RetentionRule{
+		{Kinds: []int{7}, MaxAge: Duration{24 * time.Hour}},
+	}}})
+	ctx := context.Background()
+	now := nostr.Now()
+
+	event := func(kind int, createdAt nostr.Timestamp, tags ...nostr.Tag) *nostr.Event {
+		ev := &nostr.Event{Kind: kind, CreatedAt: createdAt, Tags: tags}
+		ev.Sign(nostr.GeneratePrivateKey())
+		if err := srv.db.SaveEvent(ctx, ev); err != nil {
+			t.Fatalf("Failed to save event: %v", err)
+		}
+		return ev
+	}
+	oldReaction := event(7, now-3*86400)
+	oldNote := event(1, now-3*86400)
+	newReaction := event(7, now)
+	expired := event(1, now-60, nostr.Tag{"expiration", strconv.FormatInt(int64(now-1), 10)})
+	// More than a page of events, all at the same time
+	for range retentionBatch + 10 {
+		event(1, now-7200)
+	}
+
+	report, err := srv.sweepRetention(ctx, true)
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if report.Total != 2 || report.Checked != retentionBatch+14 {
+		t.Errorf("Expected dry run to find 2 of %d events, got %d of %d", retentionBatch+14, report.Total, report.Checked)
+	}
+	if count := countEvents(t, srv, oldReaction.ID); count != 1 {
+		t.Error("Expected dry run to keep events")
+	}
+
+	if _, err := srv.sweepRetention(ctx, false); err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+	for _, ev := range []*nostr.Event{oldReaction, expired} {
+		if countEvents(t, srv, ev.ID) != 0 {
+			t.Errorf("Expected %s to be deleted", ev.ID[:8])
+		}
+	}
+	for _, ev := range []*nostr.Event{oldNote, newReaction} {
+		if countEvents(t, srv, ev.ID) != 1 {
+			t.Errorf("Expected %s to be kept", ev.ID[:8])
+		}
+	}
+
+	if reject, _ := srv.retention.rejectEvent(ctx, expired); !reject {
+		t.Error("Expected expired events to be refused")
+	}
+}
+
+func countEvents(t *testing.T, srv *Server, id string) int {
+	t.Helper()
+
+	ch, err := srv.db.QueryEvents(context.Background(), nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		t.Fatalf("Failed to query storage: %v", err)
+	}
+	count := 0
+	for range ch {
+		count++
+	}
+	return count
+}
+
+func TestRetentionKeepsRelayState(t *testing.T) {
+	config := &Config{
+		DBPath:         filepath.Join(t.TempDir(), "db"),
+		RelaySecretKey: nostr.GeneratePrivateKey(),
+		GroupsEnabled:  true,
+		Retention:      Retention{Rules: []RetentionRule{{MaxAge: Duration{time.Hour}}}},
+	}
+	srv := newTestServer(t, config)
+	ctx := context.Background()
+	old := nostr.Now() - 86400
+
+	save := func(sk string, kind int, tags ...nostr.Tag) *nostr.Event {
+		ev := &nostr.Event{Kind: kind, CreatedAt: old, Tags: tags}
+		ev.Sign(sk)
+		if err := srv.db.SaveEvent(ctx, ev); err != nil {
+			t.Fatalf("Failed to save event: %v", err)
+		}
+		srv.groups.groups.OnEventSaved(ctx, ev)
+		return ev
+	}
+	user := nostr.GeneratePrivateKey()
+	created := save(user, nostr.KindSimpleGroupCreateGroup, nostr.Tag{"h", "garden"})
+	profile := save(user, 0)
+	relayEvent := save(config.RelaySecretKey, 1)
+	note := save(user, 1)
+
+	if reject, msg := srv.retention.rejectEvent(ctx, profile); reject {
+		t.Errorf("Expected an old profile to be accepted, got %q", msg)
+	}
+
+	if _, err := srv.sweepRetention(ctx, false); err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+	for _, ev := range []*nostr.Event{created, profile, relayEvent} {
+		if countEvents(t, srv, ev.ID) != 1 {
+			t.Errorf("Expected kind %d to be kept", ev.Kind)
+		}
+	}
+	if countEvents(t, srv, note.ID) != 0 {
+		t.Error("Expected the old note to be deleted")
+	}
+
+	// Groups are rebuilt from storage on restart
+	srv.Close()
+	restarted, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to restart: %v", err)
+	}
+	defer restarted.Close()
+	if !restarted.groups.groups.Hosts("garden") {
+		t.Error("Expected the group to survive the sweep")
+	}
+}
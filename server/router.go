@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Router shares one HTTP listener between several communities, picking
+// one by the request's hostname, path, or both.
+type Router struct {
+	servers []*Server
+}
+
+func NewRouter(servers ...*Server) *Router {
+	return &Router{servers: servers}
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv := rt.match(r)
+	if srv == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if srv.config.Path == "" {
+		srv.ServeHTTP(w, r)
+		return
+	}
+	http.StripPrefix(srv.config.Path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" {
+			r.URL.Path = "/"
+		}
+		srv.ServeHTTP(w, r)
+	})).ServeHTTP(w, r)
+}
+
+// match finds the most specific community for a request. A hostname match
+// beats any path match, and a longer path beats a shorter one.
+func (rt *Router) match(r *http.Request) *Server {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var best *Server
+	bestScore := -1
+	for _, srv := range rt.servers {
+		score := 0
+		if srv.config.Hostname != "" {
+			if !strings.EqualFold(srv.config.Hostname, host) {
+				continue
+			}
+			score += 1 << 16
+		}
+		if srv.config.Path != "" {
+			if r.URL.Path != srv.config.Path && !strings.HasPrefix(r.URL.Path, srv.config.Path+"/") {
+				continue
+			}
+			score += len(srv.config.Path)
+		}
+		if score > bestScore {
+			best, bestScore = srv, score
+		}
+	}
+	return best
+}
+
+// withCommunityURL makes khatru see a path-routed community's URL as the
+// relay's. khatru checks NIP-42 and NIP-86 authorizations against a URL it
+// builds from the request's host alone, so without the path every one sent
+// to the community would be refused. Other requests are left alone, as
+// requestURL would otherwise count the path twice.
+func (s *Server) withCommunityURL(r *http.Request) *http.Request {
+	if s.config.Path == "" {
+		return r
+	}
+	if r.Header.Get("Upgrade") != "websocket" && r.Header.Get("Content-Type") != "application/nostr+json+rpc" {
+		return r
+	}
+	u, err := url.Parse(requestURL(r))
+	if err != nil {
+		return r
+	}
+
+	r = r.Clone(r.Context())
+	r.Header.Set("X-Forwarded-Proto", u.Scheme)
+	r.Header.Set("X-Forwarded-Host", u.Host+s.config.Path)
+	return r
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+func newTestServer(t *testing.T, config *Config) *Server {
+	t.Helper()
+
+	if config.DBPath == "" {
+		config.DBPath = filepath.Join(t.TempDir(), "db")
+	}
+	srv, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func relayName(t *testing.T, handler http.Handler, host, path string) string {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	req.Header.Set("Accept", "application/nostr+json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code == http.StatusNotFound {
+		return ""
+	}
+
+	var info nip11.RelayInformationDocument
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to decode NIP-11 response for %s%s: %v", host, path, err)
+	}
+	return info.Name
+}
+
+func TestRouterPicksCommunityByPathAndHostname(t *testing.T) {
+	router := NewRouter(
+		newTestServer(t, &Config{Name: "North", Path: "/north"}),
+		newTestServer(t, &Config{Name: "South", Path: "/south"}),
+		newTestServer(t, &Config{Name: "Harbour", Hostname: "harbour.example"}),
+		newTestServer(t, &Config{Name: "Default"}),
+	)
+
+	cases := []struct {
+		host, path, want string
+	}{
+		{"relay.example", "/north", "North"},
+		{"relay.example", "/north/", "North"},
+		{"relay.example", "/south", "South"},
+		{"harbour.example:3334", "/", "Harbour"},
+		{"harbour.example", "/north", "Harbour"},
+		{"relay.example", "/", "Default"},
+		{"relay.example", "/northern", "Default"},
+	}
+
+	for _, c := range cases {
+		if got := relayName(t, router, c.host, c.path); got != c.want {
+			t.Errorf("%s%s: expected %q, got %q", c.host, c.path, c.want, got)
+		}
+	}
+}
+
+func TestRouterReturnsNotFoundWithoutADefault(t *testing.T) {
+	router := NewRouter(newTestServer(t, &Config{Name: "North", Path: "/north"}))
+
+	if got := relayName(t, router, "relay.example", "/"); got != "" {
+		t.Errorf("Expected no community, got %q", got)
+	}
+}
+
+func TestCommunityConfigs(t *testing.T) {
+	single := &Config{Name: "Solo"}
+	configs, err := single.CommunityConfigs()
+	if err != nil || len(configs) != 1 || configs[0] != single {
+		t.Fatalf("Expected a config without communities to host itself, got %v %v", configs, err)
+	}
+
+	multi := &Config{Communities: []Config{
+		{Name: "North", Path: "north/", DBPath: "north_db"},
+		{Name: "South", Path: "/south", DBPath: "south_db"},
+	}}
+	configs, err = multi.CommunityConfigs()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if configs[0].Path != "/north" {
+		t.Errorf("Expected path to be normalised, got %q", configs[0].Path)
+	}
+
+	invalid := []*Config{
+		{Communities: []Config{{Path: "/a"}}},
+		{Communities: []Config{{Path: "/a", DBPath: "db"}, {Path: "/b", DBPath: "db"}}},
+		{Communities: []Config{{Path: "/a", DBPath: "a"}, {Path: "/a", DBPath: "b"}}},
+		{Communities: []Config{{DBPath: "a"}, {DBPath: "b"}}},
+	}
+	for i, config := range invalid {
+		if _, err := config.CommunityConfigs(); err == nil {
+			t.Errorf("Expected invalid config %d to fail", i)
+		}
+	}
+}
+
+func TestPathRoutedCommunityAcceptsAuth(t *testing.T) {
+	north := newTestServer(t, &Config{
+		Name:              "North",
+		Path:              "/north",
+		MembershipEnabled: true,
+		MembersFile:       filepath.Join(t.TempDir(), "members.json"),
+	})
+	httpServer := httptest.NewServer(NewRouter(north, newTestServer(t, &Config{Name: "Default"})))
+	defer httpServer.Close()
+
+	invite, err := north.membership.store.CreateInvite(1, 0, "test")
+	if err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The relay asks connections with an invite to authenticate
+	client, err := nostr.RelayConnect(ctx, "ws"+strings.TrimPrefix(httpServer.URL, "http")+"/north?invite="+invite.Code)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	authed := waitUntil(t, func() bool {
+		return client.Auth(ctx, func(event *nostr.Event) error { return event.Sign(sk) }) == nil
+	})
+	if !authed {
+		t.Fatal("Expected authenticating to the community's URL to succeed")
+	}
+	if err := client.Publish(ctx, *signedEvent(t, sk, 1)); err != nil {
+		t.Fatalf("Expected the invite to be redeemed, got %v", err)
+	}
+	if !north.membership.isMember(pubkey) {
+		t.Error("Expected the new member to be recorded")
+	}
+}
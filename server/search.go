@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"log"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/quota"
+	"github.crom/crbroughton/townsquares-relay/search"
+)
+
+// searchPolicy answers NIP-50 queries from the index kept by storage.
+// Events from peers are only held in memory, so they are indexed as they
+// arrive and are looked up in the manager.
+type searchPolicy struct {
+	index *search.Index
+}
+
+// newSearchPolicy returns nil unless storage keeps a search index.
+func newSearchPolicy(db *quota.Store) *searchPolicy {
+	indexed, ok := db.Store.(*search.Store)
+	if !ok {
+		return nil
+	}
+	return &searchPolicy{index: indexed.Index}
+}
+
+func (p *searchPolicy) onIncomingEvent(_ string, event *nostr.Event) {
+	if err := p.index.Add(event); err != nil {
+		log.Printf("Error indexing event %s: %v", event.ID, err)
+	}
+}
+
+// forget drops an event from a peer that is no longer held.
+func (p *searchPolicy) forget(event *nostr.Event) {
+	if p == nil || !search.Searchable(event) {
+		return
+	}
+	if err := p.index.Remove(event.ID); err != nil {
+		log.Printf("Error removing event %s from search index: %v", event.ID, err)
+	}
+}
+
+// searchEvents sends up to limit events matching a search filter, best
+// match first. Ids the index returns for events that can't be found, or
+// that don't match the rest of the filter, are skipped.
+func (s *Server) searchEvents(ctx context.Context, filter nostr.Filter, limit int, visible func(*nostr.Event) bool) (chan *nostr.Event, error) {
+	ids, err := s.search.index.Search(ctx, filter, search.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+
+		// Looked up as a negentropy session so backends return every id
+		// rather than stopping at their max_limit
+		found := make(map[string]*nostr.Event, len(ids))
+		if len(ids) > 0 {
+			localCh, err := s.db.QueryEvents(eventstore.SetNegentropy(ctx), nostr.Filter{IDs: ids})
+			if err != nil {
+				return
+			}
+			for event := range localCh {
+				found[event.ID] = event
+			}
+		}
+
+		sent := 0
+		for _, id := range ids {
+			if limit > 0 && sent >= limit {
+				return
+			}
+			event, ok := found[id]
+			if !ok {
+				event, ok = s.Manager.GetEvent(id)
+			}
+			if !ok || !filter.Matches(event) || !visible(event) {
+				continue
+			}
+			select {
+			case ch <- event:
+				sent++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
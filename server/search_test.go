@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestSearchQueries(t *testing.T) {
+	srv := newTestServer(t, &Config{SearchEnabled: true})
+	ctx := context.Background()
+
+	if !slices.Contains(srv.Relay.Info.SupportedNIPs, 50) {
+		t.Error("Expected NIP-50 to be advertised")
+	}
+
+	note := func(content string, tags ...nostr.Tag) *nostr.Event {
+		ev := &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Content: content, Tags: tags}
+		ev.Sign(nostr.GeneratePrivateKey())
+		if err := srv.storeEvent(ctx, ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		return ev
+	}
+	lost := note("Lost cat near the market", nostr.Tag{"t", "pets"})
+	found := note("Found a cat, is it yours? Lost and found at the library")
+	note("Bin collection moved to Tuesday")
+
+	query := func(filter nostr.Filter) []string {
+		ch, err := srv.queryEvents(ctx, filter)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		var ids []string
+		for event := range ch {
+			ids = append(ids, event.ID)
+		}
+		return ids
+	}
+
+	if ids := query(nostr.Filter{Search: "lost cat"}); !slices.Equal(ids, []string{lost.ID, found.ID}) {
+		t.Errorf("Expected both cats, best match first, got %v", ids)
+	}
+	if ids := query(nostr.Filter{Search: "lost cat", Limit: 1}); !slices.Equal(ids, []string{lost.ID}) {
+		t.Errorf("Expected the limit to apply, got %v", ids)
+	}
+	if ids := query(nostr.Filter{Search: "cat", Tags: nostr.TagMap{"t": {"pets"}}}); !slices.Equal(ids, []string{lost.ID}) {
+		t.Errorf("Expected tags to apply, got %v", ids)
+	}
+
+	if err := srv.moderation.store.MutePubKey(lost.PubKey, "", ""); err != nil {
+		t.Fatalf("Failed to mute: %v", err)
+	}
+	if ids := query(nostr.Filter{Search: "lost cat"}); !slices.Equal(ids, []string{found.ID}) {
+		t.Errorf("Expected muted authors to be hidden, got %v", ids)
+	}
+}
+
+func TestSearchDisabled(t *testing.T) {
+	srv := newTestServer(t, &Config{})
+
+	if slices.Contains(srv.Relay.Info.SupportedNIPs, 50) {
+		t.Error("Expected NIP-50 not to be advertised")
+	}
+	if srv.search != nil {
+		t.Error("Expected no search index")
+	}
+}
+
+func TestReplacedEventsLeaveSearch(t *testing.T) {
+	srv := newTestServer(t, &Config{SearchEnabled: true})
+	ctx := context.Background()
+
+	sk := nostr.GeneratePrivateKey()
+	for i, name := range []string{"Greengrocer", "Fishmonger"} {
+		profile := &nostr.Event{Kind: 0, CreatedAt: nostr.Timestamp(i + 1), Content: `{"name":"` + name + `"}`}
+		profile.Sign(sk)
+		if _, err := srv.Relay.AddEvent(ctx, profile); err != nil {
+			t.Fatalf("Failed to publish profile: %v", err)
+		}
+	}
+
+	for search, want := range map[string]int{"greengrocer": 0, "fishmonger": 1} {
+		ids, err := srv.search.index.Search(ctx, nostr.Filter{Search: search}, 0)
+		if err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		if len(ids) != want {
+			t.Errorf("Expected %d results for %q, got %v", want, search, ids)
+		}
+	}
+}
@@ -0,0 +1,515 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/netip"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.crom/crbroughton/townsquares-relay/groups"
+	"github.crom/crbroughton/townsquares-relay/manager"
+	"github.crom/crbroughton/townsquares-relay/quota"
+	"github.crom/crbroughton/townsquares-relay/search"
+	"github.crom/crbroughton/townsquares-relay/storage"
+)
+
+// Server is a single townsquares relay: the khatru relay, its local
+// storage and the manager that federates with peer relays.
+type Server struct {
+	Relay   *khatru.Relay
+	Manager *manager.RelayManager
+	config  *Config
+	db      *quota.Store
+	// blossom is nil unless the media server is enabled
+	blossom *blossomPolicy
+	clients *clientTracker
+	geohash *geohashPolicy
+	groups  *groupPolicy
+	// maintenance schedules value log GC and compaction
+	maintenance *maintenancePolicy
+	// membership is nil unless membership_enabled is set
+	membership *membershipPolicy
+	moderation *moderationPolicy
+	peers      *peerSync
+	// pow is nil unless proof of work is required
+	pow        *powPolicy
+	quota      *quotaPolicy
+	rateLimits *rateLimitPolicy
+	// rates counts recent events by kind for the admin dashboard
+	rates *eventRates
+	// relayPubKey signs the relay's own events, empty without a relay key
+	relayPubKey string
+	retention   *retentionPolicy
+	// search is nil unless search_enabled is set
+	search *searchPolicy
+	// templates render the landing page
+	templates *template.Template
+	// trustedProxies may tell us who their clients are
+	trustedProxies []netip.Prefix
+	// usedAuth stops NIP-98 authorizations being replayed
+	usedAuth    *usedAuthorizations
+	writePolicy *writePolicy
+}
+
+// New opens the relay's storage and wires up the khatru hooks. Peers are
+// not contacted until Start is called.
+func New(config *Config) (*Server, error) {
+	geohashPolicy, err := newGeohashPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+
+	templates, err := loadTemplates(config.TemplatesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	var relayPubKey string
+	if config.RelaySecretKey != "" {
+		if relayPubKey, err = nostr.GetPublicKey(config.RelaySecretKey); err != nil {
+			return nil, fmt.Errorf("invalid relay_secret_key: %w", err)
+		}
+	}
+
+	relay := khatru.NewRelay()
+
+	db, err := OpenStorage(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Relay:     relay,
+		Manager:   manager.NewRelayManager(),
+		config:    config,
+		db:        db,
+		clients:   newClientTracker(),
+		geohash:   geohashPolicy,
+		peers:     &peerSync{dialing: make(map[string]bool)},
+		rates:     newEventRates(),
+		templates: templates,
+
+		relayPubKey: relayPubKey,
+
+		trustedProxies: trustedProxies,
+		usedAuth:       newUsedAuthorizations(),
+	}
+	if err := s.setupPolicies(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// Bans may have changed while the relay was down
+	s.publishModerationLists(context.Background())
+
+	relay.StoreEvent = append(relay.StoreEvent, s.storeEvent)
+	relay.ReplaceEvent = append(relay.ReplaceEvent, s.replaceEvent)
+	relay.DeleteEvent = append(relay.DeleteEvent, s.removeEvent)
+	relay.QueryEvents = append(relay.QueryEvents, s.queryEvents)
+
+	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+		clientIP := khatru.GetIP(ctx)
+		log.Printf("New connection from %s", clientIP)
+	})
+	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+		clientIP := khatru.GetIP(ctx)
+		log.Printf("Connection closed from %s", clientIP)
+	})
+	relay.OnConnect = append(relay.OnConnect, s.clients.onConnect)
+	relay.OnDisconnect = append(relay.OnDisconnect, s.clients.onDisconnect)
+	relay.OnEventSaved = append(relay.OnEventSaved, s.rates.onEventSaved)
+	s.Manager.AddIncomingEventHandler(s.rates.onIncomingEvent)
+
+	mux := relay.Router()
+	if s.membership != nil {
+		s.registerMembershipAPI(mux)
+	}
+	s.registerPeersAPI(mux)
+	s.registerBansAPI(mux)
+	s.registerPeerListsAPI(mux)
+	s.registerReportsAPI(mux)
+	s.registerRateLimitAPI(mux)
+	s.registerRetentionAPI(mux)
+	s.registerQuotaAPI(mux)
+	s.registerStorageAPI(mux)
+	s.registerDashboardAPI(mux)
+	if s.blossom != nil {
+		s.registerBlossomAPI(mux)
+	}
+	if s.config.WebClientEnabled {
+		s.registerWebClient(mux)
+	}
+	if len(s.config.AdminPubKeys) > 0 || s.config.AdminToken != "" {
+		s.registerDashboard(mux)
+	}
+	mux.HandleFunc("/", s.serveLanding)
+
+	return s, nil
+}
+
+// OpenStorage opens the community's configured storage backend, counting
+// what each pubkey stores as events are saved and deleted, and keeping the
+// search index up to date when search is enabled. Commands that work on
+// storage while the relay is stopped use it too.
+func OpenStorage(config *Config) (*quota.Store, error) {
+	backend, err := storage.Open(config.DBBackend, config.DatabasePath(), config.DBSettings)
+	if err != nil {
+		return nil, err
+	}
+	var store eventstore.Store = backend
+	if config.SearchEnabled {
+		index, err := search.Open(config.SearchIndexPath())
+		if err != nil {
+			backend.Close()
+			return nil, err
+		}
+		store = search.NewStore(backend, index)
+	}
+	db, err := quota.New(store, backend.Meta)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to count storage usage: %w", err)
+	}
+	return db, nil
+}
+
+// limitation returns the relay's NIP-11 limitations, for policies to
+// advertise themselves in.
+func (s *Server) limitation() *nip11.RelayLimitationDocument {
+	if s.Relay.Info.Limitation == nil {
+		s.Relay.Info.Limitation = &nip11.RelayLimitationDocument{}
+	}
+	return s.Relay.Info.Limitation
+}
+
+// powWaived reports whether a pubkey can write without proof of work.
+func (s *Server) powWaived(pubkey string) bool {
+	if s.isAdmin(pubkey) {
+		return true
+	}
+	return s.config.PoW.WaiveForMembers && s.membership != nil && s.membership.isMember(pubkey)
+}
+
+// controlEvent reports whether an event from a peer tells us about the
+// peer rather than being content to federate: the moderation list of a
+// peer we trust, or group metadata when groups are enabled. Policies on
+// which content is federated leave them alone.
+func (s *Server) controlEvent(event *nostr.Event) bool {
+	if s.moderation.lists.trusted(event) {
+		return true
+	}
+	return s.groups != nil && nip29.MetadataEventKinds.Includes(event.Kind)
+}
+
+// relayState reports whether the relay depends on an event: group state
+// changes, which groups are rebuilt from, and the events the relay or its
+// peers sign about themselves.
+func (s *Server) relayState(event *nostr.Event) bool {
+	if s.relayPubKey != "" && event.PubKey == s.relayPubKey {
+		return true
+	}
+	return s.controlEvent(event) || (s.groups != nil && groups.IsStateEvent(event))
+}
+
+// setupPolicies registers the hooks of every policy. Rate limits are
+// checked first as they are cheapest, then bans, then membership, so the
+// most fundamental refusal is the one given.
+func (s *Server) setupPolicies() error {
+	relay := s.Relay
+	var err error
+
+	s.rateLimits = newRateLimitPolicy(s.config)
+	relay.RejectConnection = append(relay.RejectConnection, s.rateLimits.rejectConnection)
+	relay.RejectEvent = append(relay.RejectEvent, s.rateLimits.rejectEvent)
+	relay.OverwriteFilter = append(relay.OverwriteFilter, s.rateLimits.countFilter)
+	relay.RejectFilter = append(relay.RejectFilter, s.rateLimits.rejectFilter)
+	relay.OnDisconnect = append(relay.OnDisconnect, s.rateLimits.onDisconnect)
+
+	s.moderation, err = newModerationPolicy(s.config)
+	if err != nil {
+		return err
+	}
+	relay.RejectConnection = append(relay.RejectConnection, s.moderation.rejectConnection)
+	relay.RejectEvent = append(relay.RejectEvent, s.moderation.rejectEvent)
+	relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation, s.moderation.overwriteRelayInformation)
+	relay.OnEventSaved = append(relay.OnEventSaved, s.moderation.onEventSaved)
+	s.Manager.AddFederationFilter(s.moderation.federates)
+	s.Manager.AddSubscriptionFilters(s.moderation.lists.subscriptionFilters)
+	s.Manager.AddIncomingEventHandler(s.moderation.lists.onIncomingEvent)
+
+	s.writePolicy, err = newWritePolicy(s.config, s.controlEvent)
+	if err != nil {
+		return err
+	}
+	s.writePolicy.advertise(s.limitation)
+	relay.RejectEvent = append(relay.RejectEvent, s.writePolicy.rejectEvent)
+	s.Manager.AddFederationFilter(s.writePolicy.federates)
+
+	s.retention, err = newRetentionPolicy(s.config, s.relayState)
+	if err != nil {
+		return err
+	}
+	relay.RejectEvent = append(relay.RejectEvent, s.retention.rejectEvent)
+	s.Manager.AddFederationFilter(s.retention.federates)
+
+	s.membership, err = newMembershipPolicy(s.config, s.isAdmin)
+	if err != nil {
+		return err
+	}
+	if s.membership != nil {
+		relay.RejectEvent = append(relay.RejectEvent, s.membership.rejectEvent)
+		relay.RejectFilter = append(relay.RejectFilter, s.membership.rejectFilter)
+		relay.OnConnect = append(relay.OnConnect, s.membership.onConnect)
+		relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, s.membership.onEphemeralEvent)
+		relay.PreventBroadcast = append(relay.PreventBroadcast, s.membership.preventBroadcast)
+	}
+
+	s.pow, err = newPoWPolicy(s.config, s.powWaived, s.controlEvent)
+	if err != nil {
+		return err
+	}
+	if s.pow != nil {
+		s.limitation().MinPowDifficulty = s.pow.min
+		relay.RejectEvent = append(relay.RejectEvent, s.pow.rejectEvent)
+		s.Manager.AddFederationFilter(s.pow.federates)
+	}
+
+	s.Manager.AddFederationFilter(s.geohash.federates)
+	relay.RejectEvent = append(relay.RejectEvent, s.geohash.rejectEvent)
+	relay.PreventBroadcast = append(relay.PreventBroadcast, s.geohash.preventBroadcast)
+
+	s.groups, err = newGroupPolicy(s.config, s.db)
+	if err != nil {
+		return err
+	}
+	if s.groups != nil {
+		s.groups.groups.OnMetadata = func(event *nostr.Event) {
+			relay.BroadcastEvent(event)
+		}
+		s.Manager.AddFederationFilter(s.groups.federates)
+		s.Manager.AddSubscriptionFilters(s.groups.subscriptionFilters)
+		s.Manager.AddIncomingEventHandler(s.groups.onIncomingEvent)
+
+		relay.RejectEvent = append(relay.RejectEvent, s.groups.groups.RejectEvent)
+		relay.RejectFilter = append(relay.RejectFilter, s.groups.rejectFilter)
+		relay.PreventBroadcast = append(relay.PreventBroadcast, s.groups.preventBroadcast)
+		relay.OnEventSaved = append(relay.OnEventSaved, s.groups.groups.OnEventSaved)
+	}
+
+	// Quotas come last, as only events that would otherwise be stored count
+	s.quota, err = newQuotaPolicy(s.config, s.db, s.isAdmin)
+	if err != nil {
+		return err
+	}
+	relay.RejectEvent = append(relay.RejectEvent, s.quota.rejectEvent)
+	relay.OnEventSaved = append(relay.OnEventSaved, s.quota.onEventSaved)
+
+	s.maintenance, err = newMaintenancePolicy(s.config)
+	if err != nil {
+		return err
+	}
+
+	s.blossom, err = newBlossomPolicy(s.config, s)
+	if err != nil {
+		return err
+	}
+	if s.blossom != nil {
+		s.Manager.AddIncomingEventHandler(s.blossom.onIncomingEvent)
+	}
+
+	s.search = newSearchPolicy(s.db)
+	if s.search != nil {
+		s.Manager.AddIncomingEventHandler(s.search.onIncomingEvent)
+	}
+
+	s.setupManagementAPI()
+	s.setupRelayInformation()
+	return nil
+}
+
+// Start connects to the community's peer relays in the background,
+// retrying each one until it succeeds or ctx is cancelled, and keeps
+// following the peers admins add and remove.
+func (s *Server) Start(ctx context.Context) {
+	s.peers.mu.Lock()
+	s.peers.ctx = ctx
+	s.peers.mu.Unlock()
+	s.syncPeers()
+	go s.runPeerSync(ctx)
+	go s.moderation.lists.runBlockFlush(ctx)
+
+	s.Manager.StartSubscriptions(ctx)
+	go s.runRetention(ctx)
+	go s.runMaintenance(ctx)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = s.withoutUntrustedForwarding(r)
+	if r.Header.Get("Upgrade") != "websocket" && r.Header.Get("Accept") == "application/nostr+json" {
+		s.serveRelayInformation(w, r)
+		return
+	}
+	r, ok := s.checkNIP86(w, r)
+	if !ok {
+		return
+	}
+	s.Relay.ServeHTTP(w, s.withCommunityURL(r))
+}
+
+func (s *Server) Close() {
+	s.Manager.Close()
+	if s.blossom != nil {
+		s.blossom.stopMirrors()
+	}
+	s.moderation.lists.flushBlocks()
+	s.db.Close()
+}
+
+func (s *Server) storeEvent(ctx context.Context, event *nostr.Event) error {
+	if err := s.db.SaveEvent(ctx, event); err != nil {
+		return err
+	}
+
+	clientIP := khatru.GetIP(ctx)
+	log.Printf("Received event %s from relay %s", event.ID[:8], clientIP)
+	s.Manager.Broadcast(ctx, event)
+	return nil
+}
+
+// replaceEvent stores a replaceable or addressable event in place of the
+// versions before it, so they stop counting toward the author's quota.
+func (s *Server) replaceEvent(ctx context.Context, event *nostr.Event) error {
+	if err := s.db.ReplaceEvent(ctx, event); err != nil {
+		return err
+	}
+
+	clientIP := khatru.GetIP(ctx)
+	log.Printf("Received event %s from relay %s", event.ID[:8], clientIP)
+	s.Manager.Broadcast(ctx, event)
+	return nil
+}
+
+// removeEvent deletes an event its author asked to delete. khatru finds it
+// through queryEvents, so it may be one received from a peer rather than
+// stored here.
+func (s *Server) removeEvent(ctx context.Context, event *nostr.Event) error {
+	s.Manager.RemoveEvent(event.ID)
+
+	ch, err := s.db.QueryEvents(ctx, nostr.Filter{IDs: []string{event.ID}})
+	if err != nil {
+		return err
+	}
+	var found []*nostr.Event
+	for stored := range ch {
+		found = append(found, stored)
+	}
+	for _, stored := range found {
+		if err := s.db.DeleteEvent(ctx, stored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) queryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	filter, geo, err := extractGeoQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.Limit == 0 && !filter.LimitZero {
+		filter.Limit = s.config.Limitation.DefaultLimit
+	}
+	if max := s.config.Limitation.MaxLimit; max > 0 && (filter.Limit == 0 || filter.Limit > max) {
+		filter.Limit = max
+	}
+
+	// Some events are dropped after storage has applied the limit, so fetch
+	// up to storage's own maximum and apply the limit here instead
+	limit := filter.Limit
+	if geo != nil || s.geohash.policy == GeohashPolicyQuarantine {
+		filter.Limit = 0
+	}
+
+	// visible decides whether an event that matched the storage filter is
+	// actually served to the client
+	visible := func(event *nostr.Event) bool {
+		if !s.geohash.visible(event) || !s.moderation.visible(event) || !s.retention.visible(event) {
+			return false
+		}
+		if s.groups != nil && !s.groups.visible(ctx, event) {
+			return false
+		}
+		return geo == nil || geo.matches(event)
+	}
+
+	if filter.Search != "" && s.search != nil {
+		return s.searchEvents(ctx, filter, limit, visible)
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+
+		// Query local storage
+		localCh, err := s.db.QueryEvents(ctx, filter)
+		if err != nil {
+			return
+		}
+
+		seenEvents := make(map[string]bool)
+		sent := 0
+		full := func() bool {
+			return limit > 0 && sent >= limit
+		}
+		send := func(event *nostr.Event) bool {
+			select {
+			case ch <- event:
+				sent++
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// Send events from local storage. Storage doesn't stop when we do,
+		// so the channel is always drained.
+		for event := range localCh {
+			seenEvents[event.ID] = true
+			if full() || !visible(event) {
+				continue
+			}
+			if !send(event) {
+				for range localCh {
+				}
+				return
+			}
+		}
+
+		// Query events from connected relays
+		for _, event := range s.Manager.GetAllEvents() {
+			if full() {
+				return
+			}
+			if filter.Matches(event) && visible(event) {
+				if !seenEvents[event.ID] {
+					if !send(event) {
+						return
+					}
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
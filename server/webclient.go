@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/http"
+
+	"github.crom/crbroughton/townsquares-relay/webclient"
+)
+
+// webClientPolicy limits the client to this relay, the remote signers
+// members connect it to and its own files.
+const webClientPolicy = "default-src 'self'; connect-src 'self' ws: wss:; img-src 'self' data:; " +
+	"base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+
+// registerWebClient serves the embedded web client under /app.
+func (s *Server) registerWebClient(mux *http.ServeMux) {
+	files := http.StripPrefix("/app", http.FileServerFS(webclient.Files()))
+	mux.HandleFunc("GET /app/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", webClientPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		files.ServeHTTP(w, r)
+	})
+	// Left relative, which http.Redirect wouldn't, so it works under a
+	// community's path
+	mux.HandleFunc("GET /app", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "app/")
+		w.WriteHeader(http.StatusMovedPermanently)
+	})
+}
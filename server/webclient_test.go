@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWebClient(t *testing.T) {
+	srv := newTestServer(t, &Config{WebClientEnabled: true})
+
+	rec := getPage(t, srv, "http://relay.example/app/")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `src="app.js"`) {
+		t.Error("Expected the client's index page")
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'self'") {
+		t.Errorf("Expected a content security policy, got %q", csp)
+	}
+
+	rec = getPage(t, srv, "http://relay.example/app/app.js")
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/javascript") {
+		t.Errorf("Expected JavaScript, got %q", ct)
+	}
+
+	rec = getPage(t, srv, "http://relay.example/app")
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "app/" {
+		t.Errorf("Expected a relative redirect to app/, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	if !strings.Contains(getPage(t, srv, "http://relay.example/").Body.String(), "http://relay.example/app/") {
+		t.Error("Expected the landing page to link to the client")
+	}
+}
+
+func TestWebClientUnderCommunityPath(t *testing.T) {
+	router := NewRouter(newTestServer(t, &Config{Path: "/north", WebClientEnabled: true}))
+
+	if rec := getPage(t, router, "http://relay.example/north/app/"); rec.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", rec.Code)
+	}
+	if body := getPage(t, router, "http://relay.example/north").Body.String(); !strings.Contains(body, "http://relay.example/north/app/") {
+		t.Error("Expected the landing page to link to the community's client")
+	}
+}
+
+func TestWebClientDisabled(t *testing.T) {
+	srv := newTestServer(t, &Config{})
+
+	if rec := getPage(t, srv, "http://relay.example/app/"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", rec.Code)
+	}
+	if strings.Contains(getPage(t, srv, "http://relay.example/").Body.String(), "/app/") {
+		t.Error("Expected no link to a disabled client")
+	}
+}
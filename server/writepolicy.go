@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"unicode/utf8"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// writePolicy enforces the config's write_policy on events from clients
+// and from peers alike.
+type writePolicy struct {
+	WritePolicy
+	// control reports the events peers send about themselves, which the
+	// policy leaves alone
+	control func(*nostr.Event) bool
+}
+
+func newWritePolicy(config *Config, control func(*nostr.Event) bool) (*writePolicy, error) {
+	policy := config.WritePolicy
+	for _, kind := range policy.AllowedKinds {
+		if slices.Contains(policy.DeniedKinds, kind) {
+			return nil, fmt.Errorf("write_policy: kind %d is both allowed and denied", kind)
+		}
+	}
+	if policy.MaxContentLength < 0 || policy.MaxTags < 0 || policy.MaxEventSize < 0 ||
+		policy.CreatedAtLowerLimit < 0 || policy.CreatedAtUpperLimit < 0 {
+		return nil, fmt.Errorf("write_policy: limits cannot be negative")
+	}
+	return &writePolicy{WritePolicy: policy, control: control}, nil
+}
+
+// advertise publishes the limits NIP-11 has fields for.
+func (p *writePolicy) advertise(limitation func() *nip11.RelayLimitationDocument) {
+	if p.MaxContentLength > 0 {
+		limitation().MaxContentLength = p.MaxContentLength
+	}
+	if p.MaxTags > 0 {
+		limitation().MaxEventTags = p.MaxTags
+	}
+	if p.CreatedAtLowerLimit > 0 {
+		limitation().CreatedAtLowerLimit = p.CreatedAtLowerLimit
+	}
+	if p.CreatedAtUpperLimit > 0 {
+		limitation().CreatedAtUpperLimit = p.CreatedAtUpperLimit
+	}
+}
+
+func (p *writePolicy) check(event *nostr.Event) (bool, string) {
+	if slices.Contains(p.DeniedKinds, event.Kind) ||
+		(len(p.AllowedKinds) > 0 && !slices.Contains(p.AllowedKinds, event.Kind)) {
+		return true, fmt.Sprintf("blocked: kind %d is not accepted by this relay", event.Kind)
+	}
+	if p.MaxContentLength > 0 && utf8.RuneCountInString(event.Content) > p.MaxContentLength {
+		return true, fmt.Sprintf("invalid: content is longer than %d characters", p.MaxContentLength)
+	}
+	if p.MaxTags > 0 && len(event.Tags) > p.MaxTags {
+		return true, fmt.Sprintf("invalid: more than %d tags", p.MaxTags)
+	}
+	if p.MaxEventSize > 0 && len(event.String()) > p.MaxEventSize {
+		return true, fmt.Sprintf("invalid: event is larger than %d bytes", p.MaxEventSize)
+	}
+
+	now := nostr.Now()
+	if p.CreatedAtLowerLimit > 0 && event.CreatedAt < now-nostr.Timestamp(p.CreatedAtLowerLimit) {
+		return true, "invalid: created_at is too far in the past"
+	}
+	if p.CreatedAtUpperLimit > 0 && event.CreatedAt > now+nostr.Timestamp(p.CreatedAtUpperLimit) {
+		return true, "invalid: created_at is too far in the future"
+	}
+	return false, ""
+}
+
+func (p *writePolicy) rejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	return p.check(event)
+}
+
+// federates applies the policy to events from peers, apart from trusted
+// peers' moderation lists and group metadata, which are always needed.
+func (p *writePolicy) federates(peerURL string, event *nostr.Event) bool {
+	if p.control(event) {
+		return true
+	}
+	reject, _ := p.check(event)
+	return !reject
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.crom/crbroughton/townsquares-relay/manager"
+)
+
+func noControlEvents(*nostr.Event) bool { return false }
+
+func TestWritePolicy(t *testing.T) {
+	policy, err := newWritePolicy(&Config{WritePolicy: WritePolicy{
+		DeniedKinds:         []int{4},
+		MaxContentLength:    10,
+		MaxTags:             2,
+		MaxEventSize:        1000,
+		CreatedAtLowerLimit: 3600,
+		CreatedAtUpperLimit: 60,
+	}}, noControlEvents)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	now := nostr.Now()
+	tests := []struct {
+		name   string
+		event  nostr.Event
+		prefix string
+	}{
+		{"acceptable", nostr.Event{Kind: 1, CreatedAt: now, Content: "hello"}, ""},
+		{"denied kind", nostr.Event{Kind: 4, CreatedAt: now}, "blocked:"},
+		{"long content", nostr.Event{Kind: 1, CreatedAt: now, Content: "hello there!"}, "invalid:"},
+		{"many tags", nostr.Event{Kind: 1, CreatedAt: now, Tags: nostr.Tags{{"t", "a"}, {"t", "b"}, {"t", "c"}}}, "invalid:"},
+		{"large", nostr.Event{Kind: 1, CreatedAt: now, Tags: nostr.Tags{{"t", strings.Repeat("a", 1000)}}}, "invalid:"},
+		{"old", nostr.Event{Kind: 1, CreatedAt: now - 7200}, "invalid:"},
+		{"future", nostr.Event{Kind: 1, CreatedAt: now + 600}, "invalid:"},
+	}
+	for _, tt := range tests {
+		reject, msg := policy.check(&tt.event)
+		if tt.prefix == "" && reject {
+			t.Errorf("%s: Expected event to be accepted, got %q", tt.name, msg)
+		}
+		if tt.prefix != "" && (!reject || !strings.HasPrefix(msg, tt.prefix)) {
+			t.Errorf("%s: Expected %s rejection, got %v %q", tt.name, tt.prefix, reject, msg)
+		}
+		if policy.federates("ws://peer", &tt.event) == reject {
+			t.Errorf("%s: Expected federation to match client writes", tt.name)
+		}
+	}
+}
+
+func TestWritePolicyAllowedKinds(t *testing.T) {
+	srv := newTestServer(t, &Config{WritePolicy: WritePolicy{AllowedKinds: []int{1, 7}, MaxTags: 5}})
+
+	if reject, _ := srv.writePolicy.check(&nostr.Event{Kind: 3, CreatedAt: nostr.Now()}); !reject {
+		t.Error("Expected kinds missing from allowed_kinds to be refused")
+	}
+	if srv.Relay.Info.Limitation.MaxEventTags != 5 {
+		t.Errorf("Expected NIP-11 to advertise 5 tags, got %d", srv.Relay.Info.Limitation.MaxEventTags)
+	}
+	if _, err := newWritePolicy(&Config{WritePolicy: WritePolicy{AllowedKinds: []int{1}, DeniedKinds: []int{1}}}, noControlEvents); err == nil {
+		t.Error("Expected a kind both allowed and denied to fail")
+	}
+}
+
+func TestPeerControlEventsPassWritePolicy(t *testing.T) {
+	peerKey := nostr.GeneratePrivateKey()
+	peerPubKey, _ := nostr.GetPublicKey(peerKey)
+	peerURL := "wss://peer.example"
+
+	transport := manager.NewMemoryTransport()
+	peer := transport.Relay(peerURL)
+	for _, event := range peerControlEvents(t, peerKey) {
+		event.CreatedAt -= 7200
+		event.Sign(peerKey)
+		peer.Publish(event)
+	}
+
+	srv := newTestServer(t, &Config{
+		Relays:         []string{peerURL},
+		TrustedPeers:   []TrustedPeer{{URL: peerURL, PubKey: peerPubKey}},
+		RelaySecretKey: nostr.GeneratePrivateKey(),
+		GroupsEnabled:  true,
+		WritePolicy:    WritePolicy{AllowedKinds: []int{1}, CreatedAtLowerLimit: 3600},
+	})
+	srv.Manager.SetTransport(transport)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv.Start(ctx)
+
+	assertPeerControlEventsHandled(t, srv, peerURL)
+	if srv.writePolicy.federates(peerURL, signedEvent(t, peerKey, 7)) {
+		t.Error("Expected the peer's other events to still follow the policy")
+	}
+}
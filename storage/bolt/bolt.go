@@ -0,0 +1,294 @@
+// Package bolt is an eventstore backend kept in a single bbolt file, for
+// small relays that want a plain file instead of a database directory.
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// eventsBucket maps event ids to their JSON
+	eventsBucket = []byte("events")
+	// The index buckets have keys ending in created_at and the event id,
+	// after the pubkey or kind they index, so they sort newest last
+	createdAtBucket = []byte("created_at")
+	pubkeyBucket    = []byte("pubkey")
+	kindBucket      = []byte("kind")
+	// tagBucket indexes single-letter tags by name and a hash of the value
+	tagBucket = []byte("tag")
+)
+
+var _ eventstore.Store = (*BoltBackend)(nil)
+
+type BoltBackend struct {
+	Path               string
+	MaxLimit           int
+	MaxLimitNegentropy int
+
+	*bolt.DB
+}
+
+func (b *BoltBackend) Init() error {
+	db, err := bolt.Open(b.Path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		// Files from before tags were indexed have their tag index built
+		indexTags := tx.Bucket(tagBucket) == nil && tx.Bucket(eventsBucket) != nil
+		for _, name := range [][]byte{eventsBucket, createdAtBucket, pubkeyBucket, kindBucket, tagBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if indexTags {
+			return buildTagIndex(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	b.DB = db
+
+	if b.MaxLimit == 0 {
+		b.MaxLimit = 1000
+	}
+	if b.MaxLimitNegentropy == 0 {
+		b.MaxLimitNegentropy = 16777216
+	}
+	return nil
+}
+
+func (b *BoltBackend) Close() {
+	b.DB.Close()
+}
+
+func (b *BoltBackend) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	if err := checkBounds(event); err != nil {
+		return err
+	}
+	return b.Update(func(tx *bolt.Tx) error {
+		return save(tx, event)
+	})
+}
+
+func (b *BoltBackend) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	return b.Update(func(tx *bolt.Tx) error {
+		return remove(tx, event.ID)
+	})
+}
+
+// ReplaceEvent deletes older versions of a replaceable or addressable
+// event and saves it, unless a newer version is already stored.
+func (b *BoltBackend) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	if err := checkBounds(event); err != nil {
+		return err
+	}
+	return b.Update(func(tx *bolt.Tx) error {
+		filter := nostr.Filter{Kinds: []int{event.Kind}, Authors: []string{event.PubKey}}
+		if nostr.IsAddressableKind(event.Kind) {
+			filter.Tags = nostr.TagMap{"d": []string{event.Tags.GetD()}}
+		}
+		previous, err := query(tx, filter, 10)
+		if err != nil {
+			return err
+		}
+
+		store := true
+		for _, old := range previous {
+			if isOlder(old, event) {
+				if err := remove(tx, old.ID); err != nil {
+					return err
+				}
+			} else {
+				store = false
+			}
+		}
+		if !store {
+			return nil
+		}
+		return save(tx, event)
+	})
+}
+
+func (b *BoltBackend) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ch := make(chan *nostr.Event)
+	if filter.LimitZero {
+		close(ch)
+		return ch, nil
+	}
+
+	maxLimit := b.MaxLimit
+	if eventstore.IsNegentropySession(ctx) {
+		maxLimit = b.MaxLimitNegentropy
+	}
+	limit := filter.Limit
+	if limit <= 0 || limit > maxLimit {
+		limit = maxLimit
+	}
+
+	var events []*nostr.Event
+	err := b.View(func(tx *bolt.Tx) error {
+		var err error
+		events, err = query(tx, filter, limit)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer close(ch)
+		for _, event := range events {
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func checkBounds(event *nostr.Event) error {
+	if event.CreatedAt > math.MaxUint32 || event.Kind > math.MaxUint16 {
+		return fmt.Errorf("event with values out of expected boundaries")
+	}
+	return nil
+}
+
+// isOlder reports whether previous is replaced by next, breaking ties on
+// created_at with the lowest id as NIP-01 asks.
+func isOlder(previous, next *nostr.Event) bool {
+	return previous.CreatedAt < next.CreatedAt ||
+		(previous.CreatedAt == next.CreatedAt && previous.ID > next.ID)
+}
+
+func save(tx *bolt.Tx, event *nostr.Event) error {
+	id, err := hex.DecodeString(event.ID)
+	if err != nil || len(id) != 32 {
+		return fmt.Errorf("invalid event id %q", event.ID)
+	}
+	events := tx.Bucket(eventsBucket)
+	if events.Get(id) != nil {
+		return eventstore.ErrDupEvent
+	}
+
+	data, err := event.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if err := events.Put(id, data); err != nil {
+		return err
+	}
+	for _, entry := range indexKeys(event, id) {
+		if err := tx.Bucket(entry.bucket).Put(entry.key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func remove(tx *bolt.Tx, eventID string) error {
+	id, err := hex.DecodeString(eventID)
+	if err != nil || len(id) != 32 {
+		return nil
+	}
+	event := get(tx, id)
+	if event == nil {
+		return nil
+	}
+
+	for _, entry := range indexKeys(event, id) {
+		if err := tx.Bucket(entry.bucket).Delete(entry.key); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(eventsBucket).Delete(id)
+}
+
+func get(tx *bolt.Tx, id []byte) *nostr.Event {
+	data := tx.Bucket(eventsBucket).Get(id)
+	if data == nil {
+		return nil
+	}
+	event := &nostr.Event{}
+	if err := event.UnmarshalJSON(data); err != nil {
+		return nil
+	}
+	return event
+}
+
+// buildTagIndex adds every stored event to the tag index.
+func buildTagIndex(tx *bolt.Tx) error {
+	bucket := tx.Bucket(tagBucket)
+	return tx.Bucket(eventsBucket).ForEach(func(id, data []byte) error {
+		event := &nostr.Event{}
+		if err := event.UnmarshalJSON(data); err != nil {
+			return nil
+		}
+		for _, entry := range indexKeys(event, id) {
+			if bytes.Equal(entry.bucket, tagBucket) {
+				if err := bucket.Put(entry.key, nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// indexEntry is the key of an event in an index bucket.
+type indexEntry struct {
+	bucket []byte
+	key    []byte
+}
+
+// indexKeys returns the keys of the event in the index buckets. Tags
+// with the same name and value share a key.
+func indexKeys(event *nostr.Event, id []byte) []indexEntry {
+	entries := []indexEntry{
+		{createdAtBucket, indexKey(nil, event.CreatedAt, id)},
+		{kindBucket, indexKey(kindPrefix(event.Kind), event.CreatedAt, id)},
+	}
+	if pubkey, err := hex.DecodeString(event.PubKey); err == nil {
+		entries = append(entries, indexEntry{pubkeyBucket, indexKey(pubkey, event.CreatedAt, id)})
+	}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && len(tag[0]) == 1 {
+			entries = append(entries, indexEntry{tagBucket, indexKey(tagPrefix(tag[0], tag[1]), event.CreatedAt, id)})
+		}
+	}
+	return entries
+}
+
+func kindPrefix(kind int) []byte {
+	return binary.BigEndian.AppendUint16(nil, uint16(kind))
+}
+
+// tagPrefix is the tag's name followed by the first 8 bytes of the
+// SHA-256 of its value, so every prefix is the same length.
+func tagPrefix(name, value string) []byte {
+	hash := sha256.Sum256([]byte(value))
+	return append([]byte(name), hash[:8]...)
+}
+
+func indexKey(prefix []byte, createdAt nostr.Timestamp, id []byte) []byte {
+	key := make([]byte, 0, len(prefix)+4+len(id))
+	key = append(key, prefix...)
+	key = binary.BigEndian.AppendUint32(key, uint32(createdAt))
+	return append(key, id...)
+}
@@ -0,0 +1,164 @@
+package bolt
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestBackend(t *testing.T, path string) *BoltBackend {
+	t.Helper()
+
+	b := &BoltBackend{Path: path}
+	if err := b.Init(); err != nil {
+		t.Fatalf("Failed to open bolt: %v", err)
+	}
+	return b
+}
+
+func signedEvent(t *testing.T, sk string, kind int, createdAt nostr.Timestamp, tags ...nostr.Tag) *nostr.Event {
+	t.Helper()
+
+	event := &nostr.Event{Kind: kind, CreatedAt: createdAt, Tags: tags}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	return event
+}
+
+func queryIDs(t *testing.T, b *BoltBackend, filter nostr.Filter) []string {
+	t.Helper()
+
+	ch, err := b.QueryEvents(context.Background(), filter)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	var ids []string
+	for event := range ch {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+// indexSize returns how many keys an index bucket has.
+func indexSize(t *testing.T, b *BoltBackend, bucket []byte) int {
+	t.Helper()
+
+	n := 0
+	b.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+func TestQueries(t *testing.T) {
+	b := openTestBackend(t, filepath.Join(t.TempDir(), "db"))
+	defer b.Close()
+	ctx := context.Background()
+
+	alice := nostr.GeneratePrivateKey()
+	bob := nostr.GeneratePrivateKey()
+	note := signedEvent(t, alice, 1, 100, nostr.Tag{"t", "townsquare"})
+	reply := signedEvent(t, bob, 1, 200, nostr.Tag{"e", note.ID}, nostr.Tag{"p", note.PubKey})
+	reaction := signedEvent(t, bob, 7, 300, nostr.Tag{"e", note.ID}, nostr.Tag{"e", note.ID})
+	// Tags with longer names aren't indexed, but still match
+	labelled := signedEvent(t, alice, 1, 400, nostr.Tag{"label", "x"})
+	for _, event := range []*nostr.Event{note, reply, reaction, labelled} {
+		if err := b.SaveEvent(ctx, event); err != nil {
+			t.Fatalf("Failed to save event: %v", err)
+		}
+	}
+	if err := b.SaveEvent(ctx, note); !errors.Is(err, eventstore.ErrDupEvent) {
+		t.Errorf("Expected saving twice to be a duplicate, got %v", err)
+	}
+
+	since, until := nostr.Timestamp(150), nostr.Timestamp(350)
+	tests := []struct {
+		name     string
+		filter   nostr.Filter
+		expected []string
+	}{
+		{"everything, newest first", nostr.Filter{}, []string{labelled.ID, reaction.ID, reply.ID, note.ID}},
+		{"ids", nostr.Filter{IDs: []string{reply.ID, "zz"}}, []string{reply.ID}},
+		{"authors", nostr.Filter{Authors: []string{note.PubKey}}, []string{labelled.ID, note.ID}},
+		{"kinds", nostr.Filter{Kinds: []int{7}}, []string{reaction.ID}},
+		{"e tags", nostr.Filter{Tags: nostr.TagMap{"e": {note.ID}}}, []string{reaction.ID, reply.ID}},
+		{"e tags and kinds", nostr.Filter{Kinds: []int{7}, Tags: nostr.TagMap{"e": {note.ID}}}, []string{reaction.ID}},
+		{"several tags", nostr.Filter{Tags: nostr.TagMap{"e": {note.ID, reply.ID}, "p": {note.PubKey}}}, []string{reply.ID}},
+		{"tag values", nostr.Filter{Tags: nostr.TagMap{"t": {"townsquare", "other"}}}, []string{note.ID}},
+		{"no tag values", nostr.Filter{Tags: nostr.TagMap{"t": {}}}, nil},
+		{"long tag names", nostr.Filter{Tags: nostr.TagMap{"label": {"x"}}}, []string{labelled.ID}},
+		{"since and until", nostr.Filter{Since: &since, Until: &until}, []string{reaction.ID, reply.ID}},
+		{"limit", nostr.Filter{Limit: 1}, []string{labelled.ID}},
+		{"tags and limit", nostr.Filter{Tags: nostr.TagMap{"e": {note.ID}}, Limit: 1}, []string{reaction.ID}},
+	}
+	for _, test := range tests {
+		if ids := queryIDs(t, b, test.filter); !slices.Equal(ids, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, ids)
+		}
+	}
+
+	if err := b.DeleteEvent(ctx, reaction); err != nil {
+		t.Fatalf("Failed to delete event: %v", err)
+	}
+	if ids := queryIDs(t, b, nostr.Filter{Tags: nostr.TagMap{"e": {note.ID}}}); !slices.Equal(ids, []string{reply.ID}) {
+		t.Errorf("Expected the deleted event to be gone, got %v", ids)
+	}
+	// The note's t tag and the reply's e and p tags are left
+	if n := indexSize(t, b, tagBucket); n != 3 {
+		t.Errorf("Expected deleting to remove the event's tag keys, got %d keys", n)
+	}
+}
+
+func TestReplaceEvent(t *testing.T) {
+	b := openTestBackend(t, filepath.Join(t.TempDir(), "db"))
+	defer b.Close()
+	ctx := context.Background()
+
+	sk := nostr.GeneratePrivateKey()
+	first := signedEvent(t, sk, 30023, 100, nostr.Tag{"d", "post"})
+	other := signedEvent(t, sk, 30023, 150, nostr.Tag{"d", "other"})
+	second := signedEvent(t, sk, 30023, 200, nostr.Tag{"d", "post"})
+	older := signedEvent(t, sk, 30023, 50, nostr.Tag{"d", "post"})
+	for _, event := range []*nostr.Event{first, other, second, older} {
+		if err := b.ReplaceEvent(ctx, event); err != nil {
+			t.Fatalf("Failed to replace event: %v", err)
+		}
+	}
+
+	ids := queryIDs(t, b, nostr.Filter{Kinds: []int{30023}})
+	if !slices.Equal(ids, []string{second.ID, other.ID}) {
+		t.Errorf("Expected the newest version of each address, got %v", ids)
+	}
+}
+
+func TestTagIndexIsBuiltForOlderFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	b := openTestBackend(t, path)
+	sk := nostr.GeneratePrivateKey()
+	note := signedEvent(t, sk, 1, 100)
+	reply := signedEvent(t, sk, 1, 200, nostr.Tag{"e", note.ID})
+	for _, event := range []*nostr.Event{note, reply} {
+		if err := b.SaveEvent(context.Background(), event); err != nil {
+			t.Fatalf("Failed to save event: %v", err)
+		}
+	}
+	// Files written before the tag index have no bucket for it
+	b.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(tagBucket)
+	})
+	b.Close()
+
+	b = openTestBackend(t, path)
+	defer b.Close()
+	if ids := queryIDs(t, b, nostr.Filter{Tags: nostr.TagMap{"e": {note.ID}}}); !slices.Equal(ids, []string{reply.ID}) {
+		t.Errorf("Expected the reply to be found by its tag, got %v", ids)
+	}
+}
@@ -0,0 +1,138 @@
+package bolt
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+	bolt "go.etcd.io/bbolt"
+)
+
+var maxID = bytes.Repeat([]byte{0xff}, 32)
+
+// query returns up to limit events matching filter, newest first. Filters
+// with authors walk the pubkey index, filters with single-letter tags the
+// tag index, filters with kinds the kind index, and anything else walks
+// every event by created_at.
+func query(tx *bolt.Tx, filter nostr.Filter, limit int) ([]*nostr.Event, error) {
+	var events []*nostr.Event
+	if len(filter.IDs) > 0 {
+		for _, eventID := range filter.IDs {
+			id, err := hex.DecodeString(eventID)
+			if err != nil || len(id) != 32 {
+				continue
+			}
+			if event := get(tx, id); event != nil && filter.Matches(event) {
+				events = append(events, event)
+			}
+		}
+		return newest(events, limit), nil
+	}
+
+	bucket := createdAtBucket
+	prefixes := [][]byte{nil}
+	switch {
+	case len(filter.Authors) > 0:
+		bucket = pubkeyBucket
+		prefixes = prefixes[:0]
+		for _, author := range filter.Authors {
+			if pubkey, err := hex.DecodeString(author); err == nil && len(pubkey) == 32 {
+				prefixes = append(prefixes, pubkey)
+			}
+		}
+	case indexedTag(filter) != "":
+		bucket = tagBucket
+		prefixes = prefixes[:0]
+		name := indexedTag(filter)
+		for _, value := range filter.Tags[name] {
+			prefixes = append(prefixes, tagPrefix(name, value))
+		}
+	case len(filter.Kinds) > 0:
+		bucket = kindBucket
+		prefixes = prefixes[:0]
+		for _, kind := range filter.Kinds {
+			if kind >= 0 && kind <= math.MaxUint16 {
+				prefixes = append(prefixes, kindPrefix(kind))
+			}
+		}
+	}
+	prefixes = slices.CompactFunc(slices.SortedFunc(slices.Values(prefixes), bytes.Compare), bytes.Equal)
+
+	since := uint32(0)
+	if filter.Since != nil {
+		since = uint32(max(0, min(int64(*filter.Since), math.MaxUint32)))
+	}
+	until := uint32(math.MaxUint32)
+	if filter.Until != nil {
+		until = uint32(max(0, min(int64(*filter.Until), math.MaxUint32)))
+	}
+
+	for _, prefix := range prefixes {
+		events = append(events, scan(tx.Bucket(bucket), prefix, since, until, filter, limit)...)
+	}
+	return newest(events, limit), nil
+}
+
+// indexedTag returns the single-letter tag of the filter with the fewest
+// values, which the tag index is walked for, or "" when it has none.
+func indexedTag(filter nostr.Filter) string {
+	best := ""
+	for name, values := range filter.Tags {
+		if len(name) != 1 || values == nil {
+			continue
+		}
+		if best == "" || len(values) < len(filter.Tags[best]) || (len(values) == len(filter.Tags[best]) && name < best) {
+			best = name
+		}
+	}
+	return best
+}
+
+// scan walks one index prefix from until back to since, returning up to
+// limit matching events.
+func scan(bucket *bolt.Bucket, prefix []byte, since, until uint32, filter nostr.Filter, limit int) []*nostr.Event {
+	var events []*nostr.Event
+	c := bucket.Cursor()
+	tx := bucket.Tx()
+
+	seek := indexKey(prefix, nostr.Timestamp(until), maxID)
+	k, _ := c.Seek(seek)
+	if k == nil {
+		k, _ = c.Last()
+	} else if bytes.Compare(k, seek) > 0 {
+		k, _ = c.Prev()
+	}
+
+	for ; k != nil && bytes.HasPrefix(k, prefix) && len(k) == len(prefix)+36; k, _ = c.Prev() {
+		if binary.BigEndian.Uint32(k[len(prefix):]) < since {
+			break
+		}
+		event := get(tx, k[len(prefix)+4:])
+		if event == nil || !filter.Matches(event) {
+			continue
+		}
+		events = append(events, event)
+		if len(events) >= limit {
+			break
+		}
+	}
+	return events
+}
+
+// newest sorts events newest first and keeps up to limit of them.
+func newest(events []*nostr.Event, limit int) []*nostr.Event {
+	slices.SortFunc(events, func(a, b *nostr.Event) int {
+		if c := cmp.Compare(b.CreatedAt, a.CreatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events
+}
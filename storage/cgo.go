@@ -0,0 +1,307 @@
+//go:build cgo
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+
+	mdb "github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/lmdb"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// lmdbMetaFile is the file in the LMDB directory Meta is kept in. The
+// backend uses every named database its environment allows, so Meta has
+// an environment of its own.
+const lmdbMetaFile = "meta.mdb"
+
+// lmdbMetaMapSize is the most Meta can grow to with LMDB. Like the event
+// database's, the map is reserved address space rather than disk.
+const lmdbMetaMapSize = 1 << 34
+
+func newLMDB(path string, settings LMDBSettings) eventstore.Store {
+	return &lmdbStore{LMDBBackend: &lmdb.LMDBBackend{
+		Path:     path,
+		MaxLimit: settings.MaxLimit,
+		MapSize:  settings.MapSize,
+	}}
+}
+
+// lmdbStore works around the lmdb backend holding negentropy sessions to
+// a configured MaxLimit, and saving an event it already has a second time.
+type lmdbStore struct {
+	*lmdb.LMDBBackend
+	mu   sync.Mutex
+	meta *lmdbMeta
+}
+
+// openMeta opens Meta in its own file inside the LMDB directory.
+func (s *lmdbStore) openMeta() (Meta, string, error) {
+	env, err := mdb.NewEnv()
+	if err != nil {
+		return nil, "", err
+	}
+	path := filepath.Join(s.Path, lmdbMetaFile)
+	mapSize := int64(lmdbMetaMapSize)
+	if s.MapSize > 0 {
+		mapSize = min(mapSize, s.MapSize)
+	}
+	if err := env.SetMapSize(mapSize); err != nil {
+		env.Close()
+		return nil, "", err
+	}
+	if err := env.Open(path, mdb.NoSubdir, 0644); err != nil {
+		env.Close()
+		return nil, "", err
+	}
+	meta := &lmdbMeta{env: env}
+	err = env.Update(func(txn *mdb.Txn) error {
+		meta.dbi, err = txn.OpenRoot(0)
+		return err
+	})
+	if err != nil {
+		env.Close()
+		return nil, "", err
+	}
+	s.meta = meta
+	return meta, path, nil
+}
+
+func (s *lmdbStore) Close() {
+	s.LMDBBackend.Close()
+	if s.meta != nil {
+		s.meta.env.Close()
+	}
+}
+
+func (s *lmdbStore) Init() error {
+	if err := s.LMDBBackend.Init(); err != nil {
+		return err
+	}
+	// Init lowers this to MaxLimit when one is set
+	s.MaxLimitNegentropy = bulkLimit
+	return nil
+}
+
+func (s *lmdbStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, err := s.QueryEvents(ctx, nostr.Filter{IDs: []string{event.ID}})
+	if err != nil {
+		return err
+	}
+	found := false
+	for range ch {
+		found = true
+	}
+	if found {
+		return eventstore.ErrDupEvent
+	}
+	return s.LMDBBackend.SaveEvent(ctx, event)
+}
+
+type lmdbMeta struct {
+	env *mdb.Env
+	dbi mdb.DBI
+}
+
+func (m *lmdbMeta) View(fn func(txn MetaTxn) error) error {
+	return m.env.View(func(txn *mdb.Txn) error {
+		return fn(lmdbTxn{txn, m.dbi})
+	})
+}
+
+func (m *lmdbMeta) Update(fn func(txn MetaTxn) error) error {
+	return m.env.Update(func(txn *mdb.Txn) error {
+		return fn(lmdbTxn{txn, m.dbi})
+	})
+}
+
+type lmdbTxn struct {
+	txn *mdb.Txn
+	dbi mdb.DBI
+}
+
+func (t lmdbTxn) Get(key []byte) ([]byte, error) {
+	value, err := t.txn.Get(t.dbi, key)
+	if mdb.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	return bytes.Clone(value), err
+}
+
+func (t lmdbTxn) Set(key, value []byte) error {
+	return t.txn.Put(t.dbi, key, value, 0)
+}
+
+func (t lmdbTxn) Delete(key []byte) error {
+	err := t.txn.Del(t.dbi, key, nil)
+	if mdb.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (t lmdbTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	c, err := t.txn.OpenCursor(t.dbi)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	k, v, err := c.Get(prefix, nil, mdb.SetRange)
+	for ; err == nil && bytes.HasPrefix(k, prefix); k, v, err = c.Get(nil, nil, mdb.Next) {
+		if err := fn(bytes.Clone(k), bytes.Clone(v)); err != nil {
+			return err
+		}
+	}
+	if err != nil && !mdb.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func newSQLite3(path string, settings SQLite3Settings) eventstore.Store {
+	return &sqliteStore{SQLite3Backend: &sqlite3.SQLite3Backend{
+		DatabaseURL: path,
+		QueryLimit:  settings.QueryLimit,
+	}}
+}
+
+// sqliteStore lets negentropy sessions, which the relay uses to read
+// everything it has stored, go past the query limit the sqlite3 backend
+// otherwise always applies.
+type sqliteStore struct {
+	*sqlite3.SQLite3Backend
+	bulk *sqlite3.SQLite3Backend
+}
+
+func (s *sqliteStore) Init() error {
+	if err := s.SQLite3Backend.Init(); err != nil {
+		return err
+	}
+	s.bulk = &sqlite3.SQLite3Backend{
+		DB:                s.DB,
+		QueryLimit:        bulkLimit,
+		QueryIDsLimit:     s.QueryIDsLimit,
+		QueryAuthorsLimit: s.QueryAuthorsLimit,
+		QueryKindsLimit:   s.QueryKindsLimit,
+		QueryTagsLimit:    s.QueryTagsLimit,
+	}
+	return nil
+}
+
+// openMeta keeps Meta in a table of the SQLite database.
+func (s *sqliteStore) openMeta() (Meta, string, error) {
+	_, err := s.DB.Exec(`CREATE TABLE IF NOT EXISTS relay_meta (key BLOB PRIMARY KEY, value BLOB NOT NULL) WITHOUT ROWID`)
+	return sqliteMeta{s.DB.DB}, "", err
+}
+
+func (s *sqliteStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	if eventstore.IsNegentropySession(ctx) {
+		return s.bulk.QueryEvents(ctx, filter)
+	}
+	return s.SQLite3Backend.QueryEvents(ctx, filter)
+}
+
+type sqliteMeta struct {
+	db *sql.DB
+}
+
+func (m sqliteMeta) View(fn func(txn MetaTxn) error) error {
+	return m.run("BEGIN", fn)
+}
+
+// Update takes the write lock as it begins, so it waits for other writers
+// rather than failing when it goes from reading to writing.
+func (m sqliteMeta) Update(fn func(txn MetaTxn) error) error {
+	return m.run("BEGIN IMMEDIATE", fn)
+}
+
+func (m sqliteMeta) run(begin string, fn func(txn MetaTxn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, begin); err != nil {
+		return err
+	}
+	if err := fn(sqliteTxn{ctx, conn}); err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return err
+}
+
+type sqliteTxn struct {
+	ctx  context.Context
+	conn *sql.Conn
+}
+
+func (t sqliteTxn) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := t.conn.QueryRowContext(t.ctx, `SELECT value FROM relay_meta WHERE key = ?`, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (t sqliteTxn) Set(key, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := t.conn.ExecContext(t.ctx, `INSERT INTO relay_meta (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+func (t sqliteTxn) Delete(key []byte) error {
+	_, err := t.conn.ExecContext(t.ctx, `DELETE FROM relay_meta WHERE key = ?`, key)
+	return err
+}
+
+func (t sqliteTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	query, args := `SELECT key, value FROM relay_meta WHERE key >= ? ORDER BY key`, []any{prefix}
+	if end := prefixEnd(prefix); end != nil {
+		query, args = `SELECT key, value FROM relay_meta WHERE key >= ? AND key < ? ORDER BY key`, append(args, end)
+	}
+	rows, err := t.conn.QueryContext(t.ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// Rows are read before calling fn, which may write to the table
+	type entry struct{ key, value []byte }
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.key, &e.value); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	for _, e := range entries {
+		if err := fn(e.key, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// DefaultDiscardRatio is how much of a value log file has to be stale
+// before garbage collection rewrites it.
+const DefaultDiscardRatio = 0.5
+
+// Size is how much disk a database uses, in bytes. Meta is only given
+// separately when it has a file of its own, and for Badger the LSM tree and
+// value log are too.
+type Size struct {
+	Total    int64 `json:"total"`
+	Events   int64 `json:"events"`
+	Meta     int64 `json:"meta"`
+	LSM      int64 `json:"lsm,omitempty"`
+	ValueLog int64 `json:"value_log,omitempty"`
+}
+
+// Size measures the database's files on disk.
+func (db *DB) Size() (Size, error) {
+	var size Size
+	err := diskUsage(db.Path, func(path string, bytes int64) {
+		if db.metaPath != "" && strings.HasPrefix(path, db.metaPath) {
+			size.Meta += bytes
+			return
+		}
+		size.Events += bytes
+		switch filepath.Ext(path) {
+		case ".sst":
+			size.LSM += bytes
+		case ".vlog":
+			size.ValueLog += bytes
+		}
+	})
+	size.Total = size.Events + size.Meta
+	return size, err
+}
+
+// diskUsage calls add with the size of every file at path, which may be a
+// file or a directory. SQLite's journal files sit next to the database.
+func diskUsage(path string, add func(path string, bytes int64)) error {
+	err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		add(path, info.Size())
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if info, err := os.Stat(path + suffix); err == nil {
+			add(path+suffix, info.Size())
+		}
+	}
+	return nil
+}
+
+// MaintenanceReport says what a maintenance run did, and how much space it
+// won back.
+type MaintenanceReport struct {
+	At        time.Time     `json:"at"`
+	Compacted bool          `json:"compacted"`
+	Rewritten int           `json:"value_log_files_rewritten"`
+	Took      time.Duration `json:"took"`
+	Before    Size          `json:"before"`
+	After     Size          `json:"after"`
+}
+
+// Maintain garbage collects Badger's value log, rewriting files with at
+// least discardRatio of stale data. With compact, the LSM tree is
+// flattened first, which drops deleted and overwritten keys. Other
+// backends look after their own space.
+func (db *DB) Maintain(compact bool, discardRatio float64) (MaintenanceReport, error) {
+	if discardRatio <= 0 || discardRatio >= 1 {
+		discardRatio = DefaultDiscardRatio
+	}
+	report := MaintenanceReport{At: time.Now(), Compacted: compact}
+	report.Before, _ = db.Size()
+
+	if bdb := db.badger; bdb != nil {
+		if compact {
+			if err := bdb.Flatten(max(1, runtime.NumCPU()/2)); err != nil {
+				return report, err
+			}
+		}
+		for {
+			err := bdb.RunValueLogGC(discardRatio)
+			if errors.Is(err, badger.ErrNoRewrite) || errors.Is(err, badger.ErrRejected) {
+				break
+			}
+			if err != nil {
+				return report, err
+			}
+			report.Rewritten++
+		}
+	}
+
+	report.After, _ = db.Size()
+	report.Took = time.Since(report.At)
+	return report, nil
+}
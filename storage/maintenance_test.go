@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMaintenance(t *testing.T) {
+	for _, backend := range Backends {
+		t.Run(backend, func(t *testing.T) {
+			db := openTestDB(t, backend, Settings{})
+			ctx := context.Background()
+			sk := nostr.GeneratePrivateKey()
+			for i := range 20 {
+				event := signedEvent(t, sk, 1, nostr.Timestamp(100+i))
+				db.SaveEvent(ctx, event)
+				if i%2 == 0 {
+					db.DeleteEvent(ctx, event)
+				}
+			}
+
+			report, err := db.Maintain(true, 0)
+			if err != nil {
+				t.Fatalf("Maintain failed: %v", err)
+			}
+			if report.After.Total == 0 || report.After.Total != report.After.Events+report.After.Meta {
+				t.Errorf("Expected the database's size to be measured, got %+v", report.After)
+			}
+			if count, _ := Count(ctx, db); count != 10 {
+				t.Errorf("Expected maintenance to keep the 10 remaining events, got %d", count)
+			}
+		})
+	}
+}
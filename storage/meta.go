@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/dgraph-io/badger/v4"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrNotFound is returned by MetaTxn.Get for a key that isn't set.
+var ErrNotFound = errors.New("key not found")
+
+// Meta is a small key-value store for the relay's own bookkeeping, such as
+// storage quotas, kept in the same backend as the events.
+type Meta interface {
+	// View calls fn in a read-only transaction.
+	View(fn func(txn MetaTxn) error) error
+	// Update calls fn in a read-write transaction, which is committed
+	// unless fn returns an error.
+	Update(fn func(txn MetaTxn) error) error
+}
+
+// MetaTxn reads and writes Meta. Keys and values it returns are copies
+// the caller may keep.
+type MetaTxn interface {
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	// Iterate calls fn with every key starting with prefix, in order,
+	// stopping at the first error.
+	Iterate(prefix []byte, fn func(key, value []byte) error) error
+}
+
+// metaBatch is how many keys are written in one transaction when copying
+// or rebuilding many of them, keeping transactions small.
+const metaBatch = 1000
+
+// prefixEnd returns the first key after every key starting with prefix,
+// or nil when there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// badgerMeta keeps Meta in the Badger event database, under keys clear of
+// the ones eventstore uses.
+type badgerMeta struct {
+	db *badger.DB
+}
+
+func (m badgerMeta) View(fn func(txn MetaTxn) error) error {
+	return m.db.View(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+func (m badgerMeta) Update(fn func(txn MetaTxn) error) error {
+	return m.db.Update(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+func (t badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (t badgerTxn) Set(key, value []byte) error {
+	return t.txn.Set(key, value)
+}
+
+func (t badgerTxn) Delete(key []byte) error {
+	return t.txn.Delete(key)
+}
+
+func (t badgerTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	it := t.txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true, PrefetchSize: 100})
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(item.KeyCopy(nil), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metaBucket is the bolt bucket Meta is kept in, next to the events.
+var metaBucket = []byte("meta")
+
+type boltMeta struct {
+	db *bolt.DB
+}
+
+func newBoltMeta(db *bolt.DB) (boltMeta, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	})
+	return boltMeta{db}, err
+}
+
+func (m boltMeta) View(fn func(txn MetaTxn) error) error {
+	return m.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTxn{tx.Bucket(metaBucket)})
+	})
+}
+
+func (m boltMeta) Update(fn func(txn MetaTxn) error) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTxn{tx.Bucket(metaBucket)})
+	})
+}
+
+type boltTxn struct {
+	bucket *bolt.Bucket
+}
+
+func (t boltTxn) Get(key []byte) ([]byte, error) {
+	// Get can't tell a missing key from an empty value, but a cursor can
+	k, v := t.bucket.Cursor().Seek(key)
+	if !bytes.Equal(k, key) {
+		return nil, ErrNotFound
+	}
+	return bytes.Clone(v), nil
+}
+
+func (t boltTxn) Set(key, value []byte) error {
+	return t.bucket.Put(key, value)
+}
+
+func (t boltTxn) Delete(key []byte) error {
+	return t.bucket.Delete(key)
+}
+
+func (t boltTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	c := t.bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(bytes.Clone(k), bytes.Clone(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMetaIsKeptInTheBackend(t *testing.T) {
+	for _, backend := range Backends {
+		t.Run(backend, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			db, err := Open(backend, path, Settings{})
+			if err != nil {
+				t.Fatalf("Failed to open %s: %v", backend, err)
+			}
+			defer db.Close()
+
+			err = db.Meta.Update(func(txn MetaTxn) error {
+				for _, key := range [][]byte{{MetaPrefix, 2}, {MetaPrefix, 1}, {MetaPrefix + 1, 1}} {
+					if err := txn.Set(key, key[1:]); err != nil {
+						return err
+					}
+				}
+				return txn.Set([]byte{MetaPrefix, 3}, nil)
+			})
+			if err != nil {
+				t.Fatalf("Failed to write keys: %v", err)
+			}
+
+			var keys [][]byte
+			err = db.Meta.View(func(txn MetaTxn) error {
+				if value, err := txn.Get([]byte{MetaPrefix, 2}); err != nil || !slices.Equal(value, []byte{2}) {
+					t.Errorf("Expected the value to be read back, got %v %v", value, err)
+				}
+				if value, err := txn.Get([]byte{MetaPrefix, 3}); err != nil || len(value) != 0 {
+					t.Errorf("Expected an empty value to be found, got %v %v", value, err)
+				}
+				if _, err := txn.Get([]byte{MetaPrefix, 9}); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Expected a missing key to be reported, got %v", err)
+				}
+				return txn.Iterate([]byte{MetaPrefix}, func(key, value []byte) error {
+					keys = append(keys, key)
+					return nil
+				})
+			})
+			if err != nil {
+				t.Fatalf("Failed to read keys: %v", err)
+			}
+			want := [][]byte{{MetaPrefix, 1}, {MetaPrefix, 2}, {MetaPrefix, 3}}
+			if !slices.EqualFunc(keys, want, slices.Equal) {
+				t.Errorf("Expected %v in order, got %v", want, keys)
+			}
+
+			err = db.Meta.Update(func(txn MetaTxn) error {
+				return txn.Delete([]byte{MetaPrefix, 2})
+			})
+			if err != nil {
+				t.Fatalf("Failed to delete key: %v", err)
+			}
+			db.Meta.View(func(txn MetaTxn) error {
+				if _, err := txn.Get([]byte{MetaPrefix, 2}); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Expected the key to be deleted, got %v", err)
+				}
+				return nil
+			})
+
+			if _, err := os.Stat(path + "-meta"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected no separate metadata database, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix, end []byte
+	}{
+		{[]byte{MetaPrefix}, []byte{MetaPrefix + 1}},
+		{[]byte{1, 0xFF}, []byte{2}},
+		{[]byte{0xFF, 0xFF}, nil},
+	}
+	for _, test := range tests {
+		if end := prefixEnd(test.prefix); !slices.Equal(end, test.end) {
+			t.Errorf("Expected the end of %v to be %v, got %v", test.prefix, test.end, end)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Keys the relay keeps in Meta start with a byte from MetaPrefix to 0xFE,
+// clear of the prefixes eventstore's badger backend uses, so they can be
+// told apart from events when Meta is the event database.
+const MetaPrefix byte = 0xF0
+
+// migrationKey records how far a migration into this database has got.
+var migrationKey = []byte{0xF2}
+
+// migrationPage is how many events are copied between saving progress.
+const migrationPage = 1000
+
+// aliases are other names backends go by.
+var aliases = map[string]string{
+	"sqlite": SQLite3,
+	"bbolt":  Bolt,
+}
+
+// ParseLocation splits a location like "sqlite:relay.db" into a backend
+// and path.
+func ParseLocation(location string) (backend, path string, err error) {
+	backend, path, found := strings.Cut(location, ":")
+	if !found || path == "" {
+		return "", "", fmt.Errorf("%q should be <backend>:<path>, like badger:db", location)
+	}
+	if alias, ok := aliases[backend]; ok {
+		backend = alias
+	}
+	return backend, path, nil
+}
+
+// MigrationProgress is how far a migration has got. Events older than
+// Until are still to be copied.
+type MigrationProgress struct {
+	From   string          `json:"from"`
+	Until  nostr.Timestamp `json:"until"`
+	Copied int             `json:"copied"`
+	Done   bool            `json:"done"`
+}
+
+// Migrate copies every event, and the relay's own keys in Meta, from one
+// database to another, newest first. Progress is saved in the destination
+// after every page, so running it again after an interruption carries on
+// where it stopped. from names the source, so a destination is never
+// resumed from a different one. Once copied, the events in both are
+// counted and must match. Events from peers, and where they came from, are
+// only held in the manager's memory, so there is none of them to copy.
+func Migrate(ctx context.Context, source, destination *DB, from string, progress func(MigrationProgress)) (MigrationProgress, error) {
+	state, err := loadProgress(destination.Meta)
+	if err != nil {
+		return state, err
+	}
+	switch {
+	case state.From == "":
+		state = MigrationProgress{From: from, Until: 1<<32 - 1}
+	case state.From != from:
+		return state, fmt.Errorf("destination already has a migration from %s", state.From)
+	case state.Done:
+		return state, verifyCounts(ctx, source, destination)
+	}
+
+	filter := nostr.Filter{Until: &state.Until}
+	err = Walk(ctx, source, filter, migrationPage, func(page []*nostr.Event, oldest nostr.Timestamp) error {
+		for _, event := range page {
+			err := destination.SaveEvent(ctx, event)
+			if err != nil && !errors.Is(err, eventstore.ErrDupEvent) {
+				return fmt.Errorf("failed to copy %s: %w", event.ID, err)
+			}
+			state.Copied++
+		}
+		state.Until = oldest - 1
+		if progress != nil {
+			progress(state)
+		}
+		return saveProgress(destination.Meta, state)
+	})
+	if err != nil {
+		return state, err
+	}
+
+	if err := copyMeta(source.Meta, destination.Meta); err != nil {
+		return state, fmt.Errorf("failed to copy relay metadata: %w", err)
+	}
+	state.Done = true
+	if err := saveProgress(destination.Meta, state); err != nil {
+		return state, err
+	}
+	return state, verifyCounts(ctx, source, destination)
+}
+
+// Count returns how many events are stored.
+func Count(ctx context.Context, store eventstore.Store) (int, error) {
+	count := 0
+	err := Walk(ctx, store, nostr.Filter{}, migrationPage, func(page []*nostr.Event, _ nostr.Timestamp) error {
+		count += len(page)
+		return nil
+	})
+	return count, err
+}
+
+func verifyCounts(ctx context.Context, source, destination *DB) error {
+	want, err := Count(ctx, source)
+	if err != nil {
+		return err
+	}
+	got, err := Count(ctx, destination)
+	if err != nil {
+		return err
+	}
+	if want != got {
+		return fmt.Errorf("source has %d events but destination has %d", want, got)
+	}
+	return nil
+}
+
+func loadProgress(meta Meta) (MigrationProgress, error) {
+	var state MigrationProgress
+	err := meta.View(func(txn MetaTxn) error {
+		value, err := txn.Get(migrationKey)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(value, &state)
+	})
+	return state, err
+}
+
+func saveProgress(meta Meta, state MigrationProgress) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return meta.Update(func(txn MetaTxn) error {
+		return txn.Set(migrationKey, data)
+	})
+}
+
+// copyMeta copies the relay's keys, such as quota counts, leaving out
+// progress of earlier migrations. Keys are written a batch at a time.
+func copyMeta(from, to Meta) error {
+	type entry struct{ key, value []byte }
+	var batch []entry
+	flush := func() error {
+		err := to.Update(func(txn MetaTxn) error {
+			for _, e := range batch {
+				if err := txn.Set(e.key, e.value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		batch = batch[:0]
+		return err
+	}
+
+	for prefix := MetaPrefix; prefix < 0xFF; prefix++ {
+		err := from.View(func(txn MetaTxn) error {
+			return txn.Iterate([]byte{prefix}, func(key, value []byte) error {
+				if bytes.Equal(key, migrationKey) {
+					return nil
+				}
+				batch = append(batch, entry{key, value})
+				if len(batch) < metaBatch {
+					return nil
+				}
+				return flush()
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return flush()
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// failingStore stops saving after a number of events, like a migration
+// that was interrupted.
+type failingStore struct {
+	eventstore.Store
+	saves int
+}
+
+func (s *failingStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	if s.saves == 0 {
+		return errors.New("interrupted")
+	}
+	s.saves--
+	return s.Store.SaveEvent(ctx, event)
+}
+
+func TestMigrationResumesAndCopiesMeta(t *testing.T) {
+	ctx := context.Background()
+	source := openTestDB(t, Badger, Settings{})
+	destination := openTestDB(t, SQLite3, Settings{})
+
+	sk := nostr.GeneratePrivateKey()
+	for i := range migrationPage + 500 {
+		// Several events share each second, so pages end partway through one
+		if err := source.SaveEvent(ctx, signedEvent(t, sk, 1, nostr.Timestamp(1000+i/7), nostr.Tag{"i", strconv.Itoa(i)})); err != nil {
+			t.Fatalf("Failed to save event: %v", err)
+		}
+	}
+	quotaKey := []byte{MetaPrefix, 1, 2, 3}
+	err := source.Meta.Update(func(txn MetaTxn) error {
+		return txn.Set(quotaKey, []byte("counts"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to write meta key: %v", err)
+	}
+
+	store := destination.Store
+	destination.Store = &failingStore{Store: store, saves: migrationPage + 100}
+	state, err := Migrate(ctx, source, destination, "badger:db", nil)
+	if err == nil {
+		t.Fatal("Expected the interrupted migration to fail")
+	}
+	if state.Copied < migrationPage || state.Done {
+		t.Errorf("Expected the first page to have been copied, got %+v", state)
+	}
+
+	destination.Store = store
+	if _, err := Migrate(ctx, source, destination, "badger:other", nil); err == nil {
+		t.Error("Expected resuming from a different source to be refused")
+	}
+	state, err = Migrate(ctx, source, destination, "badger:db", nil)
+	if err != nil {
+		t.Fatalf("Resumed migration failed: %v", err)
+	}
+	if !state.Done {
+		t.Errorf("Expected the migration to be done, got %+v", state)
+	}
+	if count, _ := Count(ctx, destination); count != migrationPage+500 {
+		t.Errorf("Expected %d events to be copied, got %d", migrationPage+500, count)
+	}
+
+	err = destination.Meta.View(func(txn MetaTxn) error {
+		_, err := txn.Get(quotaKey)
+		return err
+	})
+	if err != nil {
+		t.Errorf("Expected the relay's meta keys to be copied, got %v", err)
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	backend, path, err := ParseLocation("sqlite:relay.db")
+	if err != nil || backend != SQLite3 || path != "relay.db" {
+		t.Errorf("Expected sqlite3 at relay.db, got %q %q %v", backend, path, err)
+	}
+	if _, _, err := ParseLocation("relay.db"); err == nil {
+		t.Error("Expected a location without a backend to be refused")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !cgo
+
+package storage
+
+import "github.com/fiatjaf/eventstore"
+
+// LMDB and SQLite are C libraries, so these backends are missing from
+// relays built without cgo.
+
+func newLMDB(path string, settings LMDBSettings) eventstore.Store {
+	return nil
+}
+
+func newSQLite3(path string, settings SQLite3Settings) eventstore.Store {
+	return nil
+}
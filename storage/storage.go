@@ -0,0 +1,143 @@
+// Package storage opens the eventstore backend a relay keeps its events
+// in, chosen by name so the rest of the relay only sees eventstore.Store.
+package storage
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fiatjaf/eventstore"
+	eventbadger "github.com/fiatjaf/eventstore/badger"
+	"github.crom/crbroughton/townsquares-relay/storage/bolt"
+)
+
+// The backends a relay can keep its events in.
+const (
+	Badger  = "badger"
+	LMDB    = "lmdb"
+	SQLite3 = "sqlite3"
+	Bolt    = "bolt"
+)
+
+// Backends lists every backend, in the order they are documented.
+var Backends = []string{Badger, LMDB, SQLite3, Bolt}
+
+// bulkLimit is how many events a negentropy session can read at once. The
+// relay uses these sessions to read everything it has stored, so they are
+// never held to a configured max_limit.
+const bulkLimit = 16777216
+
+// Settings tune each backend. Only the settings of the backend in use are
+// read, and zero values keep the backend's defaults.
+type Settings struct {
+	Badger  BadgerSettings  `json:"badger,omitzero"`
+	LMDB    LMDBSettings    `json:"lmdb,omitzero"`
+	SQLite3 SQLite3Settings `json:"sqlite3,omitzero"`
+	Bolt    BoltSettings    `json:"bolt,omitzero"`
+}
+
+type BadgerSettings struct {
+	// MaxLimit is the most events one query returns
+	MaxLimit int `json:"max_limit,omitempty"`
+	// MemTableSize and ValueLogFileSize are in bytes. Smaller values suit
+	// small devices.
+	MemTableSize     int64 `json:"mem_table_size,omitempty"`
+	ValueLogFileSize int64 `json:"value_log_file_size,omitempty"`
+}
+
+type LMDBSettings struct {
+	MaxLimit int `json:"max_limit,omitempty"`
+	// MapSize is the most the database can grow to, in bytes
+	MapSize int64 `json:"map_size,omitempty"`
+}
+
+type SQLite3Settings struct {
+	// QueryLimit is the most events one query returns
+	QueryLimit int `json:"query_limit,omitempty"`
+}
+
+type BoltSettings struct {
+	MaxLimit int `json:"max_limit,omitempty"`
+}
+
+// DB is an opened backend. Meta keeps the relay's own bookkeeping, such as
+// storage quotas, in the same backend: under keys of its own with Badger,
+// in a bucket with bolt, in a table with SQLite, and in a file of its own
+// inside the LMDB directory.
+type DB struct {
+	eventstore.Store
+	Backend string
+	Path    string
+	Meta    Meta
+	// badger is the event database with the badger backend
+	badger *badger.DB
+	// metaPath is set when Meta has a file of its own
+	metaPath string
+}
+
+// metaOpener is a backend that keeps Meta itself.
+type metaOpener interface {
+	// openMeta returns Meta and the file it is in, if it has its own.
+	openMeta() (Meta, string, error)
+}
+
+// Open opens the named backend at path, which defaults to badger.
+func Open(backend, path string, settings Settings) (*DB, error) {
+	if backend == "" {
+		backend = Badger
+	}
+
+	var store eventstore.Store
+	switch backend {
+	case Badger:
+		store = newBadger(path, settings.Badger)
+	case LMDB:
+		store = newLMDB(path, settings.LMDB)
+	case SQLite3:
+		store = newSQLite3(path, settings.SQLite3)
+	case Bolt:
+		store = &bolt.BoltBackend{Path: path, MaxLimit: settings.Bolt.MaxLimit, MaxLimitNegentropy: bulkLimit}
+	default:
+		return nil, fmt.Errorf("unknown db_backend %q, expected one of %v", backend, Backends)
+	}
+	if store == nil {
+		return nil, fmt.Errorf("db_backend %q needs cgo, and this relay was built without it", backend)
+	}
+	if err := store.Init(); err != nil {
+		return nil, fmt.Errorf("failed to initialize %s database: %w", backend, err)
+	}
+
+	db := &DB{Store: store, Backend: backend, Path: path}
+	var err error
+	switch s := store.(type) {
+	case *eventbadger.BadgerBackend:
+		// Init lowers this to MaxLimit when one is set
+		s.MaxLimitNegentropy = bulkLimit
+		db.Meta, db.badger = badgerMeta{s.DB}, s.DB
+	case *bolt.BoltBackend:
+		db.Meta, err = newBoltMeta(s.DB)
+	case metaOpener:
+		db.Meta, db.metaPath, err = s.openMeta()
+	}
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to initialize metadata: %w", err)
+	}
+	return db, nil
+}
+
+func newBadger(path string, settings BadgerSettings) *eventbadger.BadgerBackend {
+	return &eventbadger.BadgerBackend{
+		Path:     path,
+		MaxLimit: settings.MaxLimit,
+		BadgerOptionsModifier: func(opts badger.Options) badger.Options {
+			if settings.MemTableSize > 0 {
+				opts = opts.WithMemTableSize(settings.MemTableSize)
+			}
+			if settings.ValueLogFileSize > 0 {
+				opts = opts.WithValueLogFileSize(settings.ValueLogFileSize)
+			}
+			return opts
+		},
+	}
+}
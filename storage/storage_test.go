@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func openTestDB(t *testing.T, backend string, settings Settings) *DB {
+	t.Helper()
+
+	db, err := Open(backend, filepath.Join(t.TempDir(), "db"), settings)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", backend, err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func signedEvent(t *testing.T, sk string, kind int, createdAt nostr.Timestamp, tags ...nostr.Tag) *nostr.Event {
+	t.Helper()
+
+	event := &nostr.Event{Kind: kind, CreatedAt: createdAt, Tags: tags}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	return event
+}
+
+func queryIDs(t *testing.T, ctx context.Context, db *DB, filter nostr.Filter) []string {
+	t.Helper()
+
+	ch, err := db.QueryEvents(ctx, filter)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	var ids []string
+	for event := range ch {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestBackends(t *testing.T) {
+	for _, backend := range Backends {
+		t.Run(backend, func(t *testing.T) {
+			db := openTestDB(t, backend, Settings{})
+			if db.Meta == nil {
+				t.Fatal("Expected a metadata database")
+			}
+			ctx := context.Background()
+
+			alice := nostr.GeneratePrivateKey()
+			bob := nostr.GeneratePrivateKey()
+			old := signedEvent(t, alice, 1, 100)
+			tagged := signedEvent(t, alice, 1, 200, nostr.Tag{"t", "townsquare"})
+			other := signedEvent(t, bob, 7, 300)
+			for _, event := range []*nostr.Event{old, tagged, other} {
+				if err := db.SaveEvent(ctx, event); err != nil {
+					t.Fatalf("Failed to save event: %v", err)
+				}
+			}
+			if err := db.SaveEvent(ctx, old); !errors.Is(err, eventstore.ErrDupEvent) {
+				t.Errorf("Expected saving twice to be a duplicate, got %v", err)
+			}
+
+			tests := []struct {
+				name     string
+				filter   nostr.Filter
+				expected []string
+			}{
+				{"everything, newest first", nostr.Filter{}, []string{other.ID, tagged.ID, old.ID}},
+				{"ids", nostr.Filter{IDs: []string{old.ID}}, []string{old.ID}},
+				{"authors", nostr.Filter{Authors: []string{old.PubKey}}, []string{tagged.ID, old.ID}},
+				{"kinds", nostr.Filter{Kinds: []int{7}}, []string{other.ID}},
+				{"tags", nostr.Filter{Tags: nostr.TagMap{"t": {"townsquare"}}}, []string{tagged.ID}},
+				{"since", nostr.Filter{Since: ptr(nostr.Timestamp(150))}, []string{other.ID, tagged.ID}},
+				{"until", nostr.Filter{Until: ptr(nostr.Timestamp(150))}, []string{old.ID}},
+				{"limit", nostr.Filter{Limit: 1}, []string{other.ID}},
+			}
+			for _, tt := range tests {
+				ids := queryIDs(t, ctx, db, tt.filter)
+				if len(ids) != len(tt.expected) {
+					t.Errorf("%s: expected %d events, got %d", tt.name, len(tt.expected), len(ids))
+					continue
+				}
+				for i := range ids {
+					if ids[i] != tt.expected[i] {
+						t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, ids)
+						break
+					}
+				}
+			}
+
+			if err := db.DeleteEvent(ctx, old); err != nil {
+				t.Fatalf("Failed to delete event: %v", err)
+			}
+			if ids := queryIDs(t, ctx, db, nostr.Filter{IDs: []string{old.ID}}); len(ids) != 0 {
+				t.Errorf("Expected deleted event to be gone, got %v", ids)
+			}
+		})
+	}
+}
+
+func TestReplaceableEvents(t *testing.T) {
+	for _, backend := range Backends {
+		t.Run(backend, func(t *testing.T) {
+			db := openTestDB(t, backend, Settings{})
+			ctx := context.Background()
+			sk := nostr.GeneratePrivateKey()
+
+			first := signedEvent(t, sk, 0, 100)
+			second := signedEvent(t, sk, 0, 200)
+			for _, event := range []*nostr.Event{first, second, signedEvent(t, sk, 0, 150)} {
+				if err := db.ReplaceEvent(ctx, event); err != nil {
+					t.Fatalf("Failed to replace event: %v", err)
+				}
+			}
+
+			ids := queryIDs(t, ctx, db, nostr.Filter{Kinds: []int{0}, Authors: []string{first.PubKey}})
+			if len(ids) != 1 || ids[0] != second.ID {
+				t.Errorf("Expected only the newest metadata %s, got %v", second.ID, ids)
+			}
+		})
+	}
+}
+
+func TestNegentropySessionsReadEverything(t *testing.T) {
+	settings := Settings{
+		Badger:  BadgerSettings{MaxLimit: 4},
+		LMDB:    LMDBSettings{MaxLimit: 4},
+		SQLite3: SQLite3Settings{QueryLimit: 4},
+		Bolt:    BoltSettings{MaxLimit: 4},
+	}
+	for _, backend := range Backends {
+		t.Run(backend, func(t *testing.T) {
+			db := openTestDB(t, backend, settings)
+			ctx := context.Background()
+			sk := nostr.GeneratePrivateKey()
+
+			for i := range 10 {
+				if err := db.SaveEvent(ctx, signedEvent(t, sk, 1, nostr.Timestamp(100+i))); err != nil {
+					t.Fatalf("Failed to save event: %v", err)
+				}
+			}
+
+			if ids := queryIDs(t, ctx, db, nostr.Filter{}); len(ids) > 4 {
+				t.Errorf("Expected queries to be limited to 4 events, got %d", len(ids))
+			}
+			if ids := queryIDs(t, eventstore.SetNegentropy(ctx), db, nostr.Filter{}); len(ids) != 10 {
+				t.Errorf("Expected a negentropy session to read all 10 events, got %d", len(ids))
+			}
+		})
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	if _, err := Open("mongo", filepath.Join(t.TempDir(), "db"), Settings{}); err == nil {
+		t.Error("Expected an unknown backend to be refused")
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"slices"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Walk calls fn with every stored event matching filter, newest first, a
+// page of about pageSize events at a time. filter's limit is ignored.
+//
+// A page may end partway through a second, so the whole of its oldest
+// second is fetched before fn is called. Once fn returns, every event from
+// oldest onwards has been seen, so a walk can carry on after an
+// interruption with Until set to oldest-1.
+func Walk(ctx context.Context, store eventstore.Store, filter nostr.Filter, pageSize int, fn func(page []*nostr.Event, oldest nostr.Timestamp) error) error {
+	// Pages are read as negentropy sessions so backends don't hold them to
+	// a lower max_limit
+	ctx = eventstore.SetNegentropy(ctx)
+
+	until := nostr.Timestamp(1<<32 - 1)
+	if filter.Until != nil {
+		until = *filter.Until
+	}
+	for {
+		page := filter
+		page.Until = &until
+		page.Limit = pageSize
+		batch, err := query(ctx, store, page)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		oldest := until
+		for _, event := range batch {
+			oldest = min(oldest, event.CreatedAt)
+		}
+		full := len(batch) >= pageSize
+		if full {
+			batch = slices.DeleteFunc(batch, func(event *nostr.Event) bool {
+				return event.CreatedAt == oldest
+			})
+			second := filter
+			second.Since = &oldest
+			second.Until = &oldest
+			second.Limit = 0
+			events, err := query(ctx, store, second)
+			if err != nil {
+				return err
+			}
+			batch = append(batch, events...)
+		}
+
+		if err := fn(batch, oldest); err != nil {
+			return err
+		}
+		if !full || oldest == 0 {
+			return nil
+		}
+		until = oldest - 1
+	}
+}
+
+func query(ctx context.Context, store eventstore.Store, filter nostr.Filter) ([]*nostr.Event, error) {
+	ch, err := store.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var events []*nostr.Event
+	for event := range ch {
+		events = append(events, event)
+	}
+	return events, nil
+}
@@ -1,6 +1,7 @@
 package tsnet
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
@@ -85,6 +86,10 @@ func (s *Server) HTTPClient() *http.Client {
 	return s.srv.HTTPClient()
 }
 
+func (s *Server) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	return s.srv.Dial(ctx, network, address)
+}
+
 func (s *Server) LocalClient() (*local.Client, error) {
 	return s.srv.LocalClient()
 }
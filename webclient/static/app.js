@@ -0,0 +1,417 @@
+// A small client for the community's own relay: read the local feed, post
+// and reply. It only ever talks to the relay that served it, apart from a
+// remote signer's relays.
+
+import { bytesToHex, npubEncode, randomBytes } from "./nostr.js";
+import { ExtensionSigner, RemoteSigner, parseBunkerURL, restoreSigner } from "./signer.js";
+
+const FEED_LIMIT = 100;
+// The signer is only remembered for the tab, as a remote signer's session
+// key is a secret anything able to read storage could sign with
+const SAVED_SIGNER = "townsquares.signer";
+
+// The relay is the community the client is served under, /app/ being
+// mounted at its root
+const base = new URL("..", location.href);
+const RELAY_URL = base.href.replace(/^http/, "ws").replace(/\/$/, "");
+
+const $ = (selector) => document.querySelector(selector);
+
+class Relay {
+  constructor(url, { onEvent, onStatus, onAuth }) {
+    this.url = url;
+    this.onEvent = onEvent;
+    this.onStatus = onStatus;
+    this.onAuth = onAuth;
+    this.subscriptions = new Map();
+    // once holds subscriptions closed at the end of stored events
+    this.once = new Set();
+    this.published = new Map();
+    this.retry = 1000;
+    this.connect();
+  }
+
+  connect() {
+    this.ws = new WebSocket(this.url);
+    this.ws.onopen = () => {
+      this.retry = 1000;
+      this.onStatus("connected");
+      for (const [id, filters] of this.subscriptions) this.send(["REQ", id, ...filters]);
+    };
+    this.ws.onclose = () => {
+      this.onStatus("disconnected");
+      this.challenge = null;
+      setTimeout(() => this.connect(), this.retry);
+      this.retry = Math.min(this.retry * 2, 30000);
+    };
+    this.ws.onmessage = (message) => this.receive(message.data);
+  }
+
+  send(message) {
+    if (this.ws.readyState === WebSocket.OPEN) this.ws.send(JSON.stringify(message));
+  }
+
+  receive(data) {
+    let message;
+    try {
+      message = JSON.parse(data);
+    } catch {
+      return;
+    }
+    switch (message[0]) {
+      case "EVENT":
+        if (this.subscriptions.has(message[1])) this.onEvent(message[2]);
+        break;
+      case "EOSE":
+        if (this.once.delete(message[1])) this.unsubscribe(message[1]);
+        break;
+      case "OK": {
+        const pending = this.published.get(message[1]);
+        if (pending) {
+          this.published.delete(message[1]);
+          pending({ ok: message[2], reason: message[3] ?? "" });
+        }
+        break;
+      }
+      case "AUTH":
+        this.challenge = message[1];
+        this.onAuth();
+        break;
+      case "CLOSED":
+        if (String(message[2]).startsWith("auth-required:") && this.subscriptions.has(message[1])) {
+          this.onAuth().then((authed) => {
+            if (authed) this.send(["REQ", message[1], ...this.subscriptions.get(message[1])]);
+          });
+        }
+        break;
+      case "NOTICE":
+        this.onStatus("notice: " + message[1]);
+        break;
+    }
+  }
+
+  subscribe(filters, { once = false } = {}) {
+    const id = "app-" + bytesToHex(randomBytes(4));
+    this.subscriptions.set(id, filters);
+    if (once) this.once.add(id);
+    this.send(["REQ", id, ...filters]);
+    return id;
+  }
+
+  unsubscribe(id) {
+    this.once.delete(id);
+    if (this.subscriptions.delete(id)) this.send(["CLOSE", id]);
+  }
+
+  // publish sends an event, or an AUTH event with verb "AUTH", and waits
+  // for the relay to accept or refuse it.
+  publish(event, verb = "EVENT") {
+    return new Promise((resolve) => {
+      this.published.set(event.id, resolve);
+      this.send([verb, event]);
+      setTimeout(() => {
+        if (this.published.delete(event.id)) resolve({ ok: false, reason: "error: the relay didn't answer" });
+      }, 15000);
+    });
+  }
+}
+
+// State.
+
+const notes = new Map();
+const names = new Map();
+let signer = null;
+let me = null;
+let replyingTo = null;
+let authing = null;
+let wantedProfiles = new Set();
+
+const relay = new Relay(RELAY_URL, {
+  onEvent: receive,
+  onStatus: (status) => ($("#relay-status").textContent = status),
+  onAuth: () => authenticate(),
+});
+
+function receive(event) {
+  if (event.kind === 0) {
+    try {
+      const profile = JSON.parse(event.content);
+      const known = names.get(event.pubkey);
+      if (!known || known.at < event.created_at) {
+        names.set(event.pubkey, { name: profile.display_name || profile.name || "", at: event.created_at });
+        render();
+      }
+    } catch {}
+    return;
+  }
+  if (event.kind === 1 && !notes.has(event.id)) {
+    notes.set(event.id, event);
+    fetchProfile(event.pubkey);
+    render();
+  }
+}
+
+// fetchProfile asks for the profiles of new authors, a batch at a time.
+function fetchProfile(pubkey) {
+  if (names.has(pubkey)) return;
+  names.set(pubkey, { name: "", at: 0 });
+  if (wantedProfiles.size === 0) {
+    setTimeout(() => {
+      relay.subscribe([{ kinds: [0], authors: [...wantedProfiles] }], { once: true });
+      wantedProfiles = new Set();
+    }, 200);
+  }
+  wantedProfiles.add(pubkey);
+}
+
+// authenticate answers the relay's NIP-42 challenge once a member has
+// signed in, as the relay may only accept posts from members.
+async function authenticate() {
+  if (!signer || !relay.challenge) return false;
+  authing ??= signer
+    .signEvent({
+      kind: 22242,
+      created_at: Math.floor(Date.now() / 1000),
+      tags: [["relay", RELAY_URL], ["challenge", relay.challenge]],
+      content: "",
+    })
+    .then((event) => relay.publish(event, "AUTH"))
+    .then((result) => result.ok)
+    .catch(() => false)
+    .finally(() => (authing = null));
+  return authing;
+}
+
+// Rendering.
+
+function displayName(pubkey) {
+  const name = names.get(pubkey)?.name;
+  if (name) return name;
+  const npub = npubEncode(pubkey);
+  return npub.slice(0, 12) + "…" + npub.slice(-4);
+}
+
+// threadTags returns the NIP-10 tags of a reply to parent.
+function threadTags(parent) {
+  const root = parent.tags.find((t) => t[0] === "e" && t[3] === "root");
+  const tags = root
+    ? [["e", root[1], RELAY_URL, "root"], ["e", parent.id, RELAY_URL, "reply", parent.pubkey]]
+    : [["e", parent.id, RELAY_URL, "root", parent.pubkey]];
+
+  const mentioned = new Set([parent.pubkey]);
+  for (const tag of parent.tags) {
+    if (tag[0] === "p" && /^[0-9a-f]{64}$/.test(tag[1])) mentioned.add(tag[1]);
+  }
+  mentioned.delete(me);
+  for (const pubkey of mentioned) tags.push(["p", pubkey]);
+  return tags;
+}
+
+function parentOf(note) {
+  const reply = note.tags.find((t) => t[0] === "e" && t[3] === "reply") ?? note.tags.find((t) => t[0] === "e" && t[3] === "root");
+  return reply ? reply[1] : null;
+}
+
+// appendText adds text to an element, turning links into anchors.
+function appendText(element, text) {
+  const link = /https?:\/\/[^\s<>"]+/g;
+  let last = 0;
+  for (const match of text.matchAll(link)) {
+    element.append(text.slice(last, match.index));
+    const a = document.createElement("a");
+    a.href = match[0];
+    a.textContent = match[0];
+    a.rel = "noopener noreferrer nofollow";
+    a.target = "_blank";
+    element.append(a);
+    last = match.index + match[0].length;
+  }
+  element.append(text.slice(last));
+}
+
+function render() {
+  const feed = $("#feed");
+  const sorted = [...notes.values()].sort((a, b) => b.created_at - a.created_at);
+  feed.replaceChildren(
+    ...sorted.map((note) => {
+      const article = document.createElement("article");
+      article.className = "note";
+
+      const header = document.createElement("header");
+      const author = document.createElement("strong");
+      author.textContent = displayName(note.pubkey);
+      const time = document.createElement("time");
+      time.dateTime = new Date(note.created_at * 1000).toISOString();
+      time.textContent = new Date(note.created_at * 1000).toLocaleString();
+      header.append(author, " ", time);
+
+      const parentID = parentOf(note);
+      if (parentID) {
+        const context = document.createElement("div");
+        context.className = "context";
+        const parent = notes.get(parentID);
+        context.textContent = parent ? "Replying to " + displayName(parent.pubkey) + ": " + parent.content.slice(0, 80) : "Reply";
+        header.append(context);
+      }
+
+      const body = document.createElement("p");
+      appendText(body, note.content);
+
+      article.append(header, body);
+      if (signer) {
+        const reply = document.createElement("button");
+        reply.className = "link";
+        reply.textContent = "Reply";
+        reply.onclick = () => startReply(note);
+        article.append(reply);
+      }
+      return article;
+    }),
+  );
+  if (sorted.length === 0) {
+    const empty = document.createElement("p");
+    empty.className = "muted";
+    empty.textContent = "Nothing has been posted yet.";
+    feed.append(empty);
+  }
+}
+
+function renderAccount() {
+  $("#signed-out").hidden = !!signer;
+  $("#signed-in").hidden = !signer;
+  $("#composer").hidden = !signer;
+  if (signer) $("#whoami").textContent = displayName(me);
+  $("#extension-sign-in").disabled = !ExtensionSigner.available();
+  render();
+}
+
+function startReply(note) {
+  replyingTo = note;
+  $("#replying-to").hidden = false;
+  $("#replying-to-text").textContent = "Replying to " + displayName(note.pubkey);
+  $("#content").focus();
+}
+
+function cancelReply() {
+  replyingTo = null;
+  $("#replying-to").hidden = true;
+}
+
+function showMessage(text, isError = false) {
+  const message = $("#message");
+  message.textContent = text;
+  message.className = isError ? "error" : "";
+}
+
+// Signing in and out.
+
+async function signIn(newSigner) {
+  signer = newSigner;
+  me = await signer.getPublicKey();
+  sessionStorage.setItem(SAVED_SIGNER, JSON.stringify(signer.saved()));
+  fetchProfile(me);
+  renderAccount();
+  authenticate();
+}
+
+function signOut() {
+  signer?.close();
+  signer = null;
+  me = null;
+  sessionStorage.removeItem(SAVED_SIGNER);
+  cancelReply();
+  renderAccount();
+}
+
+$("#extension-sign-in").onclick = async () => {
+  try {
+    await signIn(new ExtensionSigner());
+    showMessage("");
+  } catch (err) {
+    showMessage(err.message, true);
+  }
+};
+
+$("#bunker-form").onsubmit = async (e) => {
+  e.preventDefault();
+  const button = $("#bunker-form button");
+  button.disabled = true;
+  showMessage("Waiting for your signer to approve…");
+  try {
+    const remote = new RemoteSigner(parseBunkerURL($("#bunker").value));
+    await remote.connect({ fresh: true });
+    await signIn(remote);
+    $("#bunker").value = "";
+    showMessage("");
+  } catch (err) {
+    showMessage(err.errors?.[0]?.message ?? err.message, true);
+  } finally {
+    button.disabled = false;
+  }
+};
+
+$("#sign-out").onclick = signOut;
+$("#cancel-reply").onclick = cancelReply;
+
+$("#composer").onsubmit = async (e) => {
+  e.preventDefault();
+  const content = $("#content").value.trim();
+  if (!content || !signer) return;
+
+  const button = $("#composer button[type=submit]");
+  button.disabled = true;
+  try {
+    const template = {
+      kind: 1,
+      created_at: Math.floor(Date.now() / 1000),
+      tags: replyingTo ? threadTags(replyingTo) : [],
+      content,
+    };
+    const event = await signer.signEvent(template);
+    let result = await relay.publish(event);
+    if (!result.ok && result.reason.startsWith("auth-required:") && (await authenticate())) {
+      result = await relay.publish(event);
+    }
+    if (!result.ok) {
+      showMessage("The relay refused the note: " + result.reason, true);
+      return;
+    }
+    $("#content").value = "";
+    cancelReply();
+    showMessage("Posted.");
+    receive(event);
+  } catch (err) {
+    showMessage(err.message, true);
+  } finally {
+    button.disabled = false;
+  }
+};
+
+// Start up.
+
+$("#relay-url").textContent = RELAY_URL;
+fetch(base, { headers: { Accept: "application/nostr+json" } })
+  .then((response) => response.json())
+  .then((info) => {
+    if (info.name) {
+      $("#community").textContent = info.name;
+      document.title = info.name;
+    }
+  })
+  .catch(() => {});
+
+relay.subscribe([{ kinds: [1], limit: FEED_LIMIT }]);
+renderAccount();
+// Extensions may only add window.nostr once the page has loaded
+window.addEventListener("load", () => renderAccount());
+
+try {
+  const saved = JSON.parse(sessionStorage.getItem(SAVED_SIGNER) ?? "null");
+  if (saved?.type === "nip07" && !ExtensionSigner.available()) {
+    await new Promise((resolve) => window.addEventListener("load", resolve, { once: true }));
+  }
+  const restored = await restoreSigner(saved);
+  if (restored) await signIn(restored);
+} catch {
+  sessionStorage.removeItem(SAVED_SIGNER);
+}
@@ -0,0 +1,353 @@
+// The nostr primitives the client needs, with no dependencies: event ids,
+// BIP-340 signatures for the remote signer session key, and NIP-44
+// encryption for talking to remote signers. Hashing uses WebCrypto.
+// testdata/vectors.mjs checks it against the BIP-340 and NIP-44 vectors.
+
+const P = 0xfffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2fn;
+const N = 0xfffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141n;
+const G = [
+  0x79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798n,
+  0x483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8n,
+  1n,
+];
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+export function bytesToHex(bytes) {
+  return Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+}
+
+export function hexToBytes(hex) {
+  if (hex.length % 2 !== 0 || !/^[0-9a-f]*$/i.test(hex)) {
+    throw new Error("invalid hex");
+  }
+  const bytes = new Uint8Array(hex.length / 2);
+  for (let i = 0; i < bytes.length; i++) {
+    bytes[i] = parseInt(hex.slice(i * 2, i * 2 + 2), 16);
+  }
+  return bytes;
+}
+
+export function randomBytes(n) {
+  return crypto.getRandomValues(new Uint8Array(n));
+}
+
+function concat(...arrays) {
+  const out = new Uint8Array(arrays.reduce((n, a) => n + a.length, 0));
+  let offset = 0;
+  for (const a of arrays) {
+    out.set(a, offset);
+    offset += a.length;
+  }
+  return out;
+}
+
+function bytesToInt(bytes) {
+  return bytes.length ? BigInt("0x" + bytesToHex(bytes)) : 0n;
+}
+
+function intToBytes(n) {
+  return hexToBytes(n.toString(16).padStart(64, "0"));
+}
+
+export async function sha256(bytes) {
+  return new Uint8Array(await crypto.subtle.digest("SHA-256", bytes));
+}
+
+async function hmac(key, message) {
+  const k = await crypto.subtle.importKey("raw", key, { name: "HMAC", hash: "SHA-256" }, false, ["sign"]);
+  return new Uint8Array(await crypto.subtle.sign("HMAC", k, message));
+}
+
+async function taggedHash(tag, ...messages) {
+  const t = await sha256(encoder.encode(tag));
+  return sha256(concat(t, t, ...messages));
+}
+
+// Field and curve arithmetic, with points in Jacobian coordinates.
+
+function mod(a, m = P) {
+  const r = a % m;
+  return r >= 0n ? r : r + m;
+}
+
+function pow(base, exp, m = P) {
+  let result = 1n;
+  base = mod(base, m);
+  while (exp > 0n) {
+    if (exp & 1n) result = (result * base) % m;
+    base = (base * base) % m;
+    exp >>= 1n;
+  }
+  return result;
+}
+
+function double([x, y, z]) {
+  if (z === 0n || y === 0n) return [0n, 1n, 0n];
+  const a = (x * x) % P;
+  const b = (y * y) % P;
+  const c = (b * b) % P;
+  const d = mod(2n * ((x + b) ** 2n - a - c));
+  const e = (3n * a) % P;
+  const f = (e * e) % P;
+  const x3 = mod(f - 2n * d);
+  const y3 = mod(e * (d - x3) - 8n * c);
+  const z3 = (2n * y * z) % P;
+  return [x3, y3, z3];
+}
+
+function add(p1, p2) {
+  const [x1, y1, z1] = p1;
+  const [x2, y2, z2] = p2;
+  if (z1 === 0n) return p2;
+  if (z2 === 0n) return p1;
+  const z1z1 = (z1 * z1) % P;
+  const z2z2 = (z2 * z2) % P;
+  const u1 = (x1 * z2z2) % P;
+  const u2 = (x2 * z1z1) % P;
+  const s1 = (y1 * z2 * z2z2) % P;
+  const s2 = (y2 * z1 * z1z1) % P;
+  if (u1 === u2) {
+    return s1 === s2 ? double(p1) : [0n, 1n, 0n];
+  }
+  const h = mod(u2 - u1);
+  const i = (4n * h * h) % P;
+  const j = (h * i) % P;
+  const r = mod(2n * (s2 - s1));
+  const v = (u1 * i) % P;
+  const x3 = mod(r * r - j - 2n * v);
+  const y3 = mod(r * (v - x3) - 2n * s1 * j);
+  const z3 = mod(((z1 + z2) ** 2n - z1z1 - z2z2) * h);
+  return [x3, y3, z3];
+}
+
+function multiply(point, k) {
+  let result = [0n, 1n, 0n];
+  let addend = point;
+  while (k > 0n) {
+    if (k & 1n) result = add(result, addend);
+    addend = double(addend);
+    k >>= 1n;
+  }
+  return result;
+}
+
+function affine([x, y, z]) {
+  if (z === 0n) throw new Error("point at infinity");
+  const zinv = pow(z, P - 2n);
+  const zinv2 = (zinv * zinv) % P;
+  return [(x * zinv2) % P, (y * zinv2 * zinv) % P];
+}
+
+// liftX returns the point with x coordinate x and an even y, as BIP-340
+// keys are x only.
+function liftX(x) {
+  if (x <= 0n || x >= P) throw new Error("invalid public key");
+  const c = mod(x ** 3n + 7n);
+  const y = pow(c, (P + 1n) / 4n);
+  if ((y * y) % P !== c) throw new Error("invalid public key");
+  return [x, y & 1n ? P - y : y, 1n];
+}
+
+function secretScalar(secretKey) {
+  const d = bytesToInt(hexToBytes(secretKey));
+  if (d <= 0n || d >= N) throw new Error("invalid secret key");
+  return d;
+}
+
+export function generateSecretKey() {
+  for (;;) {
+    const key = randomBytes(32);
+    const d = bytesToInt(key);
+    if (d > 0n && d < N) return bytesToHex(key);
+  }
+}
+
+export function getPublicKey(secretKey) {
+  const [x] = affine(multiply(G, secretScalar(secretKey)));
+  return bytesToHex(intToBytes(x));
+}
+
+// schnorrSign makes a BIP-340 signature. auxRand is only given by tests,
+// which check it against the BIP-340 vectors.
+export async function schnorrSign(message, secretKey, auxRand = randomBytes(32)) {
+  const d0 = secretScalar(secretKey);
+  const [px, py] = affine(multiply(G, d0));
+  const d = py & 1n ? N - d0 : d0;
+  const pubkey = intToBytes(px);
+
+  const aux = await taggedHash("BIP0340/aux", auxRand);
+  const t = intToBytes(d).map((b, i) => b ^ aux[i]);
+  const k0 = mod(bytesToInt(await taggedHash("BIP0340/nonce", t, pubkey, message)), N);
+  if (k0 === 0n) throw new Error("signing failed");
+  const [rx, ry] = affine(multiply(G, k0));
+  const k = ry & 1n ? N - k0 : k0;
+  const r = intToBytes(rx);
+
+  const e = mod(bytesToInt(await taggedHash("BIP0340/challenge", r, pubkey, message)), N);
+  return bytesToHex(concat(r, intToBytes(mod(k + e * d, N))));
+}
+
+// Events.
+
+export async function getEventHash(event) {
+  const serialized = JSON.stringify([0, event.pubkey, event.created_at, event.kind, event.tags, event.content]);
+  return bytesToHex(await sha256(encoder.encode(serialized)));
+}
+
+// finalizeEvent signs a template with a secret key held by the client,
+// which is only ever the session key used to talk to a remote signer.
+export async function finalizeEvent(template, secretKey) {
+  const event = {
+    kind: template.kind,
+    created_at: template.created_at ?? Math.floor(Date.now() / 1000),
+    tags: template.tags ?? [],
+    content: template.content ?? "",
+    pubkey: getPublicKey(secretKey),
+  };
+  event.id = await getEventHash(event);
+  event.sig = await schnorrSign(hexToBytes(event.id), secretKey);
+  return event;
+}
+
+// NIP-44 version 2.
+
+function rotl(x, n) {
+  return ((x << n) | (x >>> (32 - n))) >>> 0;
+}
+
+function chacha20(key, nonce, data) {
+  const constants = [0x61707865, 0x3320646e, 0x79622d32, 0x6b206574];
+  const kv = new DataView(key.buffer, key.byteOffset, key.byteLength);
+  const nv = new DataView(nonce.buffer, nonce.byteOffset, nonce.byteLength);
+  const state = new Uint32Array(16);
+  state.set(constants);
+  for (let i = 0; i < 8; i++) state[4 + i] = kv.getUint32(i * 4, true);
+  for (let i = 0; i < 3; i++) state[13 + i] = nv.getUint32(i * 4, true);
+
+  const out = new Uint8Array(data.length);
+  const x = new Uint32Array(16);
+  const block = new Uint8Array(64);
+  const bv = new DataView(block.buffer);
+  const quarter = (a, b, c, d) => {
+    x[a] += x[b]; x[d] = rotl(x[d] ^ x[a], 16);
+    x[c] += x[d]; x[b] = rotl(x[b] ^ x[c], 12);
+    x[a] += x[b]; x[d] = rotl(x[d] ^ x[a], 8);
+    x[c] += x[d]; x[b] = rotl(x[b] ^ x[c], 7);
+  };
+
+  for (let offset = 0, counter = 0; offset < data.length; offset += 64, counter++) {
+    state[12] = counter;
+    x.set(state);
+    for (let round = 0; round < 10; round++) {
+      quarter(0, 4, 8, 12); quarter(1, 5, 9, 13); quarter(2, 6, 10, 14); quarter(3, 7, 11, 15);
+      quarter(0, 5, 10, 15); quarter(1, 6, 11, 12); quarter(2, 7, 8, 13); quarter(3, 4, 9, 14);
+    }
+    for (let i = 0; i < 16; i++) bv.setUint32(i * 4, (x[i] + state[i]) >>> 0, true);
+    for (let i = 0; i < 64 && offset + i < data.length; i++) {
+      out[offset + i] = data[offset + i] ^ block[i];
+    }
+  }
+  return out;
+}
+
+export async function getConversationKey(secretKey, publicKey) {
+  const [sharedX] = affine(multiply(liftX(bytesToInt(hexToBytes(publicKey))), secretScalar(secretKey)));
+  return hmac(encoder.encode("nip44-v2"), intToBytes(sharedX));
+}
+
+async function messageKeys(conversationKey, nonce) {
+  let block = new Uint8Array(0);
+  let okm = new Uint8Array(0);
+  for (let i = 1; okm.length < 76; i++) {
+    block = await hmac(conversationKey, concat(block, nonce, new Uint8Array([i])));
+    okm = concat(okm, block);
+  }
+  return { chachaKey: okm.slice(0, 32), chachaNonce: okm.slice(32, 44), hmacKey: okm.slice(44, 76) };
+}
+
+function paddedLength(length) {
+  if (length <= 32) return 32;
+  const nextPower = 1 << (Math.floor(Math.log2(length - 1)) + 1);
+  const chunk = nextPower <= 256 ? 32 : nextPower / 8;
+  return chunk * (Math.floor((length - 1) / chunk) + 1);
+}
+
+function base64(bytes) {
+  let binary = "";
+  for (const b of bytes) binary += String.fromCharCode(b);
+  return btoa(binary);
+}
+
+function unbase64(text) {
+  return Uint8Array.from(atob(text), (c) => c.charCodeAt(0));
+}
+
+export async function nip44Encrypt(plaintext, conversationKey, nonce = randomBytes(32)) {
+  const unpadded = encoder.encode(plaintext);
+  if (unpadded.length < 1 || unpadded.length > 65535) throw new Error("invalid plaintext length");
+  const padded = new Uint8Array(2 + paddedLength(unpadded.length));
+  new DataView(padded.buffer).setUint16(0, unpadded.length);
+  padded.set(unpadded, 2);
+
+  const { chachaKey, chachaNonce, hmacKey } = await messageKeys(conversationKey, nonce);
+  const ciphertext = chacha20(chachaKey, chachaNonce, padded);
+  const mac = await hmac(hmacKey, concat(nonce, ciphertext));
+  return base64(concat(new Uint8Array([2]), nonce, ciphertext, mac));
+}
+
+export async function nip44Decrypt(payload, conversationKey) {
+  const data = unbase64(payload);
+  if (data.length < 99 || data[0] !== 2) throw new Error("unsupported encryption version");
+  const nonce = data.slice(1, 33);
+  const ciphertext = data.slice(33, data.length - 32);
+  const mac = data.slice(data.length - 32);
+
+  const { chachaKey, chachaNonce, hmacKey } = await messageKeys(conversationKey, nonce);
+  const expected = await hmac(hmacKey, concat(nonce, ciphertext));
+  if (expected.some((b, i) => b !== mac[i])) throw new Error("invalid message authentication code");
+
+  const padded = chacha20(chachaKey, chachaNonce, ciphertext);
+  const length = new DataView(padded.buffer).getUint16(0);
+  if (length < 1 || padded.length !== 2 + paddedLength(length)) throw new Error("invalid padding");
+  return decoder.decode(padded.slice(2, 2 + length));
+}
+
+// NIP-19, enough to show npubs.
+
+const BECH32 = "qpzry9x8gf2tvdw0s3jn54khce6mua7l";
+
+function polymod(values) {
+  const generators = [0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3];
+  let chk = 1;
+  for (const v of values) {
+    const top = chk >>> 25;
+    chk = ((chk & 0x1ffffff) << 5) ^ v;
+    for (let i = 0; i < 5; i++) {
+      if ((top >>> i) & 1) chk ^= generators[i];
+    }
+  }
+  return chk;
+}
+
+export function npubEncode(pubkey) {
+  const words = [];
+  let acc = 0;
+  let bits = 0;
+  for (const b of hexToBytes(pubkey)) {
+    acc = (acc << 8) | b;
+    bits += 8;
+    while (bits >= 5) {
+      bits -= 5;
+      words.push((acc >>> bits) & 31);
+    }
+  }
+  if (bits > 0) words.push((acc << (5 - bits)) & 31);
+
+  const hrp = "npub";
+  const expanded = [...Array.from(hrp, (c) => c.charCodeAt(0) >> 5), 0, ...Array.from(hrp, (c) => c.charCodeAt(0) & 31)];
+  const checksum = polymod([...expanded, ...words, 0, 0, 0, 0, 0, 0]) ^ 1;
+  const check = Array.from({ length: 6 }, (_, i) => (checksum >>> (5 * (5 - i))) & 31);
+  return hrp + "1" + [...words, ...check].map((w) => BECH32[w]).join("");
+}
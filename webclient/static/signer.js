@@ -0,0 +1,176 @@
+// Signers sign events for the member, who never gives the client their
+// secret key: either a NIP-07 browser extension or a NIP-46 remote signer.
+
+import {
+  bytesToHex,
+  finalizeEvent,
+  generateSecretKey,
+  getConversationKey,
+  getPublicKey,
+  nip44Decrypt,
+  nip44Encrypt,
+  randomBytes,
+} from "./nostr.js";
+
+const KIND_NOSTR_CONNECT = 24133;
+const REQUEST_TIMEOUT = 120 * 1000;
+
+export class ExtensionSigner {
+  static available() {
+    return typeof window.nostr?.signEvent === "function";
+  }
+
+  async getPublicKey() {
+    return window.nostr.getPublicKey();
+  }
+
+  async signEvent(template) {
+    return window.nostr.signEvent(template);
+  }
+
+  saved() {
+    return { type: "nip07" };
+  }
+
+  close() {}
+}
+
+// parseBunkerURL reads a bunker:// URL given by a remote signer.
+export function parseBunkerURL(text) {
+  let url;
+  try {
+    url = new URL(text.trim());
+  } catch {
+    throw new Error("That isn't a bunker:// address");
+  }
+  const pubkey = url.hostname || url.pathname.replace(/^\/\//, "");
+  if (url.protocol !== "bunker:" || !/^[0-9a-f]{64}$/.test(pubkey)) {
+    throw new Error("That isn't a bunker:// address");
+  }
+  const relays = url.searchParams.getAll("relay").filter((r) => /^wss?:\/\//.test(r));
+  if (relays.length === 0) {
+    throw new Error("The bunker address doesn't name a relay");
+  }
+  return { pubkey, relays, secret: url.searchParams.get("secret") ?? "" };
+}
+
+// RemoteSigner talks to a NIP-46 remote signer over the relays it named,
+// using a session key generated here.
+export class RemoteSigner {
+  constructor(bunker, sessionKey = generateSecretKey(), onAuthURL = (url) => window.open(url, "_blank", "noopener")) {
+    this.bunker = bunker;
+    this.sessionKey = sessionKey;
+    this.sessionPubKey = getPublicKey(sessionKey);
+    this.onAuthURL = onAuthURL;
+    this.pending = new Map();
+    this.sockets = [];
+  }
+
+  // connect opens the session. The secret is only sent the first time, as
+  // signers accept it once.
+  async connect({ fresh }) {
+    this.conversationKey = await getConversationKey(this.sessionKey, this.bunker.pubkey);
+    await Promise.any(this.bunker.relays.map((url) => this.open(url)));
+    if (fresh) {
+      await this.request("connect", [this.bunker.pubkey, this.bunker.secret]);
+    }
+    this.pubkey = await this.request("get_public_key", []);
+  }
+
+  open(url) {
+    return new Promise((resolve, reject) => {
+      const ws = new WebSocket(url);
+      const sub = "signer-" + bytesToHex(randomBytes(4));
+      ws.onopen = () => {
+        const since = Math.floor(Date.now() / 1000) - 60;
+        ws.send(JSON.stringify(["REQ", sub, { kinds: [KIND_NOSTR_CONNECT], "#p": [this.sessionPubKey], since }]));
+        this.sockets.push(ws);
+        resolve();
+      };
+      ws.onerror = () => reject(new Error("Couldn't reach " + url));
+      ws.onmessage = (message) => this.receive(message.data);
+    });
+  }
+
+  async receive(data) {
+    let message;
+    try {
+      message = JSON.parse(data);
+    } catch {
+      return;
+    }
+    const event = message[2];
+    if (message[0] !== "EVENT" || event?.kind !== KIND_NOSTR_CONNECT || event.pubkey !== this.bunker.pubkey) {
+      return;
+    }
+
+    let response;
+    try {
+      response = JSON.parse(await nip44Decrypt(event.content, this.conversationKey));
+    } catch {
+      return;
+    }
+    const pending = this.pending.get(response.id);
+    if (!pending) return;
+
+    if (response.result === "auth_url" && response.error) {
+      // The signer wants the member to approve the client in a browser
+      this.onAuthURL(response.error);
+      return;
+    }
+    this.pending.delete(response.id);
+    clearTimeout(pending.timer);
+    if (response.error) {
+      pending.reject(new Error(response.error));
+    } else {
+      pending.resolve(response.result);
+    }
+  }
+
+  async request(method, params) {
+    const id = bytesToHex(randomBytes(8));
+    const content = await nip44Encrypt(JSON.stringify({ id, method, params }), this.conversationKey);
+    const event = await finalizeEvent({ kind: KIND_NOSTR_CONNECT, tags: [["p", this.bunker.pubkey]], content }, this.sessionKey);
+
+    return new Promise((resolve, reject) => {
+      const timer = setTimeout(() => {
+        this.pending.delete(id);
+        reject(new Error("The remote signer didn't answer"));
+      }, REQUEST_TIMEOUT);
+      this.pending.set(id, { resolve, reject, timer });
+      for (const ws of this.sockets) {
+        if (ws.readyState === WebSocket.OPEN) ws.send(JSON.stringify(["EVENT", event]));
+      }
+    });
+  }
+
+  async getPublicKey() {
+    return this.pubkey;
+  }
+
+  async signEvent(template) {
+    return JSON.parse(await this.request("sign_event", [JSON.stringify(template)]));
+  }
+
+  saved() {
+    return { type: "nip46", bunker: this.bunker, sessionKey: this.sessionKey };
+  }
+
+  close() {
+    for (const ws of this.sockets) ws.close();
+    this.sockets = [];
+  }
+}
+
+// restoreSigner signs back in with the signer the tab last used, if any.
+export async function restoreSigner(saved) {
+  if (saved?.type === "nip07" && ExtensionSigner.available()) {
+    return new ExtensionSigner();
+  }
+  if (saved?.type === "nip46") {
+    const signer = new RemoteSigner(saved.bunker, saved.sessionKey);
+    await signer.connect({ fresh: false });
+    return signer;
+  }
+  return null;
+}
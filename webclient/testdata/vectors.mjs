@@ -0,0 +1,86 @@
+// Checks static/nostr.js against the BIP-340 and NIP-44 test vectors in
+// vectors.json, printing each failure and exiting non-zero if there are any.
+// Run by TestCryptoVectors.
+
+import { readFile } from "node:fs/promises";
+
+// static/nostr.js is an ES module without a package.json to say so, so it is
+// loaded from its source rather than by path
+const source = await readFile(new URL("../static/nostr.js", import.meta.url), "utf8");
+const nostr = await import("data:text/javascript;base64," + Buffer.from(source).toString("base64"));
+const vectors = JSON.parse(await readFile(new URL("vectors.json", import.meta.url), "utf8"));
+
+let failures = 0;
+function fail(name, message) {
+  failures++;
+  console.log(`${name}: ${message}`);
+}
+
+async function check(name, fn) {
+  try {
+    await fn();
+  } catch (err) {
+    fail(name, `threw ${err}`);
+  }
+}
+
+async function rejects(name, fn) {
+  try {
+    await fn();
+  } catch {
+    return;
+  }
+  fail(name, "expected an error");
+}
+
+function equal(name, got, want) {
+  if (got !== want) fail(name, `expected ${want}, got ${got}`);
+}
+
+for (const [i, v] of vectors.bip340.entries()) {
+  const name = `bip340 ${i}`;
+  await check(name, async () => {
+    equal(name + " public key", nostr.getPublicKey(v.secretKey), v.publicKey);
+    const sig = await nostr.schnorrSign(nostr.hexToBytes(v.message), v.secretKey, nostr.hexToBytes(v.auxRand));
+    equal(name + " signature", sig, v.signature);
+  });
+}
+
+const { nip44 } = vectors;
+for (const [i, v] of nip44.conversationKey.entries()) {
+  const name = `nip44 conversation key ${i}`;
+  await check(name, async () => {
+    equal(name, nostr.bytesToHex(await nostr.getConversationKey(v.sec1, v.pub2)), v.conversationKey);
+  });
+}
+
+for (const [i, v] of nip44.invalidConversationKey.entries()) {
+  await rejects(`nip44 invalid conversation key ${i} (${v.note})`, () => nostr.getConversationKey(v.sec1, v.pub2));
+}
+
+for (const [i, v] of nip44.encrypt.entries()) {
+  const name = `nip44 encrypt ${i}`;
+  await check(name, async () => {
+    const key = await nostr.getConversationKey(v.sec1, nostr.getPublicKey(v.sec2));
+    equal(name + " conversation key", nostr.bytesToHex(key), v.conversationKey);
+    equal(name + " payload", await nostr.nip44Encrypt(v.plaintext, key, nostr.hexToBytes(v.nonce)), v.payload);
+    equal(name + " plaintext", await nostr.nip44Decrypt(v.payload, key), v.plaintext);
+  });
+}
+
+const encoder = new TextEncoder();
+for (const [i, v] of nip44.encryptLong.entries()) {
+  const name = `nip44 long ${i}`;
+  await check(name, async () => {
+    const plaintext = v.pattern.repeat(v.repeat);
+    equal(name + " plaintext", nostr.bytesToHex(await nostr.sha256(encoder.encode(plaintext))), v.plaintextSha256);
+    const payload = await nostr.nip44Encrypt(plaintext, nostr.hexToBytes(v.conversationKey), nostr.hexToBytes(v.nonce));
+    equal(name + " payload", nostr.bytesToHex(await nostr.sha256(encoder.encode(payload))), v.payloadSha256);
+  });
+}
+
+for (const [i, v] of nip44.invalidDecrypt.entries()) {
+  await rejects(`nip44 invalid payload ${i} (${v.note})`, () => nostr.nip44Decrypt(v.payload, nostr.hexToBytes(v.conversationKey)));
+}
+
+if (failures > 0) process.exit(1);
@@ -0,0 +1,20 @@
+// Package webclient holds a small nostr client the relay serves to people
+// without one. It is plain HTML and JavaScript, so it needs no build step.
+package webclient
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed static
+var static embed.FS
+
+// Files returns the client's files, with index.html at the root.
+func Files() fs.FS {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	return files
+}
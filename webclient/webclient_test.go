@@ -0,0 +1,59 @@
+package webclient
+
+import (
+	"io/fs"
+	"os/exec"
+	"regexp"
+	"testing"
+)
+
+func TestIndexReferencesBundledFiles(t *testing.T) {
+	files := Files()
+
+	index, err := fs.ReadFile(files, "index.html")
+	if err != nil {
+		t.Fatalf("Expected index.html, got %v", err)
+	}
+
+	refs := regexp.MustCompile(`(?:src|href)="([^":]+)"`).FindAllSubmatch(index, -1)
+	if len(refs) == 0 {
+		t.Fatal("Expected index.html to load scripts and styles")
+	}
+	for _, ref := range refs {
+		if _, err := fs.Stat(files, string(ref[1])); err != nil {
+			t.Errorf("Expected %s to be bundled, got %v", ref[1], err)
+		}
+	}
+}
+
+func TestModulesImportBundledFiles(t *testing.T) {
+	files := Files()
+	imports := regexp.MustCompile(`from "\./([^"]+)"`)
+
+	scripts, _ := fs.Glob(files, "*.js")
+	for _, script := range scripts {
+		data, err := fs.ReadFile(files, script)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", script, err)
+		}
+		for _, ref := range imports.FindAllSubmatch(data, -1) {
+			if _, err := fs.Stat(files, string(ref[1])); err != nil {
+				t.Errorf("%s imports %s, which isn't bundled", script, ref[1])
+			}
+		}
+	}
+}
+
+// TestCryptoVectors checks the client's own secp256k1, BIP-340 and NIP-44
+// code against the published test vectors, which needs node.
+func TestCryptoVectors(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node isn't installed")
+	}
+
+	out, err := exec.Command(node, "testdata/vectors.mjs").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Expected the vectors to pass, got %v:\n%s", err, out)
+	}
+}